@@ -0,0 +1,684 @@
+// anthropic package provides middleware for partial compatibility with the Anthropic Messages API
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+// MessagesRequest is the body of a request to create a message
+type MessagesRequest struct {
+	Model         string          `json:"model"`
+	MaxTokens     int             `json:"max_tokens"`
+	Messages      []MessageParam  `json:"messages"`
+	System        json.RawMessage `json:"system"`
+	StopSequences []string        `json:"stop_sequences"`
+	Stream        bool            `json:"stream"`
+	Temperature   *float64        `json:"temperature"`
+	TopP          *float64        `json:"top_p"`
+	TopK          *int            `json:"top_k"`
+	Tools         []Tool          `json:"tools"`
+	ToolChoice    *ToolChoice     `json:"tool_choice"`
+}
+
+// MessageParam is a message of the conversation, with content that is
+// either a string or a list of content blocks
+type MessageParam struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// ContentBlock is a block of text, an image, a tool use or a tool result
+type ContentBlock struct {
+	Type string `json:"type"`
+
+	// text
+	Text *string `json:"text,omitempty"`
+
+	// image
+	Source *ImageSource `json:"source,omitempty"`
+
+	// tool_use
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Input any    `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type ToolChoice struct {
+	Type                   string `json:"type"`
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// MessagesResponse is a message created by the model
+type MessagesResponse struct {
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	Role         string         `json:"role"`
+	Model        string         `json:"model"`
+	Content      []ContentBlock `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
+	StopSequence *string        `json:"stop_sequence"`
+	Usage        Usage          `json:"usage"`
+}
+
+// MessageStartEvent is the first event of a streamed message
+type MessageStartEvent struct {
+	Type    string           `json:"type"`
+	Message MessagesResponse `json:"message"`
+}
+
+// ContentBlockStartEvent starts the content block at Index
+type ContentBlockStartEvent struct {
+	Type         string       `json:"type"`
+	Index        int          `json:"index"`
+	ContentBlock ContentBlock `json:"content_block"`
+}
+
+// ContentBlockDeltaEvent adds text or the JSON of a tool's input to the
+// content block at Index
+type ContentBlockDeltaEvent struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Delta Delta  `json:"delta"`
+}
+
+type Delta struct {
+	Type        string `json:"type"`
+	Text        string `json:"text,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+}
+
+// ContentBlockStopEvent ends the content block at Index
+type ContentBlockStopEvent struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+}
+
+// MessageDeltaEvent reports why a streamed message stopped
+type MessageDeltaEvent struct {
+	Type  string       `json:"type"`
+	Delta MessageDelta `json:"delta"`
+	Usage Usage        `json:"usage"`
+}
+
+type MessageDelta struct {
+	StopReason   *string `json:"stop_reason"`
+	StopSequence *string `json:"stop_sequence"`
+}
+
+// MessageStopEvent is the last event of a streamed message
+type MessageStopEvent struct {
+	Type string `json:"type"`
+}
+
+func NewError(code int, message string) ErrorResponse {
+	var etype string
+	switch code {
+	case http.StatusBadRequest:
+		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
+	case http.StatusNotFound:
+		etype = "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		etype = "request_too_large"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		etype = "overloaded_error"
+	default:
+		etype = "api_error"
+	}
+
+	return ErrorResponse{Type: "error", Error: Error{Type: etype, Message: message}}
+}
+
+func randomID(prefix string) string {
+	const letterBytes = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 24)
+	for i := range b {
+		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+	}
+	return prefix + string(b)
+}
+
+// stopReason maps the reason a native response is done to a stop reason
+func stopReason(r api.ChatResponse, toolUse bool) *string {
+	var reason string
+	switch {
+	case toolUse:
+		reason = "tool_use"
+	case r.DoneReason == "length":
+		reason = "max_tokens"
+	case r.DoneReason != "":
+		reason = "end_turn"
+	default:
+		return nil
+	}
+
+	return &reason
+}
+
+func toMessagesResponse(id string, r api.ChatResponse) MessagesResponse {
+	content := []ContentBlock{}
+	if r.Message.Content != "" {
+		content = append(content, ContentBlock{Type: "text", Text: &r.Message.Content})
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		input := tc.Function.Arguments
+		if input == nil {
+			input = api.ToolCallFunctionArguments{}
+		}
+
+		content = append(content, ContentBlock{Type: "tool_use", ID: randomID("toolu_"), Name: tc.Function.Name, Input: input})
+	}
+
+	return MessagesResponse{
+		ID:         id,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      r.Model,
+		Content:    content,
+		StopReason: stopReason(r, len(r.Message.ToolCalls) > 0),
+		Usage: Usage{
+			InputTokens:  r.PromptEvalCount,
+			OutputTokens: r.EvalCount,
+		},
+	}
+}
+
+// contentBlocks decodes content that is either a string or a list of
+// content blocks
+func contentBlocks(content json.RawMessage) ([]ContentBlock, error) {
+	var s string
+	if err := json.Unmarshal(content, &s); err == nil {
+		return []ContentBlock{{Type: "text", Text: &s}}, nil
+	}
+
+	var blocks []ContentBlock
+	if err := json.Unmarshal(content, &blocks); err != nil {
+		return nil, errors.New("content must be a string or a list of content blocks")
+	}
+
+	return blocks, nil
+}
+
+// text joins the text of content blocks
+func text(blocks []ContentBlock) (string, error) {
+	var texts []string
+	for _, block := range blocks {
+		if block.Type != "text" || block.Text == nil {
+			return "", fmt.Errorf("invalid content block type %q, expected text", block.Type)
+		}
+
+		texts = append(texts, *block.Text)
+	}
+
+	return strings.Join(texts, "\n"), nil
+}
+
+func fromImageSource(source *ImageSource) (api.ImageData, error) {
+	if source == nil || source.Type != "base64" {
+		return nil, errors.New("image source must be base64 encoded")
+	}
+
+	if !slices.Contains([]string{"image/jpeg", "image/png", "image/gif", "image/webp"}, source.MediaType) {
+		return nil, fmt.Errorf("invalid image media type %q", source.MediaType)
+	}
+
+	img, err := base64.StdEncoding.DecodeString(source.Data)
+	if err != nil {
+		return nil, errors.New("invalid image data")
+	}
+
+	return img, nil
+}
+
+func fromMessagesRequest(r MessagesRequest) (*api.ChatRequest, error) {
+	if r.Model == "" {
+		return nil, errors.New("model is required")
+	}
+
+	if r.MaxTokens <= 0 {
+		return nil, errors.New("max_tokens must be greater than 0")
+	}
+
+	if len(r.Messages) == 0 {
+		return nil, errors.New("messages must not be empty")
+	}
+
+	var messages []api.Message
+	if len(r.System) > 0 {
+		blocks, err := contentBlocks(r.System)
+		if err != nil {
+			return nil, fmt.Errorf("system: %w", err)
+		}
+
+		for _, block := range blocks {
+			s, err := text([]ContentBlock{block})
+			if err != nil {
+				return nil, fmt.Errorf("system: %w", err)
+			}
+
+			messages = append(messages, api.Message{Role: "system", Content: s})
+		}
+	}
+
+	for _, msg := range r.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, fmt.Errorf("invalid message role %q", msg.Role)
+		}
+
+		blocks, err := contentBlocks(msg.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range blocks {
+			switch block.Type {
+			case "text":
+				if block.Text == nil {
+					return nil, errors.New("text content block requires text")
+				}
+
+				messages = append(messages, api.Message{Role: msg.Role, Content: *block.Text})
+			case "image":
+				img, err := fromImageSource(block.Source)
+				if err != nil {
+					return nil, err
+				}
+
+				messages = append(messages, api.Message{Role: msg.Role, Images: []api.ImageData{img}})
+			case "tool_use":
+				var args api.ToolCallFunctionArguments
+				if block.Input != nil {
+					b, err := json.Marshal(block.Input)
+					if err != nil {
+						return nil, err
+					}
+
+					if err := json.Unmarshal(b, &args); err != nil {
+						return nil, errors.New("tool_use input must be an object")
+					}
+				}
+
+				messages = append(messages, api.Message{Role: msg.Role, ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: block.Name, Arguments: args}}}})
+			case "tool_result":
+				var content string
+				if len(block.Content) > 0 {
+					blocks, err := contentBlocks(block.Content)
+					if err != nil {
+						return nil, fmt.Errorf("tool_result: %w", err)
+					}
+
+					if content, err = text(blocks); err != nil {
+						return nil, fmt.Errorf("tool_result: %w", err)
+					}
+				}
+
+				messages = append(messages, api.Message{Role: "tool", Content: content})
+			default:
+				return nil, fmt.Errorf("invalid content block type %q", block.Type)
+			}
+		}
+	}
+
+	options := map[string]any{
+		"num_predict": r.MaxTokens,
+	}
+
+	if len(r.StopSequences) > 0 {
+		options["stop"] = r.StopSequences
+	}
+
+	if r.Temperature != nil {
+		options["temperature"] = *r.Temperature
+	}
+
+	if r.TopP != nil {
+		options["top_p"] = *r.TopP
+	}
+
+	if r.TopK != nil {
+		options["top_k"] = *r.TopK
+	}
+
+	var tools []api.Tool
+	for _, t := range r.Tools {
+		tool := api.Tool{Type: "function", Function: api.ToolFunction{Name: t.Name, Description: t.Description}}
+		if len(t.InputSchema) > 0 {
+			if err := json.Unmarshal(t.InputSchema, &tool.Function.Parameters); err != nil {
+				return nil, fmt.Errorf("tool %q: invalid input_schema", t.Name)
+			}
+		}
+
+		tools = append(tools, tool)
+	}
+
+	tools, toolChoice, parallelToolCalls, err := fromToolChoice(tools, r.ToolChoice)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ChatRequest{
+		Model:             r.Model,
+		Messages:          messages,
+		Options:           options,
+		Stream:            &r.Stream,
+		Tools:             tools,
+		ToolChoice:        toolChoice,
+		ParallelToolCalls: parallelToolCalls,
+	}, nil
+}
+
+// fromToolChoice maps tool_choice to the native tool choice, limiting tools
+// to the named tool if tool_choice names one
+func fromToolChoice(tools []api.Tool, toolChoice *ToolChoice) ([]api.Tool, string, *bool, error) {
+	if toolChoice == nil {
+		return tools, "", nil, nil
+	}
+
+	var parallelToolCalls *bool
+	if toolChoice.DisableParallelToolUse {
+		parallelToolCalls = new(bool)
+	}
+
+	switch toolChoice.Type {
+	case "auto":
+		return tools, "auto", parallelToolCalls, nil
+	case "any":
+		return tools, "required", parallelToolCalls, nil
+	case "none":
+		return tools, "none", parallelToolCalls, nil
+	case "tool":
+		for _, tool := range tools {
+			if tool.Function.Name == toolChoice.Name {
+				return []api.Tool{tool}, "required", parallelToolCalls, nil
+			}
+		}
+
+		return nil, "", nil, fmt.Errorf("tool_choice tool %q is not in tools", toolChoice.Name)
+	default:
+		return nil, "", nil, fmt.Errorf("invalid tool_choice type %q", toolChoice.Type)
+	}
+}
+
+type BaseWriter struct {
+	gin.ResponseWriter
+}
+
+type MessagesWriter struct {
+	stream bool
+	id     string
+
+	// started is true once message_start is written
+	started bool
+
+	// index is the index of the next content block and open is the type of
+	// the block being streamed, if any
+	index int
+	open  string
+
+	// toolUse is true once a tool_use block is streamed
+	toolUse bool
+
+	BaseWriter
+}
+
+func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
+	var serr api.StatusError
+	err := json.Unmarshal(data, &serr)
+	if err != nil {
+		// errors already in the compatible format, such as those of the
+		// API key and limit checks, are written as is
+		var e ErrorResponse
+		if json.Unmarshal(data, &e) != nil || e.Error.Message == "" {
+			return 0, err
+		}
+
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(code, serr.Error()))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// writeEvent writes a server-sent event
+func (w *MessagesWriter) writeEvent(event string, data any) error {
+	d, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, d)))
+	return err
+}
+
+// startBlock ends the open content block and starts block
+func (w *MessagesWriter) startBlock(block ContentBlock) error {
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+
+	w.open = block.Type
+	return w.writeEvent("content_block_start", ContentBlockStartEvent{Type: "content_block_start", Index: w.index, ContentBlock: block})
+}
+
+func (w *MessagesWriter) stopBlock() error {
+	if w.open == "" {
+		return nil
+	}
+
+	w.open = ""
+	w.index++
+	return w.writeEvent("content_block_stop", ContentBlockStopEvent{Type: "content_block_stop", Index: w.index - 1})
+}
+
+func (w *MessagesWriter) writeDelta(delta Delta) error {
+	return w.writeEvent("content_block_delta", ContentBlockDeltaEvent{Type: "content_block_delta", Index: w.index, Delta: delta})
+}
+
+func (w *MessagesWriter) writeChunk(r api.ChatResponse) error {
+	if !w.started {
+		w.started = true
+		if err := w.writeEvent("message_start", MessageStartEvent{
+			Type: "message_start",
+			Message: MessagesResponse{
+				ID:      w.id,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   r.Model,
+				Content: []ContentBlock{},
+			},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if r.Message.Content != "" {
+		if w.open != "text" {
+			if err := w.startBlock(ContentBlock{Type: "text", Text: new(string)}); err != nil {
+				return err
+			}
+		}
+
+		if err := w.writeDelta(Delta{Type: "text_delta", Text: r.Message.Content}); err != nil {
+			return err
+		}
+	}
+
+	for _, tc := range r.Message.ToolCalls {
+		switch {
+		case tc.Function.Arguments != nil:
+			// the final update of a call repeats the input already streamed
+		case tc.Function.Name != "":
+			w.toolUse = true
+			if err := w.startBlock(ContentBlock{Type: "tool_use", ID: randomID("toolu_"), Name: tc.Function.Name, Input: map[string]any{}}); err != nil {
+				return err
+			}
+		case w.open == "tool_use":
+			if err := w.writeDelta(Delta{Type: "input_json_delta", PartialJSON: tc.Function.PartialArguments}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !r.Done {
+		return nil
+	}
+
+	if err := w.stopBlock(); err != nil {
+		return err
+	}
+
+	if err := w.writeEvent("message_delta", MessageDeltaEvent{
+		Type:  "message_delta",
+		Delta: MessageDelta{StopReason: stopReason(r, w.toolUse)},
+		Usage: Usage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount},
+	}); err != nil {
+		return err
+	}
+
+	return w.writeEvent("message_stop", MessageStopEvent{Type: "message_stop"})
+}
+
+func (w *MessagesWriter) writeResponse(data []byte) (int, error) {
+	// errors after the response has started are streamed
+	var serr struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &serr); err == nil && serr.Error != "" {
+		if err := w.writeEvent("error", NewError(http.StatusInternalServerError, serr.Error)); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	var chatResponse api.ChatResponse
+	err := json.Unmarshal(data, &chatResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	// queued status frames have nothing to translate
+	if chatResponse.Queued != nil {
+		return len(data), nil
+	}
+
+	if w.stream {
+		if err := w.writeChunk(chatResponse); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(toMessagesResponse(w.id, chatResponse))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *MessagesWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
+func MessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MessagesRequest
+		err := c.ShouldBindJSON(&req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		var b bytes.Buffer
+
+		chatReq, err := fromMessagesRequest(req)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &MessagesWriter{
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			stream:     req.Stream,
+			id:         randomID("msg_"),
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
@@ -0,0 +1,495 @@
+package anthropic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+)
+
+const image = `iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAQAAAC1HAwCAAAAC0lEQVR42mNk+A8AAQUBAScY42YAAAAASUVORK5CYII=`
+
+var (
+	False = false
+	True  = true
+)
+
+func captureRequestMiddleware(capturedRequest any) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bodyBytes, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		err := json.Unmarshal(bodyBytes, capturedRequest)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, "failed to unmarshal request")
+		}
+		c.Next()
+	}
+}
+
+func TestMessagesMiddleware(t *testing.T) {
+	type testCase struct {
+		name string
+		body string
+		req  api.ChatRequest
+		err  ErrorResponse
+	}
+
+	var capturedRequest *api.ChatRequest
+
+	img, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tools []api.Tool
+	if err := json.Unmarshal([]byte(`[{"type": "function", "function": {"name": "get_weather", "description": "Get the weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}}}, {"type": "function", "function": {"name": "get_time", "description": "", "parameters": {"type": "", "properties": null, "required": null}}}]`), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []testCase{
+		{
+			name: "messages handler",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 100.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "messages handler with system and options",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"system": [{"type": "text", "text": "You are helpful."}, {"type": "text", "text": "Be brief."}],
+				"stop_sequences": ["\n\nHuman:"],
+				"temperature": 0.5,
+				"top_p": 0.9,
+				"top_k": 40,
+				"stream": true,
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "You are helpful."},
+					{Role: "system", Content: "Be brief."},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"num_predict": 100.0,
+					"stop":        []any{"\n\nHuman:"},
+					"temperature": 0.5,
+					"top_p":       0.9,
+					"top_k":       40.0,
+				},
+				Stream: &True,
+			},
+		},
+		{
+			name: "messages handler with content blocks",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"tools": [
+					{"name": "get_weather", "description": "Get the weather", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}},
+					{"name": "get_time"}
+				],
+				"messages": [
+					{"role": "user", "content": [
+						{"type": "text", "text": "What's the weather here?"},
+						{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "` + image + `"}}
+					]},
+					{"role": "assistant", "content": [
+						{"type": "tool_use", "id": "toolu_01", "name": "get_weather", "input": {"city": "Paris"}}
+					]},
+					{"role": "user", "content": [
+						{"type": "tool_result", "tool_use_id": "toolu_01", "content": [{"type": "text", "text": "Sunny"}]}
+					]}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather here?"},
+					{Role: "user", Images: []api.ImageData{img}},
+					{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}}}},
+					{Role: "tool", Content: "Sunny"},
+				},
+				Options: map[string]any{
+					"num_predict": 100.0,
+				},
+				Stream: &False,
+				Tools:  tools,
+			},
+		},
+		{
+			name: "messages handler with named tool choice",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"tools": [
+					{"name": "get_weather", "description": "Get the weather", "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}},
+					{"name": "get_time"}
+				],
+				"tool_choice": {"type": "tool", "name": "get_weather", "disable_parallel_tool_use": true},
+				"messages": [
+					{"role": "user", "content": "What's the weather in Paris?"}
+				]
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather in Paris?"},
+				},
+				Options: map[string]any{
+					"num_predict": 100.0,
+				},
+				Stream:            &False,
+				Tools:             tools[:1],
+				ToolChoice:        "required",
+				ParallelToolCalls: &False,
+			},
+		},
+		{
+			name: "messages handler with unknown tool choice",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"tool_choice": {"type": "tool", "name": "get_weather"},
+				"messages": [
+					{"role": "user", "content": "What's the weather in Paris?"}
+				]
+			}`,
+			err: ErrorResponse{
+				Type: "error",
+				Error: Error{
+					Type:    "invalid_request_error",
+					Message: `tool_choice tool "get_weather" is not in tools`,
+				},
+			},
+		},
+		{
+			name: "missing max_tokens",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				]
+			}`,
+			err: ErrorResponse{
+				Type: "error",
+				Error: Error{
+					Type:    "invalid_request_error",
+					Message: "max_tokens must be greater than 0",
+				},
+			},
+		},
+		{
+			name: "invalid role",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"messages": [
+					{"role": "system", "content": "Hello"}
+				]
+			}`,
+			err: ErrorResponse{
+				Type: "error",
+				Error: Error{
+					Type:    "invalid_request_error",
+					Message: `invalid message role "system"`,
+				},
+			},
+		},
+		{
+			name: "image url",
+			body: `{
+				"model": "test-model",
+				"max_tokens": 100,
+				"messages": [
+					{"role": "user", "content": [{"type": "image", "source": {"type": "url", "url": "https://example.com/image.png"}}]}
+				]
+			}`,
+			err: ErrorResponse{
+				Type: "error",
+				Error: Error{
+					Type:    "invalid_request_error",
+					Message: "image source must be base64 encoded",
+				},
+			},
+		},
+	}
+
+	endpoint := func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MessagesMiddleware(), captureRequestMiddleware(&capturedRequest))
+	router.Handle(http.MethodPost, "/v1/messages", endpoint)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			var errResp ErrorResponse
+			if resp.Code != http.StatusOK {
+				if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if capturedRequest != nil && !reflect.DeepEqual(tc.req, *capturedRequest) {
+				t.Errorf("requests did not match:\nexpected %+v\ngot %+v", tc.req, *capturedRequest)
+			}
+
+			if !reflect.DeepEqual(tc.err, errResp) {
+				t.Errorf("errors did not match:\nexpected %+v\ngot %+v", tc.err, errResp)
+			}
+			capturedRequest = nil
+		})
+	}
+}
+
+func TestMessagesWriter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	metrics := api.Metrics{PromptEvalCount: 10, EvalCount: 3}
+	router := gin.New()
+	router.POST("/v1/messages", MessagesMiddleware(), func(c *gin.Context) {
+		switch c.Query("response") {
+		case "error":
+			c.JSON(http.StatusNotFound, gin.H{"error": "model not found"})
+		case "tools":
+			c.JSON(http.StatusOK, api.ChatResponse{
+				Model: "test",
+				Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+					{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}},
+				}},
+				Done:       true,
+				DoneReason: "stop",
+				Metrics:    metrics,
+			})
+		default:
+			c.JSON(http.StatusOK, api.ChatResponse{
+				Model:      "test",
+				Message:    api.Message{Role: "assistant", Content: "Hi"},
+				Done:       true,
+				DoneReason: "length",
+				Metrics:    metrics,
+			})
+		}
+	})
+
+	body := `{"model": "test", "max_tokens": 3, "messages": [{"role": "user", "content": "Hello"}]}`
+
+	t.Run("text", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.Code)
+		}
+
+		var message MessagesResponse
+		if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(message.ID, "msg_") || message.Type != "message" || message.Role != "assistant" || message.Model != "test" {
+			t.Errorf("unexpected message %+v", message)
+		}
+
+		if len(message.Content) != 1 || message.Content[0].Type != "text" || *message.Content[0].Text != "Hi" {
+			t.Errorf("expected a text block, got %+v", message.Content)
+		}
+
+		if message.StopReason == nil || *message.StopReason != "max_tokens" {
+			t.Errorf("expected stop reason max_tokens, got %v", message.StopReason)
+		}
+
+		if !reflect.DeepEqual(message.Usage, Usage{InputTokens: 10, OutputTokens: 3}) {
+			t.Errorf("unexpected usage %+v", message.Usage)
+		}
+	})
+
+	t.Run("tool use", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/messages?response=tools", strings.NewReader(body)))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.Code)
+		}
+
+		var message MessagesResponse
+		if err := json.NewDecoder(resp.Body).Decode(&message); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(message.Content) != 1 || message.Content[0].Type != "tool_use" || message.Content[0].Name != "get_weather" || !strings.HasPrefix(message.Content[0].ID, "toolu_") {
+			t.Fatalf("expected a tool_use block, got %+v", message.Content)
+		}
+
+		if !reflect.DeepEqual(message.Content[0].Input, map[string]any{"city": "Paris"}) {
+			t.Errorf("unexpected input %v", message.Content[0].Input)
+		}
+
+		if message.StopReason == nil || *message.StopReason != "tool_use" {
+			t.Errorf("expected stop reason tool_use, got %v", message.StopReason)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/messages?response=error", strings.NewReader(body)))
+		if resp.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", resp.Code)
+		}
+
+		var errResp ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := ErrorResponse{Type: "error", Error: Error{Type: "not_found_error", Message: "model not found"}}
+		if !reflect.DeepEqual(errResp, expect) {
+			t.Errorf("expected %+v, got %+v", expect, errResp)
+		}
+	})
+}
+
+func TestMessagesStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/v1/messages", MessagesMiddleware(), func(c *gin.Context) {
+		for _, resp := range []api.ChatResponse{
+			{Model: "test", Message: api.Message{Role: "assistant", Content: "Let me check."}},
+			{Model: "test", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather"}}}}},
+			{Model: "test", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{PartialArguments: `{"city": `}}}}},
+			{Model: "test", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+				{Function: api.ToolCallFunction{PartialArguments: `"Paris"}`}},
+				{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}},
+			}}},
+			{Model: "test", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop", Metrics: api.Metrics{PromptEvalCount: 10, EvalCount: 8}},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	})
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model": "test", "max_tokens": 100, "stream": true, "messages": [{"role": "user", "content": "What's the weather?"}]}`)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+
+	if ct := resp.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected content type text/event-stream, got %q", ct)
+	}
+
+	var types []string
+	var text, input string
+	for _, event := range strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n") {
+		name, data, ok := strings.Cut(event, "\n")
+		if !ok {
+			t.Fatalf("invalid event %q", event)
+		}
+
+		var e struct {
+			Type         string            `json:"type"`
+			Index        int               `json:"index"`
+			ContentBlock ContentBlock      `json:"content_block"`
+			Delta        json.RawMessage   `json:"delta"`
+			Message      *MessagesResponse `json:"message"`
+			Usage        *Usage            `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &e); err != nil {
+			t.Fatal(err)
+		}
+
+		if name != "event: "+e.Type {
+			t.Errorf("expected %q to name the event %q", name, e.Type)
+		}
+
+		types = append(types, e.Type)
+		switch e.Type {
+		case "content_block_start":
+			if e.Index == 1 && (e.ContentBlock.Type != "tool_use" || e.ContentBlock.Name != "get_weather") {
+				t.Errorf("expected a tool_use block, got %+v", e.ContentBlock)
+			}
+		case "content_block_delta":
+			var delta Delta
+			if err := json.Unmarshal(e.Delta, &delta); err != nil {
+				t.Fatal(err)
+			}
+
+			switch delta.Type {
+			case "text_delta":
+				text += delta.Text
+			case "input_json_delta":
+				if e.Index != 1 {
+					t.Errorf("expected input for block 1, got %d", e.Index)
+				}
+
+				input += delta.PartialJSON
+			}
+		case "message_delta":
+			var delta MessageDelta
+			if err := json.Unmarshal(e.Delta, &delta); err != nil {
+				t.Fatal(err)
+			}
+
+			if delta.StopReason == nil || *delta.StopReason != "tool_use" {
+				t.Errorf("expected stop reason tool_use, got %v", delta.StopReason)
+			}
+
+			if !reflect.DeepEqual(e.Usage, &Usage{InputTokens: 10, OutputTokens: 8}) {
+				t.Errorf("unexpected usage %+v", e.Usage)
+			}
+		}
+	}
+
+	expect := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if !reflect.DeepEqual(types, expect) {
+		t.Errorf("expected events %v, got %v", expect, types)
+	}
+
+	if text != "Let me check." {
+		t.Errorf("expected text %q, got %q", "Let me check.", text)
+	}
+
+	if input != `{"city": "Paris"}` {
+		t.Errorf("expected input %q, got %q", `{"city": "Paris"}`, input)
+	}
+}
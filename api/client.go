@@ -17,12 +17,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 
 	"github.com/ollama/ollama/envconfig"
@@ -33,8 +37,9 @@ import (
 // Client encapsulates client state for interacting with the ollama
 // service. Use [ClientFromEnvironment] to create new Clients.
 type Client struct {
-	base *url.URL
-	http *http.Client
+	base  *url.URL
+	http  *http.Client
+	token string
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -61,14 +66,86 @@ func checkError(resp *http.Response, body []byte) error {
 //	<scheme>://<host>:<port>
 //
 // If the variable is not specified, a default ollama host and port will be
-// used.
+// used. A unix:///path/to.sock value connects to the server over the unix
+// domain socket at that path.
+//
+// If the environment variable OLLAMA_API_KEY is set, its value is sent as a
+// bearer token with each request.
+//
+// For servers using HTTPS, OLLAMA_TLS_CA may name a PEM encoded CA bundle to
+// verify the server certificate against, in addition to the system roots.
+// OLLAMA_TLS_CLIENT_CERT and OLLAMA_TLS_CLIENT_KEY may name a PEM encoded
+// certificate and private key to present to servers that require client
+// certificates.
 func ClientFromEnvironment() (*Client, error) {
+	base, client := envconfig.Host(), http.DefaultClient
+
+	tlsConfig, err := tlsConfigFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil || base.Scheme == "unix" {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		if base.Scheme == "unix" {
+			path := base.Path
+			transport.Proxy = nil
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}
+
+			// every connection dials the socket so the host only fills the
+			// Host header
+			base = &url.URL{Scheme: "http", Host: "localhost"}
+		}
+
+		client = &http.Client{Transport: transport}
+	}
+
 	return &Client{
-		base: envconfig.Host(),
-		http: http.DefaultClient,
+		base:  base,
+		http:  client,
+		token: envconfig.APIKey(),
 	}, nil
 }
 
+func tlsConfigFromEnvironment() (*tls.Config, error) {
+	caFile, certFile, keyFile := envconfig.TLSCA(), envconfig.TLSClientCert(), envconfig.TLSClientKey()
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
 func NewClient(base *url.URL, http *http.Client) *Client {
 	return &Client{
 		base: base,
@@ -105,6 +182,9 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/json")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
 
 	respObj, err := c.http.Do(request)
 	if err != nil {
@@ -151,6 +231,9 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
 
 	response, err := c.http.Do(request)
 	if err != nil {
@@ -1,7 +1,23 @@
 package api
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestClientFromEnvironment(t *testing.T) {
@@ -43,3 +59,178 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestClientAPIKey(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Authorization"))
+		fmt.Fprint(w, `{"version": "0.0.0"}`)
+	}))
+	defer ts.Close()
+
+	t.Setenv("OLLAMA_HOST", ts.URL)
+	for _, key := range []string{"", "secret"} {
+		t.Setenv("OLLAMA_API_KEY", key)
+
+		client, err := ClientFromEnvironment()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Version(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got[0] != "" || got[1] != "Bearer secret" {
+		t.Fatalf("unexpected Authorization headers %q", got)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1, usable
+// as both a CA and a leaf certificate, and its key to dir
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ollama test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestClientTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": "0.0.0"}`)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	t.Setenv("OLLAMA_HOST", ts.URL)
+
+	cases := []struct {
+		name          string
+		ca, cert, key string
+		err           bool
+	}{
+		{name: "untrusted server", cert: certFile, key: keyFile, err: true},
+		{name: "no client certificate", ca: certFile, err: true},
+		{name: "mutual", ca: certFile, cert: certFile, key: keyFile},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TLS_CA", tt.ca)
+			t.Setenv("OLLAMA_TLS_CLIENT_CERT", tt.cert)
+			t.Setenv("OLLAMA_TLS_CLIENT_KEY", tt.key)
+
+			client, err := ClientFromEnvironment()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.Version(context.Background())
+			if tt.err && err == nil {
+				t.Fatal("expected error")
+			} else if !tt.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		t.Setenv("OLLAMA_TLS_CA", "")
+		t.Setenv("OLLAMA_TLS_CLIENT_CERT", certFile)
+		t.Setenv("OLLAMA_TLS_CLIENT_KEY", "")
+
+		if _, err := ClientFromEnvironment(); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ollama.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("unix sockets are not supported:", err)
+	}
+
+	var host string
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		fmt.Fprint(w, `{"version": "0.0.0"}`)
+	}))
+	ts.Listener.Close()
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	t.Setenv("OLLAMA_HOST", "unix://"+path)
+
+	client, err := ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := client.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != "0.0.0" || host != "localhost" {
+		t.Fatalf("unexpected version %q from host %q", version, host)
+	}
+}
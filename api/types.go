@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math"
@@ -10,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ollama/ollama/grammar"
 )
 
 // StatusError is an error with and HTTP status code.
@@ -47,6 +50,10 @@ type GenerateRequest struct {
 	// Prompt is the textual prompt to send to the model.
 	Prompt string `json:"prompt"`
 
+	// Tokens is a prompt of token IDs that is evaluated as is, in place of
+	// Prompt. It requires Raw.
+	Tokens []int `json:"tokens,omitempty"`
+
 	// Suffix is the text that comes after the inserted text.
 	Suffix string `json:"suffix"`
 
@@ -66,8 +73,9 @@ type GenerateRequest struct {
 	// Raw set to true means that no formatting will be applied to the prompt.
 	Raw bool `json:"raw,omitempty"`
 
-	// Format specifies the format to return a response in.
-	Format string `json:"format"`
+	// Format specifies the format to return a response in. It is either the
+	// string "json" or a JSON Schema object the response must match.
+	Format json.RawMessage `json:"format,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
@@ -77,6 +85,28 @@ type GenerateRequest struct {
 	// request, for multimodal models.
 	Images []ImageData `json:"images,omitempty"`
 
+	// Priority is the scheduling priority class of the request, e.g. "high",
+	// "normal" or "low". Any other value is treated as a tenant key that is
+	// queued fairly against other tenants.
+	Priority string `json:"priority,omitempty"`
+
+	// Logprobs requests the log probability of each generated token.
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of most likely tokens, up to 20, to return
+	// with the log probability of each generated token. It requires Logprobs.
+	TopLogprobs int `json:"top_logprobs,omitempty"`
+
+	// Cache names a prefix cache for the prompt. The model's state after the
+	// prompt is saved under this name and restored by later requests with the
+	// same name, which reuse it for as much of their prompt as matches.
+	Cache string `json:"cache,omitempty"`
+
+	// Draft names a small model that drafts tokens for the model to verify,
+	// which speeds up generation with speculative decoding. It overrides the
+	// model's DRAFT Modelfile directive.
+	Draft string `json:"draft,omitempty"`
+
 	// Options lists model-specific options. For example, temperature can be
 	// set through this field, if the model supports it.
 	Options map[string]interface{} `json:"options"`
@@ -93,8 +123,8 @@ type ChatRequest struct {
 	// Stream enable streaming of returned response; true by default.
 	Stream *bool `json:"stream,omitempty"`
 
-	// Format is the format to return the response in (e.g. "json").
-	Format string `json:"format"`
+	// Format is the format to return the response in, as in [GenerateRequest].
+	Format json.RawMessage `json:"format,omitempty"`
 
 	// KeepAlive controls how long the model will stay loaded into memory
 	// followin the request.
@@ -103,6 +133,37 @@ type ChatRequest struct {
 	// Tools is an optional list of tools the model has access to.
 	Tools `json:"tools,omitempty"`
 
+	// ToolChoice controls how the model uses Tools: "auto", the default,
+	// lets the model choose whether to call them, "none" hides them from
+	// the model and "required" constrains the model to call at least one.
+	ToolChoice string `json:"tool_choice,omitempty"`
+
+	// ParallelToolCalls set to false limits the model to one tool call.
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+
+	// Priority is the scheduling priority class, as in [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+
+	// Logprobs requests the log probability of each generated token, as in
+	// [GenerateRequest].
+	Logprobs bool `json:"logprobs,omitempty"`
+
+	// TopLogprobs is the number of most likely tokens to return with each
+	// generated token, as in [GenerateRequest].
+	TopLogprobs int `json:"top_logprobs,omitempty"`
+
+	// Cache names a prefix cache for the prompt, as in [GenerateRequest].
+	Cache string `json:"cache,omitempty"`
+
+	// Draft names a model drafting tokens, as in [GenerateRequest].
+	Draft string `json:"draft,omitempty"`
+
+	// Session identifies the conversation the request continues, so it is
+	// processed in the runner slot that holds its earlier turns. A session
+	// is inferred from the first messages of the conversation when it is
+	// empty.
+	Session string `json:"session,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -142,12 +203,19 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 }
 
 type ToolCall struct {
+	// Index identifies the call a streamed update belongs to.
+	Index    int              `json:"index,omitempty"`
 	Function ToolCallFunction `json:"function"`
 }
 
 type ToolCallFunction struct {
 	Name      string                    `json:"name"`
 	Arguments ToolCallFunctionArguments `json:"arguments"`
+
+	// PartialArguments is a fragment of the JSON arguments of a call that
+	// is still being streamed. The fragments of a call concatenate to its
+	// arguments, and a final update sets Name and Arguments.
+	PartialArguments string `json:"partial_arguments,omitempty"`
 }
 
 type ToolCallFunctionArguments map[string]any
@@ -191,6 +259,18 @@ type ChatResponse struct {
 
 	Done bool `json:"done"`
 
+	// Logprobs holds the log probabilities of the tokens in Message when
+	// requested, as in [GenerateResponse].
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
+	// Queued is set on streamed responses sent while the request is waiting
+	// to be scheduled.
+	Queued *QueueStatus `json:"queued,omitempty"`
+
+	// DroppedMessages is the number of messages of the chat left out of the
+	// prompt to fit into the context window, set on the final response.
+	DroppedMessages int `json:"dropped_messages,omitempty"`
+
 	Metrics
 }
 
@@ -201,6 +281,16 @@ type Metrics struct {
 	PromptEvalDuration time.Duration `json:"prompt_eval_duration,omitempty"`
 	EvalCount          int           `json:"eval_count,omitempty"`
 	EvalDuration       time.Duration `json:"eval_duration,omitempty"`
+
+	// SessionHit reports whether a chat request was processed in the runner
+	// slot that processed the previous request of its session. It is unset
+	// for the first request of a session.
+	SessionHit *bool `json:"session_hit,omitempty"`
+
+	// DraftAcceptedCount and DraftRejectedCount are the numbers of tokens
+	// drafted by the draft model that the model accepted and rejected.
+	DraftAcceptedCount int `json:"draft_accepted_count,omitempty"`
+	DraftRejectedCount int `json:"draft_rejected_count,omitempty"`
 }
 
 // Options specified in [GenerateRequest], if you add a new option here add it
@@ -227,8 +317,55 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+
+	// LogitBias adds a bias between -100 and 100 to the logits of tokens.
+	// Keys that are integers are token IDs, and other keys are text, every
+	// token of which is biased. A bias of -100 bans the tokens.
+	LogitBias map[string]float32 `json:"logit_bias,omitempty"`
+
+	// Grammar is a GBNF grammar the generated text must match. A format
+	// requested with the request takes its place.
+	Grammar string `json:"grammar,omitempty"`
+
+	// DRY ("don't repeat yourself") penalizes tokens that would extend a
+	// sequence of more than DRYAllowedLength tokens repeated from the last
+	// DRYPenaltyLastN tokens of the context, by DRYMultiplier times DRYBase to
+	// the power of the extra length. Sequences don't extend past the
+	// DRYSequenceBreakers.
+	DRYMultiplier       float32  `json:"dry_multiplier,omitempty"`
+	DRYBase             float32  `json:"dry_base,omitempty"`
+	DRYAllowedLength    int      `json:"dry_allowed_length,omitempty"`
+	DRYPenaltyLastN     int      `json:"dry_penalty_last_n,omitempty"`
+	DRYSequenceBreakers []string `json:"dry_sequence_breakers,omitempty"`
+
+	// XTC ("exclude top choices") removes all but the least likely of the
+	// tokens with a probability of at least XTCThreshold, for a share of
+	// XTCProbability of the tokens generated
+	XTCProbability float32 `json:"xtc_probability,omitempty"`
+	XTCThreshold   float32 `json:"xtc_threshold,omitempty"`
+
+	// ContextStrategy chooses which messages of a chat are left out of the
+	// prompt when they don't all fit into the context window: one of
+	// [ContextDropOldest], the default, [ContextMiddleOut] or
+	// [ContextSummarize].
+	ContextStrategy string `json:"context_strategy,omitempty"`
 }
 
+// Strategies for fitting chat messages into the context window. System
+// messages and the latest message are always kept.
+const (
+	// ContextDropOldest leaves out the oldest messages
+	ContextDropOldest = "drop_oldest"
+
+	// ContextMiddleOut leaves out the messages in the middle of the chat,
+	// keeping its start and its most recent messages
+	ContextMiddleOut = "middle_out"
+
+	// ContextSummarize leaves out the oldest messages and adds a summary of
+	// them written by the model in their place
+	ContextSummarize = "summarize"
+)
+
 // Runner options which must be set when the model is loaded into memory
 type Runner struct {
 	NumCtx    int   `json:"num_ctx,omitempty"`
@@ -258,6 +395,9 @@ type EmbedRequest struct {
 
 	Truncate *bool `json:"truncate,omitempty"`
 
+	// Priority is the scheduling priority class, as in [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+
 	// Options lists model-specific options.
 	Options map[string]interface{} `json:"options"`
 }
@@ -280,6 +420,9 @@ type EmbeddingRequest struct {
 	// Prompt is the textual prompt to embed.
 	Prompt string `json:"prompt"`
 
+	// Priority is the scheduling priority class, as in [GenerateRequest].
+	Priority string `json:"priority,omitempty"`
+
 	// KeepAlive controls how long the model will stay loaded in memory following
 	// this request.
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
@@ -345,6 +488,7 @@ type ShowResponse struct {
 	ModelInfo     map[string]any `json:"model_info,omitempty"`
 	ProjectorInfo map[string]any `json:"projector_info,omitempty"`
 	ModifiedAt    time.Time      `json:"modified_at,omitempty"`
+	Capabilities  []string       `json:"capabilities,omitempty"`
 }
 
 // CopyRequest is the request passed to [Client.Copy].
@@ -394,6 +538,9 @@ type ListResponse struct {
 // ProcessResponse is the response from [Client.Process].
 type ProcessResponse struct {
 	Models []ProcessModelResponse `json:"models"`
+
+	// Queue is the number of requests waiting to be scheduled, by priority class.
+	Queue map[string]int `json:"queue,omitempty"`
 }
 
 // ListModelResponse is a single model description in [ListResponse].
@@ -415,6 +562,13 @@ type ProcessModelResponse struct {
 	Details   ModelDetails `json:"details,omitempty"`
 	ExpiresAt time.Time    `json:"expires_at"`
 	SizeVRAM  int64        `json:"size_vram"`
+
+	// Pinned is true for models that are kept loaded by the server configuration.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Reason is why the model is loaded: "loading", "active" while serving
+	// requests, "pinned", or "keep_alive" while idle until ExpiresAt.
+	Reason string `json:"reason,omitempty"`
 }
 
 type RetrieveModelResponse struct {
@@ -449,9 +603,41 @@ type GenerateResponse struct {
 	// can be sent in the next request to keep a conversational memory.
 	Context []int `json:"context,omitempty"`
 
+	// Logprobs holds the log probability of each token in Response when
+	// requested with [GenerateRequest.Logprobs].
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
+	// Queued is set on streamed responses sent while the request is waiting
+	// to be scheduled.
+	Queued *QueueStatus `json:"queued,omitempty"`
+
 	Metrics
 }
 
+// Logprob is the log probability of a token.
+type Logprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+}
+
+// TokenLogprob is the log probability of a generated token along with the most
+// likely tokens at its position.
+type TokenLogprob struct {
+	Token       string    `json:"token"`
+	Logprob     float64   `json:"logprob"`
+	TopLogprobs []Logprob `json:"top_logprobs,omitempty"`
+}
+
+// QueueStatus describes a request that is waiting for a model to become
+// available.
+type QueueStatus struct {
+	// Position is the 1-based position of the request in the queue.
+	Position int `json:"position"`
+
+	// ExpectedWait is an estimate of how long until the request is scheduled.
+	ExpectedWait time.Duration `json:"expected_wait,omitempty"`
+}
+
 // ModelDetails provides details about a model.
 type ModelDetails struct {
 	ParentModel       string   `json:"parent_model"`
@@ -488,6 +674,14 @@ func (m *Metrics) Summary() {
 		fmt.Fprintf(os.Stderr, "eval duration:        %s\n", m.EvalDuration)
 		fmt.Fprintf(os.Stderr, "eval rate:            %.2f tokens/s\n", float64(m.EvalCount)/m.EvalDuration.Seconds())
 	}
+
+	if m.SessionHit != nil {
+		fmt.Fprintf(os.Stderr, "session hit:          %t\n", *m.SessionHit)
+	}
+
+	if drafted := m.DraftAcceptedCount + m.DraftRejectedCount; drafted > 0 {
+		fmt.Fprintf(os.Stderr, "draft accepted:       %d/%d token(s)\n", m.DraftAcceptedCount, drafted)
+	}
 }
 
 func (opts *Options) FromMap(m map[string]interface{}) error {
@@ -573,9 +767,84 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 				} else {
 					return fmt.Errorf("unknown type loading config params: %v %v", field.Kind(), field.Type())
 				}
+			case reflect.Map:
+				// JSON unmarshals to map[string]interface{} of float64
+				val, ok := val.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("option %q must be of type object", key)
+				}
+				m := make(map[string]float32, len(val))
+				for k, v := range val {
+					switch v := v.(type) {
+					case float64:
+						m[k] = float32(v)
+					case float32:
+						m[k] = v
+					default:
+						return fmt.Errorf("option %q must be an object of numbers", key)
+					}
+				}
+				field.Set(reflect.ValueOf(m))
 			default:
 				return fmt.Errorf("unknown type loading config params: %v", field.Kind())
 			}
+
+			if err := opts.checkOption(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkOption returns an error if the option with the JSON name key is out
+// of range
+func (opts *Options) checkOption(key string) error {
+	switch key {
+	case "logit_bias":
+		for token, bias := range opts.LogitBias {
+			if token == "" {
+				return errors.New(`option "logit_bias" must not have an empty token`)
+			} else if bias < -100 || bias > 100 {
+				return fmt.Errorf(`option "logit_bias" must be between -100 and 100, got %v for %q`, bias, token)
+			}
+		}
+	case "grammar":
+		if opts.Grammar != "" {
+			if err := grammar.Validate(opts.Grammar); err != nil {
+				return fmt.Errorf(`option "grammar" is invalid: %w`, err)
+			}
+		}
+	case "dry_multiplier":
+		if opts.DRYMultiplier < 0 {
+			return errors.New(`option "dry_multiplier" must not be negative`)
+		}
+	case "dry_base":
+		if opts.DRYBase < 1 {
+			return errors.New(`option "dry_base" must be at least 1`)
+		}
+	case "dry_allowed_length":
+		if opts.DRYAllowedLength < 1 {
+			return errors.New(`option "dry_allowed_length" must be at least 1`)
+		}
+	case "dry_penalty_last_n":
+		if opts.DRYPenaltyLastN < -1 {
+			return errors.New(`option "dry_penalty_last_n" must be -1 (num_ctx), 0 (disabled) or greater`)
+		}
+	case "xtc_probability":
+		if opts.XTCProbability < 0 || opts.XTCProbability > 1 {
+			return errors.New(`option "xtc_probability" must be between 0 and 1`)
+		}
+	case "xtc_threshold":
+		if opts.XTCThreshold < 0 || opts.XTCThreshold > 1 {
+			return errors.New(`option "xtc_threshold" must be between 0 and 1`)
+		}
+	case "context_strategy":
+		switch opts.ContextStrategy {
+		case "", ContextDropOldest, ContextMiddleOut, ContextSummarize:
+		default:
+			return fmt.Errorf(`option "context_strategy" must be one of %q, %q or %q, got %q`, ContextDropOldest, ContextMiddleOut, ContextSummarize, opts.ContextStrategy)
 		}
 	}
 
@@ -606,6 +875,13 @@ func DefaultOptions() Options {
 		PenalizeNewline:  true,
 		Seed:             -1,
 
+		// DRY and XTC are disabled by default
+		DRYBase:             1.75,
+		DRYAllowedLength:    2,
+		DRYPenaltyLastN:     -1,
+		DRYSequenceBreakers: []string{"\n", ":", "\"", "*"},
+		XTCThreshold:        0.1,
+
 		Runner: Runner{
 			// options set when the model is loaded
 			NumCtx:    2048,
@@ -711,6 +987,26 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 				case reflect.Slice:
 					// TODO: only string slices are supported right now
 					out[key] = vals
+				case reflect.Map:
+					// a map is set a key at a time, from a token or quoted
+					// text followed by its bias
+					s := strings.Join(vals, " ")
+					i := strings.LastIndexAny(s, " \t")
+					if i < 0 {
+						return nil, fmt.Errorf("invalid %s value %s, expected a token and a bias", key, vals)
+					}
+
+					k := strings.TrimSpace(s[:i])
+					if unquoted, err := strconv.Unquote(k); err == nil {
+						k = unquoted
+					}
+
+					bias, err := strconv.ParseFloat(s[i+1:], 32)
+					if err != nil {
+						return nil, fmt.Errorf("invalid float value %s", vals)
+					}
+
+					out[key] = map[string]any{k: float32(bias)}
 				case reflect.Pointer:
 					var b bool
 					if field.Type() == reflect.TypeOf(&b) {
@@ -729,5 +1025,21 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 		}
 	}
 
+	// check the values as they will be loaded, from JSON
+	bts, err := json.Marshal(out)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(bts, &m); err != nil {
+		return nil, err
+	}
+
+	checked := DefaultOptions()
+	if err := checked.FromMap(m); err != nil {
+		return nil, err
+	}
+
 	return out, nil
 }
@@ -209,6 +209,150 @@ func TestUseMmapFormatParams(t *testing.T) {
 	}
 }
 
+func TestSamplingOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		req  string
+		exp  func(*Options)
+		err  string
+	}{
+		{
+			name: "logit bias",
+			req:  `{"logit_bias": {"15043": -100, " world": 5.5}}`,
+			exp: func(o *Options) {
+				o.LogitBias = map[string]float32{"15043": -100, " world": 5.5}
+			},
+		},
+		{
+			name: "grammar",
+			req:  `{"grammar": "root ::= \"yes\" | \"no\""}`,
+			exp: func(o *Options) {
+				o.Grammar = `root ::= "yes" | "no"`
+			},
+		},
+		{
+			name: "dry and xtc",
+			req:  `{"dry_multiplier": 0.8, "dry_allowed_length": 3, "dry_sequence_breakers": ["\n"], "xtc_probability": 0.5, "xtc_threshold": 0.2}`,
+			exp: func(o *Options) {
+				o.DRYMultiplier = 0.8
+				o.DRYAllowedLength = 3
+				o.DRYSequenceBreakers = []string{"\n"}
+				o.XTCProbability = 0.5
+				o.XTCThreshold = 0.2
+			},
+		},
+		{
+			name: "logit bias out of range",
+			req:  `{"logit_bias": {"15043": -101}}`,
+			err:  `option "logit_bias" must be between -100 and 100, got -101 for "15043"`,
+		},
+		{
+			name: "logit bias not a number",
+			req:  `{"logit_bias": {"15043": "ban"}}`,
+			err:  `option "logit_bias" must be an object of numbers`,
+		},
+		{
+			name: "invalid grammar",
+			req:  `{"grammar": "root ::= value"}`,
+			err:  `option "grammar" is invalid: grammar refers to undefined rule "value"`,
+		},
+		{
+			name: "dry base",
+			req:  `{"dry_base": 0.5}`,
+			err:  `option "dry_base" must be at least 1`,
+		},
+		{
+			name: "xtc probability",
+			req:  `{"xtc_probability": 2}`,
+			err:  `option "xtc_probability" must be between 0 and 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var oMap map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(test.req), &oMap))
+
+			opts := DefaultOptions()
+			err := opts.FromMap(oMap)
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+
+			require.NoError(t, err)
+			exp := DefaultOptions()
+			test.exp(&exp)
+			assert.Equal(t, exp, opts)
+		})
+	}
+}
+
+func TestContextStrategy(t *testing.T) {
+	for _, strategy := range []string{ContextDropOldest, ContextMiddleOut, ContextSummarize} {
+		opts := DefaultOptions()
+		require.NoError(t, opts.FromMap(map[string]interface{}{"context_strategy": strategy}))
+		assert.Equal(t, strategy, opts.ContextStrategy)
+	}
+
+	opts := DefaultOptions()
+	err := opts.FromMap(map[string]interface{}{"context_strategy": "oldest"})
+	require.EqualError(t, err, `option "context_strategy" must be one of "drop_oldest", "middle_out" or "summarize", got "oldest"`)
+}
+
+func TestSamplingFormatParams(t *testing.T) {
+	tests := []struct {
+		name string
+		req  map[string][]string
+		exp  map[string]interface{}
+		err  string
+	}{
+		{
+			name: "logit bias token",
+			req:  map[string][]string{"logit_bias": {"15043 -100"}},
+			exp:  map[string]interface{}{"logit_bias": map[string]any{"15043": float32(-100)}},
+		},
+		{
+			name: "logit bias text",
+			req:  map[string][]string{"logit_bias": {`" world" 2.5`}},
+			exp:  map[string]interface{}{"logit_bias": map[string]any{" world": float32(2.5)}},
+		},
+		{
+			name: "logit bias arguments",
+			req:  map[string][]string{"logit_bias": {"15043", "-100"}},
+			exp:  map[string]interface{}{"logit_bias": map[string]any{"15043": float32(-100)}},
+		},
+		{
+			name: "logit bias without bias",
+			req:  map[string][]string{"logit_bias": {"15043"}},
+			err:  "invalid logit_bias value [15043], expected a token and a bias",
+		},
+		{
+			name: "logit bias out of range",
+			req:  map[string][]string{"logit_bias": {"15043 200"}},
+			err:  `option "logit_bias" must be between -100 and 100, got 200 for "15043"`,
+		},
+		{
+			name: "invalid grammar",
+			req:  map[string][]string{"grammar": {`root ::= "a`}},
+			err:  `option "grammar" is invalid: grammar line 1: unterminated literal`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := FormatParams(test.req)
+			if test.err != "" {
+				require.EqualError(t, err, test.err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, resp)
+		})
+	}
+}
+
 func TestMessage_UnmarshalJSON(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -7,6 +7,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -83,7 +85,7 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 
 	for i := range modelfile.Commands {
 		switch modelfile.Commands[i].Name {
-		case "model", "adapter":
+		case "model", "adapter", "draft":
 			path := modelfile.Commands[i].Args
 			if path == "~" {
 				path = home
@@ -96,7 +98,7 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 			}
 
 			fi, err := os.Stat(path)
-			if errors.Is(err, os.ErrNotExist) && modelfile.Commands[i].Name == "model" {
+			if errors.Is(err, os.ErrNotExist) && modelfile.Commands[i].Name != "adapter" {
 				continue
 			} else if err != nil {
 				return err
@@ -613,7 +615,11 @@ func ListRunningHandler(cmd *cobra.Command, args []string) error {
 				cpuPercent := math.Round(float64(sizeCPU) / float64(m.Size) * 100)
 				procStr = fmt.Sprintf("%d%%/%d%% CPU/GPU", int(cpuPercent), int(100-cpuPercent))
 			}
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, format.HumanTime(m.ExpiresAt, "Never")})
+			until := format.HumanTime(m.ExpiresAt, "Never")
+			if m.Pinned {
+				until = "Pinned"
+			}
+			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), procStr, until})
 		}
 	}
 
@@ -911,6 +917,18 @@ func PullHandler(cmd *cobra.Command, args []string) error {
 
 type generateContextKey string
 
+// requestFormat returns the format for a request from the format flag, which
+// is either "json" or a JSON Schema object
+func requestFormat(format string) json.RawMessage {
+	if format == "" {
+		return nil
+	} else if strings.HasPrefix(strings.TrimSpace(format), "{") {
+		return json.RawMessage(format)
+	}
+
+	return json.RawMessage(strconv.Quote(format))
+}
+
 type runOptions struct {
 	Model       string
 	ParentModel string
@@ -1023,7 +1041,7 @@ func chat(cmd *cobra.Command, opts runOptions) (*api.Message, error) {
 	req := &api.ChatRequest{
 		Model:    opts.Model,
 		Messages: opts.Messages,
-		Format:   opts.Format,
+		Format:   requestFormat(opts.Format),
 		Options:  opts.Options,
 	}
 
@@ -1110,7 +1128,7 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		Prompt:    opts.Prompt,
 		Context:   generateContext,
 		Images:    opts.Images,
-		Format:    opts.Format,
+		Format:    requestFormat(opts.Format),
 		System:    opts.System,
 		Options:   opts.Options,
 		KeepAlive: opts.KeepAlive,
@@ -1152,7 +1170,13 @@ func RunServer(_ *cobra.Command, _ []string) error {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", envconfig.Host().Host)
+	var ln net.Listener
+	var err error
+	if host := envconfig.Host(); host.Scheme == "unix" {
+		ln, err = listenUnix(host.Path, envconfig.SocketMode())
+	} else {
+		ln, err = net.Listen("tcp", host.Host)
+	}
 	if err != nil {
 		return err
 	}
@@ -1165,6 +1189,35 @@ func RunServer(_ *cobra.Command, _ []string) error {
 	return err
 }
 
+// listenUnix listens on the unix domain socket at path, replacing a socket
+// left behind by a server that didn't shut down cleanly
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: another server is already listening on the socket", path)
+	} else if fi, err := os.Lstat(path); err == nil && fi.Mode().Type() == os.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// create the socket with no more than mode so it's never reachable with
+	// looser permissions, even briefly
+	old := umask(0o777 &^ int(mode.Perm()))
+	ln, err := net.Listen("unix", path)
+	umask(old)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
 func initializeKeypair() error {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -1327,7 +1380,7 @@ func NewCLI() *cobra.Command {
 	runCmd.Flags().Bool("verbose", false, "Show timings for response")
 	runCmd.Flags().Bool("insecure", false, "Use an insecure registry")
 	runCmd.Flags().Bool("nowordwrap", false, "Don't wrap words to the next line automatically")
-	runCmd.Flags().String("format", "", "Response format (e.g. json)")
+	runCmd.Flags().String("format", "", "Response format (json or a JSON Schema)")
 	serveCmd := &cobra.Command{
 		Use:     "serve",
 		Aliases: []string{"start"},
@@ -1389,7 +1442,12 @@ func NewCLI() *cobra.Command {
 
 	envVars := envconfig.AsMap()
 
-	envs := []envconfig.EnvVar{envVars["OLLAMA_HOST"]}
+	envs := []envconfig.EnvVar{
+		envVars["OLLAMA_HOST"],
+		envVars["OLLAMA_TLS_CA"],
+		envVars["OLLAMA_TLS_CLIENT_CERT"],
+		envVars["OLLAMA_TLS_CLIENT_KEY"],
+	}
 
 	for _, cmd := range []*cobra.Command{
 		createCmd,
@@ -1405,11 +1463,12 @@ func NewCLI() *cobra.Command {
 	} {
 		switch cmd {
 		case runCmd:
-			appendEnvDocs(cmd, []envconfig.EnvVar{envVars["OLLAMA_HOST"], envVars["OLLAMA_NOHISTORY"]})
+			appendEnvDocs(cmd, append(envs, envVars["OLLAMA_NOHISTORY"]))
 		case serveCmd:
 			appendEnvDocs(cmd, []envconfig.EnvVar{
 				envVars["OLLAMA_DEBUG"],
 				envVars["OLLAMA_HOST"],
+				envVars["OLLAMA_SOCKET_MODE"],
 				envVars["OLLAMA_KEEP_ALIVE"],
 				envVars["OLLAMA_MAX_LOADED_MODELS"],
 				envVars["OLLAMA_MAX_QUEUE"],
@@ -1423,6 +1482,9 @@ func NewCLI() *cobra.Command {
 				envVars["OLLAMA_LLM_LIBRARY"],
 				envVars["OLLAMA_GPU_OVERHEAD"],
 				envVars["OLLAMA_LOAD_TIMEOUT"],
+				envVars["OLLAMA_TLS_CERT"],
+				envVars["OLLAMA_TLS_KEY"],
+				envVars["OLLAMA_TLS_CLIENT_CA"],
 			})
 		default:
 			appendEnvDocs(cmd, envs)
@@ -0,0 +1,6 @@
+package cmd
+
+// umask is a no-op since windows has no file mode creation mask
+func umask(mask int) int {
+	return 0
+}
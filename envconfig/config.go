@@ -15,7 +15,8 @@ import (
 )
 
 // Host returns the scheme and host. Host can be configured via the OLLAMA_HOST environment variable.
-// Default is scheme "http" and host "127.0.0.1:11434"
+// Default is scheme "http" and host "127.0.0.1:11434". A "unix" scheme, e.g. "unix:///run/ollama.sock",
+// names a unix domain socket, returned as the URL path.
 func Host() *url.URL {
 	defaultPort := "11434"
 
@@ -28,6 +29,8 @@ func Host() *url.URL {
 		defaultPort = "80"
 	case scheme == "https":
 		defaultPort = "443"
+	case scheme == "unix":
+		return &url.URL{Scheme: scheme, Path: hostport}
 	}
 
 	hostport, path, _ := strings.Cut(hostport, "/")
@@ -92,6 +95,31 @@ func Models() string {
 	return filepath.Join(home, ".ollama", "models")
 }
 
+// PinnedModels returns the models that are loaded at startup and kept loaded. PinnedModels can be configured via the
+// OLLAMA_PINNED_MODELS environment variable as a comma separated list of model names.
+func PinnedModels() (models []string) {
+	for _, m := range strings.Split(Var("OLLAMA_PINNED_MODELS"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+
+	return models
+}
+
+// TrustedProxies returns the addresses and CIDR ranges of proxies whose forwarding headers are trusted to give the
+// address of a client. TrustedProxies can be configured via the OLLAMA_TRUSTED_PROXIES environment variable as a comma
+// separated list. Default is none, so clients are identified by the address of the connection.
+func TrustedProxies() (proxies []string) {
+	for _, p := range strings.Split(Var("OLLAMA_TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+
+	return proxies
+}
+
 // KeepAlive returns the duration that models stay loaded in memory. KeepAlive can be configured via the OLLAMA_KEEP_ALIVE environment variable.
 // Negative values are treated as infinite. Zero is treated as no keep alive.
 // Default is 5 minutes.
@@ -160,6 +188,10 @@ var (
 	SchedSpread = Bool("OLLAMA_SCHED_SPREAD")
 	// IntelGPU enables experimental Intel GPU detection.
 	IntelGPU = Bool("OLLAMA_INTEL_GPU")
+	// AuditLogContent records prompts and responses in the audit log.
+	AuditLogContent = Bool("OLLAMA_AUDIT_LOG_CONTENT")
+	// PersistPromptCache saves named prompt caches to disk under the models directory.
+	PersistPromptCache = Bool("OLLAMA_PERSIST_PROMPT_CACHE")
 )
 
 func String(s string) func() string {
@@ -171,6 +203,37 @@ func String(s string) func() string {
 var (
 	LLMLibrary = String("OLLAMA_LLM_LIBRARY")
 	TmpDir     = String("OLLAMA_TMPDIR")
+	// Traces sets where request traces are exported: "stdout", an OTLP/HTTP collector URL or a file path.
+	// Traces can be configured via the OLLAMA_TRACES environment variable. Tracing is disabled by default.
+	Traces = String("OLLAMA_TRACES")
+	// APIKeysFile is the path of a JSON file of API keys the server requires clients to authenticate with.
+	// APIKeysFile can be configured via the OLLAMA_API_KEYS_FILE environment variable. Authentication is disabled by default.
+	APIKeysFile = String("OLLAMA_API_KEYS_FILE")
+	// LimitsFile is the path of a JSON file of per client and per model rate limits and token quotas.
+	// LimitsFile can be configured via the OLLAMA_LIMITS_FILE environment variable.
+	LimitsFile = String("OLLAMA_LIMITS_FILE")
+	// AuditLog is the path of a JSON lines file recording each model request. AuditLog can be configured via the
+	// OLLAMA_AUDIT_LOG environment variable. Audit logging is disabled by default.
+	AuditLog = String("OLLAMA_AUDIT_LOG")
+	// APIKey is the bearer token clients send to the server. APIKey can be configured via the OLLAMA_API_KEY
+	// environment variable. It is deliberately left out of AsMap so it isn't logged.
+	APIKey = String("OLLAMA_API_KEY")
+	// TLSCert and TLSKey are the paths of the PEM encoded certificate and private key the server uses to serve HTTPS.
+	// TLSCert and TLSKey can be configured via the OLLAMA_TLS_CERT and OLLAMA_TLS_KEY environment variables.
+	TLSCert = String("OLLAMA_TLS_CERT")
+	TLSKey  = String("OLLAMA_TLS_KEY")
+	// TLSClientCA is the path of a PEM encoded CA bundle the server verifies client certificates against. Clients
+	// must present a certificate when it is set. TLSClientCA can be configured via the OLLAMA_TLS_CLIENT_CA
+	// environment variable.
+	TLSClientCA = String("OLLAMA_TLS_CLIENT_CA")
+	// TLSCA is the path of a PEM encoded CA bundle clients verify the server certificate against in addition to the
+	// system roots. TLSCA can be configured via the OLLAMA_TLS_CA environment variable.
+	TLSCA = String("OLLAMA_TLS_CA")
+	// TLSClientCert and TLSClientKey are the paths of the PEM encoded certificate and private key clients present to
+	// the server. TLSClientCert and TLSClientKey can be configured via the OLLAMA_TLS_CLIENT_CERT and
+	// OLLAMA_TLS_CLIENT_KEY environment variables.
+	TLSClientCert = String("OLLAMA_TLS_CLIENT_CERT")
+	TLSClientKey  = String("OLLAMA_TLS_CLIENT_KEY")
 
 	CudaVisibleDevices    = String("CUDA_VISIBLE_DEVICES")
 	HipVisibleDevices     = String("HIP_VISIBLE_DEVICES")
@@ -249,6 +312,9 @@ var (
 	MaxQueue = Uint("OLLAMA_MAX_QUEUE", 512)
 	// MaxVRAM sets a maximum VRAM override in bytes. MaxVRAM can be configured via the OLLAMA_MAX_VRAM environment variable.
 	MaxVRAM = Uint("OLLAMA_MAX_VRAM", 0)
+	// AuditLogMaxFiles sets the number of rotated audit logs to keep. AuditLogMaxFiles can be configured via the
+	// OLLAMA_AUDIT_LOG_MAX_FILES environment variable.
+	AuditLogMaxFiles = Uint("OLLAMA_AUDIT_LOG_MAX_FILES", 5)
 )
 
 func Uint64(key string, defaultValue uint64) func() uint64 {
@@ -268,6 +334,53 @@ func Uint64(key string, defaultValue uint64) func() uint64 {
 // Set aside VRAM per GPU
 var GpuOverhead = Uint64("OLLAMA_GPU_OVERHEAD", 0)
 
+// AuditLogMaxSize sets the size in bytes at which the audit log is rotated. AuditLogMaxSize can be configured via the
+// OLLAMA_AUDIT_LOG_MAX_SIZE environment variable. Zero disables rotation.
+var AuditLogMaxSize = Uint64("OLLAMA_AUDIT_LOG_MAX_SIZE", 100*1024*1024)
+
+// BatchMaxFileSize sets the maximum size in bytes of a file uploaded for batches. BatchMaxFileSize can be configured via
+// the OLLAMA_BATCH_MAX_FILE_SIZE environment variable. Zero disables the limit.
+var BatchMaxFileSize = Uint64("OLLAMA_BATCH_MAX_FILE_SIZE", 200*1024*1024)
+
+// SchedWeights returns the relative weights of scheduler priority classes. SchedWeights can be configured via the
+// OLLAMA_SCHED_WEIGHTS environment variable as a comma separated list of class=weight pairs, e.g. "high=8,batch=1".
+// Classes not listed use the scheduler defaults.
+func SchedWeights() map[string]uint {
+	weights := make(map[string]uint)
+	for _, pair := range strings.Split(Var("OLLAMA_SCHED_WEIGHTS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(pair, "=")
+		n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 32)
+		if !ok || err != nil || n == 0 || strings.TrimSpace(k) == "" {
+			slog.Warn("invalid scheduler weight, ignoring", "value", pair)
+			continue
+		}
+
+		weights[strings.TrimSpace(k)] = uint(n)
+	}
+
+	return weights
+}
+
+// SocketMode returns the file mode of the unix domain socket the server listens on when OLLAMA_HOST has a
+// "unix" scheme. SocketMode can be configured via the OLLAMA_SOCKET_MODE environment variable as an octal
+// number, e.g. "0600". Default is 0660
+func SocketMode() os.FileMode {
+	if s := Var("OLLAMA_SOCKET_MODE"); s != "" {
+		if n, err := strconv.ParseUint(s, 8, 32); err != nil || n > 0o777 {
+			slog.Warn("invalid socket mode, using default", "value", s, "default", "0660")
+		} else {
+			return os.FileMode(n)
+		}
+	}
+
+	return 0o660
+}
+
 type EnvVar struct {
 	Name        string
 	Value       any
@@ -276,23 +389,42 @@ type EnvVar struct {
 
 func AsMap() map[string]EnvVar {
 	ret := map[string]EnvVar{
-		"OLLAMA_DEBUG":             {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
-		"OLLAMA_FLASH_ATTENTION":   {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
-		"OLLAMA_GPU_OVERHEAD":      {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
-		"OLLAMA_HOST":              {"OLLAMA_HOST", Host(), "IP Address for the ollama server (default 127.0.0.1:11434)"},
-		"OLLAMA_KEEP_ALIVE":        {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
-		"OLLAMA_LLM_LIBRARY":       {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
-		"OLLAMA_LOAD_TIMEOUT":      {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
-		"OLLAMA_MAX_LOADED_MODELS": {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
-		"OLLAMA_MAX_QUEUE":         {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
-		"OLLAMA_MODELS":            {"OLLAMA_MODELS", Models(), "The path to the models directory"},
-		"OLLAMA_NOHISTORY":         {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
-		"OLLAMA_NOPRUNE":           {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
-		"OLLAMA_NUM_PARALLEL":      {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
-		"OLLAMA_ORIGINS":           {"OLLAMA_ORIGINS", Origins(), "A comma separated list of allowed origins"},
-		"OLLAMA_RUNNERS_DIR":       {"OLLAMA_RUNNERS_DIR", RunnersDir(), "Location for runners"},
-		"OLLAMA_SCHED_SPREAD":      {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
-		"OLLAMA_TMPDIR":            {"OLLAMA_TMPDIR", TmpDir(), "Location for temporary files"},
+		"OLLAMA_API_KEYS_FILE":        {"OLLAMA_API_KEYS_FILE", APIKeysFile(), "Path of a JSON file of API keys required to access the server"},
+		"OLLAMA_AUDIT_LOG":            {"OLLAMA_AUDIT_LOG", AuditLog(), "Path of a JSON lines file recording each model request"},
+		"OLLAMA_AUDIT_LOG_CONTENT":    {"OLLAMA_AUDIT_LOG_CONTENT", AuditLogContent(), "Record prompts and responses in the audit log"},
+		"OLLAMA_AUDIT_LOG_MAX_FILES":  {"OLLAMA_AUDIT_LOG_MAX_FILES", AuditLogMaxFiles(), "Number of rotated audit logs to keep (default 5)"},
+		"OLLAMA_AUDIT_LOG_MAX_SIZE":   {"OLLAMA_AUDIT_LOG_MAX_SIZE", AuditLogMaxSize(), "Size in bytes at which the audit log is rotated (default 100 MiB)"},
+		"OLLAMA_BATCH_MAX_FILE_SIZE":  {"OLLAMA_BATCH_MAX_FILE_SIZE", BatchMaxFileSize(), "Maximum size in bytes of a file uploaded for batches (default 200 MiB)"},
+		"OLLAMA_DEBUG":                {"OLLAMA_DEBUG", Debug(), "Show additional debug information (e.g. OLLAMA_DEBUG=1)"},
+		"OLLAMA_FLASH_ATTENTION":      {"OLLAMA_FLASH_ATTENTION", FlashAttention(), "Enabled flash attention"},
+		"OLLAMA_GPU_OVERHEAD":         {"OLLAMA_GPU_OVERHEAD", GpuOverhead(), "Reserve a portion of VRAM per GPU (bytes)"},
+		"OLLAMA_HOST":                 {"OLLAMA_HOST", Host(), "IP Address or unix:// socket path for the ollama server (default 127.0.0.1:11434)"},
+		"OLLAMA_KEEP_ALIVE":           {"OLLAMA_KEEP_ALIVE", KeepAlive(), "The duration that models stay loaded in memory (default \"5m\")"},
+		"OLLAMA_LIMITS_FILE":          {"OLLAMA_LIMITS_FILE", LimitsFile(), "Path of a JSON file of rate limits and token quotas"},
+		"OLLAMA_LLM_LIBRARY":          {"OLLAMA_LLM_LIBRARY", LLMLibrary(), "Set LLM library to bypass autodetection"},
+		"OLLAMA_LOAD_TIMEOUT":         {"OLLAMA_LOAD_TIMEOUT", LoadTimeout(), "How long to allow model loads to stall before giving up (default \"5m\")"},
+		"OLLAMA_MAX_LOADED_MODELS":    {"OLLAMA_MAX_LOADED_MODELS", MaxRunners(), "Maximum number of loaded models per GPU"},
+		"OLLAMA_MAX_QUEUE":            {"OLLAMA_MAX_QUEUE", MaxQueue(), "Maximum number of queued requests"},
+		"OLLAMA_MODELS":               {"OLLAMA_MODELS", Models(), "The path to the models directory"},
+		"OLLAMA_NOHISTORY":            {"OLLAMA_NOHISTORY", NoHistory(), "Do not preserve readline history"},
+		"OLLAMA_NOPRUNE":              {"OLLAMA_NOPRUNE", NoPrune(), "Do not prune model blobs on startup"},
+		"OLLAMA_NUM_PARALLEL":         {"OLLAMA_NUM_PARALLEL", NumParallel(), "Maximum number of parallel requests"},
+		"OLLAMA_ORIGINS":              {"OLLAMA_ORIGINS", Origins(), "A comma separated list of allowed origins"},
+		"OLLAMA_PERSIST_PROMPT_CACHE": {"OLLAMA_PERSIST_PROMPT_CACHE", PersistPromptCache(), "Save named prompt caches to disk so they outlive the model being unloaded"},
+		"OLLAMA_PINNED_MODELS":        {"OLLAMA_PINNED_MODELS", PinnedModels(), "A comma separated list of models to load at startup and keep loaded"},
+		"OLLAMA_RUNNERS_DIR":          {"OLLAMA_RUNNERS_DIR", RunnersDir(), "Location for runners"},
+		"OLLAMA_SCHED_SPREAD":         {"OLLAMA_SCHED_SPREAD", SchedSpread(), "Always schedule model across all GPUs"},
+		"OLLAMA_SOCKET_MODE":          {"OLLAMA_SOCKET_MODE", SocketMode(), "File mode of the unix socket when OLLAMA_HOST is unix:///path (default 0660)"},
+		"OLLAMA_SCHED_WEIGHTS":        {"OLLAMA_SCHED_WEIGHTS", SchedWeights(), "Relative weights of request priority classes (e.g. \"high=8,normal=4,low=1\")"},
+		"OLLAMA_TLS_CA":               {"OLLAMA_TLS_CA", TLSCA(), "Path of a CA bundle clients use to verify the server certificate"},
+		"OLLAMA_TLS_CERT":             {"OLLAMA_TLS_CERT", TLSCert(), "Path of the certificate used to serve HTTPS"},
+		"OLLAMA_TLS_CLIENT_CA":        {"OLLAMA_TLS_CLIENT_CA", TLSClientCA(), "Path of a CA bundle used to require and verify client certificates"},
+		"OLLAMA_TLS_CLIENT_CERT":      {"OLLAMA_TLS_CLIENT_CERT", TLSClientCert(), "Path of the certificate clients present to the server"},
+		"OLLAMA_TLS_CLIENT_KEY":       {"OLLAMA_TLS_CLIENT_KEY", TLSClientKey(), "Path of the private key clients present to the server"},
+		"OLLAMA_TLS_KEY":              {"OLLAMA_TLS_KEY", TLSKey(), "Path of the private key used to serve HTTPS"},
+		"OLLAMA_TMPDIR":               {"OLLAMA_TMPDIR", TmpDir(), "Location for temporary files"},
+		"OLLAMA_TRACES":               {"OLLAMA_TRACES", Traces(), "Export request traces to stdout, an OTLP/HTTP endpoint or a file"},
+		"OLLAMA_TRUSTED_PROXIES":      {"OLLAMA_TRUSTED_PROXIES", TrustedProxies(), "A comma separated list of proxy addresses or CIDR ranges whose X-Forwarded-For headers are trusted"},
 	}
 	if runtime.GOOS != "darwin" {
 		ret["CUDA_VISIBLE_DEVICES"] = EnvVar{"CUDA_VISIBLE_DEVICES", CudaVisibleDevices(), "Set which NVIDIA devices are visible"}
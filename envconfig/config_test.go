@@ -2,6 +2,7 @@ package envconfig
 
 import (
 	"math"
+	"os"
 	"testing"
 	"time"
 
@@ -35,6 +36,7 @@ func TestHost(t *testing.T) {
 		"https":               {"https://1.2.3.4", "https://1.2.3.4:443"},
 		"https port":          {"https://1.2.3.4:4321", "https://1.2.3.4:4321"},
 		"proxy path":          {"https://example.com/ollama", "https://example.com:443/ollama"},
+		"unix socket":         {"unix:///run/ollama.sock", "unix:///run/ollama.sock"},
 	}
 
 	for name, tt := range cases {
@@ -182,6 +184,80 @@ func TestUint(t *testing.T) {
 	}
 }
 
+func TestPinnedModels(t *testing.T) {
+	cases := map[string][]string{
+		"":                                nil,
+		"llama3":                          {"llama3"},
+		"llama3, nomic-embed-text:latest": {"llama3", "nomic-embed-text:latest"},
+		" ,llama3,,":                      {"llama3"},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("OLLAMA_PINNED_MODELS", k)
+			if diff := cmp.Diff(PinnedModels(), v); diff != "" {
+				t.Errorf("%s: mismatch (-got +want):\n%s", k, diff)
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	cases := map[string][]string{
+		"":                         nil,
+		"10.0.0.1":                 {"10.0.0.1"},
+		"10.0.0.1, 192.168.0.0/16": {"10.0.0.1", "192.168.0.0/16"},
+		" ,::1,,":                  {"::1"},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("OLLAMA_TRUSTED_PROXIES", k)
+			if diff := cmp.Diff(TrustedProxies(), v); diff != "" {
+				t.Errorf("%s: mismatch (-got +want):\n%s", k, diff)
+			}
+		})
+	}
+}
+
+func TestSchedWeights(t *testing.T) {
+	cases := map[string]map[string]uint{
+		"":                      {},
+		"high=8":                {"high": 8},
+		"high=8, low=1":         {"high": 8, "low": 1},
+		"high=8,bad,team=x":     {"high": 8},
+		"zero=0,=3,negative=-1": {},
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("OLLAMA_SCHED_WEIGHTS", k)
+			if diff := cmp.Diff(SchedWeights(), v); diff != "" {
+				t.Errorf("%s: mismatch (-got +want):\n%s", k, diff)
+			}
+		})
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	cases := map[string]os.FileMode{
+		"":     0o660,
+		"600":  0o600,
+		"0666": 0o666,
+		"888":  0o660,
+		"1777": 0o660,
+	}
+
+	for k, v := range cases {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv("OLLAMA_SOCKET_MODE", k)
+			if mode := SocketMode(); mode != v {
+				t.Errorf("%s: expected %o, got %o", k, v, mode)
+			}
+		})
+	}
+}
+
 func TestKeepAlive(t *testing.T) {
 	cases := map[string]time.Duration{
 		"":       5 * time.Minute,
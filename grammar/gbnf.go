@@ -0,0 +1,297 @@
+package grammar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validate checks that gbnf is a GBNF grammar the runner can parse: that its
+// rules are well formed, that every rule it refers to is defined and that it
+// has a root rule.
+func Validate(gbnf string) error {
+	p := gbnfParser{src: gbnf, defined: make(map[string]bool)}
+	if err := p.parse(); err != nil {
+		return err
+	}
+
+	if !p.defined["root"] {
+		return errors.New("grammar does not define a root rule")
+	}
+
+	for _, name := range p.refs {
+		if !p.defined[name] {
+			return fmt.Errorf("grammar refers to undefined rule %q", name)
+		}
+	}
+
+	return nil
+}
+
+// gbnfParser follows the grammar parser of llama.cpp, where a rule ends at the
+// end of its line unless it continues inside parentheses
+type gbnfParser struct {
+	src string
+	pos int
+
+	defined map[string]bool
+	refs    []string
+}
+
+func (p *gbnfParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("grammar line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *gbnfParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *gbnfParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+
+	return p.src[p.pos]
+}
+
+// space skips spaces and comments, and newlines if newlines is true
+func (p *gbnfParser) space(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case (c == '\r' || c == '\n') && newlines:
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isNameChar(c byte) bool {
+	return c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *gbnfParser) name() string {
+	start := p.pos
+	for !p.eof() && isNameChar(p.peek()) {
+		p.pos++
+	}
+
+	return p.src[start:p.pos]
+}
+
+func (p *gbnfParser) parse() error {
+	p.space(true)
+	for !p.eof() {
+		name := p.name()
+		if name == "" {
+			return p.errorf("expected a rule name, got %q", p.peek())
+		}
+
+		p.space(false)
+		if !strings.HasPrefix(p.src[p.pos:], "::=") {
+			return p.errorf("expected ::= after rule %q", name)
+		}
+
+		p.pos += len("::=")
+		p.space(true)
+		if err := p.alternates(false); err != nil {
+			return err
+		}
+
+		p.defined[name] = true
+
+		switch c := p.peek(); {
+		case c == '\r' || c == '\n':
+			p.space(true)
+		case p.eof():
+		default:
+			return p.errorf("unexpected %q at the end of rule %q", c, name)
+		}
+	}
+
+	return nil
+}
+
+func (p *gbnfParser) alternates(nested bool) error {
+	for {
+		if err := p.sequence(nested); err != nil {
+			return err
+		}
+
+		if p.peek() != '|' {
+			return nil
+		}
+
+		p.pos++
+		p.space(true)
+	}
+}
+
+func (p *gbnfParser) sequence(nested bool) error {
+	var items int
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == '"':
+			if err := p.literal(); err != nil {
+				return err
+			}
+		case c == '[':
+			if err := p.class(); err != nil {
+				return err
+			}
+		case c == '(':
+			p.pos++
+			p.space(true)
+			if err := p.alternates(true); err != nil {
+				return err
+			}
+
+			if p.peek() != ')' {
+				return p.errorf("expected ) to close a group")
+			}
+
+			p.pos++
+		case c == '.':
+			p.pos++
+		case isNameChar(c):
+			p.refs = append(p.refs, p.name())
+		case c == '*' || c == '+' || c == '?':
+			if items == 0 {
+				return p.errorf("expected an item before %q", c)
+			}
+
+			p.pos++
+			p.space(nested)
+			continue
+		case c == '{':
+			if items == 0 {
+				return p.errorf("expected an item before {")
+			}
+
+			if err := p.repetitions(); err != nil {
+				return err
+			}
+
+			p.space(nested)
+			continue
+		default:
+			return nil
+		}
+
+		items++
+		p.space(nested)
+	}
+
+	return nil
+}
+
+// char consumes a character of a literal or a character class, which may be
+// escaped
+func (p *gbnfParser) char() error {
+	if p.peek() != '\\' {
+		p.pos++
+		return nil
+	}
+
+	p.pos++
+	if p.eof() {
+		return p.errorf("unexpected end of grammar in escape")
+	}
+
+	var digits int
+	switch c := p.peek(); c {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	case '"', '[', ']', '\\', '/', 'n', 'r', 't', '-', '^':
+	default:
+		return p.errorf("unknown escape \\%c", c)
+	}
+
+	p.pos++
+	for range digits {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", rune(p.peek())) || p.eof() {
+			return p.errorf("expected %d hex digits in escape", digits)
+		}
+
+		p.pos++
+	}
+
+	return nil
+}
+
+func (p *gbnfParser) literal() error {
+	p.pos++
+	for p.peek() != '"' {
+		if p.eof() || p.peek() == '\n' {
+			return p.errorf("unterminated literal")
+		}
+
+		if err := p.char(); err != nil {
+			return err
+		}
+	}
+
+	p.pos++
+	return nil
+}
+
+func (p *gbnfParser) class() error {
+	p.pos++
+	if p.peek() == '^' {
+		p.pos++
+	}
+
+	for p.peek() != ']' {
+		if p.eof() || p.peek() == '\n' {
+			return p.errorf("unterminated character class")
+		}
+
+		if err := p.char(); err != nil {
+			return err
+		}
+
+		if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+			p.pos++
+			if err := p.char(); err != nil {
+				return err
+			}
+		}
+	}
+
+	p.pos++
+	return nil
+}
+
+// repetitions consumes a repetition count such as {2}, {2,} or {2,5}
+func (p *gbnfParser) repetitions() error {
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return p.errorf("expected } to close a repetition count")
+	}
+
+	count := strings.TrimSpace(p.src[p.pos+1 : p.pos+end])
+	lo, hi, _ := strings.Cut(count, ",")
+	for _, s := range []string{strings.TrimSpace(lo), strings.TrimSpace(hi)} {
+		if strings.Trim(s, "0123456789") != "" {
+			return p.errorf("invalid repetition count {%s}", count)
+		}
+	}
+
+	if strings.TrimSpace(lo) == "" {
+		return p.errorf("invalid repetition count {%s}", count)
+	}
+
+	p.pos += end + 1
+	return nil
+}
@@ -0,0 +1,65 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []string{
+		`root ::= "yes" | "no"`,
+		`root ::= [a-z]+ ("," ws [a-z]+)* # words
+ws ::= [ \t\n]*`,
+		`root ::=
+  "{" (
+    item
+  )? "}"
+item ::= "\x41" [^"\\\x7F\x00-\x1F] "é" .`,
+		`root ::= [0-9]{1,3} ("." [0-9]{1,3}){3}`,
+	}
+
+	for _, schema := range []string{
+		`{"type": "object", "properties": {"name": {"type": "string"}, "tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3}}}`,
+		`{"enum": ["a", 1, null]}`,
+	} {
+		g, err := FromSchema([]byte(schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cases = append(cases, g)
+	}
+
+	for _, g := range cases {
+		if err := Validate(g); err != nil {
+			t.Errorf("%s: %v", g, err)
+		}
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	cases := []struct {
+		grammar string
+		err     string
+	}{
+		{`item ::= "a"`, "does not define a root rule"},
+		{`root ::= item`, `undefined rule "item"`},
+		{`root = "a"`, "expected ::="},
+		{`root ::= "a`, "unterminated literal"},
+		{`root ::= [a-z`, "unterminated character class"},
+		{`root ::= ("a" | "b"`, "expected ) to close a group"},
+		{`root ::= * "a"`, "expected an item before '*'"},
+		{`root ::= "\q"`, `unknown escape \q`},
+		{`root ::= "a"{x}`, "invalid repetition count {x}"},
+		{"root ::= \"a\"\n  | \"b\"", "line 2: expected a rule name"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.grammar, func(t *testing.T) {
+			err := Validate(tt.grammar)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
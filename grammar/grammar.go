@@ -0,0 +1,681 @@
+// Package grammar converts JSON Schemas into GBNF grammars that constrain a
+// model to generate JSON values matching the schema.
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maxRepetitions bounds the rules generated for minItems, maxItems,
+// minLength and maxLength, which are expanded into repeated terms
+const maxRepetitions = 1000
+
+// primitives are the rules for JSON values that aren't constrained further.
+// Each rule consumes the whitespace that follows it.
+var primitives = map[string]struct {
+	rule string
+	deps []string
+}{
+	"ws":      {`([ \t\n] ws)?`, nil},
+	"char":    {`[^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])`, nil},
+	"string":  {`"\"" char* "\"" ws`, []string{"char", "ws"}},
+	"integer": {`"-"? ("0" | [1-9] [0-9]*) ws`, []string{"ws"}},
+	"number":  {`"-"? ("0" | [1-9] [0-9]*) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws`, []string{"ws"}},
+	"boolean": {`("true" | "false") ws`, []string{"ws"}},
+	"null":    {`"null" ws`, []string{"ws"}},
+	"value":   {`object | array | string | number | boolean | null`, []string{"object", "array", "string", "number", "boolean", "null"}},
+	"object":  {`"{" ws (string ":" ws value ("," ws string ":" ws value)*)? "}" ws`, []string{"string", "value", "ws"}},
+	"array":   {`"[" ws (value ("," ws value)*)? "]" ws`, []string{"value", "ws"}},
+}
+
+// annotations are schema keywords that don't constrain values
+var annotations = []string{
+	"$schema", "$id", "$comment", "title", "description", "default", "examples",
+	"deprecated", "readOnly", "writeOnly", "format", "contentEncoding", "contentMediaType",
+}
+
+// schema is the supported subset of a JSON Schema
+type schema struct {
+	// always is set for the boolean schemas true and false
+	always *bool
+
+	Type                 []string
+	Enum                 []json.RawMessage
+	Const                json.RawMessage
+	AnyOf                []*schema
+	Ref                  string
+	Defs                 map[string]*schema
+	Properties           []property
+	Required             []string
+	AdditionalProperties *schema
+	Items                *schema
+	PrefixItems          []*schema
+	MinItems, MaxItems   *int
+	MinLength, MaxLength *int
+}
+
+type property struct {
+	name   string
+	schema *schema
+}
+
+func (s *schema) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if bytes.Equal(b, []byte("true")) || bytes.Equal(b, []byte("false")) {
+		always := b[0] == 't'
+		s.always = &always
+		return nil
+	} else if len(b) == 0 || b[0] != '{' {
+		return errors.New("schema must be an object or a boolean")
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	for k, v := range raw {
+		var err error
+		switch k {
+		case "type":
+			if err = json.Unmarshal(v, &s.Type); err != nil {
+				var t string
+				if err = json.Unmarshal(v, &t); err == nil {
+					s.Type = []string{t}
+				}
+			}
+		case "enum":
+			err = json.Unmarshal(v, &s.Enum)
+		case "const":
+			s.Const = v
+		case "anyOf", "oneOf":
+			var alternatives []*schema
+			err = json.Unmarshal(v, &alternatives)
+			s.AnyOf = append(s.AnyOf, alternatives...)
+		case "$ref":
+			err = json.Unmarshal(v, &s.Ref)
+		case "$defs", "definitions":
+			var defs map[string]*schema
+			err = json.Unmarshal(v, &defs)
+			if s.Defs == nil {
+				s.Defs = make(map[string]*schema)
+			}
+
+			for name, def := range defs {
+				s.Defs["#/"+k+"/"+name] = def
+			}
+		case "properties":
+			s.Properties, err = unmarshalProperties(v)
+		case "required":
+			err = json.Unmarshal(v, &s.Required)
+		case "additionalProperties":
+			err = json.Unmarshal(v, &s.AdditionalProperties)
+		case "items":
+			err = json.Unmarshal(v, &s.Items)
+		case "prefixItems":
+			err = json.Unmarshal(v, &s.PrefixItems)
+		case "minItems":
+			err = json.Unmarshal(v, &s.MinItems)
+		case "maxItems":
+			err = json.Unmarshal(v, &s.MaxItems)
+		case "minLength":
+			err = json.Unmarshal(v, &s.MinLength)
+		case "maxLength":
+			err = json.Unmarshal(v, &s.MaxLength)
+		default:
+			if !slices.Contains(annotations, k) {
+				return fmt.Errorf("unsupported keyword %q", k)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+// unmarshalProperties decodes properties in the order they appear, which is
+// the order the model generates them in
+func unmarshalProperties(b []byte) ([]property, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	if t, err := d.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, errors.New("expected an object")
+	}
+
+	properties := []property{}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		var p property
+		p.name = t.(string)
+		if err := d.Decode(&p.schema); err != nil {
+			return nil, fmt.Errorf("%s: %w", p.name, err)
+		}
+
+		properties = append(properties, p)
+	}
+
+	return properties, nil
+}
+
+// FromSchema returns a grammar for the JSON values matching the JSON Schema.
+// It returns an error if the schema is invalid or uses keywords that
+// constrain values in ways the grammar can't express, such as "pattern" or
+// "minimum". Annotations such as "description" and "format" are ignored.
+func FromSchema(b []byte) (string, error) {
+	var root schema
+	if err := json.Unmarshal(b, &root); err != nil {
+		return "", fmt.Errorf("invalid schema: %w", err)
+	}
+
+	c := converter{
+		root:  &root,
+		rules: make(map[string]string),
+		refs:  make(map[string]string),
+	}
+
+	expr, err := c.visit(&root, "root")
+	if err != nil {
+		return "", fmt.Errorf("invalid schema: %w", err)
+	}
+
+	if expr != "root" {
+		c.define("root", expr)
+	}
+
+	var sb strings.Builder
+	for _, name := range c.order {
+		fmt.Fprintf(&sb, "%s ::= %s\n", name, c.rules[name])
+	}
+
+	return sb.String(), nil
+}
+
+type converter struct {
+	root *schema
+
+	rules map[string]string
+	order []string
+
+	// refs maps references to the names of their rules
+	refs map[string]string
+
+	// pending is the name allocated to the reference being visited, which
+	// its schema may use for its rule
+	pending string
+}
+
+var invalidRuleChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// name returns an unused rule name based on the path to a schema
+func (c *converter) name(path string) string {
+	name := strings.Trim(invalidRuleChars.ReplaceAllString(path, "-"), "-")
+	if name == "" {
+		name = "rule"
+	}
+
+	if name == c.pending {
+		c.pending = ""
+		return name
+	}
+
+	unique := name
+	for i := 1; ; i++ {
+		if _, ok := c.rules[unique]; !ok && !slices.Contains(c.reserved(), unique) {
+			return unique
+		}
+
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+}
+
+// reserved returns the names of rules that have been allocated to references
+// but may not be defined yet
+func (c *converter) reserved() []string {
+	names := make([]string, 0, len(c.refs))
+	for _, name := range c.refs {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func (c *converter) define(name, rule string) string {
+	if _, ok := c.rules[name]; !ok {
+		c.order = append(c.order, name)
+	}
+
+	c.rules[name] = rule
+	return name
+}
+
+// primitive defines the rule for an unconstrained JSON value and the rules
+// it depends on
+func (c *converter) primitive(name string) string {
+	if _, ok := c.rules[name]; !ok {
+		p := primitives[name]
+		c.define(name, p.rule)
+		for _, dep := range p.deps {
+			c.primitive(dep)
+		}
+	}
+
+	return name
+}
+
+// visit returns a grammar expression for the values matching s, defining
+// rules named after path as needed
+func (c *converter) visit(s *schema, path string) (string, error) {
+	if s.always != nil {
+		if !*s.always {
+			return "", fmt.Errorf("%s: schema false matches no values", path)
+		}
+
+		return c.primitive("value"), nil
+	}
+
+	for ref, def := range s.Defs {
+		if c.root.Defs == nil {
+			c.root.Defs = make(map[string]*schema)
+		}
+
+		if _, ok := c.refs[ref]; !ok {
+			c.root.Defs[ref] = def
+		}
+	}
+
+	switch {
+	case s.Ref != "":
+		return c.ref(s.Ref)
+	case s.Const != nil:
+		return c.literal(s.Const)
+	case s.Enum != nil:
+		if len(s.Enum) == 0 {
+			return "", fmt.Errorf("%s: enum matches no values", path)
+		}
+
+		alternatives := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			lit, err := c.literal(v)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", path, err)
+			}
+
+			alternatives[i] = lit
+		}
+
+		return c.define(c.name(path), strings.Join(alternatives, " | ")), nil
+	case len(s.AnyOf) > 0:
+		alternatives := make([]string, len(s.AnyOf))
+		for i, alternative := range s.AnyOf {
+			expr, err := c.visit(alternative, fmt.Sprintf("%s-%d", path, i))
+			if err != nil {
+				return "", err
+			}
+
+			alternatives[i] = expr
+		}
+
+		return c.define(c.name(path), strings.Join(alternatives, " | ")), nil
+	}
+
+	types := s.Type
+	if len(types) == 0 {
+		switch {
+		case s.Properties != nil || s.AdditionalProperties != nil || s.Required != nil:
+			types = []string{"object"}
+		case s.Items != nil || s.PrefixItems != nil || s.MinItems != nil || s.MaxItems != nil:
+			types = []string{"array"}
+		case s.MinLength != nil || s.MaxLength != nil:
+			types = []string{"string"}
+		default:
+			return c.primitive("value"), nil
+		}
+	}
+
+	alternatives := make([]string, len(types))
+	for i, t := range types {
+		name := path
+		if len(types) > 1 {
+			name = path + "-" + t
+		}
+
+		var expr string
+		var err error
+		switch t {
+		case "object":
+			expr, err = c.object(s, name)
+		case "array":
+			expr, err = c.array(s, name)
+		case "string":
+			expr, err = c.string(s, name)
+		case "integer", "number", "boolean", "null":
+			expr = c.primitive(t)
+		default:
+			err = fmt.Errorf("%s: unsupported type %q", path, t)
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		alternatives[i] = expr
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+
+	return c.define(c.name(path), strings.Join(alternatives, " | ")), nil
+}
+
+// ref returns the name of the rule for a reference to the root schema or one
+// of its definitions
+func (c *converter) ref(ref string) (string, error) {
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+
+	if ref == "#" {
+		c.refs[ref] = "root"
+		return "root", nil
+	}
+
+	def, ok := c.root.Defs[ref]
+	if !ok {
+		return "", fmt.Errorf("unresolved reference %q", ref)
+	}
+
+	name := c.name("def-" + ref[strings.LastIndex(ref, "/")+1:])
+	c.refs[ref] = name
+
+	pending := c.pending
+	c.pending = name
+	expr, err := c.visit(def, name)
+	c.pending = pending
+	if err != nil {
+		return "", err
+	}
+
+	if expr != name {
+		c.define(name, expr)
+	}
+
+	return name, nil
+}
+
+// literal returns an expression matching exactly the JSON value v
+func (c *converter) literal(v json.RawMessage) (string, error) {
+	var b bytes.Buffer
+	if err := json.Compact(&b, v); err != nil {
+		return "", err
+	}
+
+	return quote(b.String()) + " " + c.primitive("ws"), nil
+}
+
+func quote(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&sb, `\x%02X`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// repeat returns an expression matching between min and max occurrences of
+// item, separated by sep. A negative max is unbounded.
+func repeat(item, sep string, min, max int) (string, error) {
+	if max >= 0 && min > max {
+		return "", fmt.Errorf("minimum of %d is greater than the maximum of %d", min, max)
+	} else if min > maxRepetitions || max > maxRepetitions {
+		return "", fmt.Errorf("limits greater than %d are not supported", maxRepetitions)
+	}
+
+	next := item
+	if sep != "" {
+		next = "(" + sep + " " + item + ")"
+	}
+
+	var terms []string
+	if min > 0 {
+		terms = append(terms, item)
+		for range min - 1 {
+			terms = append(terms, next)
+		}
+	}
+
+	var optional string
+	switch {
+	case max < 0 && min > 0:
+		optional = next + "*"
+	case max < 0:
+		optional = "(" + item + " " + next + "*)?"
+	default:
+		// nest the optional terms so each is only allowed after the last
+		for i := max - min; i > 0; i-- {
+			term := next
+			if min == 0 && i == 1 {
+				term = item
+			}
+
+			if optional == "" {
+				optional = "(" + term + ")?"
+			} else {
+				optional = "(" + term + " " + optional + ")?"
+			}
+		}
+	}
+
+	if optional != "" {
+		terms = append(terms, optional)
+	}
+
+	if len(terms) == 0 {
+		return `""`, nil
+	}
+
+	return strings.Join(terms, " "), nil
+}
+
+func (c *converter) string(s *schema, path string) (string, error) {
+	if s.MinLength == nil && s.MaxLength == nil {
+		return c.primitive("string"), nil
+	}
+
+	chars, err := repeat(c.primitive("char"), "", ptrValue(s.MinLength, 0), ptrValue(s.MaxLength, -1))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	return c.define(c.name(path), `"\"" `+chars+` "\"" `+c.primitive("ws")), nil
+}
+
+func (c *converter) array(s *schema, path string) (string, error) {
+	if s.Items == nil && s.PrefixItems == nil && s.MinItems == nil && s.MaxItems == nil {
+		return c.primitive("array"), nil
+	}
+
+	ws := c.primitive("ws")
+
+	var item string
+	if s.Items != nil {
+		var err error
+		if item, err = c.visit(s.Items, path+"-item"); err != nil {
+			return "", err
+		}
+	} else if s.PrefixItems == nil {
+		item = c.primitive("value")
+	}
+
+	var terms []string
+	for i, prefix := range s.PrefixItems {
+		expr, err := c.visit(prefix, fmt.Sprintf("%s-%d", path, i))
+		if err != nil {
+			return "", err
+		}
+
+		if i > 0 {
+			expr = `"," ` + ws + " " + expr
+		}
+
+		terms = append(terms, expr)
+	}
+
+	minItems, maxItems := ptrValue(s.MinItems, 0), ptrValue(s.MaxItems, -1)
+	if len(s.PrefixItems) > 0 {
+		if minItems > len(s.PrefixItems) || (maxItems >= 0 && maxItems < len(s.PrefixItems)) {
+			return "", fmt.Errorf("%s: minItems and maxItems must allow every prefixItems item", path)
+		}
+
+		// prefix items are required, and may be followed by further items
+		minItems = 0
+		if maxItems >= 0 {
+			maxItems -= len(s.PrefixItems)
+		}
+
+		if s.Items != nil && maxItems != 0 {
+			rest, err := repeat(`("," `+ws+" "+item+")", "", 0, maxItems)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", path, err)
+			}
+
+			terms = append(terms, rest)
+		}
+	} else {
+		items, err := repeat(item, `"," `+ws, minItems, maxItems)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+
+		terms = append(terms, items)
+	}
+
+	return c.define(c.name(path), `"[" `+ws+" "+strings.Join(terms, " ")+` "]" `+ws), nil
+}
+
+func (c *converter) object(s *schema, path string) (string, error) {
+	if s.Properties == nil && s.AdditionalProperties == nil {
+		if len(s.Required) > 0 {
+			return "", fmt.Errorf("%s: required properties must be listed in properties", path)
+		}
+
+		return c.primitive("object"), nil
+	}
+
+	ws := c.primitive("ws")
+
+	var required, optional []string
+	for _, p := range s.Properties {
+		value, err := c.visit(p.schema, path+"-"+p.name)
+		if err != nil {
+			return "", err
+		}
+
+		key, err := json.Marshal(p.name)
+		if err != nil {
+			return "", err
+		}
+
+		kv := c.define(c.name(path+"-"+p.name+"-kv"), quote(string(key))+" "+ws+` ":" `+ws+" "+value)
+		if slices.Contains(s.Required, p.name) {
+			required = append(required, kv)
+		} else {
+			optional = append(optional, kv)
+		}
+	}
+
+	for _, name := range s.Required {
+		if !slices.ContainsFunc(s.Properties, func(p property) bool { return p.name == name }) {
+			return "", fmt.Errorf("%s: required property %q must be listed in properties", path, name)
+		}
+	}
+
+	// additional properties are only allowed when explicitly enabled since
+	// models tend to invent them otherwise
+	additional := ""
+	if ap := s.AdditionalProperties; ap != nil && (ap.always == nil || *ap.always) {
+		value, err := c.visit(ap, path+"-additional")
+		if err != nil {
+			return "", err
+		}
+
+		additional = c.define(c.name(path+"-additional-kv"), c.primitive("string")+` ":" `+ws+" "+value)
+	}
+
+	sep := `"," ` + ws
+	body := strings.Join(required, " "+sep+" ")
+
+	// optional properties keep their order, so each alternative starts with
+	// a different one of them and is followed by any of the rest
+	var rest func([]string) string
+	rest = func(kvs []string) string {
+		expr := ""
+		for i := len(kvs) - 1; i >= 0; i-- {
+			expr = strings.TrimSpace("(" + sep + " " + kvs[i] + ")? " + expr)
+		}
+
+		if additional != "" {
+			expr = strings.TrimSpace(expr + " (" + sep + " " + additional + ")*")
+		}
+
+		return expr
+	}
+
+	var alternatives []string
+	for i, kv := range optional {
+		alternatives = append(alternatives, strings.TrimSpace(kv+" "+rest(optional[i+1:])))
+	}
+
+	if additional != "" {
+		alternatives = append(alternatives, strings.TrimSpace(additional+" ("+sep+" "+additional+")*"))
+	}
+
+	switch {
+	case body != "" && len(alternatives) > 0:
+		body += " " + rest(optional)
+	case len(alternatives) > 0:
+		body = "(" + strings.Join(alternatives, " | ") + ")?"
+	}
+
+	return c.define(c.name(path), `"{" `+ws+" "+body+` "}" `+ws), nil
+}
+
+func ptrValue(p *int, defaultValue int) int {
+	if p == nil {
+		return defaultValue
+	}
+
+	return *p
+}
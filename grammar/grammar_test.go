@@ -0,0 +1,110 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFromSchema(t *testing.T) {
+	cases := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{
+			name:   "primitive",
+			schema: `{"type": "boolean"}`,
+			want: `boolean ::= ("true" | "false") ws
+ws ::= ([ \t\n] ws)?
+root ::= boolean
+`,
+		},
+		{
+			name:   "object",
+			schema: `{"type": "object", "properties": {"name": {"type": "string", "description": "ignored"}, "age": {"type": "integer"}}, "required": ["name"]}`,
+			want: `ws ::= ([ \t\n] ws)?
+string ::= "\"" char* "\"" ws
+char ::= [^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F] [0-9a-fA-F])
+root-name-kv ::= "\"name\"" ws ":" ws string
+integer ::= "-"? ("0" | [1-9] [0-9]*) ws
+root-age-kv ::= "\"age\"" ws ":" ws integer
+root ::= "{" ws root-name-kv ("," ws root-age-kv)? "}" ws
+`,
+		},
+		{
+			name:   "optional properties",
+			schema: `{"properties": {"a": {"type": "null"}, "b": {"type": "null"}}}`,
+			want: `ws ::= ([ \t\n] ws)?
+null ::= "null" ws
+root-a-kv ::= "\"a\"" ws ":" ws null
+root-b-kv ::= "\"b\"" ws ":" ws null
+root ::= "{" ws (root-a-kv ("," ws root-b-kv)? | root-b-kv)? "}" ws
+`,
+		},
+		{
+			name:   "enum",
+			schema: `{"enum": ["a\"b", 1, null]}`,
+			want: `ws ::= ([ \t\n] ws)?
+root ::= "\"a\\\"b\"" ws | "1" ws | "null" ws
+`,
+		},
+		{
+			name:   "array",
+			schema: `{"type": "array", "items": {"type": "number"}, "minItems": 1, "maxItems": 3}`,
+			want: `ws ::= ([ \t\n] ws)?
+number ::= "-"? ("0" | [1-9] [0-9]*) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? ws
+root ::= "[" ws number (("," ws number) (("," ws number))?)? "]" ws
+`,
+		},
+		{
+			name:   "recursive",
+			schema: `{"$ref": "#/$defs/list", "$defs": {"list": {"type": ["array", "null"], "items": {"$ref": "#/$defs/list"}}}}`,
+			want: `ws ::= ([ \t\n] ws)?
+def-list-array ::= "[" ws (def-list ("," ws def-list)*)? "]" ws
+null ::= "null" ws
+def-list ::= def-list-array | null
+root ::= def-list
+`,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFromSchemaInvalid(t *testing.T) {
+	cases := []struct {
+		schema string
+		err    string
+	}{
+		{`[]`, "schema must be an object or a boolean"},
+		{`false`, "schema false matches no values"},
+		{`{"properties": {"name": {"type": "string", "pattern": "^a"}}}`, `unsupported keyword "pattern"`},
+		{`{"type": "date"}`, `unsupported type "date"`},
+		{`{"$ref": "#/$defs/missing"}`, `unresolved reference "#/$defs/missing"`},
+		{`{"enum": []}`, "enum matches no values"},
+		{`{"required": ["name"]}`, "required properties must be listed in properties"},
+		{`{"properties": {}, "required": ["name"]}`, `required property "name" must be listed in properties`},
+		{`{"type": "array", "minItems": 2, "maxItems": 1}`, "minimum of 2 is greater than the maximum of 1"},
+		{`{"type": "string", "maxLength": 100000}`, "limits greater than 1000 are not supported"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.schema, func(t *testing.T) {
+			_, err := FromSchema([]byte(tt.schema))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
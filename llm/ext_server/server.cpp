@@ -45,11 +45,15 @@
 #endif
 
 #include <algorithm>
+#include <cmath>
 #include <cstddef>
 #include <thread>
 #include <chrono>
 #include <condition_variable>
 #include <atomic>
+#include <random>
+#include <unordered_map>
+#include <unordered_set>
 #include <signal.h>
 
 using json = nlohmann::json;
@@ -64,6 +68,7 @@ struct server_params {
     bool slots_endpoint = true;
     bool metrics_endpoint = false;
     int n_threads_http = -1;
+    std::string prompt_cache_dir;
 };
 
 bool server_verbose = false;
@@ -89,6 +94,7 @@ enum slot_command {
 struct slot_params {
     bool stream       = true;
     bool cache_prompt = false; // remember the prompt to avoid reprocessing all prompt
+    std::string prompt_cache;  // name of a prefix cache to restore the prompt from and save it in
 
     uint32_t seed      = -1; // RNG seed
     int32_t  n_keep    =  0; // number of tokens to keep from initial prompt
@@ -154,6 +160,16 @@ struct server_slot {
     struct llama_sampling_params sparams;
     llama_sampling_context *ctx_sampling = nullptr;
 
+    // DRY and XTC, which are applied to the logits before sampling
+    float   dry_multiplier     = 0.0f;
+    float   dry_base           = 1.75f;
+    int32_t dry_allowed_length = 2;
+    int32_t dry_penalty_last_n = -1;
+    std::unordered_set<llama_token> dry_sequence_breakers;
+    float   xtc_probability    = 0.0f;
+    float   xtc_threshold      = 0.1f;
+    std::mt19937 rng;
+
     int32_t ga_i = 0;   // group-attention state
     int32_t ga_n = 1;   // group-attention factor
     int32_t ga_w = 512; // group-attention width
@@ -176,6 +192,17 @@ struct server_slot {
     // multitasks
     int multitask_id = -1;
 
+    // save the prompt cache when the slot is released
+    bool save_prompt_cache = false;
+
+    // speculative decoding: the tokens of the slot the draft context holds,
+    // the tokens drafted for the batch being decoded and how many drafted
+    // tokens were and weren't generated
+    std::vector<llama_token> cache_tokens_dft;
+    std::vector<llama_token> draft;
+    int32_t n_draft_accepted = 0;
+    int32_t n_draft_rejected = 0;
+
     void reset() {
         n_prompt_tokens        = 0;
         generated_text         = "";
@@ -189,7 +216,11 @@ struct server_slot {
         n_sent_token_probs     = 0;
         ga_i                   = 0;
         n_past_se              = 0;
+        save_prompt_cache      = false;
+        n_draft_accepted       = 0;
+        n_draft_rejected       = 0;
 
+        draft.clear();
         generated_token_probs.clear();
 
         for (slot_image & img : images) {
@@ -255,6 +286,9 @@ struct server_slot {
             {"predicted_ms",           t_token_generation},
             {"predicted_per_token_ms", t_token_generation / n_decoded},
             {"predicted_per_second",   1e3 / t_token_generation * n_decoded},
+
+            {"draft_accepted_n",       n_draft_accepted},
+            {"draft_rejected_n",       n_draft_rejected},
         };
     }
 
@@ -330,6 +364,22 @@ struct server_metrics {
     }
 };
 
+// a named prefix cache: the state of a sequence holding tokens, which can be
+// restored into any slot
+struct prompt_cache_entry {
+    std::vector<llama_token> tokens;
+    std::vector<uint8_t>     state;
+
+    int64_t t_last_used = -1;
+};
+
+// the most prompt caches held in memory; the least recently used ones beyond
+// it are only kept on disk, when there is a directory to save them in
+static const size_t n_prompt_caches_max = 4;
+
+// drafting stops at a token the draft model gives a lower probability than this
+static const float draft_p_min = 0.75f;
+
 struct llama_server_context
 {
     llama_model *model = nullptr;
@@ -338,6 +388,12 @@ struct llama_server_context
 
     clip_ctx *clp_ctx = nullptr;
 
+    // the draft model for speculative decoding, which guesses the tokens the
+    // model generates so that it can check several of them in one batch
+    llama_model   *model_dft = nullptr;
+    llama_context *ctx_dft   = nullptr;
+    llama_batch    batch_dft;
+
     gpt_params params;
 
     llama_batch batch;
@@ -366,6 +422,10 @@ struct llama_server_context
 
     server_metrics metrics;
 
+    // named prefix caches, also saved in prompt_cache_dir when it is set
+    std::unordered_map<std::string, prompt_cache_entry> prompt_caches;
+    std::string prompt_cache_dir;
+
     ~llama_server_context()
     {
         if (clp_ctx)
@@ -374,6 +434,17 @@ struct llama_server_context
             clip_free(clp_ctx);
             clp_ctx = nullptr;
         }
+        if (ctx_dft)
+        {
+            llama_batch_free(batch_dft);
+            llama_free(ctx_dft);
+            ctx_dft = nullptr;
+        }
+        if (model_dft)
+        {
+            llama_free_model(model_dft);
+            model_dft = nullptr;
+        }
         if (ctx)
         {
             llama_free(ctx);
@@ -427,6 +498,54 @@ struct llama_server_context
 
         add_bos_token = llama_add_bos_token(model);
 
+        if (!params.model_draft.empty() && !load_draft_model())
+        {
+            return false;
+        }
+
+        return true;
+    }
+
+    bool load_draft_model()
+    {
+        gpt_params params_dft = params;
+        params_dft.model           = params.model_draft;
+        params_dft.n_gpu_layers    = params.n_gpu_layers_draft;
+        params_dft.cpuparams       = params.draft_cpuparams;
+        params_dft.cpuparams_batch = params.draft_cpuparams_batch;
+        params_dft.embedding       = false;
+        params_dft.lora_adapters.clear();
+
+        auto init_result = llama_init_from_gpt_params(params_dft);
+        model_dft = init_result.model;
+        ctx_dft = init_result.context;
+        if (model_dft == nullptr)
+        {
+            LOG_ERROR("unable to load draft model", {{"model", params.model_draft}});
+            return false;
+        }
+
+        batch_dft = llama_batch_init(params.n_batch, 0, 1);
+
+        // the draft model's tokens are checked by the model, so they must
+        // share a vocabulary
+        const int n_vocab     = llama_n_vocab(model);
+        const int n_vocab_dft = llama_n_vocab(model_dft);
+        if (llama_vocab_type(model_dft) != llama_vocab_type(model) ||
+            std::abs(n_vocab - n_vocab_dft) > 128 ||
+            llama_token_bos(model_dft) != llama_token_bos(model) ||
+            llama_token_eos(model_dft) != llama_token_eos(model))
+        {
+            LOG_ERROR("the draft model's vocabulary does not match the model's", {
+                {"model",       params.model},
+                {"draft_model", params.model_draft},
+                {"n_vocab",     n_vocab},
+                {"n_vocab_dft", n_vocab_dft},
+            });
+            return false;
+        }
+
+        LOG_INFO("loaded draft model", {{"model", params.model_draft}, {"n_draft", params.n_draft}});
         return true;
     }
 
@@ -549,12 +668,176 @@ struct llama_server_context
         return last_used;
     }
 
+    // apply_dry penalizes the tokens that would extend a sequence at the end
+    // of the context that was repeated earlier in it, by how long the
+    // repeated sequence is
+    void apply_dry(const server_slot &slot, float * logits) {
+        if (slot.dry_multiplier <= 0.0f || slot.dry_penalty_last_n == 0) {
+            return;
+        }
+
+        // longer matches are penalized as much as this
+        const int max_length = 64;
+
+        const auto &tokens = slot.cache_tokens;
+        const int n = tokens.size();
+        const int last_n = slot.dry_penalty_last_n < 0 ? slot.n_ctx : slot.dry_penalty_last_n;
+        const int start = std::max(0, n - last_n);
+        if (n - start < 2 || slot.dry_sequence_breakers.count(tokens[n - 1])) {
+            return;
+        }
+
+        // each earlier occurrence of the last token ends a sequence that
+        // matches the end of the context, and the token after it would repeat
+        // the sequence
+        std::unordered_map<llama_token, int> lengths;
+        for (int i = n - 2; i >= start; i--) {
+            if (tokens[i] != tokens[n - 1]) {
+                continue;
+            }
+
+            int length = 1;
+            while (length < max_length && i - length >= start &&
+                   tokens[i - length] == tokens[n - 1 - length] &&
+                   !slot.dry_sequence_breakers.count(tokens[i - length])) {
+                length++;
+            }
+
+            int &longest = lengths[tokens[i + 1]];
+            longest = std::max(longest, length);
+        }
+
+        for (const auto &it : lengths) {
+            if (it.second >= slot.dry_allowed_length) {
+                logits[it.first] -= slot.dry_multiplier * std::pow(slot.dry_base, it.second - slot.dry_allowed_length);
+            }
+        }
+    }
+
+    // apply_xtc removes all but the least likely of the tokens with a
+    // probability of at least the threshold, for a share of the tokens
+    // generated given by the probability
+    void apply_xtc(server_slot &slot, float * logits) {
+        // at most one token has a probability above a threshold over 0.5
+        if (slot.xtc_probability <= 0.0f || slot.xtc_threshold > 0.5f) {
+            return;
+        }
+
+        std::uniform_real_distribution<float> dist(0.0f, 1.0f);
+        if (dist(slot.rng) >= slot.xtc_probability) {
+            return;
+        }
+
+        const int n_vocab = llama_n_vocab(model);
+        const float max_logit = *std::max_element(logits, logits + n_vocab);
+
+        double sum = 0.0;
+        for (int i = 0; i < n_vocab; i++) {
+            sum += std::exp(logits[i] - max_logit);
+        }
+
+        std::vector<llama_token> top;
+        llama_token least = -1;
+        for (int i = 0; i < n_vocab; i++) {
+            if (std::exp(logits[i] - max_logit) / sum >= slot.xtc_threshold) {
+                top.push_back(i);
+                if (least < 0 || logits[i] < logits[least]) {
+                    least = i;
+                }
+            }
+        }
+
+        if (top.size() < 2) {
+            return;
+        }
+
+        for (llama_token tok : top) {
+            if (tok != least) {
+                logits[tok] = -INFINITY;
+            }
+        }
+    }
+
+    // draft_tokens has the draft model guess up to n_draft tokens that follow
+    // the slot's tokens, greedily, until it is unsure of one
+    std::vector<llama_token> draft_tokens(server_slot &slot, int n_draft) {
+        std::vector<llama_token> draft;
+
+        std::vector<llama_token> tokens(system_tokens);
+        tokens.insert(tokens.end(), slot.cache_tokens.begin(), slot.cache_tokens.end());
+        if (n_draft <= 0 || tokens.empty()) {
+            return draft;
+        }
+
+        // bring the draft context up to date from where the tokens it holds
+        // for the slot differ; the last token is decoded again for its logits
+        size_t n_past = std::min(common_part(slot.cache_tokens_dft, tokens), tokens.size() - 1);
+        llama_kv_cache_seq_rm(ctx_dft, slot.id, n_past, -1);
+        slot.cache_tokens_dft.resize(n_past);
+
+        while (n_past < tokens.size()) {
+            llama_batch_clear(batch_dft);
+            for (; n_past < tokens.size() && batch_dft.n_tokens < params.n_batch; n_past++) {
+                llama_batch_add(batch_dft, tokens[n_past], n_past, { slot.id }, n_past == tokens.size() - 1);
+            }
+
+            if (llama_decode(ctx_dft, batch_dft) != 0) {
+                LOG_WARNING("failed to decode the draft batch", {{"slot_id", slot.id}});
+                llama_kv_cache_seq_rm(ctx_dft, slot.id, -1, -1);
+                slot.cache_tokens_dft.clear();
+                return draft;
+            }
+
+            slot.cache_tokens_dft.insert(slot.cache_tokens_dft.end(), tokens.begin() + slot.cache_tokens_dft.size(), tokens.begin() + n_past);
+        }
+
+        const int n_vocab = std::min(llama_n_vocab(model), llama_n_vocab(model_dft));
+        int32_t i_logits = batch_dft.n_tokens - 1;
+        while ((int) draft.size() < n_draft) {
+            const float * logits = llama_get_logits_ith(ctx_dft, i_logits);
+
+            llama_token best = 0;
+            for (llama_token tok = 1; tok < n_vocab; tok++) {
+                if (logits[tok] > logits[best]) {
+                    best = tok;
+                }
+            }
+
+            double sum = 0.0;
+            for (llama_token tok = 0; tok < n_vocab; tok++) {
+                sum += std::exp(logits[tok] - logits[best]);
+            }
+
+            if (1.0 / sum < draft_p_min) {
+                break;
+            }
+
+            draft.push_back(best);
+            if ((int) draft.size() == n_draft || llama_token_is_eog(model, best)) {
+                break;
+            }
+
+            llama_batch_clear(batch_dft);
+            llama_batch_add(batch_dft, best, n_past, { slot.id }, true);
+            if (llama_decode(ctx_dft, batch_dft) != 0) {
+                break;
+            }
+
+            slot.cache_tokens_dft.push_back(best);
+            n_past++;
+            i_logits = 0;
+        }
+
+        return draft;
+    }
+
     bool launch_slot_with_data(server_slot* &slot, json data) {
         slot_params default_params;
         llama_sampling_params default_sparams;
 
         slot->params.stream             = json_value(data, "stream",            false);
         slot->params.cache_prompt       = json_value(data, "cache_prompt",      false);
+        slot->params.prompt_cache       = json_value(data, "prompt_cache",      std::string());
         slot->params.n_predict          = json_value(data, "n_predict",         default_params.n_predict);
         slot->sparams.top_k             = json_value(data, "top_k",             default_sparams.top_k);
         slot->sparams.top_p             = json_value(data, "top_p",             default_sparams.top_p);
@@ -577,6 +860,30 @@ struct llama_server_context
         slot->sparams.grammar           = json_value(data, "grammar",           default_sparams.grammar);
         slot->sparams.n_probs           = json_value(data, "n_probs",           default_sparams.n_probs);
         slot->sparams.min_keep          = json_value(data, "min_keep",          default_sparams.min_keep);
+        slot->dry_multiplier            = json_value(data, "dry_multiplier",    0.0f);
+        slot->dry_base                  = json_value(data, "dry_base",          1.75f);
+        slot->dry_allowed_length        = json_value(data, "dry_allowed_length", 2);
+        slot->dry_penalty_last_n        = json_value(data, "dry_penalty_last_n", -1);
+        slot->xtc_probability           = json_value(data, "xtc_probability",   0.0f);
+        slot->xtc_threshold             = json_value(data, "xtc_threshold",     0.1f);
+        slot->rng.seed(slot->sparams.seed == LLAMA_DEFAULT_SEED ? std::random_device{}() : slot->sparams.seed);
+
+        // sequences are broken by any token of the breakers
+        slot->dry_sequence_breakers.clear();
+        const auto &dry_sequence_breakers = data.find("dry_sequence_breakers");
+        if (dry_sequence_breakers != data.end() && dry_sequence_breakers->is_array())
+        {
+            for (const auto &breaker : *dry_sequence_breakers)
+            {
+                if (breaker.is_string())
+                {
+                    for (auto tok : llama_tokenize(model, breaker.get<std::string>(), false))
+                    {
+                        slot->dry_sequence_breakers.insert(tok);
+                    }
+                }
+            }
+        }
 
         if (slot->n_predict > 0 && slot->params.n_predict > slot->n_predict) {
             // Might be better to reject the request with a 400 ?
@@ -1394,7 +1701,7 @@ struct llama_server_context
     // Find the slot that has the greatest common prefix
     server_slot *prefix_slot(const json &prompt) {
         if (!prompt.is_string()) {
-            return nullptr;
+            return get_slot(-1);
         }
 
         std::string prompt_str = prompt.get<std::string>();
@@ -1424,6 +1731,178 @@ struct llama_server_context
         return slot;
     }
 
+    // Find the slot a task asks for, e.g. the one that holds the earlier turns
+    // of a chat, if it is available
+    server_slot *requested_slot(int id) {
+        for (server_slot &s : slots) {
+            if (s.id == id && s.available()) {
+                return &s;
+            }
+        }
+
+        return nullptr;
+    }
+
+    // Find the slot that last used a prompt cache, whose sequence still holds it
+    server_slot *cache_slot(const std::string &name) {
+        if (name.empty()) {
+            return nullptr;
+        }
+
+        server_slot *slot = nullptr;
+        for (server_slot &s : slots) {
+            if (s.available() && s.params.prompt_cache == name && (!slot || s.t_last_used > slot->t_last_used)) {
+                slot = &s;
+            }
+        }
+
+        return slot;
+    }
+
+    std::string prompt_cache_path(const std::string &name) {
+        return prompt_cache_dir + "/" + name + ".bin";
+    }
+
+    // save_prompt_cache saves the state of the slot's sequence, which holds
+    // the first n_tokens of its cache tokens, as its prompt cache
+    void save_prompt_cache(server_slot &slot, size_t n_tokens) {
+        const std::string &name = slot.params.prompt_cache;
+        if (n_tokens == 0) {
+            prompt_caches.erase(name);
+            if (!prompt_cache_dir.empty()) {
+                std::remove(prompt_cache_path(name).c_str());
+            }
+            return;
+        }
+
+        prompt_cache_entry entry;
+        entry.tokens.assign(slot.cache_tokens.begin(), slot.cache_tokens.begin() + n_tokens);
+        entry.state.resize(llama_state_seq_get_size(ctx, slot.id));
+
+        const size_t n_state = llama_state_seq_get_data(ctx, entry.state.data(), entry.state.size(), slot.id);
+        if (n_state == 0) {
+            LOG_ERROR("failed to save prompt cache", {{"slot_id", slot.id}, {"prompt_cache", name}});
+            return;
+        }
+
+        entry.state.resize(n_state);
+        entry.t_last_used = ggml_time_us();
+
+        if (!prompt_cache_dir.empty()) {
+            // write a temporary file first so a cache is never read half written
+            const std::string path = prompt_cache_path(name);
+            const std::string temp = path + ".tmp";
+            if (llama_state_seq_save_file(ctx, temp.c_str(), slot.id, entry.tokens.data(), entry.tokens.size()) == 0 ||
+                std::rename(temp.c_str(), path.c_str()) != 0) {
+                LOG_ERROR("failed to write prompt cache", {{"slot_id", slot.id}, {"path", path}});
+                std::remove(temp.c_str());
+            }
+        }
+
+        LOG_INFO("prompt cache saved", {
+            {"slot_id",      slot.id},
+            {"prompt_cache", name},
+            {"n_tokens",     n_tokens},
+            {"size",         n_state},
+        });
+
+        prompt_caches[name] = std::move(entry);
+        while (prompt_caches.size() > n_prompt_caches_max) {
+            auto oldest = prompt_caches.begin();
+            for (auto it = prompt_caches.begin(); it != prompt_caches.end(); ++it) {
+                if (it->second.t_last_used < oldest->second.t_last_used) {
+                    oldest = it;
+                }
+            }
+            prompt_caches.erase(oldest);
+        }
+    }
+
+    // find_prompt_cache returns the slot's prompt cache from memory or, by
+    // loading it into the slot's sequence, from disk
+    prompt_cache_entry *find_prompt_cache(server_slot &slot) {
+        const std::string &name = slot.params.prompt_cache;
+        auto it = prompt_caches.find(name);
+        if (it != prompt_caches.end()) {
+            return &it->second;
+        }
+
+        if (prompt_cache_dir.empty()) {
+            return nullptr;
+        }
+
+        const std::string path = prompt_cache_path(name);
+        if (FILE *f = std::fopen(path.c_str(), "rb")) {
+            std::fclose(f);
+        } else {
+            return nullptr;
+        }
+
+        std::vector<llama_token> tokens(slot.n_ctx);
+        size_t n_tokens = 0;
+        if (llama_state_seq_load_file(ctx, path.c_str(), slot.id, tokens.data(), tokens.size(), &n_tokens) == 0) {
+            LOG_WARNING("failed to read prompt cache", {{"slot_id", slot.id}, {"path", path}});
+            // the sequence may hold part of the cache
+            llama_kv_cache_seq_rm(ctx, slot.id, -1, -1);
+            slot.cache_tokens.clear();
+            return nullptr;
+        }
+
+        tokens.resize(n_tokens);
+        slot.cache_tokens = tokens;
+
+        prompt_cache_entry entry;
+        entry.tokens = tokens;
+        entry.state.resize(llama_state_seq_get_size(ctx, slot.id));
+        entry.state.resize(llama_state_seq_get_data(ctx, entry.state.data(), entry.state.size(), slot.id));
+
+        LOG_INFO("prompt cache loaded", {
+            {"slot_id",      slot.id},
+            {"prompt_cache", name},
+            {"n_tokens",     n_tokens},
+        });
+
+        prompt_caches[name] = std::move(entry);
+        return &prompt_caches[name];
+    }
+
+    // restore_prompt_cache restores the slot's prompt cache into its sequence
+    // when the cache holds more of the prompt than the sequence does. It
+    // returns true when the cache goes on past the prompt and should be cut
+    // down to the part they share.
+    bool restore_prompt_cache(server_slot &slot, const std::vector<llama_token> &prompt_tokens) {
+        prompt_cache_entry *entry = find_prompt_cache(slot);
+        if (entry == nullptr) {
+            slot.save_prompt_cache = true;
+            return false;
+        }
+
+        entry->t_last_used = ggml_time_us();
+
+        const size_t n_cached = common_part(entry->tokens, prompt_tokens);
+        if (n_cached > common_part(slot.cache_tokens, prompt_tokens)) {
+            if (llama_state_seq_set_data(ctx, entry->state.data(), entry->state.size(), slot.id) == 0) {
+                LOG_ERROR("failed to restore prompt cache", {{"slot_id", slot.id}, {"prompt_cache", slot.params.prompt_cache}});
+                llama_kv_cache_seq_rm(ctx, slot.id, -1, -1);
+                slot.cache_tokens.clear();
+                prompt_caches.erase(slot.params.prompt_cache);
+                slot.save_prompt_cache = true;
+                return false;
+            }
+
+            slot.cache_tokens = entry->tokens;
+
+            LOG_INFO("prompt cache restored", {
+                {"slot_id",      slot.id},
+                {"task_id",      slot.task_id},
+                {"prompt_cache", slot.params.prompt_cache},
+                {"n_tokens",     n_cached},
+            });
+        }
+
+        return n_cached < entry->tokens.size();
+    }
+
     void process_single_task(task_server& task)
     {
         switch (task.type)
@@ -1434,7 +1913,15 @@ struct llama_server_context
                     // Embedding seq_id (aka slot id) must always be <= token length, so always use slot 0
                     slot = slots[0].available() ? &slots[0] : nullptr;
                 } else {
-                    slot = prefix_slot(task.data["prompt"]);
+                    slot = requested_slot(json_value(task.data, "slot_id", -1));
+                    if (slot == nullptr)
+                    {
+                        slot = cache_slot(json_value(task.data, "prompt_cache", std::string()));
+                    }
+                    if (slot == nullptr)
+                    {
+                        slot = prefix_slot(task.data["prompt"]);
+                    }
                 }
                 if (slot == nullptr)
                 {
@@ -1545,12 +2032,17 @@ struct llama_server_context
         result.stop = true;
         result.error = false;
 
+        // subtasks finish in any order, their ids follow the order of the prompts
+        std::sort(multitask.results.begin(), multitask.results.end(), [](const task_result & a, const task_result & b) {
+            return a.id < b.id;
+        });
+
         // collect json results into one json result
         std::vector<json> result_jsons;
         for (auto& subres : multitask.results)
         {
             result_jsons.push_back(subres.result_json);
-            result.error = result.error && subres.error;
+            result.error = result.error || subres.error;
         }
         result.result_json = json{ { "results", result_jsons } };
         queue_results.send(result);
@@ -1631,6 +2123,13 @@ struct llama_server_context
                 slot.command = NONE;
                 slot.t_last_used = ggml_time_us();
 
+                if (slot.save_prompt_cache)
+                {
+                    // the last sampled token is not in the KV cache
+                    slot.save_prompt_cache = false;
+                    save_prompt_cache(slot, std::min((size_t) slot.n_past, slot.cache_tokens.size()));
+                }
+
                 LOG_DEBUG("slot released", {
                     {"slot_id",         slot.id},
                     {"task_id",         slot.task_id},
@@ -1658,6 +2157,28 @@ struct llama_server_context
             //       this is not great and needs to be improved somehow
             llama_batch_add(batch, slot.sampled, system_tokens.size() + slot_npast, { slot.id }, true);
             slot.n_past += 1;
+
+            // the tokens the draft model guesses follow the sampled token in
+            // the batch, so that the model checks them all at once
+            if (ctx_dft != nullptr && slot.ga_n == 1 && slot.images.empty())
+            {
+                // they have to fit into the slot's context, the first view of
+                // the batch and what is left of the slot's budget
+                int n_draft = std::min(params.n_draft, slot.n_ctx - (int) system_tokens.size() - slot.n_past - 1);
+                n_draft = std::min(n_draft, params.n_batch - batch.n_tokens);
+
+                const int n_predict = slot.params.n_predict != -1 ? slot.params.n_predict : params.n_predict;
+                if (n_predict != -1)
+                {
+                    n_draft = std::min(n_draft, n_predict - slot.n_decoded - 1);
+                }
+
+                slot.draft = draft_tokens(slot, n_draft);
+                for (size_t j = 0; j < slot.draft.size(); j++)
+                {
+                    llama_batch_add(batch, slot.draft[j], system_tokens.size() + slot.n_past + j, { slot.id }, true);
+                }
+            }
         }
 
         // process in chunks of params.n_batch
@@ -1685,6 +2206,7 @@ struct llama_server_context
                     slot.state = PROCESSING;
                     slot.command = NONE;
                     std::vector<llama_token> prompt_tokens;
+                    bool trim_prompt_cache = false;
                     slot.t_start_process_prompt = ggml_time_us();
                     slot.t_start_genereration = 0;
 
@@ -1738,6 +2260,11 @@ struct llama_server_context
                     }
                     else
                     {
+                        if (!slot.params.prompt_cache.empty() && slot.ga_n == 1)
+                        {
+                            trim_prompt_cache = restore_prompt_cache(slot, prompt_tokens);
+                        }
+
                         // push the prompt into the sampling context (do not apply grammar)
                         for (auto &token : prompt_tokens)
                         {
@@ -1808,6 +2335,12 @@ struct llama_server_context
                     });
                     llama_kv_cache_seq_rm(ctx, slot.id, p0, -1);
 
+                    if (trim_prompt_cache)
+                    {
+                        // the sequence holds the part of the prompt cache this prompt shares with it
+                        save_prompt_cache(slot, slot.n_past);
+                    }
+
                     LOG_VERBOSE("prompt ingested", {
                                                     {"n_past",  slot.n_past},
                                                     {"cached",  tokens_to_str(ctx, slot.cache_tokens.cbegin(), slot.cache_tokens.cbegin() + slot.n_past)},
@@ -1950,46 +2483,99 @@ struct llama_server_context
                     continue;
                 }
 
-                completion_token_output result;
-                const llama_token id = llama_sampling_sample(slot.ctx_sampling, ctx, NULL, slot.i_batch - i);
+                // the sampled token and each drafted token after it give the
+                // logits of the next token, and a drafted token is accepted
+                // when it is the token sampled from the logits before it
+                const int n_view_drafts = std::min((int) slot.draft.size(), (int) (i + n_tokens) - slot.i_batch - 1);
+                int n_accepted = 0;
+                for (int j = 0; ; j++)
+                {
+                    completion_token_output result;
 
-                llama_sampling_accept(slot.ctx_sampling, ctx, id, true);
+                    const int32_t i_logits = slot.i_batch - i + j;
+                    float * logits = llama_get_logits_ith(ctx, i_logits);
+                    apply_dry(slot, logits);
+                    apply_xtc(slot, logits);
 
-                slot.n_decoded += 1;
-                if (slot.n_decoded == 1)
-                {
-                    slot.t_start_genereration = ggml_time_us();
-                    slot.t_prompt_processing = (slot.t_start_genereration - slot.t_start_process_prompt) / 1e3;
-                    metrics.on_prompt_eval(slot);
-                }
+                    const llama_token id = llama_sampling_sample(slot.ctx_sampling, ctx, NULL, i_logits);
 
-                llama_token_data_array cur_p = { slot.ctx_sampling->cur.data(), slot.ctx_sampling->cur.size(), false };
-                result.tok = id;
+                    llama_sampling_accept(slot.ctx_sampling, ctx, id, true);
 
-                const int32_t n_probs = slot.sparams.n_probs;
-                if (slot.sparams.temp <= 0 && n_probs > 0)
-                {
-                    // for llama_sample_token_greedy we need to sort candidates
-                    llama_sample_softmax(ctx, &cur_p);
-                }
+                    slot.n_decoded += 1;
+                    if (slot.n_decoded == 1)
+                    {
+                        slot.t_start_genereration = ggml_time_us();
+                        slot.t_prompt_processing = (slot.t_start_genereration - slot.t_start_process_prompt) / 1e3;
+                        metrics.on_prompt_eval(slot);
+                    }
 
-                for (size_t i = 0; i < std::min(cur_p.size, (size_t)n_probs); ++i)
-                {
-                    result.probs.push_back({cur_p.data[i].id, cur_p.data[i].p});
-                }
+                    llama_token_data_array cur_p = { slot.ctx_sampling->cur.data(), slot.ctx_sampling->cur.size(), false };
+                    result.tok = id;
 
-                if (!process_token(result, slot))
-                {
-                    slot.release();
-                    slot.print_timings();
-                    send_final_response(slot);
-                    metrics.on_prediction(slot);
+                    const int32_t n_probs = slot.sparams.n_probs;
+                    if (slot.sparams.temp <= 0 && n_probs > 0)
+                    {
+                        // for llama_sample_token_greedy we need to sort candidates
+                        llama_sample_softmax(ctx, &cur_p);
+                    }
+
+                    for (size_t i = 0; i < std::min(cur_p.size, (size_t)n_probs); ++i)
+                    {
+                        result.probs.push_back({cur_p.data[i].id, cur_p.data[i].p});
+                    }
+
+                    if (n_probs > 0)
+                    {
+                        // the sampled token isn't necessarily among the most likely
+                        for (size_t i = 0; i < cur_p.size; ++i)
+                        {
+                            if (cur_p.data[i].id == id)
+                            {
+                                result.prob = cur_p.data[i].p;
+                                break;
+                            }
+                        }
+                    }
+
+                    // drafted tokens past the view have no logits yet, so
+                    // they are rejected with those after a wrong one
+                    const bool has_next = process_token(result, slot);
+                    if (has_next && j < n_view_drafts && id == slot.draft[j])
+                    {
+                        n_accepted++;
+                        slot.n_past += 1;
+                        continue;
+                    }
+
+                    slot.n_draft_accepted += n_accepted;
+                    slot.n_draft_rejected += slot.draft.size() - n_accepted;
+
+                    if (!has_next)
+                    {
+                        slot.release();
+                        slot.print_timings();
+                        send_final_response(slot);
+                        metrics.on_prediction(slot);
+                    }
+
+                    break;
                 }
 
                 slot.i_batch = -1;
             }
         }
 
+        // the KV cache holds the rejected drafted tokens after the slots'
+        // accepted tokens
+        for (auto & slot : slots)
+        {
+            if (!slot.draft.empty())
+            {
+                llama_kv_cache_seq_rm(ctx, slot.id, system_tokens.size() + slot.n_past, -1);
+                slot.draft.clear();
+            }
+        }
+
         LOG_VERBOSE("slots updated", {});
         return true;
     }
@@ -2079,10 +2665,16 @@ static void server_print_usage(const char *argv0, const gpt_params &params,
     printf("  -ctv TYPE, --cache-type-v TYPE\n");
     printf("                            KV cache data type for V (default: f16)\n");
     printf("  --mmproj MMPROJ_FILE      path to a multimodal projector file for LLaVA.\n");
+    printf("  -md FNAME, --model-draft FNAME\n");
+    printf("                            draft model for speculative decoding, which must share the model's vocabulary (default: unused)\n");
+    printf("  -ngld N, --gpu-layers-draft N\n");
+    printf("                            number of layers of the draft model to store in VRAM\n");
+    printf("  --draft N                 number of tokens to draft for speculative decoding (default: %d)\n", params.n_draft);
     printf("  --log-format              log output format: json or text (default: json)\n");
     printf("  --log-disable             disables logging to a file.\n");
     printf("  --slots-endpoint-disable  disables slots monitoring endpoint.\n");
     printf("  --metrics                 enable prometheus compatible metrics endpoint (default: %s).\n", sparams.metrics_endpoint ? "enabled" : "disabled");
+    printf("  --prompt-cache-dir DIR    save named prompt caches in DIR so they outlive the server (default: memory only)\n");
     printf("\n");
     printf("  -n, --n-predict           maximum tokens to predict (default: %d)\n", params.n_predict);
     printf("  --override-kv KEY=TYPE:VALUE\n");
@@ -2523,6 +3115,33 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
             }
             params.mmproj = argv[i];
         }
+        else if (arg == "-md" || arg == "--model-draft")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            params.model_draft = argv[i];
+        }
+        else if (arg == "-ngld" || arg == "--gpu-layers-draft")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            params.n_gpu_layers_draft = std::stoi(argv[i]);
+        }
+        else if (arg == "--draft")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            params.n_draft = std::stoi(argv[i]);
+        }
         else if (arg == "--log-format")
         {
             if (++i >= argc)
@@ -2557,6 +3176,15 @@ static void server_params_parse(int argc, char **argv, server_params &sparams, g
         {
             sparams.metrics_endpoint = true;
         }
+        else if (arg == "--prompt-cache-dir")
+        {
+            if (++i >= argc)
+            {
+                invalid_param = true;
+                break;
+            }
+            sparams.prompt_cache_dir = argv[i];
+        }
         else if (arg == "--chat-template")
         {
             if (++i >= argc)
@@ -2767,6 +3395,7 @@ int main(int argc, char **argv) {
     llama_server_context llama;
 
     server_params_parse(argc, argv, sparams, params);
+    llama.prompt_cache_dir = sparams.prompt_cache_dir;
 
     if (params.model_alias == "unknown")
     {
@@ -107,6 +107,8 @@ struct completion_token_output {
 
     std::vector<token_prob> probs;
     llama_token tok;
+    // probability of the sampled token, set when n_probs > 0
+    float prob = 0.0f;
     std::string text_to_send;
 };
 
@@ -651,6 +653,7 @@ static json probs_vector_to_json(const llama_context *ctx, const std::vector<com
         std::string tok_str = tokens_to_output_formatted_string(ctx, prob.tok);
         out.push_back(json{
             {"content", tok_str},
+            {"prob",    prob.prob},
             {"probs",   probs_for_token},
         });
     }
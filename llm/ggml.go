@@ -120,6 +120,44 @@ func (kv KV) ChatTemplate() string {
 	return s
 }
 
+// ImageTokens returns the number of embeddings a vision projector produces
+// for an image, or 0 if the projector doesn't describe its image size
+func (kv KV) ImageTokens() uint64 {
+	size, patch := kv.u64("clip.vision.image_size"), kv.u64("clip.vision.patch_size")
+	if size == 0 || patch == 0 {
+		return 0
+	}
+
+	n := (size / patch) * (size / patch)
+
+	// projectors with grid pinpoints also embed the image in tiles of its
+	// size, up to the largest grid of width and height pairs
+	var tiles uint64
+	if pinpoints, ok := kv["clip.vision.image_grid_pinpoints"].(*array); ok {
+		for i := 0; i+1 < len(pinpoints.values); i += 2 {
+			w, h := toUint64(pinpoints.values[i]), toUint64(pinpoints.values[i+1])
+			tiles = max(tiles, (w/size)*(h/size))
+		}
+	}
+
+	return n * (tiles + 1)
+}
+
+func toUint64(v any) uint64 {
+	switch v := v.(type) {
+	case int32:
+		return uint64(max(v, 0))
+	case uint32:
+		return uint64(v)
+	case int64:
+		return uint64(max(v, 0))
+	case uint64:
+		return v
+	default:
+		return 0
+	}
+}
+
 type Tensors struct {
 	Items  []*Tensor
 	Offset uint64
@@ -58,11 +58,19 @@ func TestEstimateGPULayers(t *testing.T) {
 	projectors := []string{}
 	opts := api.DefaultOptions()
 	t.Run("cpu", func(t *testing.T) {
-		estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+		estimate := EstimateGPULayers(gpus, ggml, projectors, "", opts)
 		assert.Equal(t, 0, estimate.Layers)
 		assert.Equal(t, uint64(0), estimate.Graph)
 	})
 
+	t.Run("cpu with draft", func(t *testing.T) {
+		estimate := EstimateGPULayers(gpus, ggml, projectors, "", opts)
+		withDraft := EstimateGPULayers(gpus, ggml, projectors, f.Name(), opts)
+		assert.Equal(t, 0, withDraft.Layers)
+		assert.Equal(t, draftMemoryRequirements(f.Name(), opts.NumCtx), withDraft.TotalSize-estimate.TotalSize)
+		assert.Greater(t, withDraft.TotalSize, estimate.TotalSize)
+	})
+
 	// derived from the dummy ggml file above
 	graphPartialOffload := uint64(202377216)
 	graphFullOffload := uint64(171968512)
@@ -109,7 +117,7 @@ func TestEstimateGPULayers(t *testing.T) {
 			gpus[1].FreeMemory += gpuMinimumMemory + layerSize + s.layer1*layerSize + 1
 			gpus[0].FreeMemory += max(graphFullOffload, graphPartialOffload)
 			gpus[1].FreeMemory += max(graphFullOffload, graphPartialOffload)
-			estimate := EstimateGPULayers(gpus, ggml, projectors, opts)
+			estimate := EstimateGPULayers(gpus, ggml, projectors, "", opts)
 			assert.Equal(t, int(s.expect0+s.expect1), estimate.Layers, "scenario %d: %v", i, s)
 			assert.Equal(t, fmt.Sprintf("%d,%d", s.expect0, s.expect1), estimate.TensorSplit, "scenario %d: %v", i, s)
 			var layerSums uint64
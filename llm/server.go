@@ -3,13 +3,16 @@ package llm
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -17,6 +20,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -27,6 +31,7 @@ import (
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/tracing"
 )
 
 type LlamaServer interface {
@@ -34,6 +39,7 @@ type LlamaServer interface {
 	WaitUntilRunning(ctx context.Context) error
 	Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error
 	Embedding(ctx context.Context, input string) ([]float32, error)
+	Embeddings(ctx context.Context, inputs []string) ([][]float32, error)
 	Tokenize(ctx context.Context, content string) ([]int, error)
 	Detokenize(ctx context.Context, tokens []int) (string, error)
 	Close() error
@@ -83,7 +89,7 @@ func LoadModel(model string, maxArraySize int) (*GGML, error) {
 
 // NewLlamaServer will run a server for the given GPUs
 // The gpu list must be a single family.
-func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, opts api.Options, numParallel int) (LlamaServer, error) {
+func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, projectors []string, draft string, opts api.Options, numParallel int) (LlamaServer, error) {
 	var err error
 	var cpuRunner string
 	var estimate MemoryEstimate
@@ -107,9 +113,9 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 	}
 	if len(gpus) == 1 && gpus[0].Library == "cpu" {
 		cpuRunner = serverForCpu()
-		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		estimate = EstimateGPULayers(gpus, ggml, projectors, draft, opts)
 	} else {
-		estimate = EstimateGPULayers(gpus, ggml, projectors, opts)
+		estimate = EstimateGPULayers(gpus, ggml, projectors, draft, opts)
 
 		switch {
 		case gpus[0].Library == "metal" && estimate.VRAMSize > systemTotalMemory:
@@ -215,6 +221,17 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 		params = append(params, "--mmproj", projectors[0])
 	}
 
+	if draft != "" {
+		params = append(params, "--model-draft", draft)
+
+		// the draft model is small, so it's offloaded whole with the model
+		if opts.NumGPU > 0 {
+			params = append(params, "--gpu-layers-draft", "999")
+		} else {
+			params = append(params, "--gpu-layers-draft", "0")
+		}
+	}
+
 	if opts.NumThread > 0 {
 		params = append(params, "--threads", strconv.Itoa(opts.NumThread))
 	}
@@ -270,6 +287,20 @@ func NewLlamaServer(gpus gpu.GpuInfoList, model string, ggml *GGML, adapters, pr
 
 	params = append(params, "--parallel", strconv.Itoa(numParallel))
 
+	if envconfig.PersistPromptCache() {
+		// saved state is only valid for the model and adapter it came from
+		dir := PromptCacheDir(model)
+		if len(adapters) > 0 {
+			dir = filepath.Join(dir, filepath.Base(adapters[0]))
+		}
+
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			slog.Warn("failed to create prompt cache directory, caches will not persist", "dir", dir, "error", err)
+		} else {
+			params = append(params, "--prompt-cache-dir", dir)
+		}
+	}
+
 	if estimate.TensorSplit != "" {
 		params = append(params, "--tensor-split", estimate.TensorSplit)
 	}
@@ -465,6 +496,23 @@ func projectorMemoryRequirements(filename string) uint64 {
 	return mem
 }
 
+// draftMemoryRequirements returns the memory taken by the weights of the draft
+// model at filename and its fp16 KV cache for numCtx tokens
+func draftMemoryRequirements(filename string, numCtx int) uint64 {
+	ggml, err := LoadModel(filename, 0)
+	if err != nil {
+		return 0
+	}
+
+	var mem uint64
+	for _, layer := range ggml.Tensors().Layers() {
+		mem += layer.size()
+	}
+
+	kv := ggml.KV()
+	return mem + 2*uint64(numCtx)*kv.BlockCount()*(kv.EmbeddingHeadCountK()+kv.EmbeddingHeadCountV())*kv.HeadCountKV()
+}
+
 type ServerStatus int
 
 const ( // iota is reset to 0
@@ -675,6 +723,40 @@ ws ::= ([ \t\n] ws)?
 
 const maxBufferSize = 512 * format.KiloByte
 
+// logitBias converts biases keyed by token ID or text to the pairs the runner
+// expects, where false bans a token
+func logitBias(biases map[string]float32) [][2]any {
+	keys := make([]string, 0, len(biases))
+	for k := range biases {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	pairs := make([][2]any, 0, len(biases))
+	for _, k := range keys {
+		var token any = k
+		if id, err := strconv.Atoi(k); err == nil {
+			token = id
+		}
+
+		var bias any = biases[k]
+		if biases[k] <= -100 {
+			bias = false
+		}
+
+		pairs = append(pairs, [2]any{token, bias})
+	}
+
+	return pairs
+}
+
+// PromptCacheDir returns the directory prompt caches of the model at path
+// are saved in when OLLAMA_PERSIST_PROMPT_CACHE is set
+func PromptCacheDir(path string) string {
+	return filepath.Join(envconfig.Models(), "caches", filepath.Base(path))
+}
+
 type ImageData struct {
 	Data []byte `json:"data"`
 	ID   int    `json:"id"`
@@ -686,20 +768,80 @@ type completion struct {
 	Prompt       string `json:"prompt"`
 	Stop         bool   `json:"stop"`
 	StoppedLimit bool   `json:"stopped_limit"`
+	SlotID       int    `json:"slot_id"`
 
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
 		PredictedMS float64 `json:"predicted_ms"`
 		PromptN     int     `json:"prompt_n"`
 		PromptMS    float64 `json:"prompt_ms"`
+
+		DraftAcceptedN int `json:"draft_accepted_n"`
+		DraftRejectedN int `json:"draft_rejected_n"`
+	}
+
+	Probabilities []struct {
+		Content string  `json:"content"`
+		Prob    float64 `json:"prob"`
+		Probs   []struct {
+			TokStr string  `json:"tok_str"`
+			Prob   float64 `json:"prob"`
+		} `json:"probs"`
+	} `json:"completion_probabilities"`
+}
+
+// logprob returns the natural log of a probability, clamped so it can be
+// encoded as JSON when the probability is zero
+func logprob(p float64) float64 {
+	return max(math.Log(p), -9999)
+}
+
+// logprobs converts the token probabilities of the completion to log
+// probabilities, keeping up to top of the most likely tokens for each
+func (c *completion) logprobs(top int) []api.TokenLogprob {
+	var logprobs []api.TokenLogprob
+	for _, p := range c.Probabilities {
+		lp := api.TokenLogprob{Token: p.Content, Logprob: logprob(p.Prob)}
+		for i, tp := range p.Probs {
+			if i < top {
+				lp.TopLogprobs = append(lp.TopLogprobs, api.Logprob{Token: tp.TokStr, Logprob: logprob(tp.Prob)})
+			}
+
+			if p.Prob == 0 && tp.TokStr == p.Content {
+				// runners that don't report the probability of the sampled
+				// token still report it when it's among the most likely
+				lp.Logprob = logprob(tp.Prob)
+			}
+		}
+
+		logprobs = append(logprobs, lp)
 	}
+
+	return logprobs
 }
 
 type CompletionRequest struct {
 	Prompt  string
+	Tokens  []int
 	Format  string
 	Images  []ImageData
 	Options *api.Options
+
+	// Grammar constrains a "json" Format further, e.g. to match a schema
+	Grammar string
+
+	// Logprobs requests the log probability of each generated token along
+	// with TopLogprobs of the most likely tokens at each position
+	Logprobs    bool
+	TopLogprobs int
+
+	// Cache names a prefix cache the runner saves the state of the prompt
+	// in, and restores it from for later requests with the same name
+	Cache string
+
+	// Slot is the runner slot to process the request in when it's
+	// available, e.g. the slot that holds the earlier turns of a chat
+	Slot *int
 }
 
 type CompletionResponse struct {
@@ -710,9 +852,24 @@ type CompletionResponse struct {
 	PromptEvalDuration time.Duration
 	EvalCount          int
 	EvalDuration       time.Duration
+	Logprobs           []api.TokenLogprob
+
+	// DraftAcceptedCount and DraftRejectedCount are the numbers of tokens
+	// drafted by the draft model that were accepted and rejected
+	DraftAcceptedCount int
+	DraftRejectedCount int
+
+	// Slot is the runner slot that processed the request
+	Slot int
 }
 
-func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) error {
+func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn func(CompletionResponse)) (err error) {
+	ctx, span := tracing.Start(ctx, "completion")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	if err := s.sem.Acquire(ctx, 1); err != nil {
 		slog.Error("Failed to acquire semaphore", "error", err)
 		return err
@@ -748,6 +905,42 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 		"stop":              req.Options.Stop,
 		"image_data":        req.Images,
 		"cache_prompt":      true,
+
+		"dry_multiplier":        req.Options.DRYMultiplier,
+		"dry_base":              req.Options.DRYBase,
+		"dry_allowed_length":    req.Options.DRYAllowedLength,
+		"dry_penalty_last_n":    req.Options.DRYPenaltyLastN,
+		"dry_sequence_breakers": req.Options.DRYSequenceBreakers,
+		"xtc_probability":       req.Options.XTCProbability,
+		"xtc_threshold":         req.Options.XTCThreshold,
+	}
+
+	if len(req.Options.LogitBias) > 0 {
+		request["logit_bias"] = logitBias(req.Options.LogitBias)
+	}
+
+	if req.Options.Grammar != "" {
+		request["grammar"] = req.Options.Grammar
+	}
+
+	if req.Slot != nil {
+		request["slot_id"] = *req.Slot
+	}
+
+	if req.Cache != "" {
+		// the runner names files after caches, so it gets a digest of the name
+		request["prompt_cache"] = fmt.Sprintf("%x", sha256.Sum256([]byte(req.Cache)))
+	}
+
+	if len(req.Tokens) > 0 {
+		// the runner evaluates token IDs in the prompt without tokenizing them
+		request["prompt"] = req.Tokens
+	}
+
+	if req.Logprobs {
+		// the runner only reports probabilities when asked for at least one
+		// of the most likely tokens
+		request["n_probs"] = max(req.TopLogprobs, 1)
 	}
 
 	// Make sure the server is ready
@@ -759,7 +952,7 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 	}
 
 	if req.Format == "json" {
-		request["grammar"] = jsonGrammar
+		request["grammar"] = cmp.Or(req.Grammar, jsonGrammar)
 		if !strings.Contains(strings.ToLower(req.Prompt), "json") {
 			slog.Warn("Prompt does not specify that the LLM should response in JSON, but JSON format is expected. For best results specify that JSON is expected in the system prompt.")
 		}
@@ -839,9 +1032,16 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 				return ctx.Err()
 			}
 
-			if c.Content != "" {
+			// the final response repeats the probabilities of every token
+			if !c.Stop && (c.Content != "" || len(c.Probabilities) > 0) {
+				var logprobs []api.TokenLogprob
+				if req.Logprobs {
+					logprobs = c.logprobs(req.TopLogprobs)
+				}
+
 				fn(CompletionResponse{
-					Content: c.Content,
+					Content:  c.Content,
+					Logprobs: logprobs,
 				})
 			}
 
@@ -851,6 +1051,10 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 					doneReason = "length"
 				}
 
+				span.SetAttribute("ollama.done_reason", doneReason)
+				span.SetAttribute("ollama.prompt_eval_count", c.Timings.PromptN)
+				span.SetAttribute("ollama.eval_count", c.Timings.PredictedN)
+
 				fn(CompletionResponse{
 					Done:               true,
 					DoneReason:         doneReason,
@@ -858,6 +1062,9 @@ func (s *llmServer) Completion(ctx context.Context, req CompletionRequest, fn fu
 					PromptEvalDuration: parseDurationMs(c.Timings.PromptMS),
 					EvalCount:          c.Timings.PredictedN,
 					EvalDuration:       parseDurationMs(c.Timings.PredictedMS),
+					DraftAcceptedCount: c.Timings.DraftAcceptedN,
+					DraftRejectedCount: c.Timings.DraftRejectedN,
+					Slot:               c.SlotID,
 				})
 				return nil
 			}
@@ -888,12 +1095,43 @@ type EmbeddingResponse struct {
 	Embedding []float32 `json:"embedding"`
 }
 
+// BatchEmbeddingRequest embeds several inputs in one runner request, each in
+// a slot of its own
+type BatchEmbeddingRequest struct {
+	Content []string `json:"content"`
+}
+
+type BatchEmbeddingResponse struct {
+	Results []struct {
+		Embedding []float32 `json:"embedding"`
+
+		// Content is the error of an input that failed
+		Content string `json:"content"`
+	} `json:"results"`
+}
+
 func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, error) {
-	if err := s.sem.Acquire(ctx, 1); err != nil {
+	embeddings, err := s.Embeddings(ctx, []string{input})
+	if err != nil {
+		return nil, err
+	}
+
+	return embeddings[0], nil
+}
+
+// Embeddings embeds inputs in a single runner request, which takes a share of
+// the runner's parallel slots for as many inputs as it has
+func (s *llmServer) Embeddings(ctx context.Context, inputs []string) ([][]float32, error) {
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+
+	n := int64(min(len(inputs), max(s.numParallel, 1)))
+	if err := s.sem.Acquire(ctx, n); err != nil {
 		slog.Error("Failed to acquire semaphore", "error", err)
 		return nil, err
 	}
-	defer s.sem.Release(1)
+	defer s.sem.Release(n)
 
 	// Make sure the server is ready
 	status, err := s.getServerStatusRetry(ctx)
@@ -903,7 +1141,14 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		return nil, fmt.Errorf("unexpected server status: %s", status.ToString())
 	}
 
-	data, err := json.Marshal(EmbeddingRequest{Content: input})
+	// a single input is sent on its own as the runner only splits requests
+	// of several inputs
+	var req any = EmbeddingRequest{Content: inputs[0]}
+	if len(inputs) > 1 {
+		req = BatchEmbeddingRequest{Content: inputs}
+	}
+
+	data, err := json.Marshal(req)
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling embed data: %w", err)
 	}
@@ -930,12 +1175,34 @@ func (s *llmServer) Embedding(ctx context.Context, input string) ([]float32, err
 		return nil, fmt.Errorf("%s", body)
 	}
 
-	var e EmbeddingResponse
+	if len(inputs) == 1 {
+		var e EmbeddingResponse
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal embedding response: %w", err)
+		}
+
+		return [][]float32{e.Embedding}, nil
+	}
+
+	var e BatchEmbeddingResponse
 	if err := json.Unmarshal(body, &e); err != nil {
-		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
+		return nil, fmt.Errorf("unmarshal embedding response: %w", err)
+	}
+
+	if len(e.Results) != len(inputs) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(inputs), len(e.Results))
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	for i, result := range e.Results {
+		if result.Embedding == nil {
+			return nil, fmt.Errorf("embedding input %d: %s", i, result.Content)
+		}
+
+		embeddings[i] = result.Embedding
 	}
 
-	return e.Embedding, nil
+	return embeddings, nil
 }
 
 type TokenizeRequest struct {
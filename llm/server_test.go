@@ -0,0 +1,45 @@
+package llm
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+)
+
+func TestCompletionLogprobs(t *testing.T) {
+	var c completion
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"content": " world",
+		"completion_probabilities": [
+			{"content": " world", "prob": 0.5, "probs": [{"tok_str": " there", "prob": 0.25}, {"tok_str": " world", "prob": 0.5}]},
+			{"content": "!", "probs": [{"tok_str": "!", "prob": 1}]},
+			{"content": "?", "prob": 0, "probs": []}
+		]
+	}`), &c))
+
+	require.Equal(t, []api.TokenLogprob{
+		{Token: " world", Logprob: math.Log(0.5), TopLogprobs: []api.Logprob{{Token: " there", Logprob: math.Log(0.25)}}},
+		{Token: "!", Logprob: 0, TopLogprobs: []api.Logprob{{Token: "!", Logprob: 0}}},
+		{Token: "?", Logprob: -9999},
+	}, c.logprobs(1))
+
+	logprobs := c.logprobs(0)
+	require.Len(t, logprobs, 3)
+	require.Nil(t, logprobs[0].TopLogprobs)
+	// the probability of the sampled token is found among the most likely
+	// tokens when the runner doesn't report it
+	require.Equal(t, 0.0, logprobs[1].Logprob)
+	require.Equal(t, -9999.0, logprobs[2].Logprob)
+}
+
+func TestLogitBias(t *testing.T) {
+	require.Equal(t, [][2]any{
+		{" world", float32(2.5)},
+		{15043, false},
+		{29871, float32(-1)},
+	}, logitBias(map[string]float32{"29871": -1, "15043": -100, " world": 2.5}))
+}
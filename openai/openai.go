@@ -3,15 +3,21 @@ package openai
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -38,21 +44,49 @@ type Message struct {
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Message      Message         `json:"message"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int             `json:"index"`
+	Delta        Message         `json:"delta"`
+	Logprobs     *ChoiceLogprobs `json:"logprobs"`
+	FinishReason *string         `json:"finish_reason"`
 }
 
 type CompleteChunkChoice struct {
-	Text         string  `json:"text"`
-	Index        int     `json:"index"`
-	FinishReason *string `json:"finish_reason"`
+	Text         string              `json:"text"`
+	Index        int                 `json:"index"`
+	Logprobs     *CompletionLogprobs `json:"logprobs"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+type ChoiceLogprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+// CompletionLogprobs is the legacy log probability format of completions
+type CompletionLogprobs struct {
+	Tokens        []string             `json:"tokens"`
+	TokenLogprobs []float64            `json:"token_logprobs"`
+	TopLogprobs   []map[string]float64 `json:"top_logprobs"`
+	TextOffset    []int                `json:"text_offset"`
 }
 
 type Usage struct {
@@ -61,8 +95,20 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
 type ResponseFormat struct {
-	Type string `json:"type"`
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+type JSONSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      *bool           `json:"strict,omitempty"`
 }
 
 type EmbedRequest struct {
@@ -71,18 +117,26 @@ type EmbedRequest struct {
 }
 
 type ChatCompletionRequest struct {
-	Model            string          `json:"model"`
-	Messages         []Message       `json:"messages"`
-	Stream           bool            `json:"stream"`
-	MaxTokens        *int            `json:"max_tokens"`
-	Seed             *int            `json:"seed"`
-	Stop             any             `json:"stop"`
-	Temperature      *float64        `json:"temperature"`
-	FrequencyPenalty *float64        `json:"frequency_penalty"`
-	PresencePenalty  *float64        `json:"presence_penalty_penalty"`
-	TopP             *float64        `json:"top_p"`
-	ResponseFormat   *ResponseFormat `json:"response_format"`
-	Tools            []api.Tool      `json:"tools"`
+	Model             string             `json:"model"`
+	Messages          []Message          `json:"messages"`
+	Stream            bool               `json:"stream"`
+	StreamOptions     *StreamOptions     `json:"stream_options"`
+	MaxTokens         *int               `json:"max_tokens"`
+	Seed              *int               `json:"seed"`
+	Stop              any                `json:"stop"`
+	Temperature       *float64           `json:"temperature"`
+	FrequencyPenalty  *float64           `json:"frequency_penalty"`
+	PresencePenalty   *float64           `json:"presence_penalty_penalty"`
+	TopP              *float64           `json:"top_p"`
+	LogitBias         map[string]float32 `json:"logit_bias"`
+	ResponseFormat    *ResponseFormat    `json:"response_format"`
+	Tools             []api.Tool         `json:"tools"`
+	ToolChoice        any                `json:"tool_choice"`
+	ParallelToolCalls *bool              `json:"parallel_tool_calls"`
+	N                 *int               `json:"n"`
+	Logprobs          bool               `json:"logprobs"`
+	TopLogprobs       int                `json:"top_logprobs"`
+	PromptCacheKey    string             `json:"prompt_cache_key"`
 }
 
 type ChatCompletion struct {
@@ -102,21 +156,30 @@ type ChatCompletionChunk struct {
 	Model             string        `json:"model"`
 	SystemFingerprint string        `json:"system_fingerprint"`
 	Choices           []ChunkChoice `json:"choices"`
+	Usage             *Usage        `json:"usage,omitempty"`
 }
 
-// TODO (https://github.com/ollama/ollama/issues/5259): support []string, []int and [][]int
+// TODO (https://github.com/ollama/ollama/issues/5259): support echo and best_of
 type CompletionRequest struct {
-	Model            string   `json:"model"`
-	Prompt           string   `json:"prompt"`
-	FrequencyPenalty float32  `json:"frequency_penalty"`
-	MaxTokens        *int     `json:"max_tokens"`
-	PresencePenalty  float32  `json:"presence_penalty"`
-	Seed             *int     `json:"seed"`
-	Stop             any      `json:"stop"`
-	Stream           bool     `json:"stream"`
-	Temperature      *float32 `json:"temperature"`
-	TopP             float32  `json:"top_p"`
-	Suffix           string   `json:"suffix"`
+	Model string `json:"model"`
+
+	// Prompt is a string, an array of strings, an array of token IDs or an
+	// array of arrays of token IDs
+	Prompt           any                `json:"prompt"`
+	FrequencyPenalty float32            `json:"frequency_penalty"`
+	MaxTokens        *int               `json:"max_tokens"`
+	PresencePenalty  float32            `json:"presence_penalty"`
+	Seed             *int               `json:"seed"`
+	Stop             any                `json:"stop"`
+	Stream           bool               `json:"stream"`
+	StreamOptions    *StreamOptions     `json:"stream_options"`
+	Temperature      *float32           `json:"temperature"`
+	TopP             float32            `json:"top_p"`
+	LogitBias        map[string]float32 `json:"logit_bias"`
+	Suffix           string             `json:"suffix"`
+	N                *int               `json:"n"`
+	Logprobs         *int               `json:"logprobs"`
+	PromptCacheKey   string             `json:"prompt_cache_key"`
 }
 
 type Completion struct {
@@ -136,13 +199,17 @@ type CompletionChunk struct {
 	Choices           []CompleteChunkChoice `json:"choices"`
 	Model             string                `json:"model"`
 	SystemFingerprint string                `json:"system_fingerprint"`
+	Usage             *Usage                `json:"usage,omitempty"`
 }
 
 type ToolCall struct {
-	ID       string `json:"id"`
-	Type     string `json:"type"`
+	// Index is only set in chunks, where the first delta of a call has its
+	// id, type and name and the following deltas add to its arguments
+	Index    *int   `json:"index,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
 	Function struct {
-		Name      string `json:"name"`
+		Name      string `json:"name,omitempty"`
 		Arguments string `json:"arguments"`
 	} `json:"function"`
 }
@@ -152,6 +219,123 @@ type Model struct {
 	Object  string `json:"object"`
 	Created int64  `json:"created"`
 	OwnedBy string `json:"owned_by"`
+
+	// the fields below extend OpenAI's model object with Ollama's metadata
+	ContextLength int      `json:"context_length,omitempty"`
+	Family        string   `json:"family,omitempty"`
+	ParameterSize string   `json:"parameter_size,omitempty"`
+	Quantization  string   `json:"quantization,omitempty"`
+	Capabilities  []string `json:"capabilities,omitempty"`
+}
+
+type DeletedModel struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// File is a file uploaded for a batch or produced by one
+type File struct {
+	Id        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+type FileList struct {
+	Object string `json:"object"`
+	Data   []File `json:"data"`
+}
+
+type DeletedFile struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// BatchRequest creates a batch running the requests of an input file
+type BatchRequest struct {
+	InputFileId      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+type Batch struct {
+	Id               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors"`
+	InputFileId      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           string             `json:"status"`
+	OutputFileId     *string            `json:"output_file_id"`
+	ErrorFileId      *string            `json:"error_file_id"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     *int64             `json:"in_progress_at"`
+	ExpiresAt        *int64             `json:"expires_at"`
+	FinalizingAt     *int64             `json:"finalizing_at"`
+	CompletedAt      *int64             `json:"completed_at"`
+	FailedAt         *int64             `json:"failed_at"`
+	ExpiredAt        *int64             `json:"expired_at"`
+	CancellingAt     *int64             `json:"cancelling_at"`
+	CancelledAt      *int64             `json:"cancelled_at"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata"`
+}
+
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    *int   `json:"line"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+type BatchList struct {
+	Object  string  `json:"object"`
+	Data    []Batch `json:"data"`
+	FirstId *string `json:"first_id"`
+	LastId  *string `json:"last_id"`
+	HasMore bool    `json:"has_more"`
+}
+
+// BatchInput is a line of a batch input file
+type BatchInput struct {
+	CustomId string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	Url      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// BatchOutput is a line of a batch output or error file
+type BatchOutput struct {
+	Id       string               `json:"id"`
+	CustomId string               `json:"custom_id"`
+	Response *BatchOutputResponse `json:"response"`
+	Error    *BatchOutputError    `json:"error"`
+}
+
+type BatchOutputResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestId  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type BatchOutputError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type Embedding struct {
@@ -182,8 +366,14 @@ func NewError(code int, message string) ErrorResponse {
 	switch code {
 	case http.StatusBadRequest:
 		etype = "invalid_request_error"
+	case http.StatusUnauthorized:
+		etype = "authentication_error"
+	case http.StatusForbidden:
+		etype = "permission_error"
 	case http.StatusNotFound:
 		etype = "not_found_error"
+	case http.StatusTooManyRequests:
+		etype = "rate_limit_error"
 	default:
 		etype = "api_error"
 	}
@@ -200,6 +390,69 @@ func toolCallId() string {
 	return "call_" + strings.ToLower(string(b))
 }
 
+// tokenBytes returns the UTF-8 bytes of a token. Tokens holding part of a
+// multi-byte character are formatted as "byte: \xNN" by the runner.
+func tokenBytes(token string) []int {
+	if s, ok := strings.CutPrefix(token, `byte: \x`); ok {
+		if b, err := strconv.ParseUint(s, 16, 8); err == nil {
+			return []int{int(b)}
+		}
+	}
+
+	b := make([]int, len(token))
+	for i := range len(token) {
+		b[i] = int(token[i])
+	}
+
+	return b
+}
+
+func toChoiceLogprobs(logprobs []api.TokenLogprob) *ChoiceLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	content := make([]TokenLogprob, len(logprobs))
+	for i, lp := range logprobs {
+		content[i] = TokenLogprob{
+			Token:       lp.Token,
+			Logprob:     lp.Logprob,
+			Bytes:       tokenBytes(lp.Token),
+			TopLogprobs: make([]TopLogprob, len(lp.TopLogprobs)),
+		}
+
+		for j, top := range lp.TopLogprobs {
+			content[i].TopLogprobs[j] = TopLogprob{Token: top.Token, Logprob: top.Logprob, Bytes: tokenBytes(top.Token)}
+		}
+	}
+
+	return &ChoiceLogprobs{Content: content}
+}
+
+// toCompletionLogprobs converts logprobs to the legacy completion format.
+// Text offsets start at offset.
+func toCompletionLogprobs(logprobs []api.TokenLogprob, offset int) *CompletionLogprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	var l CompletionLogprobs
+	for _, lp := range logprobs {
+		top := make(map[string]float64, len(lp.TopLogprobs))
+		for _, t := range lp.TopLogprobs {
+			top[t.Token] = t.Logprob
+		}
+
+		l.Tokens = append(l.Tokens, lp.Token)
+		l.TokenLogprobs = append(l.TokenLogprobs, lp.Logprob)
+		l.TopLogprobs = append(l.TopLogprobs, top)
+		l.TextOffset = append(l.TextOffset, offset)
+		offset += len(tokenBytes(lp.Token))
+	}
+
+	return &l
+}
+
 func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 	toolCalls := make([]ToolCall, len(r.Message.ToolCalls))
 	for i, tc := range r.Message.ToolCalls {
@@ -223,8 +476,9 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Index:    0,
+			Message:  Message{Role: r.Message.Role, Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(toolCalls) > 0 {
 					reason = "tool_calls"
@@ -244,6 +498,25 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 }
 
 func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
+	var toolCalls []ToolCall
+	for _, tc := range r.Message.ToolCalls {
+		// the final update of a call repeats the arguments already streamed
+		if tc.Function.Arguments != nil {
+			continue
+		}
+
+		var toolCall ToolCall
+		toolCall.Index = &tc.Index
+		if tc.Function.Name != "" {
+			toolCall.ID = toolCallId()
+			toolCall.Type = "function"
+			toolCall.Function.Name = tc.Function.Name
+		}
+
+		toolCall.Function.Arguments = tc.Function.PartialArguments
+		toolCalls = append(toolCalls, toolCall)
+	}
+
 	return ChatCompletionChunk{
 		Id:                id,
 		Object:            "chat.completion.chunk",
@@ -251,8 +524,9 @@ func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{{
-			Index: 0,
-			Delta: Message{Role: "assistant", Content: r.Message.Content},
+			Index:    0,
+			Delta:    Message{Role: "assistant", Content: r.Message.Content, ToolCalls: toolCalls},
+			Logprobs: toChoiceLogprobs(r.Logprobs),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -271,8 +545,9 @@ func toCompletion(id string, r api.GenerateResponse) Completion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs, 0),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -296,8 +571,9 @@ func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []CompleteChunkChoice{{
-			Text:  r.Response,
-			Index: 0,
+			Text:     r.Response,
+			Index:    0,
+			Logprobs: toCompletionLogprobs(r.Logprobs, 0),
 			FinishReason: func(reason string) *string {
 				if len(reason) > 0 {
 					return &reason
@@ -308,14 +584,24 @@ func toCompleteChunk(id string, r api.GenerateResponse) CompletionChunk {
 	}
 }
 
-func toListCompletion(r api.ListResponse) ListCompletion {
+func toListCompletion(r api.ListResponse, show func(string) (api.ShowResponse, error)) ListCompletion {
 	var data []Model
 	for _, m := range r.Models {
+		if show != nil {
+			if resp, err := show(m.Name); err == nil {
+				data = append(data, toModel(resp, m.Name))
+				continue
+			}
+		}
+
 		data = append(data, Model{
-			Id:      m.Name,
-			Object:  "model",
-			Created: m.ModifiedAt.Unix(),
-			OwnedBy: model.ParseName(m.Name).Namespace,
+			Id:            m.Name,
+			Object:        "model",
+			Created:       m.ModifiedAt.Unix(),
+			OwnedBy:       model.ParseName(m.Name).Namespace,
+			Family:        m.Details.Family,
+			ParameterSize: m.Details.ParameterSize,
+			Quantization:  m.Details.QuantizationLevel,
 		})
 	}
 
@@ -351,15 +637,56 @@ func toEmbeddingList(model string, r api.EmbedResponse) EmbeddingList {
 }
 
 func toModel(r api.ShowResponse, m string) Model {
+	// model info is keyed by architecture, e.g. llama.context_length
+	var contextLength int
+	if arch, ok := r.ModelInfo["general.architecture"].(string); ok {
+		// the value is a float64 once decoded from JSON and an unsigned
+		// integer when it comes straight from the model file
+		switch n := r.ModelInfo[arch+".context_length"].(type) {
+		case float64:
+			contextLength = int(n)
+		case uint32:
+			contextLength = int(n)
+		case uint64:
+			contextLength = int(n)
+		}
+	}
+
 	return Model{
-		Id:      m,
-		Object:  "model",
-		Created: r.ModifiedAt.Unix(),
-		OwnedBy: model.ParseName(m).Namespace,
+		Id:            m,
+		Object:        "model",
+		Created:       r.ModifiedAt.Unix(),
+		OwnedBy:       model.ParseName(m).Namespace,
+		ContextLength: contextLength,
+		Family:        r.Details.Family,
+		ParameterSize: r.Details.ParameterSize,
+		Quantization:  r.Details.QuantizationLevel,
+		Capabilities:  r.Capabilities,
 	}
 }
 
+// maxChoices is the most choices a request may ask for with n
+const maxChoices = 128
+
+func checkChoices(n *int) error {
+	if n != nil && (*n < 1 || *n > maxChoices) {
+		return fmt.Errorf("n must be between 1 and %d", maxChoices)
+	}
+
+	return nil
+}
+
 func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
+	if err := checkChoices(r.N); err != nil {
+		return nil, err
+	}
+
+	if r.TopLogprobs < 0 || r.TopLogprobs > 20 {
+		return nil, errors.New("top_logprobs must be between 0 and 20")
+	} else if r.TopLogprobs > 0 && !r.Logprobs {
+		return nil, errors.New("logprobs must be true when top_logprobs is set")
+	}
+
 	var messages []api.Message
 	for _, msg := range r.Messages {
 		switch content := msg.Content.(type) {
@@ -475,22 +802,171 @@ func fromChatRequest(r ChatCompletionRequest) (*api.ChatRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	var format string
-	if r.ResponseFormat != nil && r.ResponseFormat.Type == "json_object" {
-		format = "json"
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
+
+	var format json.RawMessage
+	if r.ResponseFormat != nil {
+		switch r.ResponseFormat.Type {
+		case "json_object":
+			format = json.RawMessage(`"json"`)
+		case "json_schema":
+			if r.ResponseFormat.JSONSchema == nil || len(r.ResponseFormat.JSONSchema.Schema) == 0 {
+				return nil, errors.New("response_format.json_schema.schema is required")
+			}
+
+			format = r.ResponseFormat.JSONSchema.Schema
+		}
+	}
+
+	tools, toolChoice, err := fromToolChoice(r.Tools, r.ToolChoice)
+	if err != nil {
+		return nil, err
 	}
 
 	return &api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-		Tools:    r.Tools,
+		Model:             r.Model,
+		Messages:          messages,
+		Format:            format,
+		Options:           options,
+		Stream:            &r.Stream,
+		Tools:             tools,
+		ToolChoice:        toolChoice,
+		ParallelToolCalls: r.ParallelToolCalls,
+		Logprobs:          r.Logprobs,
+		TopLogprobs:       r.TopLogprobs,
+		Cache:             r.PromptCacheKey,
 	}, nil
 }
 
-func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
+// fromToolChoice returns the tools and tool choice for a chat request. A tool
+// choice naming a function requires a call to that function alone.
+func fromToolChoice(tools []api.Tool, toolChoice any) ([]api.Tool, string, error) {
+	switch t := toolChoice.(type) {
+	case nil:
+		return tools, "", nil
+	case string:
+		if t != "none" && t != "auto" && t != "required" {
+			return nil, "", fmt.Errorf("invalid tool_choice %q", t)
+		}
+
+		return tools, t, nil
+	case map[string]any:
+		var name string
+		if fn, ok := t["function"].(map[string]any); ok && t["type"] == "function" {
+			name, _ = fn["name"].(string)
+		}
+
+		if name == "" {
+			return nil, "", errors.New("tool_choice must name a function")
+		}
+
+		for _, tool := range tools {
+			if tool.Function.Name == name {
+				return []api.Tool{tool}, "required", nil
+			}
+		}
+
+		return nil, "", fmt.Errorf("tool_choice function %q is not in tools", name)
+	default:
+		return nil, "", errors.New("invalid tool_choice")
+	}
+}
+
+// completionPrompt is one of the prompts of a completion request, given
+// either as text or as token IDs
+type completionPrompt struct {
+	text   string
+	tokens []int
+}
+
+func fromPrompt(prompt any) ([]completionPrompt, error) {
+	switch prompt := prompt.(type) {
+	case nil:
+		return []completionPrompt{{}}, nil
+	case string:
+		return []completionPrompt{{text: prompt}}, nil
+	case []any:
+		if len(prompt) == 0 {
+			return nil, errors.New("prompt must not be empty")
+		}
+
+		// an array of numbers is a single prompt of token IDs
+		if _, ok := prompt[0].(float64); ok {
+			tokens, err := fromTokens(prompt)
+			if err != nil {
+				return nil, err
+			}
+
+			return []completionPrompt{{tokens: tokens}}, nil
+		}
+
+		prompts := make([]completionPrompt, len(prompt))
+		for i, p := range prompt {
+			switch p := p.(type) {
+			case string:
+				prompts[i].text = p
+			case []any:
+				tokens, err := fromTokens(p)
+				if err != nil {
+					return nil, err
+				}
+
+				prompts[i].tokens = tokens
+			default:
+				return nil, fmt.Errorf("invalid type for 'prompt' field: %T", p)
+			}
+		}
+
+		return prompts, nil
+	default:
+		return nil, fmt.Errorf("invalid type for 'prompt' field: %T", prompt)
+	}
+}
+
+func fromTokens(tokens []any) ([]int, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("prompt tokens must not be empty")
+	}
+
+	ids := make([]int, len(tokens))
+	for i, t := range tokens {
+		f, ok := t.(float64)
+		if !ok || f < 0 || f != math.Trunc(f) || f > math.MaxInt32 {
+			return nil, fmt.Errorf("invalid token in 'prompt' field: %v", t)
+		}
+
+		ids[i] = int(f)
+	}
+
+	return ids, nil
+}
+
+// fromCompleteRequest returns a generate request for each prompt of r
+func fromCompleteRequest(r CompletionRequest) ([]api.GenerateRequest, error) {
+	if err := checkChoices(r.N); err != nil {
+		return nil, err
+	}
+
+	if r.Logprobs != nil && (*r.Logprobs < 0 || *r.Logprobs > 5) {
+		return nil, errors.New("logprobs must be between 0 and 5")
+	}
+
+	prompts, err := fromPrompt(r.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	choices := len(prompts)
+	if r.N != nil {
+		choices *= *r.N
+	}
+
+	if choices > maxChoices {
+		return nil, fmt.Errorf("prompt and n must request at most %d choices, got %d", maxChoices, choices)
+	}
+
 	options := make(map[string]any)
 
 	switch stop := r.Stop.(type) {
@@ -502,7 +978,7 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 			if str, ok := s.(string); ok {
 				stops = append(stops, str)
 			} else {
-				return api.GenerateRequest{}, fmt.Errorf("invalid type for 'stop' field: %T", s)
+				return nil, fmt.Errorf("invalid type for 'stop' field: %T", s)
 			}
 		}
 		options["stop"] = stops
@@ -532,13 +1008,38 @@ func fromCompleteRequest(r CompletionRequest) (api.GenerateRequest, error) {
 		options["top_p"] = 1.0
 	}
 
-	return api.GenerateRequest{
-		Model:   r.Model,
-		Prompt:  r.Prompt,
-		Options: options,
-		Stream:  &r.Stream,
-		Suffix:  r.Suffix,
-	}, nil
+	if len(r.LogitBias) > 0 {
+		options["logit_bias"] = r.LogitBias
+	}
+
+	reqs := make([]api.GenerateRequest, len(prompts))
+	for i, p := range prompts {
+		req := api.GenerateRequest{
+			Model:   r.Model,
+			Prompt:  p.text,
+			Options: options,
+			Stream:  &r.Stream,
+			Suffix:  r.Suffix,
+			Cache:   r.PromptCacheKey,
+		}
+
+		if p.tokens != nil {
+			if r.Suffix != "" {
+				return nil, errors.New("suffix is not supported with a prompt of tokens")
+			}
+
+			// token IDs are evaluated as they are, without a template
+			req.Tokens, req.Raw = p.tokens, true
+		}
+
+		if r.Logprobs != nil {
+			req.Logprobs, req.TopLogprobs = true, *r.Logprobs
+		}
+
+		reqs[i] = req
+	}
+
+	return reqs, nil
 }
 
 type BaseWriter struct {
@@ -546,19 +1047,229 @@ type BaseWriter struct {
 }
 
 type ChatWriter struct {
-	stream bool
-	id     string
+	stream        bool
+	streamOptions *StreamOptions
+	id            string
+	choiceState
+
+	// toolCalls is true once the choice has streamed a tool call
+	toolCalls bool
+
+	// completion collects the choices of a response that isn't streamed
+	completion *ChatCompletion
 	BaseWriter
 }
 
 type CompleteWriter struct {
-	stream bool
-	id     string
+	stream        bool
+	streamOptions *StreamOptions
+	id            string
+	choiceState
+
+	// offset is the length of the text streamed so far for the choice
+	offset int
+
+	// completion collects the choices of a response that isn't streamed
+	completion *Completion
+
+	// prompts holds the generate requests of the prompts after the first of
+	// a request with several prompts. Each prompt is translated by a writer
+	// of its own, with the index of its prompt, that adds to group.
+	prompts [][]byte
+	prompt  int
+	group   *promptGroup
 	BaseWriter
 }
 
+// choicesKey holds the writer of a request that may generate several choices
+const choicesKey = "openai.choices"
+
+// choiceWriter combines the native responses from running the handler once
+// for each requested choice into a single response
+type choiceWriter interface {
+	choices() int
+	setChoice(index int)
+}
+
+type choiceState struct {
+	n     int
+	index int
+
+	// usage totals the usage of the choices streamed so far
+	usage Usage
+}
+
+func (s *choiceState) choices() int {
+	return s.n
+}
+
+func (s *choiceState) setChoice(index int) {
+	s.index = index
+}
+
+// last reports whether the writer is translating the final choice
+func (s *choiceState) last() bool {
+	return s.index >= s.n-1
+}
+
+// addUsage adds the usage of the current choice. Every choice evaluates the
+// same prompt, so its tokens are only counted once.
+func (s *choiceState) addUsage(m api.Metrics) {
+	if s.index == 0 {
+		s.usage.PromptTokens = m.PromptEvalCount
+	}
+
+	s.usage.CompletionTokens += m.EvalCount
+	s.usage.TotalTokens = s.usage.PromptTokens + s.usage.CompletionTokens
+}
+
+// promptGroup combines the responses of the prompts of a completion request
+// with several prompts, which run concurrently
+type promptGroup struct {
+	mu sync.Mutex
+	w  gin.ResponseWriter
+
+	// written is true once a prompt has streamed a chunk
+	written bool
+
+	model      string
+	usage      Usage
+	completion *Completion
+
+	// code and data are the error of the first prompt that failed, which
+	// cancels the others
+	code   int
+	data   []byte
+	cancel context.CancelFunc
+}
+
+func (g *promptGroup) addUsage(model string, usage Usage) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.model = model
+	g.usage.PromptTokens += usage.PromptTokens
+	g.usage.CompletionTokens += usage.CompletionTokens
+	g.usage.TotalTokens += usage.TotalTokens
+}
+
+func (g *promptGroup) addCompletion(completion *Completion) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.completion == nil {
+		c := *completion
+		g.completion = &c
+		return
+	}
+
+	g.completion.Choices = append(g.completion.Choices, completion.Choices...)
+	g.completion.Usage.PromptTokens += completion.Usage.PromptTokens
+	g.completion.Usage.CompletionTokens += completion.Usage.CompletionTokens
+	g.completion.Usage.TotalTokens += completion.Usage.TotalTokens
+}
+
+func (g *promptGroup) fail(code int, data []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.data == nil {
+		g.code, g.data = code, data
+		g.cancel()
+	}
+}
+
+// promptWriter is the response writer of one prompt of a request with several
+// prompts. It keeps the status and headers of the prompt to itself and
+// serializes writes to the response.
+type promptWriter struct {
+	gin.ResponseWriter
+	group  *promptGroup
+	header http.Header
+	status int
+	size   int
+}
+
+func (w *promptWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *promptWriter) WriteHeader(code int) {
+	if code > 0 && w.size == 0 {
+		w.status = code
+	}
+}
+
+func (w *promptWriter) WriteHeaderNow() {}
+
+func (w *promptWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+func (w *promptWriter) Size() int {
+	return w.size
+}
+
+func (w *promptWriter) Written() bool {
+	return w.size > 0
+}
+
+func (w *promptWriter) Write(data []byte) (int, error) {
+	w.group.mu.Lock()
+	defer w.group.mu.Unlock()
+
+	if !w.group.written {
+		w.group.w.Header().Set("Content-Type", w.header.Get("Content-Type"))
+		w.group.written = true
+	}
+
+	n, err := w.group.w.Write(data)
+	w.size += n
+	return n, err
+}
+
+func (w *promptWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *promptWriter) Flush() {
+	w.group.mu.Lock()
+	defer w.group.mu.Unlock()
+	w.group.w.Flush()
+}
+
+// PromptWriter is implemented by the writer of a middleware that runs after
+// [CompletionsMiddleware] and wraps the response, such as one that inspects
+// the native frames. Each prompt of a request with several prompts writes
+// through its own writer from Prompt, which is closed once the prompt has
+// finished.
+type PromptWriter interface {
+	gin.ResponseWriter
+	Prompt(w gin.ResponseWriter) PromptWriter
+	Close() error
+}
+
+func includeUsage(o *StreamOptions) bool {
+	return o != nil && o.IncludeUsage
+}
+
+func (w *ChatWriter) setChoice(index int) {
+	w.choiceState.setChoice(index)
+	w.toolCalls = false
+}
+
+func (w *CompleteWriter) setChoice(index int) {
+	w.choiceState.setChoice(index)
+	w.offset = 0
+}
+
 type ListWriter struct {
 	BaseWriter
+	show func(string) (api.ShowResponse, error)
 }
 
 type RetrieveWriter struct {
@@ -566,6 +1277,11 @@ type RetrieveWriter struct {
 	model string
 }
 
+type DeleteWriter struct {
+	BaseWriter
+	model string
+}
+
 type EmbedWriter struct {
 	BaseWriter
 	model string
@@ -575,7 +1291,15 @@ func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
 	var serr api.StatusError
 	err := json.Unmarshal(data, &serr)
 	if err != nil {
-		return 0, err
+		// errors already in the compatible format, such as those of the
+		// API key and limit checks, are written as is
+		var e ErrorResponse
+		if json.Unmarshal(data, &e) != nil || e.Error.Message == "" {
+			return 0, err
+		}
+
+		w.ResponseWriter.Header().Set("Content-Type", "application/json")
+		return w.ResponseWriter.Write(data)
 	}
 
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
@@ -587,6 +1311,38 @@ func (w *BaseWriter) writeError(code int, data []byte) (int, error) {
 	return len(data), nil
 }
 
+// isStreamError reports whether data is an error reported in the body of a
+// response that has already started with a 200, such as a failure to schedule
+// the request after queued status frames were streamed
+func isStreamError(data []byte) bool {
+	var serr api.StatusError
+	return json.Unmarshal(data, &serr) == nil && serr.ErrorMessage != ""
+}
+
+// writeStreamError writes an error from the body of a response that has
+// already started with a 200
+func (w *BaseWriter) writeStreamError(data []byte) error {
+	var serr api.StatusError
+	if err := json.Unmarshal(data, &serr); err != nil {
+		return err
+	}
+
+	if !w.ResponseWriter.Written() {
+		w.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+		_, err := w.writeError(http.StatusInternalServerError, data)
+		return err
+	}
+
+	// the stream has started, so it ends with the error instead
+	d, err := json.Marshal(NewError(http.StatusInternalServerError, serr.Error()))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+	return err
+}
+
 func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 	var chatResponse api.ChatResponse
 	err := json.Unmarshal(data, &chatResponse)
@@ -594,9 +1350,24 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 
+	// queued status frames have nothing to translate
+	if chatResponse.Queued != nil {
+		return len(data), nil
+	}
+
 	// chat chunk
 	if w.stream {
-		d, err := json.Marshal(toChunk(w.id, chatResponse))
+		chunk := toChunk(w.id, chatResponse)
+		chunk.Choices[0].Index = w.index
+		if len(chunk.Choices[0].Delta.ToolCalls) > 0 {
+			w.toolCalls = true
+		}
+
+		if chatResponse.Done && w.toolCalls {
+			reason := "tool_calls"
+			chunk.Choices[0].FinishReason = &reason
+		}
+		d, err := json.Marshal(chunk)
 		if err != nil {
 			return 0, err
 		}
@@ -608,6 +1379,30 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 		}
 
 		if chatResponse.Done {
+			w.addUsage(chatResponse.Metrics)
+		}
+
+		if chatResponse.Done && w.last() {
+			if includeUsage(w.streamOptions) {
+				d, err := json.Marshal(ChatCompletionChunk{
+					Id:                w.id,
+					Object:            "chat.completion.chunk",
+					Created:           time.Now().Unix(),
+					Model:             chatResponse.Model,
+					SystemFingerprint: "fp_ollama",
+					Choices:           []ChunkChoice{},
+					Usage:             &w.usage,
+				})
+				if err != nil {
+					return 0, err
+				}
+
+				_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+				if err != nil {
+					return 0, err
+				}
+			}
+
 			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
 			if err != nil {
 				return 0, err
@@ -618,8 +1413,23 @@ func (w *ChatWriter) writeResponse(data []byte) (int, error) {
 	}
 
 	// chat completion
+	completion := toChatCompletion(w.id, chatResponse)
+	completion.Choices[0].Index = w.index
+	if w.completion == nil {
+		w.completion = &completion
+	} else {
+		// every choice evaluates the same prompt
+		w.completion.Choices = append(w.completion.Choices, completion.Choices...)
+		w.completion.Usage.CompletionTokens += completion.Usage.CompletionTokens
+		w.completion.Usage.TotalTokens += completion.Usage.CompletionTokens
+	}
+
+	if !w.last() {
+		return len(data), nil
+	}
+
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toChatCompletion(w.id, chatResponse))
+	err = json.NewEncoder(w.ResponseWriter).Encode(w.completion)
 	if err != nil {
 		return 0, err
 	}
@@ -633,6 +1443,14 @@ func (w *ChatWriter) Write(data []byte) (int, error) {
 		return w.writeError(code, data)
 	}
 
+	if isStreamError(data) {
+		if err := w.writeStreamError(data); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
 	return w.writeResponse(data)
 }
 
@@ -643,9 +1461,26 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		return 0, err
 	}
 
+	// queued status frames have nothing to translate
+	if generateResponse.Queued != nil {
+		return len(data), nil
+	}
+
+	// choices are numbered by prompt, then by choice within the prompt
+	index := w.prompt*w.n + w.index
+
 	// completion chunk
 	if w.stream {
-		d, err := json.Marshal(toCompleteChunk(w.id, generateResponse))
+		chunk := toCompleteChunk(w.id, generateResponse)
+		chunk.Choices[0].Index = index
+		if logprobs := chunk.Choices[0].Logprobs; logprobs != nil {
+			for i := range logprobs.TextOffset {
+				logprobs.TextOffset[i] += w.offset
+			}
+		}
+
+		w.offset += len(generateResponse.Response)
+		d, err := json.Marshal(chunk)
 		if err != nil {
 			return 0, err
 		}
@@ -657,8 +1492,16 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 		}
 
 		if generateResponse.Done {
-			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
-			if err != nil {
+			w.addUsage(generateResponse.Metrics)
+		}
+
+		if generateResponse.Done && w.last() {
+			if w.group != nil {
+				w.group.addUsage(generateResponse.Model, w.usage)
+				return len(data), nil
+			}
+
+			if err := w.writeDone(generateResponse.Model, w.usage); err != nil {
 				return 0, err
 			}
 		}
@@ -667,8 +1510,28 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 	}
 
 	// completion
+	completion := toCompletion(w.id, generateResponse)
+	completion.Choices[0].Index = index
+	if w.completion == nil {
+		w.completion = &completion
+	} else {
+		// every choice evaluates the same prompt
+		w.completion.Choices = append(w.completion.Choices, completion.Choices...)
+		w.completion.Usage.CompletionTokens += completion.Usage.CompletionTokens
+		w.completion.Usage.TotalTokens += completion.Usage.CompletionTokens
+	}
+
+	if !w.last() {
+		return len(data), nil
+	}
+
+	if w.group != nil {
+		w.group.addCompletion(w.completion)
+		return len(data), nil
+	}
+
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toCompletion(w.id, generateResponse))
+	err = json.NewEncoder(w.ResponseWriter).Encode(w.completion)
 	if err != nil {
 		return 0, err
 	}
@@ -676,12 +1539,56 @@ func (w *CompleteWriter) writeResponse(data []byte) (int, error) {
 	return len(data), nil
 }
 
+// writeDone ends a stream with the usage of the request, if asked for
+func (w *CompleteWriter) writeDone(model string, usage Usage) error {
+	if includeUsage(w.streamOptions) {
+		d, err := json.Marshal(CompletionChunk{
+			Id:                w.id,
+			Object:            "text_completion",
+			Created:           time.Now().Unix(),
+			Model:             model,
+			SystemFingerprint: "fp_ollama",
+			Choices:           []CompleteChunkChoice{},
+			Usage:             &usage,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
+	return err
+}
+
 func (w *CompleteWriter) Write(data []byte) (int, error) {
 	code := w.ResponseWriter.Status()
 	if code != http.StatusOK {
+		if w.group != nil {
+			w.group.fail(code, data)
+			return len(data), nil
+		}
+
 		return w.writeError(code, data)
 	}
 
+	if isStreamError(data) {
+		if w.group != nil {
+			w.group.fail(http.StatusInternalServerError, data)
+			return len(data), nil
+		}
+
+		if err := w.writeStreamError(data); err != nil {
+			return 0, err
+		}
+
+		return len(data), nil
+	}
+
 	return w.writeResponse(data)
 }
 
@@ -693,7 +1600,7 @@ func (w *ListWriter) writeResponse(data []byte) (int, error) {
 	}
 
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(toListCompletion(listResponse))
+	err = json.NewEncoder(w.ResponseWriter).Encode(toListCompletion(listResponse, w.show))
 	if err != nil {
 		return 0, err
 	}
@@ -736,6 +1643,26 @@ func (w *RetrieveWriter) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
+func (w *DeleteWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return len(data), nil
+}
+
+// writeDeleted writes the deleted model since the delete handler doesn't
+// write a response body when it succeeds
+func (w *DeleteWriter) writeDeleted() error {
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w.ResponseWriter).Encode(DeletedModel{
+		Id:      w.model,
+		Object:  "model",
+		Deleted: true,
+	})
+}
+
 func (w *EmbedWriter) writeResponse(data []byte) (int, error) {
 	var embedResponse api.EmbedResponse
 	err := json.Unmarshal(data, &embedResponse)
@@ -761,10 +1688,14 @@ func (w *EmbedWriter) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
-func ListMiddleware() gin.HandlerFunc {
+// ListMiddleware translates the model list. show looks up the details of
+// each model so that entries carry the same metadata as a retrieved model;
+// without it entries only have what the list itself holds.
+func ListMiddleware(show func(model string) (api.ShowResponse, error)) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		w := &ListWriter{
 			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			show:       show,
 		}
 
 		c.Writer = w
@@ -795,6 +1726,33 @@ func RetrieveMiddleware() gin.HandlerFunc {
 	}
 }
 
+func DeleteMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(api.DeleteRequest{Model: c.Param("model")}); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &DeleteWriter{
+			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
+			model:      c.Param("model"),
+		}
+
+		c.Writer = w
+
+		c.Next()
+
+		if !w.ResponseWriter.Written() {
+			if err := w.writeDeleted(); err != nil {
+				slog.Error("failed to write deleted model", "model", w.model, "error", err)
+			}
+		}
+	}
+}
+
 func CompletionsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req CompletionRequest
@@ -804,27 +1762,39 @@ func CompletionsMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		var b bytes.Buffer
-		genReq, err := fromCompleteRequest(req)
+		genReqs, err := fromCompleteRequest(req)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
 			return
 		}
 
-		if err := json.NewEncoder(&b).Encode(genReq); err != nil {
-			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
-			return
+		bodies := make([][]byte, len(genReqs))
+		for i, genReq := range genReqs {
+			bodies[i], err = json.Marshal(genReq)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+				return
+			}
 		}
 
-		c.Request.Body = io.NopCloser(&b)
+		// the request body is the first prompt, and [Choices] runs the rest
+		c.Request.Body = io.NopCloser(bytes.NewReader(bodies[0]))
 
 		w := &CompleteWriter{
-			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
-			stream:     req.Stream,
-			id:         fmt.Sprintf("cmpl-%d", rand.Intn(999)),
+			BaseWriter:    BaseWriter{ResponseWriter: c.Writer},
+			stream:        req.Stream,
+			streamOptions: req.StreamOptions,
+			id:            fmt.Sprintf("cmpl-%d", rand.Intn(999)),
+			choiceState:   choiceState{n: 1},
+			prompts:       bodies[1:],
+		}
+
+		if req.N != nil {
+			w.n = *req.N
 		}
 
 		c.Writer = w
+		c.Set(choicesKey, w)
 		c.Next()
 	}
 }
@@ -901,13 +1871,189 @@ func ChatMiddleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &ChatWriter{
-			BaseWriter: BaseWriter{ResponseWriter: c.Writer},
-			stream:     req.Stream,
-			id:         fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			BaseWriter:    BaseWriter{ResponseWriter: c.Writer},
+			stream:        req.Stream,
+			streamOptions: req.StreamOptions,
+			id:            fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			choiceState:   choiceState{n: 1},
+		}
+
+		if req.N != nil {
+			w.n = *req.N
 		}
 
 		c.Writer = w
+		c.Set(choicesKey, w)
 
 		c.Next()
 	}
 }
+
+// Choices runs h once for each choice a request asks for with n, replaying
+// the request body each time. The prompts of a completion request with
+// several prompts run concurrently, each generating its choices in turn. It
+// wraps the handler following [ChatMiddleware] or [CompletionsMiddleware].
+func Choices(h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		v, _ := c.Get(choicesKey)
+		if w, ok := v.(*CompleteWriter); ok && len(w.prompts) > 0 {
+			runPrompts(c, h, w)
+			return
+		}
+
+		w, ok := v.(choiceWriter)
+		if !ok {
+			h(c)
+			return
+		}
+
+		runChoices(c, h, w)
+	}
+}
+
+func runChoices(c *gin.Context, h gin.HandlerFunc, w choiceWriter) {
+	if w.choices() <= 1 {
+		h(c)
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// a copy of c for a prompt of the request starts out aborted, so only
+	// its status and context stop it
+	aborted := c.IsAborted()
+	for i := range w.choices() {
+		w.setChoice(i)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		h(c)
+		if (c.IsAborted() && !aborted) || c.Writer.Status() >= http.StatusBadRequest || c.Request.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+// runPrompts runs the choices of every prompt of a completion request, each
+// prompt with a copy of c and a writer of its own, and writes the combined
+// response once they have all finished
+func runPrompts(c *gin.Context, h gin.HandlerFunc, w *CompleteWriter) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	g := &promptGroup{w: w.ResponseWriter, cancel: cancel}
+	bodies := append([][]byte{body}, w.prompts...)
+
+	// the first prompt runs with c itself, so that what the handler records
+	// in c is seen by the middleware before it
+	contexts := make([]*gin.Context, len(bodies))
+	for i := range bodies {
+		contexts[i] = c
+		if i > 0 {
+			contexts[i] = c.Copy()
+		}
+	}
+
+	request, writer := c.Request, c.Writer
+	defer func() {
+		c.Request, c.Writer = request, writer
+	}()
+
+	writers := make([]*CompleteWriter, len(bodies))
+	for i, pc := range contexts {
+		pw := &CompleteWriter{
+			BaseWriter:    BaseWriter{ResponseWriter: &promptWriter{ResponseWriter: w.ResponseWriter, group: g, header: make(http.Header)}},
+			stream:        w.stream,
+			streamOptions: w.streamOptions,
+			id:            w.id,
+			choiceState:   choiceState{n: w.n},
+			prompt:        i,
+			group:         g,
+		}
+
+		pc.Request = request.Clone(ctx)
+		pc.Request.Body = io.NopCloser(bytes.NewReader(bodies[i]))
+		pc.Writer = pw
+		// middleware after this one wrapped the writer of the request, so it
+		// wraps the writer of each prompt as well
+		if mw, ok := writer.(PromptWriter); ok {
+			pc.Writer = mw.Prompt(pw)
+		}
+
+		pc.Set(choicesKey, pw)
+		writers[i] = pw
+	}
+
+	run := func(c *gin.Context, w *CompleteWriter) {
+		runChoices(c, h, w)
+		if pw, ok := c.Writer.(PromptWriter); ok {
+			if err := pw.Close(); err != nil {
+				slog.Error("failed to close prompt writer", "error", err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i < len(contexts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(contexts[i], writers[i])
+		}()
+	}
+
+	run(c, writers[0])
+	wg.Wait()
+
+	if err := w.writePrompts(g); err != nil {
+		slog.Error("failed to write completion", "error", err)
+	}
+}
+
+// writePrompts writes the combined response of the prompts of a request
+func (w *CompleteWriter) writePrompts(g *promptGroup) error {
+	if g.data != nil {
+		if g.written {
+			// the stream has started, so it ends with the error instead
+			var serr api.StatusError
+			if err := json.Unmarshal(g.data, &serr); err != nil {
+				return err
+			}
+
+			d, err := json.Marshal(NewError(http.StatusInternalServerError, serr.Error()))
+			if err != nil {
+				return err
+			}
+
+			_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+			return err
+		}
+
+		w.ResponseWriter.WriteHeader(g.code)
+		_, err := w.writeError(g.code, g.data)
+		return err
+	}
+
+	if w.stream {
+		return w.writeDone(g.model, g.usage)
+	}
+
+	if g.completion == nil {
+		return nil
+	}
+
+	slices.SortFunc(g.completion.Choices, func(a, b CompleteChunkChoice) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w.ResponseWriter).Encode(g.completion)
+}
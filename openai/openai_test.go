@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -155,6 +156,188 @@ func TestChatMiddleware(t *testing.T) {
 			},
 		},
 
+		{
+			name: "chat handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"n": 2,
+				"logprobs": true,
+				"top_logprobs": 3
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 3,
+			},
+		},
+		{
+			name: "chat handler with prompt cache key",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "system", "content": "You are a helpful assistant."},
+					{"role": "user", "content": "Hello"}
+				],
+				"prompt_cache_key": "assistant"
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{Role: "system", Content: "You are a helpful assistant."},
+					{Role: "user", Content: "Hello"},
+				},
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+				Cache:  "assistant",
+			},
+		},
+		{
+			name: "chat handler with json schema",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"response_format": {
+					"type": "json_schema",
+					"json_schema": {
+						"name": "greeting",
+						"schema": {"type": "object", "properties": {"greeting": {"type": "string"}}}
+					}
+				}
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "Hello",
+					},
+				},
+				Format: json.RawMessage(`{"type":"object","properties":{"greeting":{"type":"string"}}}`),
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler json schema without schema",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"response_format": {"type": "json_schema", "json_schema": {"name": "greeting"}}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "response_format.json_schema.schema is required",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler with named tool choice",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "What's the weather like in Paris Today?"}
+				],
+				"tools": [
+					{"type": "function", "function": {"name": "get_current_weather"}},
+					{"type": "function", "function": {"name": "get_current_time"}}
+				],
+				"tool_choice": {"type": "function", "function": {"name": "get_current_time"}},
+				"parallel_tool_calls": false
+			}`,
+			req: api.ChatRequest{
+				Model: "test-model",
+				Messages: []api.Message{
+					{
+						Role:    "user",
+						Content: "What's the weather like in Paris Today?",
+					},
+				},
+				Tools:             []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "get_current_time"}}},
+				ToolChoice:        "required",
+				ParallelToolCalls: &False,
+				Options: map[string]any{
+					"temperature": 1.0,
+					"top_p":       1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "chat handler with unknown tool choice",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"tools": [
+					{"type": "function", "function": {"name": "get_current_weather"}}
+				],
+				"tool_choice": {"type": "function", "function": {"name": "get_current_time"}}
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "tool_choice function \"get_current_time\" is not in tools",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler top_logprobs without logprobs",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"top_logprobs": 3
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "logprobs must be true when top_logprobs is set",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "chat handler invalid n",
+			body: `{
+				"model": "test-model",
+				"messages": [
+					{"role": "user", "content": "Hello"}
+				],
+				"n": 0
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "n must be between 1 and 128",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "chat handler error forwarding",
 			body: `{
@@ -241,6 +424,124 @@ func TestCompletionsMiddleware(t *testing.T) {
 				Stream: &False,
 			},
 		},
+		{
+			name: "completions handler with logprobs",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logprobs": 2
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream:      &False,
+				Logprobs:    true,
+				TopLogprobs: 2,
+			},
+		},
+		{
+			name: "completions handler with logit bias",
+			body: `{
+				"model": "test-model",
+				"prompt": "Hello",
+				"logit_bias": {"15043": -100, "29871": 2.5}
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+					"logit_bias":        map[string]any{"15043": -100.0, "29871": 2.5},
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "completions handler with prompts",
+			body: `{
+				"model": "test-model",
+				"prompt": ["Hello", [1, 2]]
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Prompt: "Hello",
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "completions handler with tokens",
+			body: `{
+				"model": "test-model",
+				"prompt": [1, 2, 3]
+			}`,
+			req: api.GenerateRequest{
+				Model:  "test-model",
+				Tokens: []int{1, 2, 3},
+				Raw:    true,
+				Options: map[string]any{
+					"frequency_penalty": 0.0,
+					"presence_penalty":  0.0,
+					"temperature":       1.0,
+					"top_p":             1.0,
+				},
+				Stream: &False,
+			},
+		},
+		{
+			name: "completions handler with invalid tokens",
+			body: `{
+				"model": "test-model",
+				"prompt": [[1, 2.5]]
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "invalid token in 'prompt' field: 2.5",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "completions handler with empty prompts",
+			body: `{
+				"model": "test-model",
+				"prompt": []
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "prompt must not be empty",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
+		{
+			name: "completions handler with too many choices",
+			body: `{
+				"model": "test-model",
+				"prompt": ["a", "b", "c"],
+				"n": 50
+			}`,
+			err: ErrorResponse{
+				Error: Error{
+					Message: "prompt and n must request at most 128 choices, got 150",
+					Type:    "invalid_request_error",
+				},
+			},
+		},
 		{
 			name: "completions handler error forwarding",
 			body: `{
@@ -428,7 +729,7 @@ func TestListMiddleware(t *testing.T) {
 
 	for _, tc := range testCases {
 		router := gin.New()
-		router.Use(ListMiddleware())
+		router.Use(ListMiddleware(nil))
 		router.Handle(http.MethodGet, "/api/tags", tc.endpoint)
 		req, _ := http.NewRequest(http.MethodGet, "/api/tags", nil)
 
@@ -474,6 +775,35 @@ func TestRetrieveMiddleware(t *testing.T) {
 				"owned_by":"library"}
 			`,
 		},
+		{
+			name: "retrieve handler with metadata",
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusOK, api.ShowResponse{
+					ModifiedAt: time.Unix(int64(1686935002), 0).UTC(),
+					Details: api.ModelDetails{
+						Family:            "llama",
+						ParameterSize:     "8.0B",
+						QuantizationLevel: "Q4_0",
+					},
+					ModelInfo: map[string]any{
+						"general.architecture": "llama",
+						"llama.context_length": 8192,
+					},
+					Capabilities: []string{"completion", "tools"},
+				})
+			},
+			resp: `{
+				"id":"test-model",
+				"object":"model",
+				"created":1686935002,
+				"owned_by":"library",
+				"context_length":8192,
+				"family":"llama",
+				"parameter_size":"8.0B",
+				"quantization":"Q4_0",
+				"capabilities":["completion","tools"]}
+			`,
+		},
 		{
 			name: "retrieve handler error forwarding",
 			endpoint: func(c *gin.Context) {
@@ -517,3 +847,616 @@ func TestRetrieveMiddleware(t *testing.T) {
 		}
 	}
 }
+
+func TestDeleteMiddleware(t *testing.T) {
+	type testCase struct {
+		name     string
+		endpoint func(c *gin.Context)
+		code     int
+		resp     string
+	}
+
+	testCases := []testCase{
+		{
+			name: "delete handler",
+			endpoint: func(c *gin.Context) {
+				var req api.DeleteRequest
+				if err := c.ShouldBindJSON(&req); err != nil || req.Model != "test-model" {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "unexpected request"})
+				}
+			},
+			code: http.StatusOK,
+			resp: `{"id":"test-model","object":"model","deleted":true}`,
+		},
+		{
+			name: "delete handler error forwarding",
+			endpoint: func(c *gin.Context) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "model 'test-model' not found"})
+			},
+			code: http.StatusNotFound,
+			resp: `{
+				"error": {
+				  "code": null,
+				  "message": "model 'test-model' not found",
+				  "param": null,
+				  "type": "api_error"
+				}
+			}`,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(DeleteMiddleware())
+			router.Handle(http.MethodDelete, "/api/delete/:model", tc.endpoint)
+			req, _ := http.NewRequest(http.MethodDelete, "/api/delete/test-model", nil)
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+
+			if resp.Code != tc.code {
+				t.Errorf("expected status %d, got %d", tc.code, resp.Code)
+			}
+
+			var expected, actual map[string]any
+			if err := json.Unmarshal([]byte(tc.resp), &expected); err != nil {
+				t.Fatalf("failed to unmarshal expected response: %v", err)
+			}
+
+			if err := json.Unmarshal(resp.Body.Bytes(), &actual); err != nil {
+				t.Fatalf("failed to unmarshal actual response: %v", err)
+			}
+
+			if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("responses did not match\nExpected: %+v\nActual: %+v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestChoices(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	logprobs := []api.TokenLogprob{{
+		Token:       "Hi",
+		Logprob:     -0.5,
+		TopLogprobs: []api.Logprob{{Token: "Hi", Logprob: -0.5}, {Token: `byte: \xe2`, Logprob: -1}},
+	}}
+
+	var calls int
+	router := gin.New()
+	router.POST("/v1/chat/completions", ChatMiddleware(), Choices(func(c *gin.Context) {
+		var req api.ChatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		calls++
+		resp := api.ChatResponse{
+			Model:      req.Model,
+			Message:    api.Message{Role: "assistant", Content: "Hi"},
+			Logprobs:   logprobs,
+			Done:       true,
+			DoneReason: "stop",
+			Metrics:    api.Metrics{PromptEvalCount: 10, EvalCount: 1},
+		}
+
+		if *req.Stream {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+			return
+		}
+
+		c.JSON(http.StatusOK, resp)
+	}))
+	router.POST("/v1/completions", CompletionsMiddleware(), Choices(func(c *gin.Context) {
+		c.JSON(http.StatusOK, api.GenerateResponse{Response: "Hi", Logprobs: logprobs, Done: true})
+	}))
+
+	t.Run("chat", func(t *testing.T) {
+		calls = 0
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model": "test", "n": 2, "logprobs": true, "top_logprobs": 2, "messages": [{"role": "user", "content": "Hello"}]}`)))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.Code)
+		}
+
+		var completion ChatCompletion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls != 2 || len(completion.Choices) != 2 {
+			t.Fatalf("expected 2 choices from 2 calls, got %d from %d", len(completion.Choices), calls)
+		}
+
+		for i, choice := range completion.Choices {
+			if choice.Index != i {
+				t.Errorf("expected index %d, got %d", i, choice.Index)
+			}
+		}
+
+		if completion.Usage != (Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}) {
+			t.Errorf("unexpected usage %+v", completion.Usage)
+		}
+
+		expect := &ChoiceLogprobs{Content: []TokenLogprob{{
+			Token:   "Hi",
+			Logprob: -0.5,
+			Bytes:   []int{'H', 'i'},
+			TopLogprobs: []TopLogprob{
+				{Token: "Hi", Logprob: -0.5, Bytes: []int{'H', 'i'}},
+				{Token: `byte: \xe2`, Logprob: -1, Bytes: []int{0xe2}},
+			},
+		}}}
+		if !reflect.DeepEqual(completion.Choices[1].Logprobs, expect) {
+			t.Errorf("unexpected logprobs %+v", completion.Choices[1].Logprobs)
+		}
+	})
+
+	t.Run("chat stream", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model": "test", "n": 3, "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`)))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.Code)
+		}
+
+		var indexes []int
+		events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+		for _, event := range events[:len(events)-1] {
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+				t.Fatal(err)
+			}
+
+			indexes = append(indexes, chunk.Choices[0].Index)
+		}
+
+		if !reflect.DeepEqual(indexes, []int{0, 1, 2}) || events[len(events)-1] != "data: [DONE]" {
+			t.Errorf("unexpected events %q", events)
+		}
+	})
+
+	t.Run("completions", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"model": "test", "prompt": "Hello", "logprobs": 2}`)))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.Code)
+		}
+
+		var completion Completion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+
+		expect := &CompletionLogprobs{
+			Tokens:        []string{"Hi"},
+			TokenLogprobs: []float64{-0.5},
+			TopLogprobs:   []map[string]float64{{"Hi": -0.5, `byte: \xe2`: -1}},
+			TextOffset:    []int{0},
+		}
+		if len(completion.Choices) != 1 || !reflect.DeepEqual(completion.Choices[0].Logprobs, expect) {
+			t.Errorf("unexpected choices %+v", completion.Choices)
+		}
+	})
+}
+
+func TestCompletionPrompts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/v1/completions", CompletionsMiddleware(), Choices(func(c *gin.Context) {
+		var req api.GenerateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.Prompt == "missing" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+
+		text := req.Prompt
+		if req.Tokens != nil {
+			text = fmt.Sprint(req.Tokens)
+		}
+
+		metrics := api.Metrics{PromptEvalCount: 10, EvalCount: 1}
+		if !*req.Stream {
+			c.JSON(http.StatusOK, api.GenerateResponse{Model: req.Model, Response: text, Done: true, DoneReason: "stop", Metrics: metrics})
+			return
+		}
+
+		for _, resp := range []api.GenerateResponse{
+			{Model: req.Model, Response: text},
+			{Model: req.Model, Done: true, DoneReason: "stop", Metrics: metrics},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+
+	texts := []string{"a", "a", "b", "b", "[1 2]", "[1 2]"}
+
+	t.Run("completions", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"model": "test", "prompt": ["a", "b", [1, 2]], "n": 2}`)))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.Code)
+		}
+
+		var completion Completion
+		if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(completion.Choices) != len(texts) {
+			t.Fatalf("expected %d choices, got %d", len(texts), len(completion.Choices))
+		}
+
+		for i, choice := range completion.Choices {
+			if choice.Index != i || choice.Text != texts[i] {
+				t.Errorf("expected choice %d to be %q, got %d %q", i, texts[i], choice.Index, choice.Text)
+			}
+		}
+
+		if completion.Usage != (Usage{PromptTokens: 30, CompletionTokens: 6, TotalTokens: 36}) {
+			t.Errorf("unexpected usage %+v", completion.Usage)
+		}
+	})
+
+	t.Run("completions stream", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"model": "test", "prompt": ["a", "b", [1, 2]], "n": 2, "stream": true, "stream_options": {"include_usage": true}}`)))
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.Code)
+		}
+
+		events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+		if events[len(events)-1] != "data: [DONE]" {
+			t.Fatalf("expected the last event to be [DONE], got %q", events[len(events)-1])
+		}
+
+		var usage CompletionChunk
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(events[len(events)-2], "data: ")), &usage); err != nil {
+			t.Fatal(err)
+		}
+
+		if usage.Usage == nil || *usage.Usage != (Usage{PromptTokens: 30, CompletionTokens: 6, TotalTokens: 36}) {
+			t.Errorf("unexpected usage %+v", usage.Usage)
+		}
+
+		got := make([]string, len(texts))
+		for _, event := range events[:len(events)-2] {
+			var chunk CompletionChunk
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+				t.Fatal(err)
+			}
+
+			got[chunk.Choices[0].Index] += chunk.Choices[0].Text
+		}
+
+		if !reflect.DeepEqual(got, texts) {
+			t.Errorf("expected choices %q, got %q", texts, got)
+		}
+	})
+
+	t.Run("completions error", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"model": "test", "prompt": ["a", "missing"]}`)))
+		if resp.Code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", resp.Code)
+		}
+
+		var errResp ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
+			t.Fatal(err)
+		}
+
+		if errResp.Error.Message != "not found" {
+			t.Errorf("unexpected error %+v", errResp)
+		}
+	})
+}
+
+func TestStreamUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	metrics := api.Metrics{PromptEvalCount: 10, EvalCount: 3}
+	router := gin.New()
+	router.POST("/v1/chat/completions", ChatMiddleware(), Choices(func(c *gin.Context) {
+		for _, resp := range []api.ChatResponse{
+			{Model: "test", Message: api.Message{Role: "assistant", Content: "Hi"}},
+			{Model: "test", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop", Metrics: metrics},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+	router.POST("/v1/completions", CompletionsMiddleware(), Choices(func(c *gin.Context) {
+		for _, resp := range []api.GenerateResponse{
+			{Model: "test", Response: "Hi"},
+			{Model: "test", Done: true, DoneReason: "stop", Metrics: metrics},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+
+	cases := []struct {
+		name  string
+		path  string
+		body  string
+		usage *Usage
+	}{
+		{
+			name:  "chat",
+			path:  "/v1/chat/completions",
+			body:  `{"model": "test", "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "Hello"}]}`,
+			usage: &Usage{PromptTokens: 10, CompletionTokens: 3, TotalTokens: 13},
+		},
+		{
+			name:  "chat choices",
+			path:  "/v1/chat/completions",
+			body:  `{"model": "test", "n": 2, "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "Hello"}]}`,
+			usage: &Usage{PromptTokens: 10, CompletionTokens: 6, TotalTokens: 16},
+		},
+		{
+			name: "chat without usage",
+			path: "/v1/chat/completions",
+			body: `{"model": "test", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`,
+		},
+		{
+			name:  "completions",
+			path:  "/v1/completions",
+			body:  `{"model": "test", "prompt": "Hello", "stream": true, "stream_options": {"include_usage": true}}`,
+			usage: &Usage{PromptTokens: 10, CompletionTokens: 3, TotalTokens: 13},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.Code)
+			}
+
+			events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+			if events[len(events)-1] != "data: [DONE]" {
+				t.Fatalf("expected the last event to be [DONE], got %q", events[len(events)-1])
+			}
+
+			var usage *Usage
+			for i, event := range events[:len(events)-1] {
+				var chunk struct {
+					Choices []json.RawMessage `json:"choices"`
+					Usage   *Usage            `json:"usage"`
+				}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+					t.Fatal(err)
+				}
+
+				if chunk.Usage != nil && (i != len(events)-2 || len(chunk.Choices) != 0) {
+					t.Errorf("expected usage only in a final chunk without choices, got %q", event)
+				}
+
+				usage = chunk.Usage
+			}
+
+			if !reflect.DeepEqual(usage, tt.usage) {
+				t.Errorf("expected usage %+v, got %+v", tt.usage, usage)
+			}
+		})
+	}
+}
+
+func TestStreamQueued(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	queued := &api.QueueStatus{Position: 1, ExpectedWait: time.Second}
+	router := gin.New()
+	router.POST("/v1/chat/completions", ChatMiddleware(), Choices(func(c *gin.Context) {
+		for _, resp := range []api.ChatResponse{
+			{Model: "test", Queued: queued},
+			{Model: "test", Message: api.Message{Role: "assistant", Content: "Hi"}},
+			{Model: "test", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop"},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+	router.POST("/v1/completions", CompletionsMiddleware(), Choices(func(c *gin.Context) {
+		for _, resp := range []api.GenerateResponse{
+			{Model: "test", Queued: queued},
+			{Model: "test", Response: "Hi"},
+			{Model: "test", Done: true, DoneReason: "stop"},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+
+	cases := map[string]string{
+		"/v1/chat/completions": `{"model": "test", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`,
+		"/v1/completions":      `{"model": "test", "prompt": "Hello", "stream": true}`,
+	}
+
+	for path, body := range cases {
+		t.Run(path, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.Code)
+			}
+
+			// the queued frame doesn't produce a chunk
+			events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+			if len(events) != 3 {
+				t.Fatalf("expected 3 events, got %d: %q", len(events), events)
+			}
+
+			if !strings.Contains(events[0], `"Hi"`) {
+				t.Errorf("expected the first chunk to hold the content, got %q", events[0])
+			}
+		})
+	}
+}
+
+func TestStreamQueuedError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	queued := &api.QueueStatus{Position: 1, ExpectedWait: time.Second}
+	router := gin.New()
+	router.POST("/v1/chat/completions", ChatMiddleware(), Choices(func(c *gin.Context) {
+		for _, resp := range []any{
+			api.ChatResponse{Model: "test", Queued: queued},
+			api.ChatResponse{Model: "test", Message: api.Message{Role: "assistant", Content: "Hi"}},
+			gin.H{"error": "boom"},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+	router.POST("/v1/completions", CompletionsMiddleware(), Choices(func(c *gin.Context) {
+		for _, resp := range []any{
+			api.GenerateResponse{Model: "test", Queued: queued},
+			api.GenerateResponse{Model: "test", Response: "Hi"},
+			gin.H{"error": "boom"},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+
+	cases := map[string]string{
+		"/v1/chat/completions": `{"model": "test", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`,
+		"/v1/completions":      `{"model": "test", "prompt": "Hello", "stream": true}`,
+	}
+
+	for path, body := range cases {
+		t.Run(path, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", resp.Code)
+			}
+
+			// the stream ends with the error rather than an empty chunk
+			events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+			if len(events) != 2 {
+				t.Fatalf("expected 2 events, got %d: %q", len(events), events)
+			}
+
+			var errResp ErrorResponse
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(events[1], "data: ")), &errResp); err != nil {
+				t.Fatal(err)
+			}
+
+			if errResp.Error.Message != "boom" {
+				t.Errorf("expected error %q, got %q", "boom", errResp.Error.Message)
+			}
+		})
+	}
+
+	t.Run("before the stream", func(t *testing.T) {
+		router := gin.New()
+		router.POST("/v1/chat/completions", ChatMiddleware(), Choices(func(c *gin.Context) {
+			for _, resp := range []any{
+				api.ChatResponse{Model: "test", Queued: queued},
+				gin.H{"error": "boom"},
+			} {
+				bts, _ := json.Marshal(resp)
+				c.Writer.Write(append(bts, '\n'))
+			}
+		}))
+
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(cases["/v1/chat/completions"])))
+		if resp.Code != http.StatusInternalServerError {
+			t.Fatalf("expected status 500, got %d", resp.Code)
+		}
+
+		var errResp ErrorResponse
+		if err := json.Unmarshal(resp.Body.Bytes(), &errResp); err != nil {
+			t.Fatal(err)
+		}
+
+		if errResp.Error.Message != "boom" {
+			t.Errorf("expected error %q, got %q", "boom", errResp.Error.Message)
+		}
+	})
+}
+
+func TestStreamToolCalls(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/v1/chat/completions", ChatMiddleware(), Choices(func(c *gin.Context) {
+		for _, resp := range []api.ChatResponse{
+			{Model: "test", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{Name: "get_weather"}}}}},
+			{Model: "test", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{{Function: api.ToolCallFunction{PartialArguments: `{"city": `}}}}},
+			{Model: "test", Message: api.Message{Role: "assistant", ToolCalls: []api.ToolCall{
+				{Function: api.ToolCallFunction{PartialArguments: `"Paris"}`}},
+				{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}},
+			}}},
+			{Model: "test", Message: api.Message{Role: "assistant"}, Done: true, DoneReason: "stop"},
+		} {
+			bts, _ := json.Marshal(resp)
+			c.Writer.Write(append(bts, '\n'))
+		}
+	}))
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model": "test", "stream": true, "messages": [{"role": "user", "content": "What's the weather?"}]}`)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+
+	events := strings.Split(strings.TrimSpace(resp.Body.String()), "\n\n")
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got %d", len(events))
+	}
+
+	var deltas []ToolCall
+	var reason *string
+	for _, event := range events[:len(events)-1] {
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		deltas = append(deltas, chunk.Choices[0].Delta.ToolCalls...)
+		reason = chunk.Choices[0].FinishReason
+	}
+
+	if len(deltas) != 3 {
+		t.Fatalf("expected 3 tool call deltas, got %d", len(deltas))
+	}
+
+	if deltas[0].ID == "" || deltas[0].Type != "function" || deltas[0].Function.Name != "get_weather" {
+		t.Errorf("expected the first delta to name the call, got %+v", deltas[0])
+	}
+
+	var args string
+	for _, delta := range deltas {
+		if delta.Index == nil || *delta.Index != 0 {
+			t.Errorf("expected index 0, got %v", delta.Index)
+		}
+
+		args += delta.Function.Arguments
+	}
+
+	if args != `{"city": "Paris"}` {
+		t.Errorf("expected arguments %q, got %q", `{"city": "Paris"}`, args)
+	}
+
+	if reason == nil || *reason != "tool_calls" {
+		t.Errorf("expected finish reason tool_calls, got %v", reason)
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/anthropic"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/types/model"
+)
+
+// keyScope controls which routes an API key may call. Each scope includes the
+// routes allowed by the scopes below it.
+type keyScope int
+
+const (
+	// scopeRead allows listing and inspecting models
+	scopeRead keyScope = iota
+	// scopeInference additionally allows generating completions and embeddings
+	scopeInference
+	// scopeAdmin allows every route, including pulling, pushing, creating,
+	// copying and deleting models
+	scopeAdmin
+)
+
+var keyScopes = map[string]keyScope{
+	"read":      scopeRead,
+	"inference": scopeInference,
+	"admin":     scopeAdmin,
+}
+
+func (s *keyScope) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+
+	scope, ok := keyScopes[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown scope %q", name)
+	}
+
+	*s = scope
+	return nil
+}
+
+// routeScopes lists the scope required by each route that doesn't need admin
+var routeScopes = map[string]keyScope{
+	"GET /api/version": scopeRead,
+	"GET /api/tags":    scopeRead,
+	"HEAD /api/tags":   scopeRead,
+	"POST /api/show":   scopeRead,
+	"GET /api/ps":      scopeRead,
+	"GET /metrics":     scopeRead,
+	"GET /v1/models":   scopeRead,
+
+	"GET /v1/models/:model": scopeRead,
+
+	"POST /api/generate":        scopeInference,
+	"POST /api/chat":            scopeInference,
+	"POST /api/embed":           scopeInference,
+	"POST /api/embeddings":      scopeInference,
+	"POST /v1/chat/completions": scopeInference,
+	"POST /v1/completions":      scopeInference,
+	"POST /v1/embeddings":       scopeInference,
+	"POST /v1/messages":         scopeInference,
+
+	// files and batches are only visible to the key that created them
+	"POST /v1/files":                 scopeInference,
+	"GET /v1/files":                  scopeInference,
+	"GET /v1/files/:file":            scopeInference,
+	"GET /v1/files/:file/content":    scopeInference,
+	"DELETE /v1/files/:file":         scopeInference,
+	"POST /v1/batches":               scopeInference,
+	"GET /v1/batches":                scopeInference,
+	"GET /v1/batches/:batch":         scopeInference,
+	"POST /v1/batches/:batch/cancel": scopeInference,
+}
+
+// apiKey is a bearer token allowed to call the server
+type apiKey struct {
+	// Name identifies the key in logs and is never used for authentication
+	Name  string   `json:"name"`
+	Key   string   `json:"key"`
+	Scope keyScope `json:"scope"`
+	// Models restricts the key to model names matching one of these
+	// patterns. An empty list allows every model.
+	Models []string `json:"models"`
+	// Limits overrides the default client limits for this key
+	Limits *limits `json:"limits,omitempty"`
+}
+
+// allows reports whether the key may call a route requiring scope
+func (k *apiKey) allows(scope keyScope) bool {
+	return k.Scope >= scope
+}
+
+// allowsModel reports whether the key may use the named model. A nil key,
+// used when authentication is disabled, allows every model.
+func (k *apiKey) allowsModel(name string) bool {
+	if k == nil || len(k.Models) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(k.Models, func(pattern string) bool {
+		return matchModel(pattern, name)
+	})
+}
+
+// matchModel reports whether the model name matches pattern. Names are
+// compared in their shortest form, e.g. "llama3:latest" or "user/model:tag".
+// A pattern without a tag matches every tag.
+func matchModel(pattern, name string) bool {
+	n := model.ParseName(name)
+	candidate := strings.ToLower(name)
+	if n.IsValid() {
+		candidate = strings.ToLower(n.DisplayShortest())
+	}
+
+	pattern = strings.ToLower(pattern)
+	if !strings.Contains(path.Base(pattern), ":") {
+		if i := strings.LastIndex(candidate, ":"); i > strings.LastIndex(candidate, "/") {
+			candidate = candidate[:i]
+		}
+	}
+
+	return matchPattern(pattern, candidate)
+}
+
+// matchPattern reports whether s matches pattern, where * matches any
+// sequence of characters, including none
+func matchPattern(pattern, s string) bool {
+	var p, i, star, next int = 0, 0, -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case p < len(pattern) && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			p = star + 1
+			next++
+			i = next
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+type apiKeys []apiKey
+
+// loadAPIKeys reads API keys from a JSON file of the form
+//
+//	{"keys": [{"name": "ci", "key": "...", "scope": "inference", "models": ["llama3*"]}]}
+func loadAPIKeys(path string) (apiKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config struct {
+		Keys apiKeys `json:"keys"`
+	}
+
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(config.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys defined", path)
+	}
+
+	seen := make(map[string]bool)
+	for i, k := range config.Keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("%s: key %d is empty", path, i)
+		} else if seen[k.Key] {
+			return nil, fmt.Errorf("%s: key %d is a duplicate", path, i)
+		}
+
+		seen[k.Key] = true
+		if k.Name == "" {
+			config.Keys[i].Name = fmt.Sprintf("key%d", i)
+		}
+	}
+
+	return config.Keys, nil
+}
+
+// lookup returns the key matching token or nil if there isn't one
+func (keys apiKeys) lookup(token string) *apiKey {
+	var found *apiKey
+	for i := range keys {
+		// compare against every key so timing doesn't reveal which one matched
+		if subtle.ConstantTimeCompare([]byte(keys[i].Key), []byte(token)) == 1 {
+			found = &keys[i]
+		}
+	}
+
+	return found
+}
+
+const apiKeyContextKey = "ollama.apiKey"
+
+// apiKeyFromContext returns the key that authenticated the request or nil if
+// authentication is disabled
+func apiKeyFromContext(c *gin.Context) *apiKey {
+	if k, ok := c.Get(apiKeyContextKey); ok {
+		return k.(*apiKey)
+	}
+
+	return nil
+}
+
+type apiKeyRequestKey struct{}
+
+// withAPIKey returns a copy of ctx for a request the server makes to itself
+// on behalf of the key k. Without a key, such as for a batch created while
+// authentication was disabled, the request is authenticated like any other.
+func withAPIKey(ctx context.Context, k *apiKey) context.Context {
+	if k == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, apiKeyRequestKey{}, k)
+}
+
+// authMiddleware requires a valid bearer token with a scope covering the
+// requested route. It is a no-op when no keys are configured.
+func authMiddleware(keys apiKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(keys) == 0 || c.FullPath() == "/" {
+			c.Next()
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			// Anthropic clients send the key in their own header
+			token = c.GetHeader("X-Api-Key")
+			ok = token != ""
+		}
+
+		k := keys.lookup(strings.TrimSpace(token))
+		if internal, found := c.Request.Context().Value(apiKeyRequestKey{}).(*apiKey); found {
+			// requests made by the server itself, such as those of batches,
+			// carry the key they run as
+			k, ok = internal, true
+		}
+
+		if !ok || k == nil {
+			c.Header("WWW-Authenticate", `Bearer realm="ollama"`)
+			abortWithError(c, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		}
+
+		scope, ok := routeScopes[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			scope = scopeAdmin
+		}
+
+		if !k.allows(scope) {
+			abortWithError(c, http.StatusForbidden, fmt.Sprintf("API key %q is not allowed to call %s %s", k.Name, c.Request.Method, c.Request.URL.Path))
+			return
+		}
+
+		c.Set(apiKeyContextKey, k)
+		c.Next()
+	}
+}
+
+// authorizeModel aborts the request with 403 Forbidden unless the API key, if
+// any, allows every named model
+func authorizeModel(c *gin.Context, names ...string) bool {
+	k := apiKeyFromContext(c)
+	for _, name := range names {
+		if name != "" && !k.allowsModel(name) {
+			abortWithError(c, http.StatusForbidden, fmt.Sprintf("API key %q is not allowed to use model %q", k.Name, name))
+			return false
+		}
+	}
+
+	return true
+}
+
+// abortWithError responds with an error in the format of the Anthropic or
+// OpenAI compatible routes, or the native format otherwise
+func abortWithError(c *gin.Context, code int, message string) {
+	if c.Request.URL.Path == "/v1/messages" {
+		c.AbortWithStatusJSON(code, anthropic.NewError(code, message))
+		return
+	}
+
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/") {
+		c.AbortWithStatusJSON(code, openai.NewError(code, message))
+		return
+	}
+
+	c.AbortWithStatusJSON(code, gin.H{"error": message})
+}
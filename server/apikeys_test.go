@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/anthropic"
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/openai"
+)
+
+func TestMatchPattern(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "llama3:latest", true},
+		{"llama3", "llama3", true},
+		{"llama3", "llama3.1", false},
+		{"llama3*", "llama3.1", true},
+		{"*:8b", "llama3:8b", true},
+		{"*:8b", "llama3:70b", false},
+		{"team/*", "team/model:latest", true},
+		{"team/*", "other/model:latest", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.pattern+" "+tt.s, func(t *testing.T) {
+			require.Equal(t, tt.match, matchPattern(tt.pattern, tt.s))
+		})
+	}
+}
+
+func TestAllowsModel(t *testing.T) {
+	var disabled *apiKey
+	require.True(t, disabled.allowsModel("anything"))
+
+	k := apiKey{Models: []string{"llama3", "mistral:7b", "team/*"}}
+	cases := map[string]bool{
+		"llama3":                             true,
+		"llama3:70b":                         true,
+		"LLaMA3:latest":                      true,
+		"registry.ollama.ai/library/llama3":  true,
+		"mistral:7b":                         true,
+		"mistral:latest":                     false,
+		"team/model":                         true,
+		"other/model":                        false,
+		"gemma2":                             false,
+		"example.com/library/llama3:8b":      false,
+		"registry.ollama.ai/team/model:test": true,
+	}
+
+	for name, allowed := range cases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, allowed, k.allowsModel(name))
+		})
+	}
+}
+
+func TestKeyPriority(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	admin := &apiKey{Name: "ops", Scope: scopeAdmin}
+	inference := &apiKey{Name: "team", Scope: scopeInference}
+	cases := []struct {
+		name     string
+		key      *apiKey
+		body     string
+		header   string
+		priority string
+	}{
+		{"no key", nil, "", "", ""},
+		{"no key tenant", nil, "", "other", "other"},
+		{"no key high", nil, PriorityHigh, "", PriorityHigh},
+		{"key", inference, "", "", "team"},
+		{"key tenant", inference, "other", "", "team"},
+		{"key header tenant", inference, "", "other", "team"},
+		{"key high", inference, PriorityHigh, "", "team"},
+		{"key low", inference, "", PriorityLow, PriorityLow},
+		{"admin high", admin, PriorityHigh, "", PriorityHigh},
+		{"admin normal", admin, PriorityNormal, "", "ops"},
+		{"key named high", &apiKey{Name: PriorityHigh, Scope: scopeInference}, "", "", PriorityNormal},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+			if tt.header != "" {
+				c.Request.Header.Set("X-Ollama-Priority", tt.header)
+			}
+
+			if tt.key != nil {
+				c.Set(apiKeyContextKey, tt.key)
+			}
+
+			require.Equal(t, tt.priority, priorityFromContext(priorityContext(c, tt.body)))
+		})
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	write := func(t *testing.T, s string) string {
+		t.Helper()
+		p := filepath.Join(t.TempDir(), "keys.json")
+		require.NoError(t, os.WriteFile(p, []byte(s), 0o600))
+		return p
+	}
+
+	keys, err := loadAPIKeys(write(t, `{"keys": [
+		{"name": "ci", "key": "secret1", "scope": "inference", "models": ["llama3*"]},
+		{"key": "secret2", "scope": "ADMIN"}
+	]}`))
+	require.NoError(t, err)
+	require.Equal(t, apiKeys{
+		{Name: "ci", Key: "secret1", Scope: scopeInference, Models: []string{"llama3*"}},
+		{Name: "key1", Key: "secret2", Scope: scopeAdmin},
+	}, keys)
+
+	require.Equal(t, &keys[1], keys.lookup("secret2"))
+	require.Nil(t, keys.lookup("secret"))
+	require.Nil(t, keys.lookup(""))
+
+	for name, s := range map[string]string{
+		"empty":     `{"keys": []}`,
+		"no key":    `{"keys": [{"name": "a", "scope": "read"}]}`,
+		"duplicate": `{"keys": [{"key": "a", "scope": "read"}, {"key": "a", "scope": "admin"}]}`,
+		"scope":     `{"keys": [{"key": "a", "scope": "root"}]}`,
+		"unknown":   `{"keys": [{"key": "a", "scope": "read", "model": "llama3"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadAPIKeys(write(t, s))
+			require.Error(t, err)
+		})
+	}
+
+	_, err = loadAPIKeys(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	for _, name := range []string{"llama3", "gemma2"} {
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+			Stream:    &stream,
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	s.sched = &Scheduler{queue: newFairQueue(), loaded: map[string]*runnerRef{
+		"llama3": {model: &Model{ShortName: "llama3:latest"}},
+		"gemma2": {model: &Model{ShortName: "gemma2:latest"}},
+	}}
+	s.keys = apiKeys{
+		{Name: "reader", Key: "read", Scope: scopeRead},
+		{Name: "llama", Key: "llama", Scope: scopeInference, Models: []string{"llama3"}},
+		{Name: "admin", Key: "admin", Scope: scopeAdmin},
+	}
+	router := s.GenerateRoutes()
+
+	do := func(method, path, token string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+
+		var b bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&b).Encode(body))
+		}
+
+		req := httptest.NewRequest(method, path, &b)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("health check", func(t *testing.T) {
+		w := do(http.MethodGet, "/", "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/tags", "", nil)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, `Bearer realm="ollama"`, w.Header().Get("WWW-Authenticate"))
+		require.JSONEq(t, `{"error": "missing or invalid API key"}`, w.Body.String())
+	})
+
+	t.Run("invalid token openai", func(t *testing.T) {
+		w := do(http.MethodGet, "/v1/models", "wrong", nil)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+
+		var resp openai.ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, "authentication_error", resp.Error.Type)
+	})
+
+	t.Run("anthropic api key header", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{}`))
+		req.Header.Set("X-Api-Key", "read")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		var resp anthropic.ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, "error", resp.Type)
+		require.Equal(t, "permission_error", resp.Error.Type)
+	})
+
+	t.Run("read scope", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/tags", "read", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp api.ListResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Models, 2)
+
+		w = do(http.MethodDelete, "/api/delete", "read", api.DeleteRequest{Model: "gemma2"})
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		w = do(http.MethodPost, "/v1/chat/completions", "read", nil)
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("model patterns", func(t *testing.T) {
+		w := do(http.MethodGet, "/api/tags", "llama", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp api.ListResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Models, 1)
+		require.Equal(t, "llama3:latest", resp.Models[0].Name)
+
+		w = do(http.MethodGet, "/v1/models", "llama", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list openai.ListCompletion
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+		require.Len(t, list.Data, 1)
+		require.Equal(t, "llama3:latest", list.Data[0].Id)
+
+		w = do(http.MethodGet, "/v1/models/gemma2", "llama", nil)
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		w = do(http.MethodGet, "/api/ps", "llama", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var ps api.ProcessResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&ps))
+		require.Len(t, ps.Models, 1)
+		require.Equal(t, "llama3:latest", ps.Models[0].Name)
+
+		w = do(http.MethodPost, "/api/show", "llama", api.ShowRequest{Model: "llama3"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodPost, "/api/show", "llama", api.ShowRequest{Model: "gemma2"})
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		w = do(http.MethodPost, "/api/pull", "llama", api.PullRequest{Model: "llama3"})
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		w = do(http.MethodPost, "/api/generate", "llama", api.GenerateRequest{Model: "llama3", Draft: "gemma2"})
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		w = do(http.MethodPost, "/api/chat", "llama", api.ChatRequest{Model: "llama3", Draft: "gemma2"})
+		require.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("model patterns compat", func(t *testing.T) {
+		for path, body := range map[string]string{
+			"/v1/chat/completions": `{"model": "gemma2", "messages": [{"role": "user", "content": "Hello!"}]}`,
+			"/v1/completions":      `{"model": "gemma2", "prompt": "Hello!"}`,
+			"/v1/embeddings":       `{"model": "gemma2", "input": "Hello!"}`,
+		} {
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer llama")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusForbidden, w.Code, path)
+
+			var resp openai.ErrorResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp), path)
+			require.Equal(t, "permission_error", resp.Error.Type, path)
+			require.Equal(t, `API key "llama" is not allowed to use model "gemma2"`, resp.Error.Message, path)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model": "gemma2", "max_tokens": 16, "messages": [{"role": "user", "content": "Hello!"}]}`))
+		req.Header.Set("X-Api-Key", "llama")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		var resp anthropic.ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, "permission_error", resp.Error.Type)
+		require.Equal(t, `API key "llama" is not allowed to use model "gemma2"`, resp.Error.Message)
+	})
+
+	t.Run("admin scope", func(t *testing.T) {
+		w := do(http.MethodPost, "/api/copy", "admin", api.CopyRequest{Source: "gemma2", Destination: "gemma2-copy"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodDelete, "/api/delete", "admin", api.DeleteRequest{Model: "gemma2-copy"})
+		require.Equal(t, http.StatusOK, w.Code)
+	})
+}
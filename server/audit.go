@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/types/model"
+)
+
+// auditLog appends one JSON object per line to a file, rotating it once it
+// grows past maxSize. Rotated files are renamed with a numeric suffix, with
+// .1 being the most recent, and at most maxFiles of them are kept.
+type auditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	content  bool
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openAuditLog(path string, maxSize int64, maxFiles int, content bool) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize, maxFiles: maxFiles, content: content}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+
+	if l.maxFiles > 0 {
+		for i := l.maxFiles - 1; i > 0; i-- {
+			if err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+func (l *auditLog) write(e *auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// auditEntry is a single line of the audit log. Prompts and responses are only
+// recorded when content capture is enabled.
+type auditEntry struct {
+	Time            time.Time      `json:"time"`
+	Client          string         `json:"client"`
+	Key             string         `json:"key,omitempty"`
+	Method          string         `json:"method"`
+	Route           string         `json:"route"`
+	Status          int            `json:"status"`
+	Model           string         `json:"model,omitempty"`
+	Digest          string         `json:"digest,omitempty"`
+	Options         map[string]any `json:"options,omitempty"`
+	PromptEvalCount int            `json:"prompt_eval_count,omitempty"`
+	EvalCount       int            `json:"eval_count,omitempty"`
+	Duration        time.Duration  `json:"duration"`
+	DoneReason      string         `json:"done_reason,omitempty"`
+	Error           string         `json:"error,omitempty"`
+
+	System   string        `json:"system,omitempty"`
+	Prompt   string        `json:"prompt,omitempty"`
+	Messages []api.Message `json:"messages,omitempty"`
+	Input    any           `json:"input,omitempty"`
+	Response string        `json:"response,omitempty"`
+}
+
+// auditRequest holds the fields of any audited request body
+type auditRequest struct {
+	Model    string         `json:"model"`
+	Name     string         `json:"name"`
+	Options  map[string]any `json:"options"`
+	System   string         `json:"system"`
+	Prompt   string         `json:"prompt"`
+	Messages []api.Message  `json:"messages"`
+	Input    any            `json:"input"`
+}
+
+// auditFrame holds the fields of any audited response, or of a single object
+// in a streamed response
+type auditFrame struct {
+	Error           string       `json:"error"`
+	DoneReason      string       `json:"done_reason"`
+	PromptEvalCount int          `json:"prompt_eval_count"`
+	EvalCount       int          `json:"eval_count"`
+	Response        string       `json:"response"`
+	Message         *api.Message `json:"message"`
+}
+
+// auditWriter inspects the native response as it is written so the entry can
+// record token counts, the done reason and any error
+type auditWriter struct {
+	gin.ResponseWriter
+	entry   *auditEntry
+	content bool
+	line    []byte
+
+	// mu guards entry, which the writers of the prompts of a request with
+	// several prompts share
+	mu *sync.Mutex
+}
+
+// Prompt returns a writer that records the response of one prompt of a
+// request with several prompts in the same entry
+func (w *auditWriter) Prompt(rw gin.ResponseWriter) openai.PromptWriter {
+	return &auditWriter{ResponseWriter: rw, entry: w.entry, content: w.content, mu: w.mu}
+}
+
+// Close records the last frame of the response, which may not end in a newline
+func (w *auditWriter) Close() error {
+	w.parse(w.line)
+	w.line = nil
+	return nil
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	w.line = append(w.line, b...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.parse(w.line[:i])
+		w.line = w.line[i+1:]
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *auditWriter) parse(b []byte) {
+	if b = bytes.TrimSpace(b); len(b) == 0 {
+		return
+	}
+
+	var f auditFrame
+	if err := json.Unmarshal(b, &f); err != nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.entry.Error = cmp.Or(f.Error, w.entry.Error)
+	w.entry.DoneReason = cmp.Or(f.DoneReason, w.entry.DoneReason)
+	w.entry.PromptEvalCount = cmp.Or(f.PromptEvalCount, w.entry.PromptEvalCount)
+	w.entry.EvalCount = cmp.Or(f.EvalCount, w.entry.EvalCount)
+	if w.content {
+		w.entry.Response += f.Response
+		if f.Message != nil {
+			w.entry.Response += f.Message.Content
+		}
+	}
+}
+
+// auditMiddleware records an audit log entry for each request to the route.
+// It must run after any middleware that translates requests into the native
+// format so the entry sees the native request and response.
+func auditMiddleware(l *auditLog) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		entry := auditEntry{
+			Time:   start.UTC(),
+			Client: c.ClientIP(),
+			Method: c.Request.Method,
+			Route:  c.FullPath(),
+		}
+
+		if k := apiKeyFromContext(c); k != nil {
+			entry.Key = k.Name
+		}
+
+		var req auditRequest
+		// uploads aren't buffered since they don't describe the request
+		if c.Request.Body != nil && !strings.HasPrefix(c.ContentType(), "multipart/") {
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+			// the handler reports malformed bodies
+			_ = json.Unmarshal(body, &req)
+		}
+
+		entry.Model = cmp.Or(req.Model, req.Name)
+		entry.Options = req.Options
+		if l.content {
+			entry.System, entry.Prompt, entry.Input = req.System, req.Prompt, req.Input
+			for _, m := range req.Messages {
+				// images are too large to log
+				m.Images = nil
+				entry.Messages = append(entry.Messages, m)
+			}
+		}
+
+		// look up the digest before the request runs in case it's deleted
+		entry.Digest = auditDigest(entry.Model)
+
+		w := &auditWriter{ResponseWriter: c.Writer, entry: &entry, content: l.content, mu: &sync.Mutex{}}
+		c.Writer = w
+		c.Next()
+		w.Close()
+
+		if entry.Digest == "" {
+			// the model may have been pulled or created by the request
+			entry.Digest = auditDigest(entry.Model)
+		}
+
+		entry.Status = w.Status()
+		entry.Duration = time.Since(start)
+		if err := l.write(&entry); err != nil {
+			slog.Error("failed to write audit log", "error", err)
+		}
+	}
+}
+
+func auditDigest(name string) string {
+	n := model.ParseName(name)
+	if !n.IsValid() {
+		return ""
+	}
+
+	m, err := ParseNamedManifest(n)
+	if err != nil {
+		return ""
+	}
+
+	return m.digest
+}
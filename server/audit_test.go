@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/openai"
+	"github.com/ollama/ollama/types/model"
+)
+
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var entries []auditEntry
+	d := json.NewDecoder(f)
+	for d.More() {
+		var e auditEntry
+		require.NoError(t, d.Decode(&e))
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path, 200, 2, false)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := range 10 {
+		require.NoError(t, l.write(&auditEntry{Route: fmt.Sprintf("/%d", i)}))
+	}
+
+	// each entry is roughly 100 bytes so each file holds two entries
+	require.Equal(t, []string{"/8", "/9"}, routes(readAuditLog(t, path)))
+	require.Equal(t, []string{"/6", "/7"}, routes(readAuditLog(t, path+".1")))
+	require.Equal(t, []string{"/4", "/5"}, routes(readAuditLog(t, path+".2")))
+	require.NoFileExists(t, path+".3")
+}
+
+func routes(entries []auditEntry) (routes []string) {
+	for _, e := range entries {
+		routes = append(routes, e.Route)
+	}
+
+	return routes
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := func(c *gin.Context) {
+		var req api.ChatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.Model == "missing" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "model not found"})
+			return
+		}
+
+		streamFrame(c, api.ChatResponse{Message: api.Message{Role: "assistant", Content: "Hello"}})
+		streamFrame(c, api.ChatResponse{Message: api.Message{Role: "assistant", Content: " world"}})
+		streamFrame(c, api.ChatResponse{
+			Done:       true,
+			DoneReason: "stop",
+			Metrics:    api.Metrics{PromptEvalCount: 12, EvalCount: 2},
+		})
+	}
+
+	body := `{"model": "test", "options": {"temperature": 0.5}, "messages": [{"role": "user", "content": "Hi", "images": ["aW1hZ2U="]}]}`
+
+	for _, content := range []bool{false, true} {
+		t.Run(fmt.Sprintf("content=%t", content), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			l, err := openAuditLog(path, 0, 0, content)
+			require.NoError(t, err)
+			defer l.Close()
+
+			r := gin.New()
+			r.POST("/api/chat", auditMiddleware(l), handler)
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body)))
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, 3, strings.Count(w.Body.String(), "\n"))
+
+			w = httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model": "missing"}`)))
+			require.Equal(t, http.StatusNotFound, w.Code)
+
+			entries := readAuditLog(t, path)
+			require.Len(t, entries, 2)
+
+			e := entries[0]
+			require.WithinDuration(t, time.Now(), e.Time, time.Minute)
+			require.Equal(t, "/api/chat", e.Route)
+			require.Equal(t, http.MethodPost, e.Method)
+			require.Equal(t, http.StatusOK, e.Status)
+			require.Equal(t, "test", e.Model)
+			require.Equal(t, map[string]any{"temperature": 0.5}, e.Options)
+			require.Equal(t, 12, e.PromptEvalCount)
+			require.Equal(t, 2, e.EvalCount)
+			require.Equal(t, "stop", e.DoneReason)
+			require.Empty(t, e.Error)
+			require.Positive(t, e.Duration)
+
+			if content {
+				require.Equal(t, []api.Message{{Role: "user", Content: "Hi"}}, e.Messages)
+				require.Equal(t, "Hello world", e.Response)
+			} else {
+				require.Empty(t, e.Messages)
+				require.Empty(t, e.Response)
+			}
+
+			e = entries[1]
+			require.Equal(t, http.StatusNotFound, e.Status)
+			require.Equal(t, "missing", e.Model)
+			require.Equal(t, "model not found", e.Error)
+		})
+	}
+}
+
+func TestAuditMiddlewarePrompts(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := func(c *gin.Context) {
+		var req api.GenerateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, api.GenerateResponse{
+			Model:      req.Model,
+			Response:   "re: " + req.Prompt,
+			Done:       true,
+			DoneReason: "stop",
+			Metrics:    api.Metrics{PromptEvalCount: 3, EvalCount: 2},
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path, 0, 0, true)
+	require.NoError(t, err)
+	defer l.Close()
+
+	r := gin.New()
+	r.POST("/v1/completions", openai.CompletionsMiddleware(), auditMiddleware(l), openai.Choices(handler))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"model": "test", "prompt": ["a", "b"]}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp openai.Completion
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp.Choices, 2)
+
+	entries := readAuditLog(t, path)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/v1/completions", entries[0].Route)
+	require.Equal(t, http.StatusOK, entries[0].Status)
+	require.Equal(t, 3, entries[0].PromptEvalCount)
+	require.Equal(t, 2, entries[0].EvalCount)
+	require.Equal(t, "stop", entries[0].DoneReason)
+	require.Contains(t, entries[0].Response, "re: a")
+	require.Contains(t, entries[0].Response, "re: b")
+}
+
+func TestAuditDelete(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name:      "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, nil, nil)),
+		Stream:    &stream,
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	m, err := ParseNamedManifest(model.ParseName("test"))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s.audit, err = openAuditLog(path, 0, 0, false)
+	require.NoError(t, err)
+	defer s.audit.Close()
+
+	var b bytes.Buffer
+	require.NoError(t, json.NewEncoder(&b).Encode(api.DeleteRequest{Model: "test"}))
+
+	w = httptest.NewRecorder()
+	s.GenerateRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/delete", &b))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	entries := readAuditLog(t, path)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/api/delete", entries[0].Route)
+	require.Equal(t, "test", entries[0].Model)
+	require.Equal(t, m.digest, entries[0].Digest)
+}
+
+func TestAuditClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	for _, tt := range []struct {
+		name    string
+		proxies string
+		expect  string
+	}{
+		{"untrusted", "", "10.0.0.1"},
+		{"trusted", "10.0.0.0/8", "192.168.0.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TRUSTED_PROXIES", tt.proxies)
+
+			path := filepath.Join(t.TempDir(), "audit.log")
+			l, err := openAuditLog(path, 0, 0, false)
+			require.NoError(t, err)
+			defer l.Close()
+
+			s := Server{audit: l}
+			r := httptest.NewRequest(http.MethodDelete, "/api/delete", strings.NewReader(`{"model": "missing"}`))
+			r.RemoteAddr = "10.0.0.1:1234"
+			r.Header.Set("X-Forwarded-For", "192.168.0.1")
+
+			w := httptest.NewRecorder()
+			s.GenerateRoutes().ServeHTTP(w, r)
+			require.Equal(t, http.StatusNotFound, w.Code)
+
+			entries := readAuditLog(t, path)
+			require.Len(t, entries, 1)
+			require.Equal(t, tt.expect, entries[0].Client)
+		})
+	}
+}
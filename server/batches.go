@@ -0,0 +1,1076 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/envconfig"
+	"github.com/ollama/ollama/openai"
+)
+
+const (
+	// maxBatchRequests is the largest number of requests in a batch
+	maxBatchRequests = 50_000
+
+	// batchRetries is the number of times a request that failed because
+	// the server was busy is retried
+	batchRetries = 3
+)
+
+var (
+	errBatchCancelled = errors.New("batch cancelled")
+	errBatchExpired   = errors.New("batch expired")
+)
+
+// batchEndpoints are the endpoints requests in a batch may call
+var batchEndpoints = []string{"/v1/chat/completions", "/v1/completions", "/v1/embeddings"}
+
+// batchFile is an uploaded file or the output of a batch, along with the
+// name of the API key that owns it
+type batchFile struct {
+	openai.File
+	Owner string `json:"owner,omitempty"`
+}
+
+// batchJob is a batch along with the name of the API key that created it
+type batchJob struct {
+	openai.Batch
+	Owner string `json:"owner,omitempty"`
+}
+
+// pending reports whether the batch still has work for the runner
+func (j *batchJob) pending() bool {
+	switch j.Status {
+	case "validating", "in_progress", "finalizing", "cancelling":
+		return true
+	default:
+		return false
+	}
+}
+
+// batchRunner runs batches of OpenAI requests in the background, one batch
+// at a time and at low priority. Files and batches are stored in dir so
+// batches resume after a restart.
+type batchRunner struct {
+	dir  string
+	keys apiKeys
+
+	// handler serves the requests of batches
+	handler http.Handler
+
+	mu      sync.Mutex
+	files   map[string]*batchFile
+	batches map[string]*batchJob
+
+	// cancel cancels the batch being run
+	cancel map[string]context.CancelCauseFunc
+	wake   chan struct{}
+}
+
+func newBatchRunner(dir string, keys apiKeys) (*batchRunner, error) {
+	b := &batchRunner{
+		dir:     dir,
+		keys:    keys,
+		files:   make(map[string]*batchFile),
+		batches: make(map[string]*batchJob),
+		cancel:  make(map[string]context.CancelCauseFunc),
+		wake:    make(chan struct{}, 1),
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "files"), 0o755); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "files", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range files {
+		var f batchFile
+		if err := readJSONFile(path, &f); err != nil {
+			return nil, err
+		}
+
+		b.files[f.Id] = &f
+	}
+
+	batches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range batches {
+		var j batchJob
+		if err := readJSONFile(path, &j); err != nil {
+			return nil, err
+		}
+
+		b.batches[j.Id] = &j
+	}
+
+	return b, nil
+}
+
+func readJSONFile(path string, v any) error {
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bts, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// writeJSONFile replaces the file at path with v
+func writeJSONFile(path string, v any) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", bts, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func randomID(prefix string) string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return prefix + hex.EncodeToString(b)
+}
+
+func (b *batchRunner) filePath(id string) string {
+	return filepath.Join(b.dir, "files", id+".jsonl")
+}
+
+// outputPath returns the path of the output of a batch being run, which
+// becomes a file once the batch is done
+func (b *batchRunner) outputPath(id, kind string) string {
+	return filepath.Join(b.dir, id+"."+kind+".jsonl")
+}
+
+// saveFile stores f, the caller must hold b.mu
+func (b *batchRunner) saveFile(f *batchFile) error {
+	if err := writeJSONFile(filepath.Join(b.dir, "files", f.Id+".json"), f); err != nil {
+		return err
+	}
+
+	b.files[f.Id] = f
+	return nil
+}
+
+// saveBatch stores j, the caller must hold b.mu
+func (b *batchRunner) saveBatch(j *batchJob) error {
+	if err := writeJSONFile(filepath.Join(b.dir, j.Id+".json"), j); err != nil {
+		return err
+	}
+
+	b.batches[j.Id] = j
+	return nil
+}
+
+// createFile stores the content read from r as a file
+func (b *batchRunner) createFile(r io.Reader, filename, purpose, owner string) (*batchFile, error) {
+	f := &batchFile{
+		File: openai.File{
+			Id:        randomID("file-"),
+			Object:    "file",
+			CreatedAt: time.Now().Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+		},
+		Owner: owner,
+	}
+
+	w, err := os.Create(b.filePath(f.Id))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	if f.Bytes, err = io.Copy(w, r); err != nil {
+		os.Remove(w.Name())
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.saveFile(f); err != nil {
+		os.Remove(w.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (b *batchRunner) deleteFile(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(b.dir, "files", id+".json")); err != nil {
+		return err
+	}
+
+	delete(b.files, id)
+	return os.Remove(b.filePath(id))
+}
+
+func (b *batchRunner) createBatch(req openai.BatchRequest, owner string) (*batchJob, error) {
+	now := time.Now()
+	expiresAt := now.Add(24 * time.Hour).Unix()
+	j := &batchJob{
+		Batch: openai.Batch{
+			Id:               randomID("batch_"),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileId:      req.InputFileId,
+			CompletionWindow: req.CompletionWindow,
+			Status:           "validating",
+			CreatedAt:        now.Unix(),
+			ExpiresAt:        &expiresAt,
+			Metadata:         req.Metadata,
+		},
+		Owner: owner,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.saveBatch(j); err != nil {
+		return nil, err
+	}
+
+	b.notify()
+	created := *j
+	return &created, nil
+}
+
+// cancelBatch stops a batch, keeping the output of requests that are done
+func (b *batchRunner) cancelBatch(id string) (*batchJob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	j := b.batches[id]
+	if j.Status != "validating" && j.Status != "in_progress" {
+		return nil, fmt.Errorf("batch with status %q can't be cancelled", j.Status)
+	}
+
+	now := time.Now().Unix()
+	j.Status = "cancelling"
+	j.CancellingAt = &now
+	if err := b.saveBatch(j); err != nil {
+		return nil, err
+	}
+
+	if cancel, ok := b.cancel[id]; ok {
+		cancel(errBatchCancelled)
+	}
+
+	b.notify()
+	cancelled := *j
+	return &cancelled, nil
+}
+
+func (b *batchRunner) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns a copy of the oldest batch with work left
+func (b *batchRunner) next() *batchJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var next *batchJob
+	for _, j := range b.batches {
+		if j.pending() && (next == nil || j.CreatedAt < next.CreatedAt || (j.CreatedAt == next.CreatedAt && j.Id < next.Id)) {
+			next = j
+		}
+	}
+
+	if next == nil {
+		return nil
+	}
+
+	j := *next
+	return &j
+}
+
+// Run runs batches with h until ctx is done
+func (b *batchRunner) Run(ctx context.Context, h http.Handler) {
+	b.handler = h
+	for {
+		if j := b.next(); j != nil {
+			b.run(ctx, j)
+			if ctx.Err() != nil {
+				return
+			}
+
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.wake:
+		}
+	}
+}
+
+// update applies fn to the stored batch and saves it
+func (b *batchRunner) update(id string, fn func(*batchJob)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	j := b.batches[id]
+	fn(j)
+	if err := b.saveBatch(j); err != nil {
+		slog.Error("failed to save batch", "batch", id, "error", err)
+	}
+}
+
+func (b *batchRunner) run(ctx context.Context, j *batchJob) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	if j.ExpiresAt != nil {
+		var cancelExpired context.CancelFunc
+		ctx, cancelExpired = context.WithDeadlineCause(ctx, time.Unix(*j.ExpiresAt, 0), errBatchExpired)
+		defer cancelExpired()
+	}
+
+	// the batch may have been cancelled since it was picked, and is cancelled
+	// through ctx from here on
+	b.mu.Lock()
+	b.cancel[j.Id] = cancel
+	j.Status = b.batches[j.Id].Status
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.cancel, j.Id)
+		b.mu.Unlock()
+	}()
+
+	if j.Status == "cancelling" {
+		b.finalize(j.Id, "cancelled")
+		return
+	}
+
+	inputs, berrs := b.validate(j)
+	if len(berrs) > 0 {
+		b.update(j.Id, func(j *batchJob) {
+			// a batch cancelled while validating is finalized as cancelled
+			// when it runs next
+			if j.Status != "validating" {
+				return
+			}
+
+			now := time.Now().Unix()
+			j.Status = "failed"
+			j.FailedAt = &now
+			j.Errors = &openai.BatchErrors{Object: "list", Data: berrs}
+		})
+		return
+	}
+
+	if j.Status == "validating" {
+		b.update(j.Id, func(j *batchJob) {
+			if j.Status != "validating" {
+				return
+			}
+
+			now := time.Now().Unix()
+			j.Status = "in_progress"
+			j.InProgressAt = &now
+			j.RequestCounts.Total = len(inputs)
+		})
+	}
+
+	if j.Status != "finalizing" {
+		if err := b.runRequests(ctx, j.Id, inputs); err != nil {
+			slog.Error("failed to run batch", "batch", j.Id, "error", err)
+		}
+	}
+
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errBatchCancelled):
+		b.finalize(j.Id, "cancelled")
+	case errors.Is(cause, errBatchExpired):
+		b.finalize(j.Id, "expired")
+	case cause != nil:
+		// the server is shutting down, the batch resumes after a restart
+	default:
+		b.finalize(j.Id, "completed")
+	}
+}
+
+// validate reads the requests of a batch from its input file
+func (b *batchRunner) validate(j *batchJob) ([]openai.BatchInput, []openai.BatchError) {
+	fail := func(line int, code, format string, args ...any) []openai.BatchError {
+		berr := openai.BatchError{Code: code, Message: fmt.Sprintf(format, args...)}
+		if line > 0 {
+			berr.Line = &line
+		}
+
+		return []openai.BatchError{berr}
+	}
+
+	f, err := os.Open(b.filePath(j.InputFileId))
+	if err != nil {
+		return nil, fail(0, "invalid_file", "input file %q can't be read", j.InputFileId)
+	}
+	defer f.Close()
+
+	var inputs []openai.BatchInput
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var input openai.BatchInput
+		if err := json.Unmarshal(scanner.Bytes(), &input); err != nil {
+			return nil, fail(line, "invalid_json_line", "line %d is not valid JSON", line)
+		}
+
+		switch {
+		case input.CustomId == "":
+			return nil, fail(line, "missing_custom_id", "line %d is missing a custom_id", line)
+		case seen[input.CustomId]:
+			return nil, fail(line, "duplicate_custom_id", "line %d repeats custom_id %q", line, input.CustomId)
+		case input.Method != http.MethodPost:
+			return nil, fail(line, "invalid_method", "line %d must use the POST method", line)
+		case input.Url != j.Endpoint:
+			return nil, fail(line, "mismatched_endpoint", "line %d calls %q rather than the batch endpoint %q", line, input.Url, j.Endpoint)
+		case len(input.Body) == 0:
+			return nil, fail(line, "missing_body", "line %d is missing a body", line)
+		}
+
+		seen[input.CustomId] = true
+		inputs = append(inputs, input)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fail(0, "invalid_file", "input file %q can't be read: %v", j.InputFileId, err)
+	}
+
+	if len(inputs) == 0 {
+		return nil, fail(0, "empty_file", "input file %q has no requests", j.InputFileId)
+	} else if len(inputs) > maxBatchRequests {
+		return nil, fail(0, "too_many_requests", "batches are limited to %d requests", maxBatchRequests)
+	}
+
+	return inputs, nil
+}
+
+// done returns the custom IDs of the requests written to the output of a
+// batch, so a batch resumed after a restart skips them
+func (b *batchRunner) done(id string) (completed, failed map[string]bool, err error) {
+	read := func(kind string) (map[string]bool, error) {
+		ids := make(map[string]bool)
+		f, err := os.Open(b.outputPath(id, kind))
+		if errors.Is(err, os.ErrNotExist) {
+			return ids, nil
+		} else if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		for scanner.Scan() {
+			var output openai.BatchOutput
+			if err := json.Unmarshal(scanner.Bytes(), &output); err != nil {
+				// a line cut short when the server stopped
+				continue
+			}
+
+			ids[output.CustomId] = true
+		}
+
+		return ids, scanner.Err()
+	}
+
+	if completed, err = read("output"); err != nil {
+		return nil, nil, err
+	}
+
+	if failed, err = read("errors"); err != nil {
+		return nil, nil, err
+	}
+
+	return completed, failed, nil
+}
+
+// runRequests runs the requests of a batch that aren't done yet, a few at a
+// time so they can share a model's parallel slots
+func (b *batchRunner) runRequests(ctx context.Context, id string, inputs []openai.BatchInput) error {
+	completed, failed, err := b.done(id)
+	if err != nil {
+		return err
+	}
+
+	b.update(id, func(j *batchJob) {
+		j.RequestCounts.Completed = len(completed)
+		j.RequestCounts.Failed = len(failed)
+	})
+
+	output, err := os.OpenFile(b.outputPath(id, "output"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	errorsOutput, err := os.OpenFile(b.outputPath(id, "errors"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer errorsOutput.Close()
+
+	b.mu.Lock()
+	owner := b.batches[id].Owner
+	b.mu.Unlock()
+
+	var k *apiKey
+	if owner != "" {
+		if i := slices.IndexFunc(b.keys, func(k apiKey) bool { return k.Name == owner }); i >= 0 {
+			k = &b.keys[i]
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(1, int(envconfig.NumParallel())))
+	for _, input := range inputs {
+		if completed[input.CustomId] || failed[input.CustomId] {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := b.runRequest(ctx, k, input)
+			if ctx.Err() != nil {
+				// the request was interrupted and runs again if the batch resumes
+				return
+			}
+
+			bts, err := json.Marshal(result)
+			if err != nil {
+				slog.Error("failed to encode batch output", "batch", id, "error", err)
+				return
+			}
+
+			ok := result.Error == nil && result.Response.StatusCode < http.StatusBadRequest
+
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			w := output
+			if !ok {
+				w = errorsOutput
+			}
+
+			if _, err := w.Write(append(bts, '\n')); err != nil {
+				slog.Error("failed to write batch output", "batch", id, "error", err)
+				return
+			}
+
+			j := b.batches[id]
+			if ok {
+				j.RequestCounts.Completed++
+			} else {
+				j.RequestCounts.Failed++
+			}
+
+			if err := b.saveBatch(j); err != nil {
+				slog.Error("failed to save batch", "batch", id, "error", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// batchResponseWriter records the response to a request of a batch
+type batchResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *batchResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func (w *batchResponseWriter) Flush() {}
+
+// runRequest runs a request of a batch as the API key k, retrying it while
+// the server is too busy to run it
+func (b *batchRunner) runRequest(ctx context.Context, k *apiKey, input openai.BatchInput) openai.BatchOutput {
+	result := openai.BatchOutput{Id: randomID("batch_req_"), CustomId: input.CustomId}
+
+	// responses are collected whole, so requests are never streamed
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(input.Body, &body); err != nil {
+		result.Error = &openai.BatchOutputError{Code: "invalid_body", Message: "body must be a JSON object"}
+		return result
+	}
+
+	body["stream"] = json.RawMessage("false")
+	bts, err := json.Marshal(body)
+	if err != nil {
+		result.Error = &openai.BatchOutputError{Code: "invalid_body", Message: err.Error()}
+		return result
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(withAPIKey(ctx, k), http.MethodPost, "http://localhost"+input.Url, bytes.NewReader(bts))
+		if err != nil {
+			result.Error = &openai.BatchOutputError{Code: "invalid_request", Message: err.Error()}
+			return result
+		}
+
+		req.RemoteAddr = "127.0.0.1:0"
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Ollama-Priority", PriorityLow)
+
+		w := &batchResponseWriter{header: make(http.Header), code: http.StatusOK}
+		b.handler.ServeHTTP(w, req)
+
+		busy := w.code == http.StatusTooManyRequests || w.code == http.StatusServiceUnavailable
+		if busy && attempt < batchRetries {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(attempt+1) * time.Second):
+				continue
+			}
+		}
+
+		respBody := json.RawMessage(bytes.TrimSpace(w.body.Bytes()))
+		if !json.Valid(respBody) {
+			respBody, _ = json.Marshal(openai.NewError(w.code, strings.TrimSpace(w.body.String())))
+		}
+
+		result.Response = &openai.BatchOutputResponse{
+			StatusCode: w.code,
+			RequestId:  randomID("req_"),
+			Body:       respBody,
+		}
+		return result
+	}
+}
+
+// finalize ends a batch with status, turning its output into files
+func (b *batchRunner) finalize(id, status string) {
+	b.update(id, func(j *batchJob) {
+		now := time.Now().Unix()
+		j.Status = "finalizing"
+		j.FinalizingAt = &now
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	j := b.batches[id]
+	for _, kind := range []string{"output", "errors"} {
+		path := b.outputPath(id, kind)
+		fi, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			slog.Error("failed to read batch output", "batch", id, "error", err)
+			continue
+		}
+
+		if fi.Size() == 0 {
+			os.Remove(path)
+			continue
+		}
+
+		f := &batchFile{
+			File: openai.File{
+				Id:        randomID("file-"),
+				Object:    "file",
+				Bytes:     fi.Size(),
+				CreatedAt: time.Now().Unix(),
+				Filename:  fmt.Sprintf("%s_%s.jsonl", id, kind),
+				Purpose:   "batch_output",
+			},
+			Owner: j.Owner,
+		}
+
+		if err := os.Rename(path, b.filePath(f.Id)); err != nil {
+			slog.Error("failed to move batch output", "batch", id, "error", err)
+			continue
+		}
+
+		if err := b.saveFile(f); err != nil {
+			slog.Error("failed to save batch output", "batch", id, "error", err)
+			continue
+		}
+
+		if kind == "output" {
+			j.OutputFileId = &f.Id
+		} else {
+			j.ErrorFileId = &f.Id
+		}
+	}
+
+	now := time.Now().Unix()
+	j.Status = status
+	switch status {
+	case "completed":
+		j.CompletedAt = &now
+	case "cancelled":
+		j.CancelledAt = &now
+	case "expired":
+		j.ExpiredAt = &now
+	}
+
+	if err := b.saveBatch(j); err != nil {
+		slog.Error("failed to save batch", "batch", id, "error", err)
+	}
+}
+
+// batchOwner returns the name of the key making the request and
+// whether it may see everyone's files and batches
+func batchOwner(c *gin.Context) (string, bool) {
+	k := apiKeyFromContext(c)
+	if k == nil {
+		return "", true
+	}
+
+	return k.Name, k.allows(scopeAdmin)
+}
+
+func (s *Server) batchRunner(c *gin.Context) (*batchRunner, bool) {
+	if s.batches == nil {
+		abortWithError(c, http.StatusNotFound, "batches are not enabled")
+		return nil, false
+	}
+
+	return s.batches, true
+}
+
+// file returns the file named in the request if the key making the request
+// owns it
+func (s *Server) file(c *gin.Context) (*batchRunner, openai.File, bool) {
+	b, ok := s.batchRunner(c)
+	if !ok {
+		return nil, openai.File{}, false
+	}
+
+	owner, all := batchOwner(c)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f, ok := b.files[c.Param("file")]
+	if !ok || (!all && f.Owner != owner) {
+		abortWithError(c, http.StatusNotFound, fmt.Sprintf("file %q not found", c.Param("file")))
+		return nil, openai.File{}, false
+	}
+
+	return b, f.File, true
+}
+
+// limitFileSize caps the size of file uploads. It runs before the other
+// middleware of the route so none of them read more than the cap either.
+func limitFileSize(c *gin.Context) {
+	if n := envconfig.BatchMaxFileSize(); n > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, int64(n))
+	}
+
+	c.Next()
+}
+
+func (s *Server) CreateFileHandler(c *gin.Context) {
+	b, ok := s.batchRunner(c)
+	if !ok {
+		return
+	}
+
+	var maxErr *http.MaxBytesError
+	if _, err := c.MultipartForm(); errors.As(err, &maxErr) {
+		abortWithError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("file exceeds the maximum size of %d bytes", maxErr.Limit))
+		return
+	}
+
+	if purpose := c.PostForm("purpose"); purpose != "batch" {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("invalid purpose %q, expected batch", purpose))
+		return
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "file is required")
+		return
+	}
+
+	r, err := fh.Open()
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Close()
+
+	owner, _ := batchOwner(c)
+	f, err := b.createFile(r, fh.Filename, "batch", owner)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, f.File)
+}
+
+func (s *Server) ListFilesHandler(c *gin.Context) {
+	b, ok := s.batchRunner(c)
+	if !ok {
+		return
+	}
+
+	owner, all := batchOwner(c)
+	purpose := c.Query("purpose")
+
+	b.mu.Lock()
+	files := []openai.File{}
+	for _, f := range b.files {
+		if (all || f.Owner == owner) && (purpose == "" || f.Purpose == purpose) {
+			files = append(files, f.File)
+		}
+	}
+	b.mu.Unlock()
+
+	slices.SortFunc(files, func(a, b openai.File) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), strings.Compare(a.Id, b.Id))
+	})
+
+	c.JSON(http.StatusOK, openai.FileList{Object: "list", Data: files})
+}
+
+func (s *Server) RetrieveFileHandler(c *gin.Context) {
+	if _, f, ok := s.file(c); ok {
+		c.JSON(http.StatusOK, f)
+	}
+}
+
+func (s *Server) FileContentHandler(c *gin.Context) {
+	b, f, ok := s.file(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.Filename))
+	c.File(b.filePath(f.Id))
+}
+
+func (s *Server) DeleteFileHandler(c *gin.Context) {
+	b, f, ok := s.file(c)
+	if !ok {
+		return
+	}
+
+	if err := b.deleteFile(f.Id); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, openai.DeletedFile{Id: f.Id, Object: "file", Deleted: true})
+}
+
+func (s *Server) CreateBatchHandler(c *gin.Context) {
+	b, ok := s.batchRunner(c)
+	if !ok {
+		return
+	}
+
+	var req openai.BatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !slices.Contains(batchEndpoints, req.Endpoint) {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("invalid endpoint %q, expected one of %s", req.Endpoint, strings.Join(batchEndpoints, ", ")))
+		return
+	}
+
+	if req.CompletionWindow != "24h" {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("invalid completion_window %q, expected 24h", req.CompletionWindow))
+		return
+	}
+
+	owner, all := batchOwner(c)
+
+	b.mu.Lock()
+	f, ok := b.files[req.InputFileId]
+	b.mu.Unlock()
+
+	if !ok || (!all && f.Owner != owner) {
+		abortWithError(c, http.StatusNotFound, fmt.Sprintf("file %q not found", req.InputFileId))
+		return
+	} else if f.Purpose != "batch" {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("file %q must have purpose batch", req.InputFileId))
+		return
+	}
+
+	j, err := b.createBatch(req, owner)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, j.Batch)
+}
+
+// batch returns the batch named in the request if the key making the
+// request owns it
+func (s *Server) batch(c *gin.Context) (*batchRunner, openai.Batch, bool) {
+	b, ok := s.batchRunner(c)
+	if !ok {
+		return nil, openai.Batch{}, false
+	}
+
+	owner, all := batchOwner(c)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	j, ok := b.batches[c.Param("batch")]
+	if !ok || (!all && j.Owner != owner) {
+		abortWithError(c, http.StatusNotFound, fmt.Sprintf("batch %q not found", c.Param("batch")))
+		return nil, openai.Batch{}, false
+	}
+
+	return b, j.Batch, true
+}
+
+func (s *Server) ListBatchesHandler(c *gin.Context) {
+	b, ok := s.batchRunner(c)
+	if !ok {
+		return
+	}
+
+	limit := 20
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			abortWithError(c, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+
+		limit = n
+	}
+
+	owner, all := batchOwner(c)
+
+	b.mu.Lock()
+	batches := []openai.Batch{}
+	for _, j := range b.batches {
+		if all || j.Owner == owner {
+			batches = append(batches, j.Batch)
+		}
+	}
+	b.mu.Unlock()
+
+	// newest first, and paged after the batch named by after
+	slices.SortFunc(batches, func(a, b openai.Batch) int {
+		return cmp.Or(cmp.Compare(b.CreatedAt, a.CreatedAt), strings.Compare(b.Id, a.Id))
+	})
+
+	if after := c.Query("after"); after != "" {
+		i := slices.IndexFunc(batches, func(b openai.Batch) bool { return b.Id == after })
+		if i < 0 {
+			abortWithError(c, http.StatusBadRequest, fmt.Sprintf("batch %q not found", after))
+			return
+		}
+
+		batches = batches[i+1:]
+	}
+
+	list := openai.BatchList{Object: "list", Data: batches}
+	if len(batches) > limit {
+		list.Data, list.HasMore = batches[:limit], true
+	}
+
+	if len(list.Data) > 0 {
+		list.FirstId, list.LastId = &list.Data[0].Id, &list.Data[len(list.Data)-1].Id
+	}
+
+	c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) RetrieveBatchHandler(c *gin.Context) {
+	if _, j, ok := s.batch(c); ok {
+		c.JSON(http.StatusOK, j)
+	}
+}
+
+func (s *Server) CancelBatchHandler(c *gin.Context) {
+	b, j, ok := s.batch(c)
+	if !ok {
+		return
+	}
+
+	cancelled, err := b.cancelBatch(j.Id)
+	if err != nil {
+		abortWithError(c, http.StatusConflict, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, cancelled.Batch)
+}
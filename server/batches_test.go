@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/openai"
+)
+
+// batchHandler stands in for the server's routes when running batches
+type batchHandler struct {
+	mu       sync.Mutex
+	requests []map[string]any
+
+	// block holds requests until their context is done
+	block bool
+}
+
+func (h *batchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body["priority"] = r.Header.Get("X-Ollama-Priority")
+
+	h.mu.Lock()
+	h.requests = append(h.requests, body)
+	h.mu.Unlock()
+
+	if h.block {
+		<-r.Context().Done()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if body["model"] != "test" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(openai.NewError(http.StatusNotFound, fmt.Sprintf("model %q not found", body["model"])))
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{"object": "chat.completion", "model": body["model"]})
+}
+
+func (h *batchHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.requests)
+}
+
+func batchInput(t *testing.T, ids ...string) string {
+	t.Helper()
+
+	var sb strings.Builder
+	for _, id := range ids {
+		model := "test"
+		if strings.HasPrefix(id, "missing") {
+			model = "missing"
+		}
+
+		bts, err := json.Marshal(openai.BatchInput{
+			CustomId: id,
+			Method:   http.MethodPost,
+			Url:      "/v1/chat/completions",
+			Body:     json.RawMessage(fmt.Sprintf(`{"model": %q, "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`, model)),
+		})
+		require.NoError(t, err)
+
+		sb.Write(bts)
+		sb.WriteByte('\n')
+	}
+
+	return sb.String()
+}
+
+func TestBatches(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	b, err := newBatchRunner(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	s := Server{batches: b}
+	router := s.GenerateRoutes()
+
+	do := func(method, path string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(method, path, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	upload := func(content string) openai.File {
+		t.Helper()
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		require.NoError(t, mw.WriteField("purpose", "batch"))
+		fw, err := mw.CreateFormFile("file", "input.jsonl")
+		require.NoError(t, err)
+		_, err = fw.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, mw.Close())
+
+		w := do(http.MethodPost, "/v1/files", &body, mw.FormDataContentType())
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var f openai.File
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&f))
+		return f
+	}
+
+	create := func(fileID string) openai.Batch {
+		t.Helper()
+
+		bts, err := json.Marshal(openai.BatchRequest{InputFileId: fileID, Endpoint: "/v1/chat/completions", CompletionWindow: "24h"})
+		require.NoError(t, err)
+
+		w := do(http.MethodPost, "/v1/batches", bytes.NewReader(bts), "application/json")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var batch openai.Batch
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&batch))
+		return batch
+	}
+
+	wait := func(id string, statuses ...string) openai.Batch {
+		t.Helper()
+
+		var batch openai.Batch
+		require.Eventually(t, func() bool {
+			w := do(http.MethodGet, "/v1/batches/"+id, nil, "")
+			require.Equal(t, http.StatusOK, w.Code)
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&batch))
+			for _, status := range statuses {
+				if batch.Status == status {
+					return true
+				}
+			}
+
+			return false
+		}, 5*time.Second, 10*time.Millisecond)
+		return batch
+	}
+
+	content := func(id string) []openai.BatchOutput {
+		t.Helper()
+
+		w := do(http.MethodGet, "/v1/files/"+id+"/content", nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var outputs []openai.BatchOutput
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			var output openai.BatchOutput
+			require.NoError(t, json.Unmarshal([]byte(line), &output))
+			outputs = append(outputs, output)
+		}
+
+		return outputs
+	}
+
+	run := func(h http.Handler) context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			b.Run(ctx, h)
+			close(done)
+		}()
+
+		return func() {
+			cancel()
+			<-done
+		}
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		h := &batchHandler{}
+		stop := run(h)
+		defer stop()
+
+		f := upload(batchInput(t, "a", "b", "missing"))
+		require.Equal(t, "batch", f.Purpose)
+		require.Equal(t, "input.jsonl", f.Filename)
+
+		batch := create(f.Id)
+		require.Equal(t, "batch", batch.Object)
+
+		batch = wait(batch.Id, "completed")
+		require.Equal(t, openai.BatchRequestCounts{Total: 3, Completed: 2, Failed: 1}, batch.RequestCounts)
+		require.NotNil(t, batch.InProgressAt)
+		require.NotNil(t, batch.CompletedAt)
+		require.NotNil(t, batch.OutputFileId)
+		require.NotNil(t, batch.ErrorFileId)
+
+		for _, req := range h.requests {
+			require.Equal(t, false, req["stream"])
+			require.Equal(t, PriorityLow, req["priority"])
+		}
+
+		outputs := content(*batch.OutputFileId)
+		require.Len(t, outputs, 2)
+		require.ElementsMatch(t, []string{"a", "b"}, []string{outputs[0].CustomId, outputs[1].CustomId})
+		require.Equal(t, http.StatusOK, outputs[0].Response.StatusCode)
+		require.JSONEq(t, `{"object": "chat.completion", "model": "test"}`, string(outputs[0].Response.Body))
+
+		errs := content(*batch.ErrorFileId)
+		require.Len(t, errs, 1)
+		require.Equal(t, "missing", errs[0].CustomId)
+		require.Equal(t, http.StatusNotFound, errs[0].Response.StatusCode)
+
+		w := do(http.MethodGet, "/v1/files?purpose=batch_output", nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var files openai.FileList
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&files))
+		require.Len(t, files.Data, 2)
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		stop := run(&batchHandler{})
+		defer stop()
+
+		input := batchInput(t, "a") + `{"custom_id": "b", "method": "POST", "url": "/v1/embeddings", "body": {}}` + "\n"
+		batch := wait(create(upload(input).Id).Id, "failed")
+		require.NotNil(t, batch.Errors)
+		require.Len(t, batch.Errors.Data, 1)
+		require.Equal(t, "mismatched_endpoint", batch.Errors.Data[0].Code)
+		require.Equal(t, 2, *batch.Errors.Data[0].Line)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		h := &batchHandler{block: true}
+		stop := run(h)
+		defer stop()
+
+		batch := create(upload(batchInput(t, "a", "b")).Id)
+		wait(batch.Id, "in_progress")
+		require.Eventually(t, func() bool { return h.count() > 0 }, 5*time.Second, 10*time.Millisecond)
+
+		w := do(http.MethodPost, "/v1/batches/"+batch.Id+"/cancel", nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		batch = wait(batch.Id, "cancelled")
+		require.NotNil(t, batch.CancellingAt)
+		require.NotNil(t, batch.CancelledAt)
+		require.Nil(t, batch.OutputFileId)
+
+		w = do(http.MethodPost, "/v1/batches/"+batch.Id+"/cancel", nil, "")
+		require.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		f := upload(batchInput(t, "a", "b", "c"))
+		j, err := b.createBatch(openai.BatchRequest{InputFileId: f.Id, Endpoint: "/v1/chat/completions", CompletionWindow: "24h"}, "")
+		require.NoError(t, err)
+
+		// the server stopped after the first request of the batch
+		b.update(j.Id, func(j *batchJob) {
+			j.Status = "in_progress"
+			j.RequestCounts.Total = 3
+		})
+
+		bts, err := json.Marshal(openai.BatchOutput{Id: "batch_req_a", CustomId: "a", Response: &openai.BatchOutputResponse{StatusCode: http.StatusOK, Body: json.RawMessage(`{}`)}})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(b.outputPath(j.Id, "output"), append(bts, '\n'), 0o644))
+
+		b, err = newBatchRunner(b.dir, nil)
+		require.NoError(t, err)
+		s.batches = b
+
+		h := &batchHandler{}
+		stop := run(h)
+		defer stop()
+
+		batch := wait(j.Id, "completed")
+		require.Equal(t, openai.BatchRequestCounts{Total: 3, Completed: 3}, batch.RequestCounts)
+		require.Equal(t, 2, h.count())
+		require.Len(t, content(*batch.OutputFileId), 3)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := do(http.MethodGet, "/v1/batches?limit=2", nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var list openai.BatchList
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+		require.Len(t, list.Data, 2)
+		require.True(t, list.HasMore)
+
+		w = do(http.MethodGet, "/v1/batches?after="+*list.LastId, nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&list))
+		require.Len(t, list.Data, 2)
+		require.False(t, list.HasMore)
+	})
+
+	t.Run("list unknown after", func(t *testing.T) {
+		w := do(http.MethodGet, "/v1/batches?after=batch_missing", nil, "")
+		require.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("file too large", func(t *testing.T) {
+		t.Setenv("OLLAMA_BATCH_MAX_FILE_SIZE", "1024")
+
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		require.NoError(t, mw.WriteField("purpose", "batch"))
+		fw, err := mw.CreateFormFile("file", "input.jsonl")
+		require.NoError(t, err)
+		_, err = fw.Write([]byte(batchInput(t, "a", "b", "c", "d", "e", "f", "g", "h")))
+		require.NoError(t, err)
+		require.NoError(t, mw.Close())
+
+		w := do(http.MethodPost, "/v1/files", &body, mw.FormDataContentType())
+		require.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+
+		upload(batchInput(t, "a"))
+	})
+
+	t.Run("cancel before run", func(t *testing.T) {
+		f := upload(batchInput(t, "a"))
+		j, err := b.createBatch(openai.BatchRequest{InputFileId: f.Id, Endpoint: "/v1/chat/completions", CompletionWindow: "24h"}, "")
+		require.NoError(t, err)
+
+		// the batch is cancelled after it's picked to run but before it starts
+		picked := b.next()
+		require.Equal(t, j.Id, picked.Id)
+		_, err = b.cancelBatch(j.Id)
+		require.NoError(t, err)
+
+		h := &batchHandler{}
+		b.handler = h
+		b.run(context.Background(), picked)
+
+		w := do(http.MethodGet, "/v1/batches/"+j.Id, nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var batch openai.Batch
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&batch))
+		require.Equal(t, "cancelled", batch.Status)
+		require.Nil(t, batch.InProgressAt)
+		require.Zero(t, h.count())
+	})
+
+	t.Run("delete file", func(t *testing.T) {
+		f := upload(batchInput(t, "a"))
+
+		w := do(http.MethodDelete, "/v1/files/"+f.Id, nil, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = do(http.MethodGet, "/v1/files/"+f.Id, nil, "")
+		require.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestBatchesOwner(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	b, err := newBatchRunner(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	f, err := b.createFile(strings.NewReader(batchInput(t, "a")), "input.jsonl", "batch", "alice")
+	require.NoError(t, err)
+
+	s := Server{batches: b, keys: apiKeys{
+		{Name: "alice", Key: "alice", Scope: scopeInference},
+		{Name: "bob", Key: "bob", Scope: scopeInference},
+		{Name: "admin", Key: "admin", Scope: scopeAdmin},
+	}}
+	router := s.GenerateRoutes()
+
+	for _, tt := range []struct {
+		key  string
+		code int
+	}{
+		{"alice", http.StatusOK},
+		{"bob", http.StatusNotFound},
+		{"admin", http.StatusOK},
+	} {
+		t.Run(tt.key, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/files/"+f.Id, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func TestBatchesOwnerWithoutKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var input openai.BatchInput
+	require.NoError(t, json.Unmarshal([]byte(batchInput(t, "a")), &input))
+
+	for _, tt := range []struct {
+		name string
+		keys apiKeys
+		code int
+	}{
+		{"auth disabled", nil, http.StatusOK},
+		{"auth enabled", apiKeys{{Name: "alice", Key: "alice", Scope: scopeInference}}, http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newBatchRunner(t.TempDir(), tt.keys)
+			require.NoError(t, err)
+
+			r := gin.New()
+			r.Use(authMiddleware(tt.keys))
+			r.POST("/v1/chat/completions", func(c *gin.Context) {
+				require.Nil(t, apiKeyFromContext(c))
+				c.JSON(http.StatusOK, gin.H{"object": "chat.completion"})
+			})
+			b.handler = r
+
+			// the owner of a batch created while authentication was disabled
+			// has no key, and its requests get no more access than a client
+			// without one
+			result := b.runRequest(context.Background(), nil, input)
+			require.Nil(t, result.Error)
+			require.Equal(t, tt.code, result.Response.StatusCode)
+		})
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestBatchesUploadAudited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_BATCH_MAX_FILE_SIZE", "1024")
+
+	b, err := newBatchRunner(t.TempDir(), nil)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := openAuditLog(path, 0, 0, false)
+	require.NoError(t, err)
+	defer l.Close()
+
+	s := Server{batches: b, audit: l}
+	router := s.GenerateRoutes()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.NoError(t, mw.WriteField("purpose", "batch"))
+	fw, err := mw.CreateFormFile("file", "input.jsonl")
+	require.NoError(t, err)
+	_, err = fw.Write(bytes.Repeat([]byte(batchInput(t, "a")), 1024))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	r := &countingReader{r: &body}
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", r)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+
+	// the audit log doesn't read the upload past the cap
+	require.Less(t, r.n, 64*1024)
+
+	entries := readAuditLog(t, path)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/v1/files", entries[0].Route)
+	require.Equal(t, http.StatusRequestEntityTooLarge, entries[0].Status)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// embedBatchDelay is how long an embedding input waits for inputs of other
+// requests to join its runner batch
+var embedBatchDelay = 5 * time.Millisecond
+
+type embedFunc func(context.Context, []string) ([][]float32, error)
+
+// embedBatcher merges the inputs of concurrent embedding requests into runner
+// batches of up to numBatch tokens, sending a batch once it's full or its
+// first input has waited for embedBatchDelay
+type embedBatcher struct {
+	embed    embedFunc
+	numBatch int
+
+	mu      sync.Mutex
+	pending []*embedInput
+	tokens  int
+
+	// batch counts the batches sent, so a timer of a batch already sent
+	// doesn't send the next one early
+	batch int
+	timer *time.Timer
+}
+
+type embedInput struct {
+	ctx    context.Context
+	text   string
+	tokens int
+	done   chan embedResult
+}
+
+type embedResult struct {
+	embedding []float32
+	err       error
+}
+
+func newEmbedBatcher(embed embedFunc, numBatch int) *embedBatcher {
+	return &embedBatcher{embed: embed, numBatch: max(numBatch, 1)}
+}
+
+// Embed embeds inputs, which take tokens[i] tokens each, in batches shared
+// with other requests and returns their embeddings in the same order
+func (b *embedBatcher) Embed(ctx context.Context, inputs []string, tokens []int) ([][]float32, error) {
+	ins := make([]*embedInput, len(inputs))
+	for i, text := range inputs {
+		ins[i] = &embedInput{ctx: ctx, text: text, tokens: tokens[i], done: make(chan embedResult, 1)}
+	}
+
+	b.add(ins)
+
+	embeddings := make([][]float32, len(inputs))
+	for i, in := range ins {
+		select {
+		case r := <-in.done:
+			if r.err != nil {
+				return nil, r.err
+			}
+
+			embeddings[i] = r.embedding
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return embeddings, nil
+}
+
+func (b *embedBatcher) add(ins []*embedInput) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, in := range ins {
+		if len(b.pending) > 0 && b.tokens+in.tokens > b.numBatch {
+			b.send()
+		}
+
+		b.pending = append(b.pending, in)
+		b.tokens += in.tokens
+		if b.tokens >= b.numBatch {
+			b.send()
+		}
+	}
+
+	if len(b.pending) > 0 && b.timer == nil {
+		batch := b.batch
+		b.timer = time.AfterFunc(embedBatchDelay, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			if b.batch == batch {
+				b.send()
+			}
+		})
+	}
+}
+
+// send runs the pending inputs as a batch. The mu must already be held.
+func (b *embedBatcher) send() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	batch := b.pending
+	b.pending = nil
+	b.tokens = 0
+	b.batch++
+
+	if len(batch) > 0 {
+		go b.run(batch)
+	}
+}
+
+func (b *embedBatcher) run(batch []*embedInput) {
+	// inputs of requests which were canceled while they waited are left out
+	var texts []string
+	var ins []*embedInput
+	for _, in := range batch {
+		if in.ctx.Err() == nil {
+			texts = append(texts, in.text)
+			ins = append(ins, in)
+		}
+	}
+
+	if len(ins) == 0 {
+		return
+	}
+
+	// the batch isn't canceled with any one of the requests in it
+	embeddings, err := b.embed(context.Background(), texts)
+	if err != nil {
+		slog.Debug("embedding batch failed", "inputs", len(ins), "error", err)
+	}
+
+	for i, in := range ins {
+		if err != nil {
+			in.done <- embedResult{err: err}
+		} else {
+			in.done <- embedResult{embedding: embeddings[i]}
+		}
+	}
+}
+
+// embedBatcher returns the runner's embedding batcher, creating it with
+// batches of numBatch tokens when it's first used
+func (runner *runnerRef) embedBatcher(numBatch int) *embedBatcher {
+	runner.embedMu.Lock()
+	defer runner.embedMu.Unlock()
+
+	if runner.embedder == nil {
+		runner.embedder = newEmbedBatcher(runner.llama.Embeddings, numBatch)
+	}
+
+	return runner.embedder
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordEmbed returns an embedFunc that embeds each input as its length and
+// records the inputs of every batch
+func recordEmbed(batches *[][]string, mu *sync.Mutex) embedFunc {
+	return func(_ context.Context, inputs []string) ([][]float32, error) {
+		mu.Lock()
+		*batches = append(*batches, inputs)
+		mu.Unlock()
+
+		embeddings := make([][]float32, len(inputs))
+		for i, input := range inputs {
+			embeddings[i] = []float32{float32(len(input))}
+		}
+
+		return embeddings, nil
+	}
+}
+
+func TestEmbedBatcherMerges(t *testing.T) {
+	embedBatchDelay = 50 * time.Millisecond
+	defer func() { embedBatchDelay = 5 * time.Millisecond }()
+
+	var mu sync.Mutex
+	var batches [][]string
+	b := newEmbedBatcher(recordEmbed(&batches, &mu), 512)
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			inputs := []string{fmt.Sprintf("%*s", i+1, ""), fmt.Sprintf("%*s", i+11, "")}
+			embeddings, err := b.Embed(context.Background(), inputs, []int{1, 1})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			for j, input := range inputs {
+				if len(embeddings[j]) != 1 || embeddings[j][0] != float32(len(input)) {
+					t.Errorf("expected embedding of input %d of request %d to be [%d], got %v", j, i, len(input), embeddings[j])
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(batches) >= 10 {
+		t.Errorf("expected requests to be merged into fewer batches, got %d", len(batches))
+	}
+
+	var n int
+	for _, batch := range batches {
+		n += len(batch)
+	}
+
+	if n != 20 {
+		t.Errorf("expected 20 inputs, got %d", n)
+	}
+}
+
+func TestEmbedBatcherNumBatch(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]string
+	b := newEmbedBatcher(recordEmbed(&batches, &mu), 4)
+
+	inputs := []string{"a", "bb", "ccc", "dddd", "eeeee", "f"}
+	tokens := []int{2, 2, 2, 5, 1, 1}
+	embeddings, err := b.Embed(context.Background(), inputs, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, input := range inputs {
+		if embeddings[i][0] != float32(len(input)) {
+			t.Errorf("expected embedding of %q to be [%d], got %v", input, len(input), embeddings[i])
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	slices.SortFunc(batches, func(a, b []string) int { return len(a[0]) - len(b[0]) })
+	expect := [][]string{{"a", "bb"}, {"ccc"}, {"dddd"}, {"eeeee", "f"}}
+	if len(batches) != len(expect) {
+		t.Fatalf("expected batches %v, got %v", expect, batches)
+	}
+
+	for i := range expect {
+		if !slices.Equal(batches[i], expect[i]) {
+			t.Errorf("expected batches %v, got %v", expect, batches)
+		}
+	}
+}
+
+func TestEmbedBatcherError(t *testing.T) {
+	b := newEmbedBatcher(func(context.Context, []string) ([][]float32, error) {
+		return nil, errors.New("runner failed")
+	}, 512)
+
+	if _, err := b.Embed(context.Background(), []string{"a", "b"}, []int{1, 1}); err == nil || err.Error() != "runner failed" {
+		t.Errorf("expected runner error, got %v", err)
+	}
+}
+
+func TestEmbedBatcherCanceled(t *testing.T) {
+	embedBatchDelay = 50 * time.Millisecond
+	defer func() { embedBatchDelay = 5 * time.Millisecond }()
+
+	var mu sync.Mutex
+	var batches [][]string
+	b := newEmbedBatcher(recordEmbed(&batches, &mu), 512)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := b.Embed(ctx, []string{"canceled"}, []int{1})
+		errCh <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if _, err := b.Embed(context.Background(), []string{"kept"}, []int{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected canceled request to fail with %v, got %v", context.Canceled, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(batches) != 1 || !slices.Equal(batches[0], []string{"kept"}) {
+		t.Errorf("expected one batch of the request which wasn't canceled, got %v", batches)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"os"
@@ -39,6 +40,7 @@ var (
 	errCapabilityCompletion = errors.New("completion")
 	errCapabilityTools      = errors.New("tools")
 	errCapabilityInsert     = errors.New("insert")
+	errCapabilityVision     = errors.New("vision")
 )
 
 type Capability string
@@ -47,6 +49,7 @@ const (
 	CapabilityCompletion = Capability("completion")
 	CapabilityTools      = Capability("tools")
 	CapabilityInsert     = Capability("insert")
+	CapabilityVision     = Capability("vision")
 )
 
 type registryOptions struct {
@@ -66,6 +69,7 @@ type Model struct {
 	ParentModel    string
 	AdapterPaths   []string
 	ProjectorPaths []string
+	DraftPath      string
 	System         string
 	License        []string
 	Digest         string
@@ -108,6 +112,10 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 			if !slices.Contains(vars, "suffix") {
 				errs = append(errs, errCapabilityInsert)
 			}
+		case CapabilityVision:
+			if len(m.ProjectorPaths) == 0 {
+				errs = append(errs, errCapabilityVision)
+			}
 		default:
 			slog.Error("unknown capability", "capability", cap)
 			return fmt.Errorf("unknown capability: %s", cap)
@@ -121,6 +129,18 @@ func (m *Model) CheckCapabilities(caps ...Capability) error {
 	return nil
 }
 
+// Capabilities returns the capabilities the model has
+func (m *Model) Capabilities() []Capability {
+	var caps []Capability
+	for _, cap := range []Capability{CapabilityCompletion, CapabilityTools, CapabilityInsert, CapabilityVision} {
+		if m.CheckCapabilities(cap) == nil {
+			caps = append(caps, cap)
+		}
+	}
+
+	return caps
+}
+
 func (m *Model) String() string {
 	var modelfile parser.File
 
@@ -143,6 +163,13 @@ func (m *Model) String() string {
 		})
 	}
 
+	if m.DraftPath != "" {
+		modelfile.Commands = append(modelfile.Commands, parser.Command{
+			Name: "draft",
+			Args: m.DraftPath,
+		})
+	}
+
 	if m.Template != nil {
 		modelfile.Commands = append(modelfile.Commands, parser.Command{
 			Name: "template",
@@ -280,6 +307,8 @@ func GetModel(name string) (*Model, error) {
 			model.AdapterPaths = append(model.AdapterPaths, filename)
 		case "application/vnd.ollama.image.projector":
 			model.ProjectorPaths = append(model.ProjectorPaths, filename)
+		case "application/vnd.ollama.image.draft":
+			model.DraftPath = filename
 		case "application/vnd.ollama.image.prompt",
 			"application/vnd.ollama.image.template":
 			bts, err := os.ReadFile(filename)
@@ -486,6 +515,18 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 
 				layers = append(layers, baseLayer.Layer)
 			}
+		case "draft":
+			layer, err := parseDraft(ctx, modelFileDir, c.Args, fn)
+			if err != nil {
+				return err
+			}
+
+			// replace, keeping the blob which may belong to the draft model
+			layers = slices.DeleteFunc(layers, func(layer Layer) bool {
+				return layer.MediaType == mediatype
+			})
+
+			layers = append(layers, layer)
 		case "license", "template", "system":
 			if c.Name == "template" {
 				if _, err := template.Parse(c.Args); err != nil {
@@ -531,6 +572,8 @@ func CreateModel(ctx context.Context, name model.Name, modelFileDir, quantizatio
 			for k, v := range ps {
 				if ks, ok := parameters[k].([]string); ok {
 					parameters[k] = append(ks, v.([]string)...)
+				} else if ms, ok := parameters[k].(map[string]any); ok {
+					maps.Copy(ms, v.(map[string]any))
 				} else if vs, ok := v.([]string); ok {
 					parameters[k] = vs
 				} else {
@@ -713,6 +756,10 @@ func deleteUnusedLayers(deleteMap map[string]struct{}) error {
 			slog.Info(fmt.Sprintf("couldn't remove file '%s': %v", fp, err))
 			continue
 		}
+
+		if err := os.RemoveAll(llm.PromptCacheDir(fp)); err != nil {
+			slog.Info(fmt.Sprintf("couldn't remove prompt caches of '%s': %v", fp, err))
+		}
 	}
 
 	return nil
@@ -0,0 +1,337 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/types/model"
+)
+
+// limits caps how much a client or model may be used. Zero values are
+// unlimited.
+type limits struct {
+	RequestsPerMinute int   `json:"requests_per_minute,omitempty"`
+	MaxConcurrent     int   `json:"max_concurrent,omitempty"`
+	TokensPerDay      int64 `json:"tokens_per_day,omitempty"`
+}
+
+func (l limits) unlimited() bool {
+	return l == limits{}
+}
+
+// limitsConfig is read from the file named by OLLAMA_LIMITS_FILE
+//
+//	{
+//	  "clients": {"requests_per_minute": 60, "max_concurrent": 2, "tokens_per_day": 1000000},
+//	  "models": {"llama3:70b": {"max_concurrent": 1}}
+//	}
+//
+// Clients are identified by API key, or by address when authentication is
+// disabled. Model limits apply across all clients and are keyed by model name
+// patterns as used by API keys.
+type limitsConfig struct {
+	Clients limits            `json:"clients"`
+	Models  map[string]limits `json:"models"`
+}
+
+func loadLimits(path string) (*limitsConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config limitsConfig
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &config, nil
+}
+
+// errLimited describes why a request was rejected and when it may be retried
+type errLimited struct {
+	message    string
+	retryAfter time.Duration
+}
+
+func (e errLimited) Error() string {
+	return e.message
+}
+
+// limitState tracks usage of a single client or model
+type limitState struct {
+	mu sync.Mutex
+
+	// requests is a token bucket refilled at RequestsPerMinute
+	requests float64
+	refilled time.Time
+
+	active int
+
+	// used counts tokens since the start of day, in UTC
+	used int64
+	day  time.Time
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// admit reserves a request slot if none of the limits are exceeded
+func (st *limitState) admit(l limits, now time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if day := startOfDay(now); !day.Equal(st.day) {
+		st.day, st.used = day, 0
+	}
+
+	if l.TokensPerDay > 0 && st.used >= l.TokensPerDay {
+		return errLimited{
+			message:    fmt.Sprintf("token quota of %d tokens per day exceeded", l.TokensPerDay),
+			retryAfter: st.day.Add(24 * time.Hour).Sub(now),
+		}
+	}
+
+	if l.MaxConcurrent > 0 && st.active >= l.MaxConcurrent {
+		return errLimited{
+			message:    fmt.Sprintf("too many concurrent requests, the limit is %d", l.MaxConcurrent),
+			retryAfter: time.Second,
+		}
+	}
+
+	if l.RequestsPerMinute > 0 {
+		rate := float64(l.RequestsPerMinute) / time.Minute.Seconds()
+		if st.refilled.IsZero() {
+			st.requests = float64(l.RequestsPerMinute)
+		} else {
+			st.requests = min(float64(l.RequestsPerMinute), st.requests+now.Sub(st.refilled).Seconds()*rate)
+		}
+
+		st.refilled = now
+		if st.requests < 1 {
+			return errLimited{
+				message:    fmt.Sprintf("rate limit of %d requests per minute exceeded", l.RequestsPerMinute),
+				retryAfter: time.Duration((1 - st.requests) / rate * float64(time.Second)),
+			}
+		}
+
+		st.requests--
+	}
+
+	st.active++
+	return nil
+}
+
+// release returns the request slot and charges the tokens it used
+func (st *limitState) release(tokens int64, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.active--
+	if day := startOfDay(now); !day.Equal(st.day) {
+		st.day, st.used = day, 0
+	}
+
+	st.used += tokens
+}
+
+// idle reports whether the state holds nothing that a new state wouldn't. A
+// request bucket refills completely within a minute.
+func (st *limitState) idle(now time.Time) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	full := now.Sub(st.refilled) >= time.Minute
+	return st.active == 0 && full && (st.used == 0 || !startOfDay(now).Equal(st.day))
+}
+
+// limiter enforces per client and per model limits
+type limiter struct {
+	config limitsConfig
+
+	mu      sync.Mutex
+	clients map[string]*limitState
+	models  map[string]*limitState
+	pruned  time.Time
+}
+
+func newLimiter(config limitsConfig) *limiter {
+	return &limiter{
+		config:  config,
+		clients: make(map[string]*limitState),
+		models:  make(map[string]*limitState),
+	}
+}
+
+// admit reserves a request slot in the state identified by id, creating it if
+// needed
+func (l *limiter) admit(states map[string]*limitState, id string, lim limits, now time.Time) (*limitState, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// drop idle states, e.g. addresses that haven't been seen for a while, so
+	// the maps don't grow without bound
+	if now.Sub(l.pruned) > time.Minute {
+		for _, m := range []map[string]*limitState{l.clients, l.models} {
+			for k, st := range m {
+				if st.idle(now) {
+					delete(m, k)
+				}
+			}
+		}
+
+		l.pruned = now
+	}
+
+	st, ok := states[id]
+	if !ok {
+		st = &limitState{}
+		states[id] = st
+	}
+
+	return st, st.admit(lim, now)
+}
+
+// modelLimits returns the limits for the most specific pattern matching name
+func (l *limiter) modelLimits(name string) limits {
+	var best string
+	var lim limits
+	for pattern, pl := range l.config.Models {
+		if matchModel(pattern, name) && (best == "" || len(pattern) > len(best) || (len(pattern) == len(best) && pattern < best)) {
+			best, lim = pattern, pl
+		}
+	}
+
+	return lim
+}
+
+// requestUsage accumulates the tokens used by a request so they can be charged
+// against quotas once it completes
+type requestUsage struct {
+	tokens atomic.Int64
+
+	// models are the states of the models the request was admitted to which
+	// have limits. mu guards them, as the prompts of a request may run
+	// concurrently.
+	mu       sync.Mutex
+	admitted bool
+	models   []*limitState
+}
+
+const requestUsageKey = "ollama.usage"
+
+func usageFromContext(c *gin.Context) *requestUsage {
+	if u, ok := c.Get(requestUsageKey); ok {
+		return u.(*requestUsage)
+	}
+
+	return nil
+}
+
+// limitsMiddleware rejects requests from clients that exceed their limits with
+// 429 Too Many Requests. Clients are identified by API key when authentication
+// is enabled and by address otherwise.
+func limitsMiddleware(l *limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if l == nil || c.FullPath() == "/" {
+			c.Next()
+			return
+		}
+
+		id, lim := "addr:"+c.ClientIP(), l.config.Clients
+		if k := apiKeyFromContext(c); k != nil {
+			id = "key:" + k.Name
+			if k.Limits != nil {
+				lim = *k.Limits
+			}
+		}
+
+		u := &requestUsage{}
+		c.Set(requestUsageKey, u)
+		if lim.unlimited() {
+			c.Next()
+		} else {
+			st, err := l.admit(l.clients, id, lim, time.Now())
+			if err != nil {
+				abortLimited(c, err)
+				return
+			}
+
+			c.Next()
+			st.release(u.tokens.Load(), time.Now())
+		}
+
+		for _, st := range u.models {
+			st.release(u.tokens.Load(), time.Now())
+		}
+	}
+}
+
+// admitModel aborts the request with 429 Too Many Requests if any of the named
+// models, such as a model and its draft model, has exceeded its limits
+func (s *Server) admitModel(c *gin.Context, names ...string) bool {
+	u := usageFromContext(c)
+	if s.limits == nil || u == nil {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.admitted {
+		// a request generating several choices is only admitted once
+		return true
+	}
+
+	u.admitted = true
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+
+		lim := s.limits.modelLimits(name)
+		if lim.unlimited() {
+			continue
+		}
+
+		id := name
+		if n := model.ParseName(name); n.IsValid() {
+			id = n.DisplayShortest()
+		}
+
+		// models admitted before one that is rejected are released with the
+		// request
+		st, err := s.limits.admit(s.limits.models, id, lim, time.Now())
+		if err != nil {
+			abortLimited(c, fmt.Errorf("model %q: %w", name, err))
+			return false
+		}
+
+		u.models = append(u.models, st)
+	}
+
+	return true
+}
+
+func abortLimited(c *gin.Context, err error) {
+	var retryAfter time.Duration
+	if e := (errLimited{}); errors.As(err, &e) {
+		retryAfter = e.retryAfter
+	}
+
+	c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	abortWithError(c, http.StatusTooManyRequests, err.Error())
+}
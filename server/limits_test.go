@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ollama/ollama/anthropic"
+	"github.com/ollama/ollama/openai"
+)
+
+func TestLimitState(t *testing.T) {
+	now := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("requests per minute", func(t *testing.T) {
+		var st limitState
+		l := limits{RequestsPerMinute: 2}
+		require.NoError(t, st.admit(l, now))
+		require.NoError(t, st.admit(l, now))
+
+		var e errLimited
+		require.ErrorAs(t, st.admit(l, now), &e)
+		require.Equal(t, 30*time.Second, e.retryAfter)
+
+		require.NoError(t, st.admit(l, now.Add(30*time.Second)))
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		var st limitState
+		l := limits{MaxConcurrent: 1}
+		require.NoError(t, st.admit(l, now))
+		require.Error(t, st.admit(l, now))
+
+		st.release(0, now)
+		require.NoError(t, st.admit(l, now))
+	})
+
+	t.Run("tokens per day", func(t *testing.T) {
+		var st limitState
+		l := limits{TokensPerDay: 100}
+		require.NoError(t, st.admit(l, now))
+		st.release(60, now)
+		require.NoError(t, st.admit(l, now))
+		st.release(60, now)
+
+		var e errLimited
+		require.ErrorAs(t, st.admit(l, now), &e)
+		require.Equal(t, 12*time.Hour, e.retryAfter)
+
+		require.NoError(t, st.admit(l, now.Add(12*time.Hour)))
+	})
+}
+
+func TestModelLimits(t *testing.T) {
+	l := newLimiter(limitsConfig{
+		Models: map[string]limits{
+			"*":          {RequestsPerMinute: 100},
+			"llama3":     {RequestsPerMinute: 10},
+			"llama3:70b": {RequestsPerMinute: 1},
+		},
+	})
+
+	require.Equal(t, 1, l.modelLimits("llama3:70b").RequestsPerMinute)
+	require.Equal(t, 10, l.modelLimits("llama3").RequestsPerMinute)
+	require.Equal(t, 10, l.modelLimits("llama3:8b").RequestsPerMinute)
+	require.Equal(t, 100, l.modelLimits("gemma2").RequestsPerMinute)
+}
+
+func TestLimitsMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := Server{
+		limits: newLimiter(limitsConfig{
+			Clients: limits{TokensPerDay: 15},
+			Models:  map[string]limits{"limited": {RequestsPerMinute: 1}},
+		}),
+	}
+
+	handler := func(c *gin.Context) {
+		model := c.Query("model")
+		if !s.admitModel(c, model) {
+			return
+		}
+
+		recordTokens(c, model, 5, 5)
+		c.Status(http.StatusOK)
+	}
+
+	r := gin.New()
+	r.Use(limitsMiddleware(s.limits))
+	r.POST("/api/generate", handler)
+	r.POST("/v1/completions", handler)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+		return w
+	}
+
+	require.Equal(t, http.StatusOK, do("/api/generate?model=limited").Code)
+
+	w := do("/api/generate?model=limited")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "60", w.Header().Get("Retry-After"))
+	require.JSONEq(t, `{"error": "model \"limited\": rate limit of 1 requests per minute exceeded"}`, w.Body.String())
+
+	// the rejected request didn't use any tokens
+	require.Equal(t, http.StatusOK, do("/api/generate?model=other").Code)
+
+	w = do("/v1/completions?model=other")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	var resp openai.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Equal(t, "rate_limit_error", resp.Error.Type)
+	require.Equal(t, "token quota of 15 tokens per day exceeded", resp.Error.Message)
+}
+
+func TestLimitsCompatRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	lim := limits{RequestsPerMinute: 1}
+	s := Server{limits: newLimiter(limitsConfig{Models: map[string]limits{"limited": lim}})}
+	router := s.GenerateRoutes()
+
+	// use up the model's only request of the minute
+	_, err := s.limits.admit(s.limits.models, "limited:latest", lim, time.Now())
+	require.NoError(t, err)
+
+	for path, body := range map[string]string{
+		"/v1/chat/completions": `{"model": "limited", "messages": [{"role": "user", "content": "Hello!"}]}`,
+		"/v1/completions":      `{"model": "limited", "prompt": "Hello!"}`,
+		"/v1/embeddings":       `{"model": "limited", "input": "Hello!"}`,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		require.Equal(t, http.StatusTooManyRequests, w.Code, path)
+		require.NotEmpty(t, w.Header().Get("Retry-After"), path)
+
+		var resp openai.ErrorResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp), path)
+		require.Equal(t, "rate_limit_error", resp.Error.Type, path)
+		require.Equal(t, `model "limited": rate limit of 1 requests per minute exceeded`, resp.Error.Message, path)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(`{"model": "limited", "max_tokens": 16, "messages": [{"role": "user", "content": "Hello!"}]}`)))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	var resp anthropic.ErrorResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Equal(t, "rate_limit_error", resp.Error.Type)
+}
+
+func TestLimitsDraftModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	lim := limits{RequestsPerMinute: 1}
+	s := Server{limits: newLimiter(limitsConfig{Models: map[string]limits{"limited": lim}})}
+	router := s.GenerateRoutes()
+
+	_, err := s.limits.admit(s.limits.models, "limited:latest", lim, time.Now())
+	require.NoError(t, err)
+
+	for path, body := range map[string]string{
+		"/api/generate": `{"model": "other", "draft": "limited", "prompt": "Hello!"}`,
+		"/api/chat":     `{"model": "other", "draft": "limited"}`,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		require.Equal(t, http.StatusTooManyRequests, w.Code, path)
+		require.JSONEq(t, `{"error": "model \"limited\": rate limit of 1 requests per minute exceeded"}`, w.Body.String(), path)
+	}
+}
+
+func TestLimitsClientAddress(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	do := func(router http.Handler, remote, forwarded string) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-For", forwarded)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("untrusted", func(t *testing.T) {
+		s := Server{limits: newLimiter(limitsConfig{Clients: limits{RequestsPerMinute: 1}})}
+		router := s.GenerateRoutes()
+
+		// a forwarding header can't make the client look like another one
+		require.Equal(t, http.StatusOK, do(router, "10.0.0.1:1234", "192.168.0.1"))
+		require.Equal(t, http.StatusTooManyRequests, do(router, "10.0.0.1:1234", "192.168.0.2"))
+	})
+
+	t.Run("trusted", func(t *testing.T) {
+		t.Setenv("OLLAMA_TRUSTED_PROXIES", "10.0.0.0/8")
+
+		s := Server{limits: newLimiter(limitsConfig{Clients: limits{RequestsPerMinute: 1}})}
+		router := s.GenerateRoutes()
+
+		require.Equal(t, http.StatusOK, do(router, "10.0.0.1:1234", "192.168.0.1"))
+		require.Equal(t, http.StatusOK, do(router, "10.0.0.1:1234", "192.168.0.2"))
+		require.Equal(t, http.StatusTooManyRequests, do(router, "10.0.0.2:1234", "192.168.0.1"))
+	})
+}
+
+func TestAbortLimited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+
+	abortLimited(c, errors.New("plain error"))
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+}
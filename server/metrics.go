@@ -0,0 +1,313 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics are exposed at /metrics in the Prometheus text exposition format.
+// Counters and histograms are recorded as requests are handled; gauges
+// describing the scheduler are sampled when the endpoint is scraped.
+var (
+	requestsTotal   = newCounterVec("ollama_requests_total", "Total number of HTTP requests.", "route", "model", "status")
+	requestDuration = newHistogramVec("ollama_request_duration_seconds", "HTTP request latency in seconds.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "route", "model")
+
+	promptTokensTotal = newCounterVec("ollama_prompt_tokens_total", "Total number of prompt tokens evaluated.", "model")
+	evalTokensTotal   = newCounterVec("ollama_eval_tokens_total", "Total number of tokens generated.", "model")
+
+	chatSessionsTotal = newCounterVec("ollama_chat_session_requests_total", "Total number of chat requests continuing a session, by whether the runner slot holding the session processed them.", "model", "result")
+
+	modelLoadDuration = newHistogramVec("ollama_model_load_duration_seconds", "Time taken to load a model in seconds.", []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "model")
+
+	pullBytesTotal = newCounterVec("ollama_pull_bytes_total", "Total number of bytes downloaded from registries.")
+	pushBytesTotal = newCounterVec("ollama_push_bytes_total", "Total number of bytes uploaded to registries.")
+)
+
+// requestModelKey is the gin context key handlers set to the model named in
+// a request, and metricsModelKey the key set to the name of the model once it
+// has been found. Requests are labeled by the latter so that names from
+// request bodies can't create new series.
+const (
+	requestModelKey = "ollama.request_model"
+	metricsModelKey = "ollama.model"
+)
+
+// setMetricsModel labels the request with the model it was for. It must only
+// be called once the model has been found or loaded.
+func setMetricsModel(c *gin.Context, name string) {
+	c.Set(metricsModelKey, strings.ToLower(name))
+}
+
+type labelSet struct {
+	names  []string
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+func (l *labelSet) key(values []string) string {
+	if len(values) != len(l.names) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(l.names), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	if _, ok := l.values[key]; !ok {
+		l.values[key] = slices.Clone(values)
+	}
+
+	return key
+}
+
+// sortedKeys returns label keys in a stable order. mu must be held.
+func (l *labelSet) sortedKeys() []string {
+	keys := make([]string, 0, len(l.values))
+	for k := range l.values {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+	return keys
+}
+
+func (l *labelSet) format(key string, extra ...string) string {
+	values := l.values[key]
+	pairs := make([]string, 0, len(values)+len(extra)/2)
+	for i, name := range l.names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	name, help string
+	labelSet
+	counts map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:     name,
+		help:     help,
+		labelSet: labelSet{names: labels, values: make(map[string][]string)},
+		counts:   make(map[string]float64),
+	}
+}
+
+func (c *counterVec) Add(v float64, labels ...string) {
+	if v <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[c.key(labels)] += v
+}
+
+func (c *counterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(k), formatFloat(c.counts[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	name, help string
+	buckets    []float64
+	labelSet
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelSet:   labelSet{names: labels, values: make(map[string][]string)},
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) Observe(v float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := h.key(labels)
+	hist, ok := h.histograms[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.histograms[k] = hist
+	}
+
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range h.sortedKeys() {
+		hist := h.histograms[k]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(k, "le", formatFloat(le)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(k), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(k), hist.count)
+	}
+}
+
+// gauge is a single sampled value with its label values
+type gauge struct {
+	labels []string
+	value  float64
+}
+
+func writeGauge(w io.Writer, name, help string, labelNames []string, gauges []gauge) {
+	l := labelSet{names: labelNames, values: make(map[string][]string)}
+	values := make(map[string]float64, len(gauges))
+	for _, g := range gauges {
+		values[l.key(g.labels)] += g.value
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, k := range l.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", name, l.format(k), formatFloat(values[k]))
+	}
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// metricsMiddleware counts requests and their latency by route, model and status code
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		// don't create a series for every unmatched path
+		route = "unmatched"
+	}
+
+	model := c.GetString(metricsModelKey)
+	if model == "" && c.GetString(requestModelKey) != "" {
+		// the model wasn't found, or the request failed before looking it up
+		model = "unknown"
+	}
+
+	requestsTotal.Inc(route, model, strconv.Itoa(c.Writer.Status()))
+	requestDuration.Observe(time.Since(start).Seconds(), route, model)
+}
+
+// recordTokens adds the token counts of a completed request to the per model
+// counters and charges them to the request's quotas
+func recordTokens(c *gin.Context, model string, promptEvalCount, evalCount int) {
+	promptTokensTotal.Add(float64(promptEvalCount), model)
+	evalTokensTotal.Add(float64(evalCount), model)
+	if u := usageFromContext(c); u != nil {
+		u.tokens.Add(int64(promptEvalCount + evalCount))
+	}
+}
+
+// recordSessionHit records whether a chat request continuing a session was
+// processed in the slot holding it
+func recordSessionHit(model string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	chatSessionsTotal.Inc(model, result)
+}
+
+func (s *Server) MetricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	requestsTotal.write(w)
+	requestDuration.write(w)
+	promptTokensTotal.write(w)
+	evalTokensTotal.write(w)
+	chatSessionsTotal.write(w)
+	modelLoadDuration.write(w)
+	pullBytesTotal.write(w)
+	pushBytesTotal.write(w)
+
+	queued := []gauge{
+		{labels: []string{PriorityHigh}},
+		{labels: []string{PriorityNormal}},
+		{labels: []string{PriorityLow}},
+	}
+	for class, n := range s.sched.queue.Depth() {
+		queued = append(queued, gauge{labels: []string{class}, value: float64(n)})
+	}
+	writeGauge(w, "ollama_scheduler_queue_length", "Number of requests waiting to be scheduled.", []string{"priority"}, queued)
+
+	var loaded int
+	var vram []gauge
+	s.sched.loadedMu.Lock()
+	for _, runner := range s.sched.loaded {
+		runner.refMu.Lock()
+		if runner.llama != nil && runner.model != nil {
+			loaded++
+			for _, g := range runner.gpus {
+				vram = append(vram, gauge{
+					labels: []string{runner.model.ShortName, g.Library, g.ID},
+					value:  float64(runner.llama.EstimatedVRAMByGPU(g.ID)),
+				})
+			}
+		}
+		runner.refMu.Unlock()
+	}
+	s.sched.loadedMu.Unlock()
+
+	writeGauge(w, "ollama_loaded_runners", "Number of loaded model runners.", nil, []gauge{{value: float64(loaded)}})
+	writeGauge(w, "ollama_runner_vram_bytes", "Estimated VRAM used by each loaded runner per GPU in bytes.", []string{"model", "library", "gpu"}, vram)
+}
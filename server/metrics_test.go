@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("test_total", "A test counter.", "model", "status")
+	c.Inc("llama3", "200")
+	c.Inc("llama3", "200")
+	c.Add(5, "gemma", "500")
+	c.Add(-1, "gemma", "500")
+
+	var b bytes.Buffer
+	c.write(&b)
+
+	expect := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{model="gemma",status="500"} 5
+test_total{model="llama3",status="200"} 2
+`
+	require.Equal(t, expect, b.String())
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "A test histogram.", []float64{0.5, 1}, "model")
+	h.Observe(0.25, "llama3")
+	h.Observe(0.75, "llama3")
+	h.Observe(2, "llama3")
+
+	var b bytes.Buffer
+	h.write(&b)
+
+	expect := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{model="llama3",le="0.5"} 1
+test_seconds_bucket{model="llama3",le="1"} 2
+test_seconds_bucket{model="llama3",le="+Inf"} 3
+test_seconds_sum{model="llama3"} 3
+test_seconds_count{model="llama3"} 3
+`
+	require.Equal(t, expect, b.String())
+}
+
+func TestMetricsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	s := &Server{
+		sched: &Scheduler{
+			queue:  newFairQueue(),
+			loaded: make(map[string]*runnerRef),
+		},
+	}
+
+	r := gin.New()
+	r.Use(metricsMiddleware)
+	r.GET("/metrics", s.MetricsHandler)
+	r.POST("/api/generate", func(c *gin.Context) {
+		c.Set(metricsModelKey, "test-metrics")
+		recordTokens(c, "test-metrics", 10, 20)
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+
+	body := w.Body.String()
+	for _, line := range []string{
+		`ollama_requests_total{route="/api/generate",model="test-metrics",status="200"} 1`,
+		`ollama_request_duration_seconds_count{route="/api/generate",model="test-metrics"} 1`,
+		`ollama_prompt_tokens_total{model="test-metrics"} 10`,
+		`ollama_eval_tokens_total{model="test-metrics"} 20`,
+		`ollama_scheduler_queue_length{priority="normal"} 0`,
+		`ollama_loaded_runners 0`,
+	} {
+		require.Contains(t, body, line+"\n")
+	}
+}
+
+func TestMetricsUnknownModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := &Server{
+		sched: &Scheduler{
+			queue:  newFairQueue(),
+			loaded: make(map[string]*runnerRef),
+		},
+	}
+
+	router := s.GenerateRoutes()
+	for _, name := range []string{"missing-a8f3", "missing-b2c7"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/show", strings.NewReader(fmt.Sprintf(`{"model": %q}`, name))))
+		require.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// names from request bodies don't create series of their own
+	body := w.Body.String()
+	require.NotContains(t, body, "missing-")
+	require.Contains(t, body, `ollama_requests_total{route="/api/show",model="unknown",status="404"}`)
+}
+
+func TestMetricsCreatedModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := &Server{
+		sched: &Scheduler{
+			queue:  newFairQueue(),
+			loaded: make(map[string]*runnerRef),
+		},
+	}
+
+	// streamed responses need a response writer that notices closed connections
+	srv := httptest.NewServer(s.GenerateRoutes())
+	defer srv.Close()
+
+	for _, stream := range []bool{false, true} {
+		name := fmt.Sprintf("metrics-create-%t", stream)
+		body := fmt.Sprintf(`{"model": %q, "modelfile": "FROM %s", "stream": %t}`, name, createBinFile(t, nil, nil), stream)
+
+		resp, err := http.Post(srv.URL+"/api/create", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// the label is set once the model has been created, in the handler
+	for _, name := range []string{"metrics-create-false:latest", "metrics-create-true:latest"} {
+		require.Contains(t, string(b), fmt.Sprintf(`ollama_requests_total{route="/api/create",model=%q,status="200"}`, name))
+	}
+}
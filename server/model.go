@@ -15,9 +15,12 @@ import (
 	"slices"
 	"strings"
 	"text/template/parse"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/convert"
+	"github.com/ollama/ollama/grammar"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
 	"github.com/ollama/ollama/types/model"
@@ -81,6 +84,66 @@ func parseFromModel(ctx context.Context, name model.Name, fn func(api.ProgressRe
 	return layers, nil
 }
 
+// parseDraft returns the layer of the draft model s, which is a blob digest
+// prefixed with "@", a path to a GGUF file or the name of a model
+func parseDraft(ctx context.Context, modelFileDir, s string, fn func(api.ProgressResponse)) (Layer, error) {
+	const mediatype = "application/vnd.ollama.image.draft"
+
+	var f *os.File
+	var err error
+	if digest, ok := strings.CutPrefix(s, "@"); ok {
+		blobpath, err := GetBlobsPath(digest)
+		if err != nil {
+			return Layer{}, err
+		}
+
+		f, err = os.Open(blobpath)
+		if err != nil {
+			return Layer{}, err
+		}
+	} else if f, err = os.Open(realpath(modelFileDir, s)); errors.Is(err, os.ErrNotExist) {
+		name := model.ParseName(s)
+		if !name.IsValid() {
+			return Layer{}, fmt.Errorf("invalid draft model reference: %s", s)
+		}
+
+		layers, err := parseFromModel(ctx, name, fn)
+		if err != nil {
+			return Layer{}, err
+		}
+
+		for _, layer := range layers {
+			if layer.MediaType == "application/vnd.ollama.image.model" {
+				return NewLayerFromLayer(layer.Digest, mediatype, name.DisplayShortest())
+			}
+		}
+
+		return Layer{}, fmt.Errorf("draft model %s has no model layer", name.DisplayShortest())
+	} else if err != nil {
+		return Layer{}, err
+	}
+	defer f.Close()
+
+	ggml, _, err := llm.DecodeGGML(f, 0)
+	if err != nil {
+		return Layer{}, err
+	}
+
+	if ggml.Name() != "gguf" || ggml.KV().Kind() == "adapter" {
+		return Layer{}, errors.New("draft model must be a GGUF model file")
+	}
+
+	if digest, ok := strings.CutPrefix(s, "@"); ok {
+		return NewLayerFromLayer(digest, mediatype, "")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return Layer{}, err
+	}
+
+	return NewLayer(f, mediatype)
+}
+
 func parseFromZipFile(_ context.Context, command string, baseLayers []*layerGGML, f *os.File, digest string, fn func(api.ProgressResponse)) (layers []*layerGGML, err error) {
 	fi, err := f.Stat()
 	if err != nil {
@@ -272,9 +335,9 @@ func detectContentType(r io.Reader) (string, error) {
 	return "unknown", nil
 }
 
-// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
-// mxyng: this only really works if the input contains tool calls in some JSON format
-func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+// toolCallKeys returns the keys the model's template uses for the name and
+// arguments of a tool call
+func (m *Model) toolCallKeys() (string, string, bool) {
 	// create a subtree from the node that ranges over .ToolCalls
 	tmpl := m.Template.Subtree(func(n parse.Node) bool {
 		if t, ok := n.(*parse.RangeNode); ok {
@@ -285,7 +348,7 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 	})
 
 	if tmpl == nil {
-		return nil, false
+		return "", "", false
 	}
 
 	var b bytes.Buffer
@@ -301,14 +364,14 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 			},
 		},
 	}); err != nil {
-		return nil, false
+		return "", "", false
 	}
 
 	var kv map[string]any
 	// execute the subtree with placeholders to identify the keys
 	// trim any commands that might exist in the template
 	if err := json.Unmarshal(bytes.TrimSuffix(b.Bytes(), []byte(",")), &kv); err != nil {
-		return nil, false
+		return "", "", false
 	}
 
 	// find the keys that correspond to the name and arguments fields
@@ -322,7 +385,93 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 		}
 	}
 
-	if name == "" || arguments == "" {
+	return name, arguments, name != "" && arguments != ""
+}
+
+// toolCallGrammar returns a grammar constraining the model to call one of
+// the tools, or several of them if parallel is true. Calls are JSON objects
+// keyed as in the model's template so they parse with parseToolCalls.
+func (m *Model) toolCallGrammar(tools api.Tools, parallel bool) (string, error) {
+	name, arguments, ok := m.toolCallKeys()
+	if !ok {
+		return "", errors.New("template does not describe tool calls")
+	}
+
+	calls := make([]json.RawMessage, len(tools))
+	for i, tool := range tools {
+		properties := make(map[string]any, len(tool.Function.Parameters.Properties))
+		for k, v := range tool.Function.Parameters.Properties {
+			property := make(map[string]any)
+			if v.Type != "" {
+				property["type"] = v.Type
+			}
+
+			if len(v.Enum) > 0 {
+				property["enum"] = v.Enum
+			}
+
+			properties[k] = property
+		}
+
+		params, err := json.Marshal(map[string]any{
+			"type":       "object",
+			"properties": properties,
+			"required":   tool.Function.Parameters.Required,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		// the name key comes first so the model picks a tool before its arguments
+		fn, err := json.Marshal(tool.Function.Name)
+		if err != nil {
+			return "", err
+		}
+
+		nameKey, err := json.Marshal(name)
+		if err != nil {
+			return "", err
+		}
+
+		argumentsKey, err := json.Marshal(arguments)
+		if err != nil {
+			return "", err
+		}
+
+		calls[i] = json.RawMessage(fmt.Sprintf(`{"type": "object", "properties": {%s: {"const": %s}, %s: %s}, "required": [%[1]s, %[3]s]}`, nameKey, fn, argumentsKey, params))
+	}
+
+	call, err := json.Marshal(map[string]any{"anyOf": calls})
+	if err != nil {
+		return "", err
+	}
+
+	schema := call
+	if parallel {
+		schema, err = json.Marshal(map[string]any{
+			"anyOf": []any{
+				json.RawMessage(call),
+				map[string]any{"type": "array", "items": json.RawMessage(call), "minItems": 1},
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	g, err := grammar.FromSchema(schema)
+	if err != nil {
+		return "", fmt.Errorf("invalid tool parameters: %w", err)
+	}
+
+	return g, nil
+}
+
+// parseToolCalls attempts to parse a JSON string into a slice of ToolCalls.
+// mxyng: this only really works if the input contains tool calls in some JSON format
+func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
+	name, arguments, ok := m.toolCallKeys()
+	if !ok {
 		return nil, false
 	}
 
@@ -381,3 +530,325 @@ func (m *Model) parseToolCalls(s string) ([]api.ToolCall, bool) {
 
 	return toolCalls, len(toolCalls) > 0
 }
+
+// toolCallPrefix returns the text the model's template writes before its
+// tool calls, such as "[TOOL_CALLS] [" or "<tool_call>"
+func (m *Model) toolCallPrefix() string {
+	isToolCalls := func(n parse.Node) bool {
+		if t, ok := n.(*parse.RangeNode); ok {
+			return slices.Contains(template.Identifiers(t.Pipe), "ToolCalls")
+		}
+
+		return false
+	}
+
+	// find the list holding the node that ranges over .ToolCalls
+	tmpl := m.Template.Subtree(func(n parse.Node) bool {
+		if l, ok := n.(*parse.ListNode); ok {
+			return slices.ContainsFunc(l.Nodes, isToolCalls)
+		}
+
+		return false
+	})
+
+	if tmpl == nil {
+		return ""
+	}
+
+	l, ok := tmpl.Tree.Root.Nodes[0].(*parse.ListNode)
+	if !ok {
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, n := range l.Nodes {
+		if isToolCalls(n) {
+			break
+		}
+
+		if t, ok := n.(*parse.TextNode); ok {
+			sb.Write(t.Text)
+		} else {
+			sb.Reset()
+		}
+	}
+
+	return strings.TrimSpace(sb.String())
+}
+
+// toolCallParser detects tool calls in a streamed response. Calls are
+// reported as they form: first the name of the call, then fragments of its
+// arguments and finally the call with its parsed arguments.
+type toolCallParser struct {
+	name, arguments string
+
+	// tag is the text the template writes before the JSON of its tool
+	// calls, without whitespace
+	tag string
+
+	state toolCallState
+	buf   []byte
+
+	// the position of the scanner in buf
+	offset   int
+	stack    []toolCallFrame
+	inString bool
+	escape   bool
+	str      int
+
+	calls int
+}
+
+type toolCallState int
+
+const (
+	// toolCallDetect holds back content that may start with tool calls
+	toolCallDetect toolCallState = iota
+	// toolCallScan holds back content while scanning it for tool calls
+	toolCallScan
+	// toolCallNone passes content through once it holds no tool calls
+	toolCallNone
+)
+
+// toolCallFrame is an object or array being scanned
+type toolCallFrame struct {
+	object bool
+	start  int
+
+	// nested is true for the frames within the arguments of a call
+	nested bool
+
+	key       string
+	expectKey bool
+
+	name  string
+	named bool
+
+	// args and argsEnd delimit the arguments of the call in buf, and sent
+	// is the position of the arguments streamed so far
+	args, argsEnd, sent int
+	index               int
+}
+
+func (m *Model) toolCallParser() (*toolCallParser, bool) {
+	name, arguments, ok := m.toolCallKeys()
+	if !ok {
+		return nil, false
+	}
+
+	return &toolCallParser{
+		name:      name,
+		arguments: arguments,
+		tag:       strings.TrimRight(strings.Join(strings.Fields(m.toolCallPrefix()), ""), "[{"),
+	}, true
+}
+
+// Add adds s to the response and returns the content to pass through along
+// with updates to the tool calls
+func (p *toolCallParser) Add(s string) (string, []api.ToolCall) {
+	if p.state == toolCallNone {
+		return s, nil
+	}
+
+	p.buf = append(p.buf, s...)
+	if p.state == toolCallDetect {
+		switch p.detect() {
+		case toolCallDetect:
+			return "", nil
+		case toolCallNone:
+			return p.passthrough(), nil
+		}
+
+		p.state = toolCallScan
+	}
+
+	calls := p.scan()
+	if p.state == toolCallNone {
+		return p.passthrough(), calls
+	}
+
+	return "", calls
+}
+
+// Flush returns any content held back that turned out not to be tool calls
+func (p *toolCallParser) Flush() string {
+	if p.calls > 0 || p.state == toolCallNone {
+		return ""
+	}
+
+	p.state = toolCallNone
+	return p.passthrough()
+}
+
+func (p *toolCallParser) passthrough() string {
+	s := string(p.buf)
+	p.buf = nil
+	return s
+}
+
+// detect decides whether the response starts with tool calls, either as
+// JSON or after the template's tag. Tags are skipped so brackets in tags
+// such as "[TOOL_CALLS]" aren't scanned.
+func (p *toolCallParser) detect() toolCallState {
+	s := strings.Join(strings.Fields(string(p.buf)), "")
+	switch {
+	case s == "":
+		return toolCallDetect
+	case p.tag != "" && strings.HasPrefix(s, p.tag):
+		var n int
+		for i, r := range string(p.buf) {
+			if !unicode.IsSpace(r) {
+				n += utf8.RuneLen(r)
+			}
+
+			if n == len(p.tag) {
+				p.offset = i + utf8.RuneLen(r)
+				break
+			}
+		}
+
+		return toolCallScan
+	case strings.HasPrefix(p.tag, s):
+		return toolCallDetect
+	case s[0] == '{', s[0] == '[':
+		return toolCallScan
+	default:
+		return toolCallNone
+	}
+}
+
+// scan scans the response added since the last scan. Anything outside of
+// JSON strings other than brackets, commas and colons is skipped so tool
+// calls may be wrapped in the template's tags.
+func (p *toolCallParser) scan() (calls []api.ToolCall) {
+	for ; p.offset < len(p.buf); p.offset++ {
+		c := p.buf[p.offset]
+		if p.inString {
+			switch {
+			case p.escape:
+				p.escape = false
+			case c == '\\':
+				p.escape = true
+			case c == '"':
+				p.inString = false
+				calls = append(calls, p.endString(p.buf[p.str:p.offset+1])...)
+			}
+
+			continue
+		}
+
+		switch c {
+		case '"':
+			p.inString = true
+			p.str = p.offset
+		case '{', '[':
+			frame := toolCallFrame{object: c == '{', start: p.offset, expectKey: c == '{', args: -1, argsEnd: -1}
+			if len(p.stack) > 0 {
+				top := &p.stack[len(p.stack)-1]
+				if c == '{' && top.object && !top.nested && !top.expectKey && top.key == p.arguments && top.args < 0 {
+					top.args = p.offset
+					top.sent = p.offset
+				}
+
+				frame.nested = top.nested || (top.args >= 0 && top.argsEnd < 0)
+			}
+
+			p.stack = append(p.stack, frame)
+		case '}', ']':
+			if len(p.stack) == 0 {
+				continue
+			}
+
+			frame := p.stack[len(p.stack)-1]
+			p.stack = p.stack[:len(p.stack)-1]
+			calls = append(calls, p.end(frame)...)
+
+			if len(p.stack) == 0 && p.calls == 0 {
+				// the response starts with JSON that isn't a tool call
+				p.state = toolCallNone
+				p.offset = len(p.buf)
+				return calls
+			}
+		case ',':
+			if len(p.stack) > 0 && p.stack[len(p.stack)-1].object {
+				p.stack[len(p.stack)-1].expectKey = true
+			}
+		}
+	}
+
+	// stream the arguments of the call being generated
+	for i := range p.stack {
+		if frame := &p.stack[i]; frame.named && frame.args >= 0 && frame.argsEnd < 0 && frame.sent < len(p.buf) {
+			calls = append(calls, api.ToolCall{Index: frame.index, Function: api.ToolCallFunction{PartialArguments: string(p.buf[frame.sent:])}})
+			frame.sent = len(p.buf)
+		}
+	}
+
+	return calls
+}
+
+// endString handles the end of a JSON string, a key or a value of the
+// innermost object
+func (p *toolCallParser) endString(b []byte) []api.ToolCall {
+	if len(p.stack) == 0 {
+		return nil
+	}
+
+	top := &p.stack[len(p.stack)-1]
+	if !top.object || top.nested {
+		return nil
+	}
+
+	if top.expectKey {
+		top.expectKey = false
+		if err := json.Unmarshal(b, &top.key); err != nil {
+			top.key = ""
+		}
+
+		return nil
+	}
+
+	if top.key != p.name || top.named {
+		return nil
+	}
+
+	if err := json.Unmarshal(b, &top.name); err != nil {
+		return nil
+	}
+
+	top.named = true
+	top.index = p.calls
+	p.calls++
+
+	calls := []api.ToolCall{{Index: top.index, Function: api.ToolCallFunction{Name: top.name}}}
+	if top.argsEnd >= 0 {
+		// the arguments came before the name
+		calls = append(calls, api.ToolCall{Index: top.index, Function: api.ToolCallFunction{PartialArguments: string(p.buf[top.args:top.argsEnd])}})
+		top.sent = top.argsEnd
+	}
+
+	return calls
+}
+
+// end handles the end of frame, which may complete the arguments of its
+// parent or a tool call
+func (p *toolCallParser) end(frame toolCallFrame) (calls []api.ToolCall) {
+	if len(p.stack) > 0 {
+		if top := &p.stack[len(p.stack)-1]; top.args == frame.start {
+			top.argsEnd = p.offset + 1
+			if top.named && top.sent < top.argsEnd {
+				calls = append(calls, api.ToolCall{Index: top.index, Function: api.ToolCallFunction{PartialArguments: string(p.buf[top.sent:top.argsEnd])}})
+				top.sent = top.argsEnd
+			}
+		}
+	}
+
+	if frame.named && frame.argsEnd >= 0 {
+		var args api.ToolCallFunctionArguments
+		if err := json.Unmarshal(p.buf[frame.args:frame.argsEnd], &args); err == nil {
+			calls = append(calls, api.ToolCall{Index: frame.index, Function: api.ToolCallFunction{Name: frame.name, Arguments: args}})
+		}
+	}
+
+	return calls
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -137,6 +138,172 @@ The temperature in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.`,
 	}
 }
 
+func TestToolCallGrammar(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+
+	var tools []api.Tool
+	if err := json.Unmarshal(readFile(t, p, "tools.json").Bytes(), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		model string
+		call  string
+	}{
+		{"mistral", `"\"name\"" ws ":" ws "\"get_current_weather\"" ws`},
+		{"command-r-plus", `"\"tool_name\"" ws ":" ws "\"get_current_weather\"" ws`},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", tt.model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+			for _, parallel := range []bool{true, false} {
+				g, err := m.toolCallGrammar(tools, parallel)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !strings.Contains(g, tt.call) {
+					t.Errorf("expected grammar to call get_current_weather, got:\n%s", g)
+				}
+
+				if parallel != strings.Contains(g, `"["`) {
+					t.Errorf("expected parallel calls %t, got:\n%s", parallel, g)
+				}
+			}
+		})
+	}
+
+	t.Run("no tool calls", func(t *testing.T) {
+		tmpl, err := template.Parse("{{ .Prompt }}")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := &Model{Template: tmpl}
+		if _, err := m.toolCallGrammar(tools, true); err == nil {
+			t.Error("expected error for a template without tool calls")
+		}
+	})
+}
+
+func TestToolCallParser(t *testing.T) {
+	p := filepath.Join("testdata", "tools")
+	cases := []struct {
+		model  string
+		output string
+		calls  int
+	}{
+		{"mistral", `[TOOL_CALLS]  [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}},{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}]`, 2},
+		{"mistral", `[{"arguments": {"format":"fahrenheit","location":"San Francisco, CA"}, "name": "get_current_weather"}]`, 1},
+		{"mistral", `{"format": "fahrenheit"}`, 0},
+		{"mistral", " The weather in San Francisco, CA is 70°F and in Toronto, Canada is 20°C.", 0},
+		{"command-r-plus", "Action: ```json" + `
+[
+    {
+        "tool_name": "get_current_weather",
+        "parameters": {
+            "format": "fahrenheit",
+            "location": "San Francisco, CA"
+        }
+    }
+]
+` + "```", 1},
+		{"firefunction", ` functools[{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}]`, 1},
+		{"firefunction", " functional programming", 0},
+		{"llama3-groq-tool-use", `<tool_call>
+{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}
+{"name": "get_current_weather", "arguments": {"format":"celsius","location":"Toronto, Canada"}}
+</tool_call>`, 2},
+		{"xlam", `{"tool_calls": [{"name": "get_current_weather", "arguments": {"format":"fahrenheit","location":"San Francisco, CA"}}]}`, 1},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.model, func(t *testing.T) {
+			tmpl, err := template.Parse(readFile(t, p, fmt.Sprintf("%s.gotmpl", tt.model)).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := &Model{Template: tmpl}
+			parser, ok := m.toolCallParser()
+			if !ok {
+				t.Fatal("expected a tool call parser")
+			}
+
+			// stream the output a few bytes at a time
+			var content strings.Builder
+			var updates []api.ToolCall
+			for s := tt.output; len(s) > 0; {
+				n := min(3, len(s))
+				c, calls := parser.Add(s[:n])
+				content.WriteString(c)
+				updates = append(updates, calls...)
+				s = s[n:]
+			}
+			content.WriteString(parser.Flush())
+
+			if tt.calls == 0 {
+				if len(updates) > 0 {
+					t.Errorf("expected no tool calls, got %v", updates)
+				}
+
+				if content.String() != tt.output {
+					t.Errorf("expected content %q, got %q", tt.output, content.String())
+				}
+
+				return
+			}
+
+			if content.Len() > 0 {
+				t.Errorf("expected no content, got %q", content.String())
+			}
+
+			names := make(map[int]string)
+			fragments := make(map[int]string)
+			var calls []api.ToolCall
+			for _, update := range updates {
+				switch {
+				case update.Function.Arguments != nil:
+					calls = append(calls, update)
+				case update.Function.Name != "":
+					names[update.Index] = update.Function.Name
+				default:
+					if names[update.Index] == "" {
+						t.Fatalf("expected the name of call %d before its arguments", update.Index)
+					}
+
+					fragments[update.Index] += update.Function.PartialArguments
+				}
+			}
+
+			if len(calls) != tt.calls {
+				t.Fatalf("expected %d calls, got %d", tt.calls, len(calls))
+			}
+
+			for i, call := range calls {
+				if call.Index != i || call.Function.Name != names[i] {
+					t.Errorf("expected call %d to be %s, got %+v", i, names[i], call)
+				}
+
+				var args api.ToolCallFunctionArguments
+				if err := json.Unmarshal([]byte(fragments[i]), &args); err != nil {
+					t.Fatal(err)
+				}
+
+				if diff := cmp.Diff(args, call.Function.Arguments); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
 func TestParseFromFileFromLayer(t *testing.T) {
 	tempModels := t.TempDir()
 	t.Setenv("OLLAMA_MODELS", tempModels)
@@ -3,65 +3,162 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/tracing"
 )
 
 type tokenizeFunc func(context.Context, string) ([]int, error)
 
+type completionFunc func(context.Context, llm.CompletionRequest, func(llm.CompletionResponse)) error
+
+// defaultImageTokens is the number of tokens an image is assumed to take when
+// the projector doesn't describe its image size
+const defaultImageTokens = 768
+
+// summaryPrompt is the system message the model is given when it summarizes
+// messages that don't fit into the context window
+const summaryPrompt = "Summarize the following conversation in a few sentences. Keep names, facts, decisions and open questions that later messages may refer to. Reply with the summary only."
+
 // chatPrompt accepts a list of messages and returns the prompt and images that should be used for the next chat turn.
-// chatPrompt truncates any messages that exceed the context window of the model, making sure to always include 1) the
-// latest message and 2) system messages
-func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, _ error) {
-	var system []api.Message
-	// always include the last message
-	n := len(msgs) - 1
-	// in reverse, find all messages that fit into context window
-	for i := n - 1; i >= 0; i-- {
-		system = make([]api.Message, 0)
-		for j := range i {
-			if msgs[j].Role == "system" {
-				system = append(system, msgs[j])
-			}
+// chatPrompt leaves out any messages that exceed the context window of the model, as chosen by opts.ContextStrategy,
+// making sure to always include 1) the latest message and 2) system messages. It returns the number of messages left out.
+func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, complete completionFunc, opts *api.Options, msgs []api.Message, tools []api.Tool) (prompt string, images []llm.ImageData, dropped int, err error) {
+	ctx, span := tracing.Start(ctx, "prompt")
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	imageTokens := projectorImageTokens(m.ProjectorPaths)
+
+	// system messages and the latest message are always kept
+	fixed := make([]bool, len(msgs))
+	var order []int
+	for i, msg := range msgs {
+		fixed[i] = msg.Role == "system" || i == len(msgs)-1
+		if !fixed[i] {
+			order = append(order, i)
 		}
+	}
+
+	keep := slices.Clone(fixed)
+	total, err := countTokens(ctx, m, tokenize, imageTokens, keptMessages(msgs, keep, nil), tools)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	// every other message is measured by the tokens it adds to the fixed
+	// messages, so tokens the template adds once per prompt, such as a BOS
+	// token, are only counted once
+	base := total
+	counts := make([]int, len(msgs))
+	for _, i := range order {
+		keep[i] = true
+		c, err := countTokens(ctx, m, tokenize, imageTokens, keptMessages(msgs, keep, nil), tools)
+		if err != nil {
+			return "", nil, 0, err
+		}
+
+		keep[i] = false
+		counts[i] = max(c-base, 0)
+		total += counts[i]
+	}
+
+	for _, i := range order {
+		keep[i] = true
+	}
+
+	strategy := opts.ContextStrategy
+	if strategy == api.ContextMiddleOut {
+		order = middleOut(order)
+	}
+
+	limit := opts.NumCtx
+	var summaryLength int
+	if strategy == api.ContextSummarize && total > limit {
+		// leave room for the summary
+		summaryLength = min(opts.NumCtx/8, 512)
+		limit -= summaryLength
+	}
 
-		var b bytes.Buffer
-		if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[i:]...), Tools: tools}); err != nil {
-			return "", nil, err
+	for total > limit && dropped < len(order) {
+		keep[order[dropped]] = false
+		total -= counts[order[dropped]]
+		dropped++
+	}
+
+	var summary *api.Message
+	if summaryLength > 0 && dropped > 0 {
+		s, err := summarize(ctx, m, complete, opts, msgs, order[:dropped], counts, summaryLength)
+		if err != nil {
+			slog.Warn("failed to summarize messages which exceed context length", "error", err)
+		} else if s != "" {
+			summary = &api.Message{Role: "system", Content: "Summary of the earlier conversation: " + s}
 		}
+	}
 
-		s, err := tokenize(ctx, b.String())
+	// the counts are estimates, so the prompt is checked as a whole and
+	// more messages are left out while it doesn't fit
+	fits := true
+	for {
+		kept := keptMessages(msgs, keep, summary)
+		c, err := countTokens(ctx, m, tokenize, imageTokens, kept, tools)
 		if err != nil {
-			return "", nil, err
+			return "", nil, 0, err
 		}
 
-		c := len(s)
-		if m.ProjectorPaths != nil {
-			for _, m := range msgs[i:] {
-				// images are represented as 768 sized embeddings
-				// TODO: get embedding length from project metadata
-				c += 768 * len(m.Images)
-			}
+		if fits = c <= opts.NumCtx; fits || dropped == len(order) {
+			break
+		}
+
+		keep[order[dropped]] = false
+		dropped++
+	}
+
+	// or messages left out are added back while it still fits, unless they
+	// are summarized
+	for fits && summary == nil && dropped > 0 {
+		keep[order[dropped-1]] = true
+		c, err := countTokens(ctx, m, tokenize, imageTokens, keptMessages(msgs, keep, nil), tools)
+		if err != nil {
+			return "", nil, 0, err
 		}
 
 		if c > opts.NumCtx {
-			slog.Debug("truncating input messages which exceed context length", "truncated", len(msgs[i:]))
+			keep[order[dropped-1]] = false
 			break
-		} else {
-			n = i
 		}
+
+		dropped--
 	}
 
-	// truncate any messages that do not fit into the context window
+	if dropped > 0 {
+		slog.Debug("truncating input messages which exceed context length", "strategy", strategy, "dropped", dropped, "summarized", summary != nil)
+	}
+
+	span.SetAttribute("ollama.messages", len(msgs))
+	span.SetAttribute("ollama.truncated", dropped > 0)
+	span.SetAttribute("ollama.dropped", dropped)
+
+	kept := keptMessages(msgs, keep, summary)
+
 	var b bytes.Buffer
-	if err := m.Template.Execute(&b, template.Values{Messages: append(system, msgs[n:]...), Tools: tools}); err != nil {
-		return "", nil, err
+	if err := m.Template.Execute(&b, template.Values{Messages: kept, Tools: tools}); err != nil {
+		return "", nil, 0, err
 	}
 
-	for _, m := range msgs[n:] {
+	for _, m := range kept {
 		for _, i := range m.Images {
 			images = append(images, llm.ImageData{
 				ID:   len(images),
@@ -70,5 +167,192 @@ func chatPrompt(ctx context.Context, m *Model, tokenize tokenizeFunc, opts *api.
 		}
 	}
 
-	return b.String(), images, nil
+	return b.String(), images, dropped, nil
+}
+
+// countTokens returns the number of tokens msgs take in the prompt, including
+// their images
+func countTokens(ctx context.Context, m *Model, tokenize tokenizeFunc, imageTokens int, msgs []api.Message, tools []api.Tool) (int, error) {
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, template.Values{Messages: msgs, Tools: tools}); err != nil {
+		return 0, err
+	}
+
+	s, err := tokenize(ctx, b.String())
+	if err != nil {
+		return 0, err
+	}
+
+	c := len(s)
+	for _, msg := range msgs {
+		c += imageTokens * len(msg.Images)
+	}
+
+	return c, nil
+}
+
+// keptMessages returns the messages of msgs that are kept, with summary in
+// place of the first of those left out
+func keptMessages(msgs []api.Message, keep []bool, summary *api.Message) []api.Message {
+	kept := make([]api.Message, 0, len(msgs)+1)
+	for i, msg := range msgs {
+		if !keep[i] && summary != nil {
+			kept = append(kept, *summary)
+			summary = nil
+		}
+
+		if keep[i] {
+			kept = append(kept, msg)
+		}
+	}
+
+	return kept
+}
+
+// middleOut orders indices from the middle outwards, so that the start and
+// the end of a chat are left out last
+func middleOut(indices []int) []int {
+	remaining := append([]int(nil), indices...)
+	order := make([]int, 0, len(indices))
+	for len(remaining) > 0 {
+		mid := len(remaining) / 2
+		order = append(order, remaining[mid])
+		remaining = append(remaining[:mid], remaining[mid+1:]...)
+	}
+
+	return order
+}
+
+// summarize has the model summarize the messages of msgs at indices in at
+// most length tokens. The oldest of them are left out of the summary when
+// they don't fit into the context window with it.
+func summarize(ctx context.Context, m *Model, complete completionFunc, opts *api.Options, msgs []api.Message, indices []int, counts []int, length int) (string, error) {
+	limit := opts.NumCtx - 2*length
+	first := len(indices)
+	for first > 0 && counts[indices[first-1]] <= limit {
+		limit -= counts[indices[first-1]]
+		first--
+	}
+
+	var sb strings.Builder
+	for _, i := range indices[first:] {
+		if msgs[i].Content != "" {
+			fmt.Fprintf(&sb, "%s: %s\n\n", msgs[i].Role, msgs[i].Content)
+		}
+	}
+
+	if sb.Len() == 0 {
+		return "", nil
+	}
+
+	// later turns of a chat usually leave out the same messages, so their
+	// summaries are reused
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s", m.ModelPath, length, sb.String())
+	key := hex.EncodeToString(h.Sum(nil))
+	if s, ok := summaries.get(key); ok {
+		return s, nil
+	}
+
+	var b bytes.Buffer
+	if err := m.Template.Execute(&b, template.Values{Messages: []api.Message{
+		{Role: "system", Content: summaryPrompt},
+		{Role: "user", Content: sb.String()},
+	}}); err != nil {
+		return "", err
+	}
+
+	// the summary isn't bound by the options constraining the response
+	o := *opts
+	o.NumPredict = length
+	o.Grammar = ""
+	o.LogitBias = nil
+
+	var summary strings.Builder
+	if err := complete(ctx, llm.CompletionRequest{Prompt: b.String(), Options: &o}, func(r llm.CompletionResponse) {
+		summary.WriteString(r.Content)
+	}); err != nil {
+		return "", err
+	}
+
+	s := strings.TrimSpace(summary.String())
+	summaries.put(key, s)
+	return s, nil
+}
+
+// maxSummaries is the most summaries that are cached
+const maxSummaries = 256
+
+// summaryCache caches summaries of messages, forgetting the least recently
+// used once it holds maxSummaries
+type summaryCache struct {
+	mu sync.Mutex
+	m  map[string]cachedSummary
+}
+
+type cachedSummary struct {
+	summary  string
+	lastUsed time.Time
+}
+
+var summaries summaryCache
+
+func (c *summaryCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.m[key]
+	if ok {
+		s.lastUsed = time.Now()
+		c.m[key] = s
+	}
+
+	return s.summary, ok
+}
+
+func (c *summaryCache) put(key, summary string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.m == nil {
+		c.m = make(map[string]cachedSummary)
+	}
+
+	c.m[key] = cachedSummary{summary: summary, lastUsed: time.Now()}
+	if len(c.m) > maxSummaries {
+		var oldest string
+		for k, s := range c.m {
+			if oldest == "" || s.lastUsed.Before(c.m[oldest].lastUsed) {
+				oldest = k
+			}
+		}
+
+		delete(c.m, oldest)
+	}
+}
+
+// imageTokens caches the number of tokens an image takes by projector path
+var imageTokens sync.Map
+
+// projectorImageTokens returns the number of tokens an image takes with the
+// projectors at paths, as described by their metadata
+func projectorImageTokens(paths []string) int {
+	var n int
+	for _, path := range paths {
+		v, ok := imageTokens.Load(path)
+		if !ok {
+			c := defaultImageTokens
+			if ggml, err := llm.LoadModel(path, 0); err != nil {
+				slog.Debug("couldn't read projector metadata", "projector", path, "error", err)
+			} else if t := ggml.KV().ImageTokens(); t > 0 {
+				c = int(t)
+			}
+
+			v, _ = imageTokens.LoadOrStore(path, c)
+		}
+
+		n = max(n, v.(int))
+	}
+
+	return n
 }
@@ -3,24 +3,29 @@ package server
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 
 	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/template"
 )
 
 func TestChatPrompt(t *testing.T) {
 	type expect struct {
-		prompt string
-		images [][]byte
+		prompt  string
+		images  [][]byte
+		dropped int
 	}
 
 	cases := []struct {
-		name  string
-		limit int
-		msgs  []api.Message
+		name     string
+		limit    int
+		strategy string
+		msgs     []api.Message
 		expect
 	}{
 		{
@@ -44,7 +49,8 @@ func TestChatPrompt(t *testing.T) {
 				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
 			},
 			expect: expect{
-				prompt: "A test. And a thumping good one at that, I'd wager. ",
+				prompt:  "A test. And a thumping good one at that, I'd wager. ",
+				dropped: 2,
 			},
 		},
 		{
@@ -60,6 +66,7 @@ func TestChatPrompt(t *testing.T) {
 				images: [][]byte{
 					[]byte("something"),
 				},
+				dropped: 2,
 			},
 		},
 		{
@@ -75,6 +82,7 @@ func TestChatPrompt(t *testing.T) {
 				images: [][]byte{
 					[]byte("somethingelse"),
 				},
+				dropped: 2,
 			},
 		},
 		{
@@ -142,6 +150,7 @@ func TestChatPrompt(t *testing.T) {
 				images: [][]byte{
 					[]byte("somethingelse"),
 				},
+				dropped: 2,
 			},
 		},
 		{
@@ -170,6 +179,55 @@ func TestChatPrompt(t *testing.T) {
 				prompt: "You're a test, Harry! I-I'm a what? You are the Test Who Lived. A test. And a thumping good one at that, I'd wager. ",
 			},
 		},
+		{
+			name:     "drop oldest messages",
+			limit:    18,
+			strategy: api.ContextDropOldest,
+			msgs: []api.Message{
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test."},
+				{Role: "assistant", Content: "A what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt:  "I-I'm a what? A test. A what? A test. And a thumping good one at that, I'd wager. ",
+				dropped: 1,
+			},
+		},
+		{
+			name:     "drop middle messages",
+			limit:    18,
+			strategy: api.ContextMiddleOut,
+			msgs: []api.Message{
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test."},
+				{Role: "assistant", Content: "A what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt:  "You're a test, Harry! A what? A test. And a thumping good one at that, I'd wager. ",
+				dropped: 2,
+			},
+		},
+		{
+			name:     "drop middle messages keeping system prompt",
+			limit:    24,
+			strategy: api.ContextMiddleOut,
+			msgs: []api.Message{
+				{Role: "system", Content: "You are the Test Who Lived."},
+				{Role: "user", Content: "You're a test, Harry!"},
+				{Role: "assistant", Content: "I-I'm a what?"},
+				{Role: "user", Content: "A test."},
+				{Role: "assistant", Content: "A what?"},
+				{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+			},
+			expect: expect{
+				prompt:  "You are the Test Who Lived. You're a test, Harry! A what? A test. And a thumping good one at that, I'd wager. ",
+				dropped: 2,
+			},
+		},
 	}
 
 	tmpl, err := template.Parse(`
@@ -183,8 +241,8 @@ func TestChatPrompt(t *testing.T) {
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
 			model := Model{Template: tmpl, ProjectorPaths: []string{"vision"}}
-			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}}
-			prompt, images, err := chatPrompt(context.TODO(), &model, mockRunner{}.Tokenize, &opts, tt.msgs, nil)
+			opts := api.Options{Runner: api.Runner{NumCtx: tt.limit}, ContextStrategy: tt.strategy}
+			prompt, images, dropped, err := chatPrompt(context.TODO(), &model, mockRunner{}.Tokenize, nil, &opts, tt.msgs, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -193,6 +251,10 @@ func TestChatPrompt(t *testing.T) {
 				t.Errorf("mismatch (-got +want):\n%s", diff)
 			}
 
+			if dropped != tt.dropped {
+				t.Errorf("expected %d dropped messages, got %d", tt.dropped, dropped)
+			}
+
 			if len(images) != len(tt.images) {
 				t.Fatalf("expected %d images, got %d", len(tt.images), len(images))
 			}
@@ -209,3 +271,172 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestChatPromptTemplateOverhead(t *testing.T) {
+	var msgs []api.Message
+	for i := range 10 {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+
+		msgs = append(msgs, api.Message{Role: role, Content: fmt.Sprintf("message%d", i)})
+	}
+
+	cases := []struct {
+		name     string
+		template string
+	}{
+		{
+			// the BOS token and the generation prompt are added once per prompt
+			name:     "bos and generation prompt",
+			template: `<s> {{ range .Messages }}{{ .Content }} {{ end }}<assistant>`,
+		},
+		{
+			// the history header is only added when there's more than one
+			// message, so every message seems to add it
+			name:     "history header",
+			template: `{{ if gt (len .Messages) 1 }}History: {{ end }}{{ range .Messages }}{{ .Content }} {{ end }}`,
+		},
+	}
+
+	for _, tt := range cases {
+		tmpl, err := template.Parse(tt.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, template.Values{Messages: msgs}); err != nil {
+			t.Fatal(err)
+		}
+
+		want := b.String()
+		tokens, err := mockRunner{}.Tokenize(context.TODO(), want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, strategy := range []string{"", api.ContextDropOldest, api.ContextMiddleOut} {
+			t.Run(tt.name+" "+strategy, func(t *testing.T) {
+				opts := api.Options{Runner: api.Runner{NumCtx: len(tokens)}, ContextStrategy: strategy}
+				prompt, _, dropped, err := chatPrompt(context.TODO(), &Model{Template: tmpl}, mockRunner{}.Tokenize, nil, &opts, msgs, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if dropped != 0 {
+					t.Errorf("expected no dropped messages, got %d", dropped)
+				}
+
+				if diff := cmp.Diff(prompt, want); diff != "" {
+					t.Errorf("mismatch (-got +want):\n%s", diff)
+				}
+			})
+		}
+	}
+}
+
+func TestChatPromptSummarize(t *testing.T) {
+	tmpl, err := template.Parse(`
+{{- if .System }}{{ .System }} {{ end }}
+{{- if .Prompt }}{{ .Prompt }} {{ end }}
+{{- if .Response }}{{ .Response }} {{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: strings.TrimSpace(strings.Repeat("Harry! ", 100))},
+		{Role: "assistant", Content: strings.TrimSpace(strings.Repeat("What? ", 50))},
+		{Role: "user", Content: "A test. And a thumping good one at that, I'd wager."},
+	}
+
+	summaries.m = nil
+
+	mock := mockRunner{CompletionResponse: llm.CompletionResponse{Content: " Harry is a test. ", Done: true}}
+	opts := api.Options{Runner: api.Runner{NumCtx: 160}, ContextStrategy: api.ContextSummarize, Grammar: `root ::= "yes"`}
+	prompt, _, dropped, err := chatPrompt(context.TODO(), &Model{Template: tmpl}, mockRunner{}.Tokenize, mock.Completion, &opts, msgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(prompt, "Summary of the earlier conversation: Harry is a test. "+strings.Repeat("What? ", 50)+"A test. And a thumping good one at that, I'd wager. "); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
+
+	if dropped != 1 {
+		t.Errorf("expected 1 dropped message, got %d", dropped)
+	}
+
+	if !strings.HasPrefix(mock.CompletionRequest.Prompt, summaryPrompt+" user: Harry! Harry!") {
+		t.Errorf("unexpected summary prompt %q", mock.CompletionRequest.Prompt)
+	}
+
+	if o := mock.CompletionRequest.Options; o == nil || o.NumPredict != 20 || o.Grammar != "" {
+		t.Errorf("unexpected summary options %+v", o)
+	}
+
+	// the summary is reused for the same messages
+	mock.CompletionRequest = llm.CompletionRequest{}
+	if prompt, _, _, err = chatPrompt(context.TODO(), &Model{Template: tmpl}, mockRunner{}.Tokenize, mock.Completion, &opts, msgs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(prompt, "Summary of the earlier conversation: Harry is a test. ") || mock.CompletionRequest.Prompt != "" {
+		t.Errorf("expected cached summary, got prompt %q and summary prompt %q", prompt, mock.CompletionRequest.Prompt)
+	}
+
+	// messages that fit aren't summarized
+	mock.CompletionRequest = llm.CompletionRequest{}
+	opts.NumCtx = 2048
+	if _, _, dropped, err = chatPrompt(context.TODO(), &Model{Template: tmpl}, mockRunner{}.Tokenize, mock.Completion, &opts, msgs, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if dropped != 0 || mock.CompletionRequest.Prompt != "" {
+		t.Errorf("expected no summary, got %d dropped messages and prompt %q", dropped, mock.CompletionRequest.Prompt)
+	}
+}
+
+func TestProjectorImageTokens(t *testing.T) {
+	cases := []struct {
+		name string
+		kv   llm.KV
+		want int
+	}{
+		{
+			name: "patches",
+			kv:   llm.KV{"general.architecture": "clip", "clip.vision.image_size": uint32(336), "clip.vision.patch_size": uint32(14)},
+			want: 576,
+		},
+		{
+			name: "grid pinpoints",
+			kv: llm.KV{
+				"general.architecture":             "clip",
+				"clip.vision.image_size":           uint32(336),
+				"clip.vision.patch_size":           uint32(14),
+				"clip.vision.image_grid_pinpoints": []int32{336, 672, 672, 336, 672, 672},
+			},
+			want: 576 * 5,
+		},
+		{
+			name: "no image size",
+			kv:   llm.KV{"general.architecture": "clip"},
+			want: defaultImageTokens,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := createBinFile(t, tt.kv, nil)
+			if got := projectorImageTokens([]string{path}); got != tt.want {
+				t.Errorf("expected %d tokens, got %d", tt.want, got)
+			}
+		})
+	}
+
+	if got := projectorImageTokens(nil); got != 0 {
+		t.Errorf("expected no tokens without a projector, got %d", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"cmp"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,15 +24,17 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/sync/errgroup"
 
+	"github.com/ollama/ollama/anthropic"
 	"github.com/ollama/ollama/api"
 	"github.com/ollama/ollama/envconfig"
 	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/grammar"
 	"github.com/ollama/ollama/llm"
 	"github.com/ollama/ollama/openai"
 	"github.com/ollama/ollama/parser"
 	"github.com/ollama/ollama/template"
+	"github.com/ollama/ollama/tracing"
 	"github.com/ollama/ollama/types/errtypes"
 	"github.com/ollama/ollama/types/model"
 	"github.com/ollama/ollama/version"
@@ -40,8 +43,12 @@ import (
 var mode string = gin.DebugMode
 
 type Server struct {
-	addr  net.Addr
-	sched *Scheduler
+	addr    net.Addr
+	sched   *Scheduler
+	keys    apiKeys
+	limits  *limiter
+	audit   *auditLog
+	batches *batchRunner
 }
 
 func init() {
@@ -59,6 +66,7 @@ func init() {
 var (
 	errRequired    = errors.New("is required")
 	errBadTemplate = errors.New("template error")
+	errBadOptions  = errors.New("invalid options")
 )
 
 func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
@@ -68,15 +76,19 @@ func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options
 	}
 
 	if err := opts.FromMap(requestOpts); err != nil {
-		return api.Options{}, err
+		return api.Options{}, fmt.Errorf("%w: %w", errBadOptions, err)
 	}
 
 	return opts, nil
 }
 
+// queueStatusInterval is how often queued requests are told their position
+var queueStatusInterval = time.Second
+
 // scheduleRunner schedules a runner after validating inputs such as capabilities and model options.
 // It returns the allocated runner, model instance, and consolidated options if successful and error otherwise.
-func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration) (llm.LlamaServer, *Model, *api.Options, error) {
+// If queued is not nil, it's called periodically with the request's queue position while it waits.
+func (s *Server) scheduleRunner(ctx context.Context, name, draft string, caps []Capability, requestOpts map[string]any, keepAlive *api.Duration, queued func(api.QueueStatus)) (*runnerRef, *Model, *api.Options, error) {
 	if name == "" {
 		return nil, nil, nil, fmt.Errorf("model %w", errRequired)
 	}
@@ -90,20 +102,150 @@ func (s *Server) scheduleRunner(ctx context.Context, name string, caps []Capabil
 		return nil, nil, nil, fmt.Errorf("%s %w", name, err)
 	}
 
+	if draft != "" {
+		d, err := GetModel(draft)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, nil, fmt.Errorf("%w: draft model %q not found, try pulling it first", errBadOptions, draft)
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+
+		model.DraftPath = d.ModelPath
+	}
+
 	opts, err := modelOptions(model, requestOpts)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	runnerCh, errCh := s.sched.GetRunner(ctx, model, opts, keepAlive)
-	var runner *runnerRef
-	select {
-	case runner = <-runnerCh:
-	case err = <-errCh:
-		return nil, nil, nil, err
+	ctx, span := tracing.Start(ctx, "schedule")
+	defer span.End()
+	span.SetAttribute("ollama.model", name)
+	span.SetAttribute("ollama.priority", priorityFromContext(ctx))
+
+	req := s.sched.enqueue(ctx, model, opts, keepAlive)
+
+	var tick <-chan time.Time
+	if queued != nil {
+		ticker := time.NewTicker(queueStatusInterval)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
-	return runner.llama, model, &opts, nil
+	for {
+		select {
+		case runner := <-req.successCh:
+			return runner, model, &opts, nil
+		case err = <-req.errCh:
+			span.RecordError(err)
+			return nil, nil, nil, err
+		case <-tick:
+			if status := s.sched.queueStatus(req); status.Position > 0 {
+				queued(status)
+			}
+		}
+	}
+}
+
+// streamFrame writes a single streamed response, such as a queued status
+// frame, ahead of the response body
+func streamFrame(c *gin.Context, v any) {
+	c.Header("Content-Type", "application/x-ndjson")
+	bts, err := json.Marshal(v)
+	if err != nil {
+		slog.Info(fmt.Sprintf("streamFrame: json.Marshal failed with %s", err))
+		return
+	}
+
+	if _, err := c.Writer.Write(append(bts, '\n')); err != nil {
+		slog.Info(fmt.Sprintf("streamFrame: w.Write failed with %s", err))
+		return
+	}
+
+	c.Writer.Flush()
+}
+
+// priorityContext returns the request context annotated with its scheduling
+// priority, preferring the value in the request body over the
+// X-Ollama-Priority header. Without API keys the priority is chosen by the
+// client, so fairness between tenants is best effort. With API keys the
+// tenant is the name of the key and only admin keys may ask for high priority.
+func priorityContext(c *gin.Context, priority string) context.Context {
+	priority = cmp.Or(priority, c.GetHeader("X-Ollama-Priority"))
+	if k := apiKeyFromContext(c); k != nil {
+		switch {
+		case priority == PriorityLow:
+		case priority == PriorityHigh && k.allows(scopeAdmin):
+		case k.Name == PriorityHigh || k.Name == PriorityLow:
+			// a key named after a class doesn't get that class's weight
+			priority = PriorityNormal
+		default:
+			priority = k.Name
+		}
+	}
+
+	return withPriority(c.Request.Context(), priority)
+}
+
+// maxTopLogprobs is the most likely tokens a request may ask for at each
+// position
+const maxTopLogprobs = 20
+
+func checkLogprobs(logprobs bool, topLogprobs int) error {
+	switch {
+	case topLogprobs < 0 || topLogprobs > maxTopLogprobs:
+		return fmt.Errorf("top_logprobs must be between 0 and %d", maxTopLogprobs)
+	case topLogprobs > 0 && !logprobs:
+		return errors.New("top_logprobs requires logprobs")
+	}
+
+	return nil
+}
+
+// parseFormat returns the format and grammar for the runner from a request's
+// format, which is either "json" or a JSON Schema object. Schemas are
+// compiled to grammars up front so invalid ones fail before generation.
+func parseFormat(format json.RawMessage) (string, string, error) {
+	format = bytes.TrimSpace(format)
+	if len(format) == 0 || bytes.Equal(format, []byte("null")) {
+		return "", "", nil
+	}
+
+	if format[0] != '{' {
+		var s string
+		if err := json.Unmarshal(format, &s); err != nil || (s != "" && s != "json") {
+			return "", "", errors.New("format must be empty, \"json\" or a JSON Schema object")
+		}
+
+		return s, "", nil
+	}
+
+	g, err := grammar.FromSchema(format)
+	if err != nil {
+		return "", "", err
+	}
+
+	return "json", g, nil
+}
+
+// checkToolChoice validates how a chat request uses its tools, removing the
+// tools if the model shouldn't see them
+func checkToolChoice(req *api.ChatRequest) error {
+	switch req.ToolChoice {
+	case "", "auto":
+	case "none":
+		req.Tools = nil
+	case "required":
+		if len(req.Tools) == 0 {
+			return errors.New("tool_choice \"required\" requires tools")
+		} else if len(req.Format) > 0 {
+			return errors.New("format is not supported with tool_choice \"required\"")
+		}
+	default:
+		return errors.New("tool_choice must be \"auto\", \"none\" or \"required\"")
+	}
+
+	return nil
 }
 
 func (s *Server) GenerateHandler(c *gin.Context) {
@@ -117,12 +259,24 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		return
 	}
 
-	if req.Format != "" && req.Format != "json" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be empty or \"json\""})
+	c.Set(requestModelKey, req.Model)
+	if !authorizeModel(c, req.Model, req.Draft) || !s.admitModel(c, req.Model, req.Draft) {
+		return
+	}
+
+	format, gbnf, err := parseFormat(req.Format)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	} else if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
 		return
+	} else if len(req.Tokens) > 0 && (!req.Raw || req.Prompt != "" || len(req.Images) > 0) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "tokens are only supported in raw mode without a prompt or images"})
+		return
+	} else if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	caps := []Capability{CapabilityCompletion}
@@ -130,18 +284,27 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		caps = append(caps, CapabilityInsert)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	var queued func(api.QueueStatus)
+	if req.Stream == nil || *req.Stream {
+		queued = func(status api.QueueStatus) {
+			streamFrame(c, api.GenerateResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Queued: &status})
+		}
+	}
+
+	r, m, opts, err := s.scheduleRunner(priorityContext(c, req.Priority), req.Model, req.Draft, caps, req.Options, req.KeepAlive, queued)
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support generate", req.Model)})
+		writeQueuedError(c, http.StatusBadRequest, fmt.Sprintf("%q does not support generate", req.Model))
 		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	setMetricsModel(c, m.ShortName)
+
 	checkpointLoaded := time.Now()
 
-	if req.Prompt == "" {
+	if req.Prompt == "" && len(req.Tokens) == 0 {
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			Model:      req.Model,
 			CreatedAt:  time.Now().UTC(),
@@ -158,11 +321,14 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 	prompt := req.Prompt
 	if !req.Raw {
+		_, span := tracing.Start(c.Request.Context(), "prompt")
 		tmpl := m.Template
 		if req.Template != "" {
 			tmpl, err = template.Parse(req.Template)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				span.RecordError(err)
+				span.End()
+				writeQueuedError(c, http.StatusInternalServerError, err.Error())
 				return
 			}
 		}
@@ -192,20 +358,25 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 
 		var b bytes.Buffer
 		if req.Context != nil {
-			s, err := r.Detokenize(c.Request.Context(), req.Context)
+			s, err := r.llama.Detokenize(c.Request.Context(), req.Context)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				span.RecordError(err)
+				span.End()
+				writeQueuedError(c, http.StatusInternalServerError, err.Error())
 				return
 			}
 			b.WriteString(s)
 		}
 
 		if err := tmpl.Execute(&b, values); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			span.RecordError(err)
+			span.End()
+			writeQueuedError(c, http.StatusInternalServerError, err.Error())
 			return
 		}
 
 		prompt = b.String()
+		span.End()
 	}
 
 	slog.Debug("generate request", "prompt", prompt, "images", images)
@@ -215,11 +386,16 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		// TODO (jmorganca): avoid building the response twice both here and below
 		var sb strings.Builder
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		if err := r.llama.Completion(c.Request.Context(), llm.CompletionRequest{
+			Prompt:      prompt,
+			Tokens:      req.Tokens,
+			Images:      images,
+			Format:      format,
+			Grammar:     gbnf,
+			Options:     opts,
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
+			Cache:       req.Cache,
 		}, func(cr llm.CompletionResponse) {
 			res := api.GenerateResponse{
 				Model:      req.Model,
@@ -227,11 +403,14 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 				Response:   cr.Content,
 				Done:       cr.Done,
 				DoneReason: cr.DoneReason,
+				Logprobs:   cr.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    cr.PromptEvalCount,
 					PromptEvalDuration: cr.PromptEvalDuration,
 					EvalCount:          cr.EvalCount,
 					EvalDuration:       cr.EvalDuration,
+					DraftAcceptedCount: cr.DraftAcceptedCount,
+					DraftRejectedCount: cr.DraftRejectedCount,
 				},
 			}
 
@@ -242,9 +421,10 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 			if cr.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				recordTokens(c, m.ShortName, cr.PromptEvalCount, cr.EvalCount)
 
 				if !req.Raw {
-					tokens, err := r.Tokenize(c.Request.Context(), prompt+sb.String())
+					tokens, err := r.llama.Tokenize(c.Request.Context(), prompt+sb.String())
 					if err != nil {
 						ch <- gin.H{"error": err.Error()}
 						return
@@ -262,10 +442,12 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 	if req.Stream != nil && !*req.Stream {
 		var r api.GenerateResponse
 		var sb strings.Builder
+		var logprobs []api.TokenLogprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(t.Response)
+				logprobs = append(logprobs, t.Logprobs...)
 				r = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -282,6 +464,7 @@ func (s *Server) GenerateHandler(c *gin.Context) {
 		}
 
 		r.Response = sb.String()
+		r.Logprobs = logprobs
 		c.JSON(http.StatusOK, r)
 		return
 	}
@@ -302,6 +485,11 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		return
 	}
 
+	c.Set(requestModelKey, req.Model)
+	if !authorizeModel(c, req.Model) || !s.admitModel(c, req.Model) {
+		return
+	}
+
 	truncate := true
 
 	if req.Truncate != nil && !*req.Truncate {
@@ -330,12 +518,14 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		}
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	r, m, opts, err := s.scheduleRunner(priorityContext(c, req.Priority), req.Model, "", []Capability{}, req.Options, req.KeepAlive, nil)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	setMetricsModel(c, m.ShortName)
+
 	checkpointLoaded := time.Now()
 
 	if len(input) == 0 {
@@ -350,8 +540,9 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 	}
 
 	var count int
+	counts := make([]int, len(input))
 	for i, s := range input {
-		tokens, err := r.Tokenize(c.Request.Context(), s)
+		tokens, err := r.llama.Tokenize(c.Request.Context(), s)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -365,7 +556,7 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 			}
 
 			tokens = tokens[:ctxLen]
-			s, err = r.Detokenize(c.Request.Context(), tokens)
+			s, err = r.llama.Detokenize(c.Request.Context(), tokens)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
@@ -373,29 +564,24 @@ func (s *Server) EmbedHandler(c *gin.Context) {
 		}
 
 		count += len(tokens)
+		counts[i] = len(tokens)
 
 		input[i] = s
 	}
 
-	var g errgroup.Group
-	embeddings := make([][]float32, len(input))
-	for i, text := range input {
-		g.Go(func() error {
-			embedding, err := r.Embedding(c.Request.Context(), text)
-			if err != nil {
-				return err
-			}
-			embeddings[i] = normalize(embedding)
-			return nil
-		})
-	}
-
-	if err := g.Wait(); err != nil {
+	embeddings, err := r.embedBatcher(opts.NumBatch).Embed(c.Request.Context(), input, counts)
+	if err != nil {
 		slog.Error("embedding generation failed", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Errorf("failed to generate embeddings: %v", err)})
 		return
 	}
 
+	for i := range embeddings {
+		embeddings[i] = normalize(embeddings[i])
+	}
+
+	recordTokens(c, m.ShortName, count, 0)
+
 	resp := api.EmbedResponse{
 		Model:           req.Model,
 		Embeddings:      embeddings,
@@ -433,19 +619,26 @@ func (s *Server) EmbeddingsHandler(c *gin.Context) {
 		return
 	}
 
-	r, _, _, err := s.scheduleRunner(c.Request.Context(), req.Model, []Capability{}, req.Options, req.KeepAlive)
+	c.Set(requestModelKey, req.Model)
+	if !authorizeModel(c, req.Model) || !s.admitModel(c, req.Model) {
+		return
+	}
+
+	r, m, _, err := s.scheduleRunner(priorityContext(c, req.Priority), req.Model, "", []Capability{}, req.Options, req.KeepAlive, nil)
 	if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	setMetricsModel(c, m.ShortName)
+
 	// an empty request loads the model
 	if req.Prompt == "" {
 		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
 		return
 	}
 
-	embedding, err := r.Embedding(c.Request.Context(), req.Prompt)
+	embedding, err := r.llama.Embedding(c.Request.Context(), req.Prompt)
 	if err != nil {
 		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
@@ -475,6 +668,11 @@ func (s *Server) PullHandler(c *gin.Context) {
 		return
 	}
 
+	c.Set(requestModelKey, cmp.Or(req.Model, req.Name))
+	if !authorizeModel(c, cmp.Or(req.Model, req.Name)) {
+		return
+	}
+
 	name := model.ParseName(cmp.Or(req.Model, req.Name))
 	if !name.IsValid() {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid model name"})
@@ -506,11 +704,15 @@ func (s *Server) PullHandler(c *gin.Context) {
 	}()
 
 	if req.Stream != nil && !*req.Stream {
-		waitForStream(c, ch)
+		if waitForStream(c, ch) {
+			setMetricsModel(c, name.DisplayShortest())
+		}
 		return
 	}
 
-	streamResponse(c, ch)
+	if streamResponse(c, ch) {
+		setMetricsModel(c, name.DisplayShortest())
+	}
 }
 
 func (s *Server) PushHandler(c *gin.Context) {
@@ -535,6 +737,11 @@ func (s *Server) PushHandler(c *gin.Context) {
 		return
 	}
 
+	c.Set(requestModelKey, model)
+	if !authorizeModel(c, model) {
+		return
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
@@ -555,11 +762,15 @@ func (s *Server) PushHandler(c *gin.Context) {
 	}()
 
 	if req.Stream != nil && !*req.Stream {
-		waitForStream(c, ch)
+		if waitForStream(c, ch) {
+			setMetricsModel(c, ParseModelPath(model).GetShortTagname())
+		}
 		return
 	}
 
-	streamResponse(c, ch)
+	if streamResponse(c, ch) {
+		setMetricsModel(c, ParseModelPath(model).GetShortTagname())
+	}
 }
 
 func checkNameExists(name model.Name) error {
@@ -587,6 +798,11 @@ func (s *Server) CreateHandler(c *gin.Context) {
 		return
 	}
 
+	c.Set(requestModelKey, cmp.Or(r.Model, r.Name))
+	if !authorizeModel(c, cmp.Or(r.Model, r.Name)) {
+		return
+	}
+
 	name := model.ParseName(cmp.Or(r.Model, r.Name))
 	if !name.IsValid() {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": errtypes.InvalidModelNameErrMsg})
@@ -640,11 +856,15 @@ func (s *Server) CreateHandler(c *gin.Context) {
 	}()
 
 	if r.Stream != nil && !*r.Stream {
-		waitForStream(c, ch)
+		if waitForStream(c, ch) {
+			setMetricsModel(c, name.DisplayShortest())
+		}
 		return
 	}
 
-	streamResponse(c, ch)
+	if streamResponse(c, ch) {
+		setMetricsModel(c, name.DisplayShortest())
+	}
 }
 
 func (s *Server) DeleteHandler(c *gin.Context) {
@@ -657,6 +877,11 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 		return
 	}
 
+	c.Set(requestModelKey, cmp.Or(r.Model, r.Name))
+	if !authorizeModel(c, cmp.Or(r.Model, r.Name)) {
+		return
+	}
+
 	n := model.ParseName(cmp.Or(r.Model, r.Name))
 	if !n.IsValid() {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name %q is invalid", cmp.Or(r.Model, r.Name))})
@@ -664,11 +889,16 @@ func (s *Server) DeleteHandler(c *gin.Context) {
 	}
 
 	m, err := ParseNamedManifest(n)
-	if err != nil {
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", cmp.Or(r.Model, r.Name))})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	setMetricsModel(c, n.DisplayShortest())
+
 	if err := m.Remove(); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -701,6 +931,11 @@ func (s *Server) ShowHandler(c *gin.Context) {
 		return
 	}
 
+	c.Set(requestModelKey, req.Model)
+	if !authorizeModel(c, req.Model) {
+		return
+	}
+
 	resp, err := GetModelInfo(req)
 	if err != nil {
 		switch {
@@ -714,6 +949,7 @@ func (s *Server) ShowHandler(c *gin.Context) {
 		return
 	}
 
+	setMetricsModel(c, model.ParseName(req.Model).DisplayShortest())
 	c.JSON(http.StatusOK, resp)
 }
 
@@ -760,6 +996,10 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 		ModifiedAt: manifest.fi.ModTime(),
 	}
 
+	for _, cap := range m.Capabilities() {
+		resp.Capabilities = append(resp.Capabilities, string(cap))
+	}
+
 	var params []string
 	cs := 30
 	for k, v := range m.Options {
@@ -806,6 +1046,17 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	return resp, nil
 }
 
+// showModel returns the details of a model for the model list of the
+// OpenAI compatible API
+func showModel(name string) (api.ShowResponse, error) {
+	resp, err := GetModelInfo(api.ShowRequest{Model: name})
+	if err != nil {
+		return api.ShowResponse{}, err
+	}
+
+	return *resp, nil
+}
+
 func getKVData(digest string, verbose bool) (llm.KV, error) {
 	maxArraySize := 0
 	if verbose {
@@ -854,6 +1105,10 @@ func (s *Server) ListHandler(c *gin.Context) {
 			}
 		}
 
+		if !apiKeyFromContext(c).allowsModel(n.DisplayShortest()) {
+			continue
+		}
+
 		// tag should never be masked
 		models = append(models, api.ListModelResponse{
 			Model:      n.DisplayShortest(),
@@ -889,6 +1144,10 @@ func (s *Server) CopyHandler(c *gin.Context) {
 		return
 	}
 
+	if !authorizeModel(c, r.Source, r.Destination) {
+		return
+	}
+
 	src := model.ParseName(r.Source)
 	if !src.IsValid() {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("source %q is invalid", r.Source)})
@@ -1028,7 +1287,8 @@ func allowedHost(host string) bool {
 
 func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if addr == nil {
+		if addr == nil || addr.Network() == "unix" {
+			// connections over a unix socket can only come from this host
 			c.Next()
 			return
 		}
@@ -1064,43 +1324,96 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	}
 }
 
+// tracingMiddleware starts a span for each request, joining the caller's trace
+// when the request carries a traceparent header
+func tracingMiddleware(c *gin.Context) {
+	name := c.Request.Method
+	if route := c.FullPath(); route != "" {
+		name += " " + route
+	}
+
+	ctx, span := tracing.StartServer(c.Request.Context(), c.Request.Header, name)
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttribute("http.request.method", c.Request.Method)
+	span.SetAttribute("http.route", c.FullPath())
+	span.SetAttribute("http.response.status_code", status)
+	if model := c.GetString(requestModelKey); model != "" {
+		span.SetAttribute("ollama.model", model)
+	}
+
+	if status >= http.StatusInternalServerError {
+		span.RecordError(errors.New(http.StatusText(status)))
+	}
+}
+
 func (s *Server) GenerateRoutes() http.Handler {
 	config := cors.DefaultConfig()
 	config.AllowWildcard = true
 	config.AllowBrowserExtensions = true
-	config.AllowHeaders = []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With"}
+	config.AllowHeaders = []string{"Authorization", "Content-Type", "User-Agent", "Accept", "X-Requested-With", "X-Ollama-Priority", "traceparent"}
 	openAIProperties := []string{"lang", "package-version", "os", "arch", "runtime", "runtime-version", "async"}
 	for _, prop := range openAIProperties {
 		config.AllowHeaders = append(config.AllowHeaders, "x-stainless-"+prop)
 	}
+	config.AllowHeaders = append(config.AllowHeaders, "x-api-key", "anthropic-version", "anthropic-beta")
 	config.AllowOrigins = envconfig.Origins()
 
 	r := gin.Default()
+	// clients are identified by the address of the connection unless it comes
+	// from a trusted proxy, so forwarding headers can't be used to evade limits
+	if err := r.SetTrustedProxies(envconfig.TrustedProxies()); err != nil {
+		slog.Warn("ignoring invalid OLLAMA_TRUSTED_PROXIES", "error", err)
+		_ = r.SetTrustedProxies(nil)
+	}
+
 	r.Use(
 		cors.New(config),
 		allowedHostsMiddleware(s.addr),
+		tracingMiddleware,
+		metricsMiddleware,
+		authMiddleware(s.keys),
+		limitsMiddleware(s.limits),
 	)
 
-	r.POST("/api/pull", s.PullHandler)
-	r.POST("/api/generate", s.GenerateHandler)
-	r.POST("/api/chat", s.ChatHandler)
-	r.POST("/api/embed", s.EmbedHandler)
-	r.POST("/api/embeddings", s.EmbeddingsHandler)
-	r.POST("/api/create", s.CreateHandler)
-	r.POST("/api/push", s.PushHandler)
+	audit := auditMiddleware(s.audit)
+
+	r.POST("/api/pull", audit, s.PullHandler)
+	r.POST("/api/generate", audit, s.GenerateHandler)
+	r.POST("/api/chat", audit, s.ChatHandler)
+	r.POST("/api/embed", audit, s.EmbedHandler)
+	r.POST("/api/embeddings", audit, s.EmbeddingsHandler)
+	r.POST("/api/create", audit, s.CreateHandler)
+	r.POST("/api/push", audit, s.PushHandler)
 	r.POST("/api/copy", s.CopyHandler)
-	r.DELETE("/api/delete", s.DeleteHandler)
+	r.DELETE("/api/delete", audit, s.DeleteHandler)
 	r.POST("/api/show", s.ShowHandler)
 	r.POST("/api/blobs/:digest", s.CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", s.HeadBlobHandler)
 	r.GET("/api/ps", s.PsHandler)
+	r.GET("/metrics", s.MetricsHandler)
 
 	// Compatibility endpoints
-	r.POST("/v1/chat/completions", openai.ChatMiddleware(), s.ChatHandler)
-	r.POST("/v1/completions", openai.CompletionsMiddleware(), s.GenerateHandler)
-	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), s.EmbedHandler)
-	r.GET("/v1/models", openai.ListMiddleware(), s.ListHandler)
+	r.POST("/v1/chat/completions", openai.ChatMiddleware(), audit, openai.Choices(s.ChatHandler))
+	r.POST("/v1/completions", openai.CompletionsMiddleware(), audit, openai.Choices(s.GenerateHandler))
+	r.POST("/v1/embeddings", openai.EmbeddingsMiddleware(), audit, s.EmbedHandler)
+	r.GET("/v1/models", openai.ListMiddleware(showModel), s.ListHandler)
 	r.GET("/v1/models/:model", openai.RetrieveMiddleware(), s.ShowHandler)
+	r.DELETE("/v1/models/:model", openai.DeleteMiddleware(), audit, s.DeleteHandler)
+	r.POST("/v1/messages", anthropic.MessagesMiddleware(), audit, s.ChatHandler)
+	r.POST("/v1/files", limitFileSize, audit, s.CreateFileHandler)
+	r.GET("/v1/files", s.ListFilesHandler)
+	r.GET("/v1/files/:file", s.RetrieveFileHandler)
+	r.GET("/v1/files/:file/content", s.FileContentHandler)
+	r.DELETE("/v1/files/:file", audit, s.DeleteFileHandler)
+	r.POST("/v1/batches", audit, s.CreateBatchHandler)
+	r.GET("/v1/batches", s.ListBatchesHandler)
+	r.GET("/v1/batches/:batch", s.RetrieveBatchHandler)
+	r.POST("/v1/batches/:batch/cancel", audit, s.CancelBatchHandler)
 
 	for _, method := range []string{http.MethodGet, http.MethodHead} {
 		r.Handle(method, "/", func(c *gin.Context) {
@@ -1162,14 +1475,66 @@ func Serve(ln net.Listener) error {
 		}
 	}
 
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return fmt.Errorf("unable to configure TLS %w", err)
+	}
+
+	var keys apiKeys
+	if path := envconfig.APIKeysFile(); path != "" {
+		keys, err = loadAPIKeys(path)
+		if err != nil {
+			return fmt.Errorf("unable to load API keys %w", err)
+		}
+
+		slog.Info("API key authentication enabled", "keys", len(keys))
+	}
+
+	var limits *limiter
+	if path := envconfig.LimitsFile(); path != "" {
+		config, err := loadLimits(path)
+		if err != nil {
+			return fmt.Errorf("unable to load limits %w", err)
+		}
+
+		limits = newLimiter(*config)
+	} else if slices.ContainsFunc(keys, func(k apiKey) bool { return k.Limits != nil }) {
+		limits = newLimiter(limitsConfig{})
+	}
+
+	var audit *auditLog
+	if path := envconfig.AuditLog(); path != "" {
+		audit, err = openAuditLog(path, int64(envconfig.AuditLogMaxSize()), int(envconfig.AuditLogMaxFiles()), envconfig.AuditLogContent())
+		if err != nil {
+			return fmt.Errorf("unable to open audit log %w", err)
+		}
+		defer audit.Close()
+	}
+
+	batches, err := newBatchRunner(filepath.Join(envconfig.Models(), "batches"), keys)
+	if err != nil {
+		return fmt.Errorf("unable to load batches %w", err)
+	}
+
+	shutdownTracing, err := tracing.Init(envconfig.Traces())
+	if err != nil {
+		return fmt.Errorf("unable to initialize tracing %w", err)
+	}
+
 	ctx, done := context.WithCancel(context.Background())
 	schedCtx, schedDone := context.WithCancel(ctx)
 	sched := InitScheduler(schedCtx)
-	s := &Server{addr: ln.Addr(), sched: sched}
+	s := &Server{addr: ln.Addr(), sched: sched, keys: keys, limits: limits, audit: audit, batches: batches}
 
-	http.Handle("/", s.GenerateRoutes())
+	routes := s.GenerateRoutes()
+	http.Handle("/", routes)
+	go batches.Run(ctx, routes)
 
 	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
+	if tlsConfig != nil {
+		slog.Info("serving HTTPS", "client_certificates", tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert)
+	}
+
 	srvr := &http.Server{
 		// Use http.DefaultServeMux so we get net/http/pprof for
 		// free.
@@ -1179,7 +1544,8 @@ func Serve(ln net.Listener) error {
 		// users to bind it to a different port. This was a quick
 		// and easy way to get pprof, but it may not be the best
 		// way.
-		Handler: nil,
+		Handler:   nil,
+		TLSConfig: tlsConfig,
 	}
 
 	// listen for a ctrl+c and stop any loaded llm
@@ -1191,6 +1557,9 @@ func Serve(ln net.Listener) error {
 		schedDone()
 		sched.unloadAllRunners()
 		gpu.Cleanup()
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
 		done()
 	}()
 
@@ -1199,13 +1568,19 @@ func Serve(ln net.Listener) error {
 	}
 
 	s.sched.Run(schedCtx)
+	s.sched.loadPinned(schedCtx)
 
 	// At startup we retrieve GPU information so we can get log messages before loading a model
 	// This will log warnings to the log in case we have problems with detected GPUs
 	gpus := gpu.GetGPUInfo()
 	gpus.LogDetails()
 
-	err = srvr.Serve(ln)
+	if tlsConfig != nil {
+		// the certificate is already loaded in TLSConfig
+		err = srvr.ServeTLS(ln, "", "")
+	} else {
+		err = srvr.Serve(ln)
+	}
 	// If server is closed from the signal handler, wait for the ctx to be done
 	// otherwise error out quickly
 	if !errors.Is(err, http.ErrServerClosed) {
@@ -1215,14 +1590,16 @@ func Serve(ln net.Listener) error {
 	return nil
 }
 
-func waitForStream(c *gin.Context, ch chan interface{}) {
+// waitForStream writes the final response of ch, reporting whether it was the
+// success of the operation
+func waitForStream(c *gin.Context, ch chan interface{}) bool {
 	c.Header("Content-Type", "application/json")
 	for resp := range ch {
 		switch r := resp.(type) {
 		case api.ProgressResponse:
 			if r.Status == "success" {
 				c.JSON(http.StatusOK, r)
-				return
+				return true
 			}
 		case gin.H:
 			status, ok := r["status"].(int)
@@ -1231,20 +1608,23 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 			}
 			if errorMsg, ok := r["error"].(string); ok {
 				c.JSON(status, gin.H{"error": errorMsg})
-				return
+				return false
 			} else {
 				c.JSON(status, gin.H{"error": "unexpected error format in progress response"})
-				return
+				return false
 			}
 		default:
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected progress response"})
-			return
+			return false
 		}
 	}
 	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
+	return false
 }
 
-func streamResponse(c *gin.Context, ch chan any) {
+// streamResponse streams the responses of ch, reporting whether they included
+// the success of an operation
+func streamResponse(c *gin.Context, ch chan any) (succeeded bool) {
 	c.Header("Content-Type", "application/x-ndjson")
 	c.Stream(func(w io.Writer) bool {
 		val, ok := <-ch
@@ -1252,6 +1632,10 @@ func streamResponse(c *gin.Context, ch chan any) {
 			return false
 		}
 
+		if r, ok := val.(api.ProgressResponse); ok && r.Status == "success" {
+			succeeded = true
+		}
+
 		bts, err := json.Marshal(val)
 		if err != nil {
 			slog.Info(fmt.Sprintf("streamResponse: json.Marshal failed with %s", err))
@@ -1267,13 +1651,20 @@ func streamResponse(c *gin.Context, ch chan any) {
 
 		return true
 	})
+
+	return succeeded
 }
 
 func (s *Server) PsHandler(c *gin.Context) {
 	models := []api.ProcessModelResponse{}
 
+	k := apiKeyFromContext(c)
 	for _, v := range s.sched.loaded {
 		model := v.model
+		if !k.allowsModel(model.ShortName) {
+			continue
+		}
+
 		modelDetails := api.ModelDetails{
 			Format:            model.Config.ModelFormat,
 			Family:            model.Config.ModelFamily,
@@ -1282,6 +1673,7 @@ func (s *Server) PsHandler(c *gin.Context) {
 			QuantizationLevel: model.Config.FileType,
 		}
 
+		v.refMu.Lock()
 		mr := api.ProcessModelResponse{
 			Model:     model.ShortName,
 			Name:      model.ShortName,
@@ -1290,7 +1682,10 @@ func (s *Server) PsHandler(c *gin.Context) {
 			Digest:    model.Digest,
 			Details:   modelDetails,
 			ExpiresAt: v.expiresAt,
+			Pinned:    v.pinned,
+			Reason:    v.reason(),
 		}
+		v.refMu.Unlock()
 		// The scheduler waits to set expiresAt, so if a model is loading it's
 		// possible that it will be set to the unix epoch. For those cases, just
 		// calculate the time w/ the sessionDuration instead.
@@ -1307,7 +1702,7 @@ func (s *Server) PsHandler(c *gin.Context) {
 		return cmp.Compare(j.ExpiresAt.Unix(), i.ExpiresAt.Unix())
 	})
 
-	c.JSON(http.StatusOK, api.ProcessResponse{Models: models})
+	c.JSON(http.StatusOK, api.ProcessResponse{Models: models, Queue: s.sched.queue.Depth()})
 }
 
 func (s *Server) ChatHandler(c *gin.Context) {
@@ -1322,22 +1717,57 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		return
 	}
 
+	c.Set(requestModelKey, req.Model)
+	if !authorizeModel(c, req.Model, req.Draft) || !s.admitModel(c, req.Model, req.Draft) {
+		return
+	}
+
+	format, gbnf, err := parseFormat(req.Format)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err := checkToolChoice(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	caps := []Capability{CapabilityCompletion}
 	if len(req.Tools) > 0 {
 		caps = append(caps, CapabilityTools)
 	}
 
-	r, m, opts, err := s.scheduleRunner(c.Request.Context(), req.Model, caps, req.Options, req.KeepAlive)
+	var queued func(api.QueueStatus)
+	if req.Stream == nil || *req.Stream {
+		queued = func(status api.QueueStatus) {
+			streamFrame(c, api.ChatResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Message: api.Message{Role: "assistant"}, Queued: &status})
+		}
+	}
+
+	runner, m, opts, err := s.scheduleRunner(priorityContext(c, req.Priority), req.Model, req.Draft, caps, req.Options, req.KeepAlive, queued)
 	if errors.Is(err, errCapabilityCompletion) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%q does not support chat", req.Model)})
+		writeQueuedError(c, http.StatusBadRequest, fmt.Sprintf("%q does not support chat", req.Model))
 		return
 	} else if err != nil {
 		handleScheduleError(c, req.Model, err)
 		return
 	}
 
+	setMetricsModel(c, m.ShortName)
+
 	checkpointLoaded := time.Now()
 
+	parallelToolCalls := req.ParallelToolCalls == nil || *req.ParallelToolCalls
+	if req.ToolChoice == "required" {
+		format = "json"
+		if gbnf, err = m.toolCallGrammar(req.Tools, parallelToolCalls); err != nil {
+			writeQueuedError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
 	if len(req.Messages) == 0 {
 		c.JSON(http.StatusOK, api.ChatResponse{
 			Model:      req.Model,
@@ -1354,40 +1784,97 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		msgs = append([]api.Message{{Role: "system", Content: m.System}}, msgs...)
 	}
 
-	prompt, images, err := chatPrompt(c.Request.Context(), m, r.Tokenize, opts, msgs, req.Tools)
+	// summaries of messages left out of the prompt count against the
+	// request's metrics and quotas like the response does
+	summarize := func(ctx context.Context, cr llm.CompletionRequest, fn func(llm.CompletionResponse)) error {
+		return runner.llama.Completion(ctx, cr, func(r llm.CompletionResponse) {
+			if r.Done {
+				recordTokens(c, m.ShortName, r.PromptEvalCount, r.EvalCount)
+			}
+
+			fn(r)
+		})
+	}
+
+	prompt, images, dropped, err := chatPrompt(c.Request.Context(), m, runner.llama.Tokenize, summarize, opts, msgs, req.Tools)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeQueuedError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	slog.Debug("chat request", "images", len(images), "prompt", prompt)
 
+	// earlier turns of the session are processed again unless the slot that
+	// holds them processes the request
+	session := chatSession(req)
+	var slot *int
+	if n, ok := runner.sessionSlot(session); ok {
+		slot = &n
+	}
+
+	// streamed tool calls are parsed as they are generated
+	var parser *toolCallParser
+	if len(req.Tools) > 0 && (req.Stream == nil || *req.Stream) {
+		parser, _ = m.toolCallParser()
+	}
+
 	ch := make(chan any)
 	go func() {
 		defer close(ch)
-		if err := r.Completion(c.Request.Context(), llm.CompletionRequest{
-			Prompt:  prompt,
-			Images:  images,
-			Format:  req.Format,
-			Options: opts,
+		if err := runner.llama.Completion(c.Request.Context(), llm.CompletionRequest{
+			Prompt:      prompt,
+			Images:      images,
+			Format:      format,
+			Grammar:     gbnf,
+			Options:     opts,
+			Logprobs:    req.Logprobs,
+			TopLogprobs: req.TopLogprobs,
+			Cache:       req.Cache,
+			Slot:        slot,
 		}, func(r llm.CompletionResponse) {
+			content := r.Content
+			var toolCalls []api.ToolCall
+			if parser != nil {
+				content, toolCalls = parser.Add(r.Content)
+				if r.Done {
+					content += parser.Flush()
+				}
+
+				if !parallelToolCalls {
+					toolCalls = slices.DeleteFunc(toolCalls, func(tc api.ToolCall) bool { return tc.Index > 0 })
+				}
+			}
+
 			res := api.ChatResponse{
 				Model:      req.Model,
 				CreatedAt:  time.Now().UTC(),
-				Message:    api.Message{Role: "assistant", Content: r.Content},
+				Message:    api.Message{Role: "assistant", Content: content, ToolCalls: toolCalls},
 				Done:       r.Done,
 				DoneReason: r.DoneReason,
+				Logprobs:   r.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
 					EvalCount:          r.EvalCount,
 					EvalDuration:       r.EvalDuration,
+					DraftAcceptedCount: r.DraftAcceptedCount,
+					DraftRejectedCount: r.DraftRejectedCount,
 				},
 			}
 
 			if r.Done {
 				res.TotalDuration = time.Since(checkpointStart)
 				res.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				res.DroppedMessages = dropped
+				recordTokens(c, m.ShortName, r.PromptEvalCount, r.EvalCount)
+
+				if slot != nil {
+					hit := r.Slot == *slot
+					res.SessionHit = &hit
+					recordSessionHit(m.ShortName, hit)
+				}
+
+				runner.recordSession(session, r.Slot)
 			}
 
 			ch <- res
@@ -1399,10 +1886,12 @@ func (s *Server) ChatHandler(c *gin.Context) {
 	if req.Stream != nil && !*req.Stream {
 		var resp api.ChatResponse
 		var sb strings.Builder
+		var logprobs []api.TokenLogprob
 		for rr := range ch {
 			switch t := rr.(type) {
 			case api.ChatResponse:
 				sb.WriteString(t.Message.Content)
+				logprobs = append(logprobs, t.Logprobs...)
 				resp = t
 			case gin.H:
 				msg, ok := t["error"].(string)
@@ -1419,9 +1908,14 @@ func (s *Server) ChatHandler(c *gin.Context) {
 		}
 
 		resp.Message.Content = sb.String()
+		resp.Logprobs = logprobs
 
 		if len(req.Tools) > 0 {
 			if toolCalls, ok := m.parseToolCalls(sb.String()); ok {
+				if !parallelToolCalls {
+					toolCalls = toolCalls[:1]
+				}
+
 				resp.Message.ToolCalls = toolCalls
 				resp.Message.Content = ""
 			}
@@ -1436,15 +1930,27 @@ func (s *Server) ChatHandler(c *gin.Context) {
 
 func handleScheduleError(c *gin.Context, name string, err error) {
 	switch {
-	case errors.Is(err, errCapabilities), errors.Is(err, errRequired):
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, errCapabilities), errors.Is(err, errRequired), errors.Is(err, errBadOptions):
+		writeQueuedError(c, http.StatusBadRequest, err.Error())
 	case errors.Is(err, context.Canceled):
-		c.JSON(499, gin.H{"error": "request canceled"})
+		writeQueuedError(c, 499, "request canceled")
 	case errors.Is(err, ErrMaxQueue):
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		writeQueuedError(c, http.StatusServiceUnavailable, err.Error())
 	case errors.Is(err, os.ErrNotExist):
-		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model %q not found, try pulling it first", name)})
+		writeQueuedError(c, http.StatusNotFound, fmt.Sprintf("model %q not found, try pulling it first", name))
 	default:
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeQueuedError(c, http.StatusInternalServerError, err.Error())
 	}
 }
+
+// writeQueuedError responds with an error of a request that may have been
+// queued. Once queued status frames have been streamed the status code can't
+// change, so the error is reported in the stream instead.
+func writeQueuedError(c *gin.Context, code int, msg string) {
+	if c.Writer.Written() {
+		streamFrame(c, gin.H{"error": msg})
+		return
+	}
+
+	c.JSON(code, gin.H{"error": msg})
+}
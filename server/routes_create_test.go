@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -616,3 +617,86 @@ func TestCreateDetectTemplate(t *testing.T) {
 		})
 	})
 }
+
+func TestCreateDraft(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p := t.TempDir()
+	t.Setenv("OLLAMA_MODELS", p)
+	var s Server
+
+	draftFile := createBinFile(t, llm.KV{"general.name": "draft"}, nil)
+
+	create := func(t *testing.T, name, modelfile string) *Model {
+		t.Helper()
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      name,
+			Modelfile: modelfile,
+			Stream:    &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status code 200, actual %d: %s", w.Code, w.Body.String())
+		}
+
+		m, err := GetModel(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return m
+	}
+
+	draft := create(t, "draft", fmt.Sprintf("FROM %s", draftFile))
+
+	t.Run("model", func(t *testing.T) {
+		m := create(t, "test", fmt.Sprintf("FROM %s\nDRAFT draft", createBinFile(t, nil, nil)))
+		if m.DraftPath != draft.ModelPath {
+			t.Errorf("expected draft path %s, actual %s", draft.ModelPath, m.DraftPath)
+		}
+
+		if !slices.Contains(strings.Split(m.String(), "\n"), "DRAFT "+draft.ModelPath) {
+			t.Errorf("expected modelfile to contain the draft model, actual %s", m.String())
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		m := create(t, "test2", fmt.Sprintf("FROM %s\nDRAFT %s", createBinFile(t, nil, nil), draftFile))
+		if m.DraftPath != draft.ModelPath {
+			t.Errorf("expected draft path %s, actual %s", draft.ModelPath, m.DraftPath)
+		}
+	})
+
+	t.Run("inherit", func(t *testing.T) {
+		m := create(t, "test3", "FROM test")
+		if m.DraftPath != draft.ModelPath {
+			t.Errorf("expected draft path %s, actual %s", draft.ModelPath, m.DraftPath)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		other := createBinFile(t, llm.KV{"general.name": "other"}, nil)
+		m := create(t, "test4", fmt.Sprintf("FROM test\nDRAFT %s", other))
+		if m.DraftPath == "" || m.DraftPath == draft.ModelPath {
+			t.Errorf("expected draft path to be replaced, actual %s", m.DraftPath)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		f := filepath.Join(t.TempDir(), "draft.txt")
+		if err := os.WriteFile(f, []byte("not a model"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		w := createRequest(t, s.CreateHandler, api.CreateRequest{
+			Name:      "test5",
+			Modelfile: fmt.Sprintf("FROM test\nDRAFT %s", f),
+			Stream:    &stream,
+		})
+
+		if w.Code == http.StatusOK {
+			t.Fatalf("expected error status code, actual %d", w.Code)
+		}
+	})
+}
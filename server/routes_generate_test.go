@@ -1,12 +1,15 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -41,8 +44,8 @@ func (mockRunner) Tokenize(_ context.Context, s string) (tokens []int, err error
 	return
 }
 
-func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, api.Options, int) (llm.LlamaServer, error) {
-	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func newMockServer(mock *mockRunner) func(gpu.GpuInfoList, string, *llm.GGML, []string, []string, string, api.Options, int) (llm.LlamaServer, error) {
+	return func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, projectors, system []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return mock, nil
 	}
 }
@@ -64,6 +67,8 @@ func TestGenerateChat(t *testing.T) {
 	s := Server{
 		sched: &Scheduler{
 			pendingReqCh:  make(chan *LlmRequest, 1),
+			queue:         newFairQueue(),
+			maxQueue:      1,
 			finishedReqCh: make(chan *LlmRequest, 1),
 			expiredCh:     make(chan *runnerRef, 1),
 			unloadedCh:    make(chan any, 1),
@@ -343,6 +348,193 @@ func TestGenerateChat(t *testing.T) {
 
 		checkChatResponse(t, w.Body, "test-system", "Abra kadabra!")
 	})
+
+	t.Run("format schema", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Format: json.RawMessage(`{"enum": ["yes", "no"]}`),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Format != "json" || !strings.Contains(mock.CompletionRequest.Grammar, `root ::= "\"yes\"" ws | "\"no\"" ws`) {
+			t.Errorf("expected json format with schema grammar, got %q and %q", mock.CompletionRequest.Format, mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("messages with cache", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Cache:  "greetings",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Cache != "greetings" {
+			t.Errorf("expected cache %q, got %q", "greetings", mock.CompletionRequest.Cache)
+		}
+	})
+
+	w = createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test-tools",
+		Modelfile: `FROM test
+TEMPLATE """
+{{- if .Tools }}Tools: {{ .Tools }} {{ end }}
+{{- range .Messages }}
+{{- if eq .Role "user" }}User: {{ .Content }} {{ end }}
+{{- range .ToolCalls }}{"name": "{{ .Function.Name }}", "arguments": {{ .Function.Arguments }}}{{ end }}
+{{- end }}"""
+`,
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var tools []api.Tool
+	if err := json.Unmarshal([]byte(`[{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]}}}]`), &tools); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("tool choice required", func(t *testing.T) {
+		mock.CompletionResponse.Content = `[{"name": "get_weather", "arguments": {"city": "Paris"}}, {"name": "get_weather", "arguments": {"city": "Rome"}}]`
+		defer func() { mock.CompletionResponse.Content = "" }()
+
+		for _, parallel := range []bool{true, false} {
+			w := createRequest(t, s.ChatHandler, api.ChatRequest{
+				Model: "test-tools",
+				Messages: []api.Message{
+					{Role: "user", Content: "What's the weather?"},
+				},
+				Tools:             tools,
+				ToolChoice:        "required",
+				ParallelToolCalls: &parallel,
+				Stream:            &stream,
+			})
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", w.Code)
+			}
+
+			if mock.CompletionRequest.Format != "json" || !strings.Contains(mock.CompletionRequest.Grammar, `"\"get_weather\""`) {
+				t.Errorf("expected tool call grammar, got %q and %q", mock.CompletionRequest.Format, mock.CompletionRequest.Grammar)
+			}
+
+			var resp api.ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := 2
+			if !parallel {
+				calls = 1
+			}
+
+			if len(resp.Message.ToolCalls) != calls {
+				t.Errorf("expected %d tool calls, got %d", calls, len(resp.Message.ToolCalls))
+			}
+		}
+	})
+
+	t.Run("stream tool calls", func(t *testing.T) {
+		mock.CompletionResponse.Content = `[{"name": "get_weather", "arguments": {"city": "Paris"}}, {"name": "get_weather", "arguments": {"city": "Rome"}}]`
+		defer func() { mock.CompletionResponse.Content = "" }()
+
+		parallel := false
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test-tools",
+			Messages: []api.Message{
+				{Role: "user", Content: "What's the weather?"},
+			},
+			Tools:             tools,
+			ParallelToolCalls: &parallel,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Message.Content != "" {
+			t.Errorf("expected no content, got %q", resp.Message.Content)
+		}
+
+		expect := []api.ToolCall{
+			{Function: api.ToolCallFunction{Name: "get_weather"}},
+			{Function: api.ToolCallFunction{PartialArguments: `{"city": "Paris"}`}},
+			{Function: api.ToolCallFunction{Name: "get_weather", Arguments: api.ToolCallFunctionArguments{"city": "Paris"}}},
+		}
+
+		if diff := cmp.Diff(resp.Message.ToolCalls, expect); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("tool choice none", func(t *testing.T) {
+		// the test model doesn't support tools, so this only succeeds if the
+		// tools are removed from the request
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Tools:      tools,
+			ToolChoice: "none",
+			Stream:     &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Grammar != "" {
+			t.Errorf("expected no grammar, got %q", mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("invalid tool choice", func(t *testing.T) {
+		for _, req := range []api.ChatRequest{
+			{Model: "test-tools", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, ToolChoice: "always", Tools: tools},
+			{Model: "test-tools", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, ToolChoice: "required"},
+			{Model: "test-tools", Messages: []api.Message{{Role: "user", Content: "Hello!"}}, ToolChoice: "required", Tools: tools, Format: json.RawMessage(`"json"`)},
+		} {
+			w := createRequest(t, s.ChatHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		}
+	})
+
+	t.Run("invalid format schema", func(t *testing.T) {
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model: "test",
+			Messages: []api.Message{
+				{Role: "user", Content: "Hello!"},
+			},
+			Format: json.RawMessage(`{"type": "integer", "minimum": 1}`),
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
 }
 
 func TestGenerate(t *testing.T) {
@@ -362,6 +554,8 @@ func TestGenerate(t *testing.T) {
 	s := Server{
 		sched: &Scheduler{
 			pendingReqCh:  make(chan *LlmRequest, 1),
+			queue:         newFairQueue(),
+			maxQueue:      1,
 			finishedReqCh: make(chan *LlmRequest, 1),
 			expiredCh:     make(chan *runnerRef, 1),
 			unloadedCh:    make(chan any, 1),
@@ -711,4 +905,260 @@ TEMPLATE """{{- if .Suffix }}<PRE> {{ .Prompt }} <SUF>{{ .Suffix }} <MID>
 			t.Errorf("mismatch (-got +want):\n%s", diff)
 		}
 	})
+
+	t.Run("tokens", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Tokens: []int{1, 2, 3},
+			Raw:    true,
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(mock.CompletionRequest.Tokens, []int{1, 2, 3}); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+
+		if mock.CompletionRequest.Prompt != "" {
+			t.Errorf("expected no prompt, got %q", mock.CompletionRequest.Prompt)
+		}
+	})
+
+	t.Run("tokens without raw", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Tokens: []int{1, 2, 3},
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+
+		if diff := cmp.Diff(w.Body.String(), `{"error":"tokens are only supported in raw mode without a prompt or images"}`); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("logprobs", func(t *testing.T) {
+		logprobs := []api.TokenLogprob{{
+			Token:       "Hi",
+			Logprob:     -0.1,
+			TopLogprobs: []api.Logprob{{Token: "Hi", Logprob: -0.1}, {Token: "Hello", Logprob: -2.5}},
+		}}
+
+		mock.CompletionResponse.Logprobs = logprobs
+		defer func() { mock.CompletionResponse.Logprobs = nil }()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:       "test",
+			Prompt:      "Hello!",
+			Stream:      &stream,
+			Logprobs:    true,
+			TopLogprobs: 2,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		if !mock.CompletionRequest.Logprobs || mock.CompletionRequest.TopLogprobs != 2 {
+			t.Errorf("expected logprobs with 2 top logprobs, got %t and %d", mock.CompletionRequest.Logprobs, mock.CompletionRequest.TopLogprobs)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(resp.Logprobs, logprobs); diff != "" {
+			t.Errorf("mismatch (-got +want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid top logprobs", func(t *testing.T) {
+		for _, req := range []api.GenerateRequest{
+			{Model: "test", Prompt: "Hello!", TopLogprobs: 2},
+			{Model: "test", Prompt: "Hello!", Logprobs: true, TopLogprobs: 21},
+		} {
+			w := createRequest(t, s.GenerateHandler, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		}
+	})
+
+	t.Run("format json", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Format: json.RawMessage(`"json"`),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Format != "json" || mock.CompletionRequest.Grammar != "" {
+			t.Errorf("expected json format without grammar, got %q and %q", mock.CompletionRequest.Format, mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("format schema", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Format: json.RawMessage(`{"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}`),
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", w.Code)
+		}
+
+		if mock.CompletionRequest.Format != "json" || !strings.Contains(mock.CompletionRequest.Grammar, `root ::= "{" ws root-name-kv "}" ws`) {
+			t.Errorf("expected json format with schema grammar, got %q and %q", mock.CompletionRequest.Format, mock.CompletionRequest.Grammar)
+		}
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		for _, format := range []string{`"xml"`, `1`, `{"type": "string", "pattern": "^a"}`} {
+			mock.CompletionRequest = llm.CompletionRequest{}
+			w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+				Model:  "test",
+				Prompt: "Hello!",
+				Format: json.RawMessage(format),
+			})
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", format, w.Code)
+			}
+
+			if mock.CompletionRequest.Prompt != "" {
+				t.Errorf("%s: expected no completion", format)
+			}
+		}
+	})
+
+	t.Run("draft", func(t *testing.T) {
+		mock.CompletionResponse.DraftAcceptedCount = 3
+		mock.CompletionResponse.DraftRejectedCount = 1
+		defer func() {
+			mock.CompletionResponse.DraftAcceptedCount = 0
+			mock.CompletionResponse.DraftRejectedCount = 0
+		}()
+
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Draft:  "test",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.GenerateResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.DraftAcceptedCount != 3 || resp.DraftRejectedCount != 1 {
+			t.Errorf("expected 3 accepted and 1 rejected draft tokens, got %d and %d", resp.DraftAcceptedCount, resp.DraftRejectedCount)
+		}
+	})
+
+	t.Run("missing draft", func(t *testing.T) {
+		w := createRequest(t, s.GenerateHandler, api.GenerateRequest{
+			Model:  "test",
+			Prompt: "Hello!",
+			Draft:  "missing",
+			Stream: &stream,
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestGenerateScheduleErrorAfterQueued(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	interval := queueStatusInterval
+	queueStatusInterval = 10 * time.Millisecond
+	t.Cleanup(func() { queueStatusInterval = interval })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh: make(chan *LlmRequest, 1),
+			queue:        newFairQueue(),
+			maxQueue:     1,
+		},
+	}
+
+	// only run the incoming loop so requests stay queued
+	go s.sched.processIncoming(ctx)
+
+	stream := false
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture": "llama",
+		}, nil)),
+		Stream: &stream,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	r := gin.New()
+	r.POST("/api/generate", s.GenerateHandler)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/generate", "application/json", strings.NewReader(`{"model": "test", "prompt": "Hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	if !scanner.Scan() {
+		t.Fatalf("expected a queued frame: %v", scanner.Err())
+	}
+
+	var queued api.GenerateResponse
+	if err := json.Unmarshal(scanner.Bytes(), &queued); err != nil {
+		t.Fatal(err)
+	}
+
+	if queued.Queued == nil || queued.Queued.Position != 1 {
+		t.Fatalf("expected a queued frame, got %s", scanner.Text())
+	}
+
+	// fail scheduling once the client has been told it's queued
+	req := s.sched.queue.pop()
+	req.errCh <- errors.New("unable to load model")
+
+	if !scanner.Scan() {
+		t.Fatalf("expected an error frame: %v", scanner.Err())
+	}
+
+	if diff := cmp.Diff(scanner.Text(), `{"error":"unable to load model"}`); diff != "" {
+		t.Errorf("mismatch (-got +want):\n%s", diff)
+	}
 }
@@ -8,13 +8,17 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 	"testing"
 
+	"github.com/gin-gonic/gin"
+	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -416,6 +420,70 @@ func TestShow(t *testing.T) {
 	if resp.ProjectorInfo["general.architecture"] != "clip" {
 		t.Fatal("Expected projector architecture to be 'clip', but got", resp.ProjectorInfo["general.architecture"])
 	}
+
+	if !slices.Equal(resp.Capabilities, []string{"completion", "vision"}) {
+		t.Fatal("Expected capabilities completion and vision, but got", resp.Capabilities)
+	}
+}
+
+func TestOpenAIListModels(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var s Server
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Name: "list-model",
+		Modelfile: fmt.Sprintf(
+			"FROM %s\nFROM %s",
+			createBinFile(t, llm.KV{"general.architecture": "test", "test.context_length": uint32(4096)}, nil),
+			createBinFile(t, llm.KV{"general.architecture": "clip"}, nil),
+		),
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	router := s.GenerateRoutes()
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var list openai.ListCompletion
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/models/list-model:latest", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, actual %d", w.Code)
+	}
+
+	var retrieved openai.Model
+	if err := json.NewDecoder(w.Body).Decode(&retrieved); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Data) != 1 {
+		t.Fatalf("expected 1 model, got %d", len(list.Data))
+	}
+
+	// list entries carry the same metadata as a retrieved model
+	if diff := cmp.Diff(retrieved, list.Data[0]); diff != "" {
+		t.Errorf("mismatch (-retrieved +listed):\n%s", diff)
+	}
+
+	if list.Data[0].ContextLength != 4096 {
+		t.Errorf("expected context length 4096, got %d", list.Data[0].ContextLength)
+	}
+
+	if !slices.Equal(list.Data[0].Capabilities, []string{"completion", "vision"}) {
+		t.Errorf("expected capabilities completion and vision, got %v", list.Data[0].Capabilities)
+	}
 }
 
 func TestNormalize(t *testing.T) {
@@ -452,3 +520,34 @@ func TestNormalize(t *testing.T) {
 		})
 	}
 }
+
+func TestAllowedHostsMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name   string
+		addr   net.Addr
+		host   string
+		status int
+	}{
+		{"loopback local host", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11434}, "localhost:11434", http.StatusOK},
+		{"loopback remote host", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11434}, "example.com", http.StatusForbidden},
+		{"unspecified remote host", &net.TCPAddr{IP: net.IPv4zero, Port: 11434}, "example.com", http.StatusOK},
+		{"unix socket remote host", &net.UnixAddr{Name: "/run/ollama.sock", Net: "unix"}, "example.com", http.StatusOK},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(allowedHostsMiddleware(tt.addr))
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, tt.status, w.Code)
+		})
+	}
+}
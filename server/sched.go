@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"reflect"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -19,6 +21,7 @@ import (
 	"github.com/ollama/ollama/format"
 	"github.com/ollama/ollama/gpu"
 	"github.com/ollama/ollama/llm"
+	"github.com/ollama/ollama/tracing"
 )
 
 type LlmRequest struct {
@@ -30,10 +33,16 @@ type LlmRequest struct {
 	successCh       chan *runnerRef
 	errCh           chan error
 	schedAttempts   uint
+	priority        string
+	queuedAt        time.Time
+	stopCancel      func() bool // stops removing the request from the queue on cancellation
+	pinned          bool        // preload request for a model in OLLAMA_PINNED_MODELS
 }
 
 type Scheduler struct {
 	pendingReqCh  chan *LlmRequest
+	queue         *fairQueue
+	maxQueue      int
 	finishedReqCh chan *LlmRequest
 	expiredCh     chan *runnerRef
 	unloadedCh    chan interface{}
@@ -42,9 +51,10 @@ type Scheduler struct {
 	loadedMu sync.Mutex
 
 	loadFn       func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int)
-	newServerFn  func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error)
+	newServerFn  func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error)
 	getGpuFn     func() gpu.GpuInfoList
 	getCpuFn     func() gpu.GpuInfoList
+	getModelFn   func(name string) (*Model, error)
 	reschedDelay time.Duration
 }
 
@@ -60,10 +70,14 @@ var defaultParallel = 4
 
 var ErrMaxQueue = errors.New("server busy, please try again.  maximum pending requests exceeded")
 
+var ErrPinned = errors.New("unable to load model, all loaded models are pinned")
+
 func InitScheduler(ctx context.Context) *Scheduler {
 	maxQueue := envconfig.MaxQueue()
 	sched := &Scheduler{
 		pendingReqCh:  make(chan *LlmRequest, maxQueue),
+		queue:         newFairQueue(),
+		maxQueue:      int(maxQueue),
 		finishedReqCh: make(chan *LlmRequest, maxQueue),
 		expiredCh:     make(chan *runnerRef, maxQueue),
 		unloadedCh:    make(chan interface{}, maxQueue),
@@ -71,6 +85,7 @@ func InitScheduler(ctx context.Context) *Scheduler {
 		newServerFn:   llm.NewLlamaServer,
 		getGpuFn:      gpu.GetGPUInfo,
 		getCpuFn:      gpu.GetCPUInfo,
+		getModelFn:    GetModel,
 		reschedDelay:  250 * time.Millisecond,
 	}
 	sched.loadFn = sched.load
@@ -79,17 +94,37 @@ func InitScheduler(ctx context.Context) *Scheduler {
 
 // context must be canceled to decrement ref count and release the runner
 func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) (chan *runnerRef, chan error) {
+	req := s.enqueue(c, model, opts, sessionDuration)
+	return req.successCh, req.errCh
+}
+
+// enqueue submits a request for a runner. The request's successCh receives
+// the runner once it's available, otherwise errCh receives the reason it
+// couldn't be scheduled, including cancellation of c while still queued.
+func (s *Scheduler) enqueue(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) *LlmRequest {
+	return s.submit(newLlmRequest(c, model, opts, sessionDuration))
+}
+
+func newLlmRequest(c context.Context, model *Model, opts api.Options, sessionDuration *api.Duration) *LlmRequest {
 	if opts.NumCtx < 4 {
 		opts.NumCtx = 4
 	}
 
-	req := &LlmRequest{
+	return &LlmRequest{
 		ctx:             c,
 		model:           model,
 		opts:            opts,
 		sessionDuration: sessionDuration,
 		successCh:       make(chan *runnerRef),
 		errCh:           make(chan error, 1),
+		priority:        priorityFromContext(c),
+	}
+}
+
+func (s *Scheduler) submit(req *LlmRequest) *LlmRequest {
+	if s.queue.Len()+len(s.pendingReqCh) >= s.maxQueue {
+		req.errCh <- ErrMaxQueue
+		return req
 	}
 
 	select {
@@ -97,12 +132,61 @@ func (s *Scheduler) GetRunner(c context.Context, model *Model, opts api.Options,
 	default:
 		req.errCh <- ErrMaxQueue
 	}
-	return req.successCh, req.errCh
+	return req
+}
+
+// loadPinned loads every model listed in OLLAMA_PINNED_MODELS. Pinned models
+// are never chosen to make room for other models and are loaded again
+// whenever they are unloaded.
+func (s *Scheduler) loadPinned(ctx context.Context) {
+	for _, name := range envconfig.PinnedModels() {
+		go s.preload(ctx, name)
+	}
+}
+
+func (s *Scheduler) preload(ctx context.Context, name string) {
+	model, err := s.getModelFn(name)
+	if err != nil {
+		slog.Error("unable to load pinned model", "model", name, "error", err)
+		return
+	}
+
+	opts, err := modelOptions(model, nil)
+	if err != nil {
+		slog.Error("unable to load pinned model", "model", name, "error", err)
+		return
+	}
+
+	// the runner is released as soon as it's loaded, pinning keeps it resident
+	reqCtx, cancel := context.WithCancel(withPriority(ctx, PriorityHigh))
+	defer cancel()
+
+	req := newLlmRequest(reqCtx, model, opts, nil)
+	req.pinned = true
+	s.submit(req)
+
+	select {
+	case <-req.successCh:
+		slog.Info("pinned model loaded", "model", name)
+	case err := <-req.errCh:
+		slog.Error("unable to load pinned model", "model", name, "error", err)
+	}
+}
+
+// queueStatus reports where req is in the queue. Position is zero once the
+// request has left the queue.
+func (s *Scheduler) queueStatus(req *LlmRequest) api.QueueStatus {
+	position, wait := s.queue.position(req)
+	return api.QueueStatus{Position: position, ExpectedWait: wait}
 }
 
 // Returns immediately, spawns go routines for the scheduler which will shutdown when ctx is done
 func (s *Scheduler) Run(ctx context.Context) {
 	slog.Debug("starting llm scheduler")
+	go func() {
+		s.processIncoming(ctx)
+	}()
+
 	go func() {
 		s.processPending(ctx)
 	}()
@@ -112,13 +196,45 @@ func (s *Scheduler) Run(ctx context.Context) {
 	}()
 }
 
+// processIncoming moves new requests into the fair queue as soon as they
+// arrive, so queue depth and ordering decisions always see every waiting
+// request, even while processPending is blocked on a load or unload
+func (s *Scheduler) processIncoming(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Debug("shutting down scheduler incoming loop")
+			return
+		case pending := <-s.pendingReqCh:
+			// Drop the request from the queue as soon as the client goes away
+			// rather than holding its place until it's popped
+			pending.stopCancel = context.AfterFunc(pending.ctx, func() {
+				if s.queue.remove(pending) {
+					slog.Debug("pending request cancelled or timed out, removed from queue")
+					pending.cancelled()
+				}
+			})
+			s.queue.push(pending)
+		}
+	}
+}
+
 func (s *Scheduler) processPending(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			slog.Debug("shutting down scheduler pending loop")
 			return
-		case pending := <-s.pendingReqCh:
+		case <-s.queue.ready:
+			pending := s.queue.pop()
+			if pending == nil {
+				continue
+			}
+
+			if pending.stopCancel != nil {
+				pending.stopCancel()
+			}
+
 			// Block other requests until we get this pending request running
 			pending.schedAttempts++
 			if pending.origNumCtx == 0 {
@@ -127,6 +243,7 @@ func (s *Scheduler) processPending(ctx context.Context) {
 
 			if pending.ctx.Err() != nil {
 				slog.Debug("pending request cancelled or timed out, skipping scheduling")
+				pending.cancelled()
 				continue
 			}
 			numParallel := int(envconfig.NumParallel())
@@ -144,7 +261,12 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				loadedCount := len(s.loaded)
 				s.loadedMu.Unlock()
 				if runner != nil {
-					if runner.needsReload(ctx, pending) {
+					if pending.pinned {
+						// Pin whatever is loaded for the model rather than
+						// reloading it with the default options
+						pending.useLoadedRunner(runner, s.finishedReqCh)
+						break
+					} else if runner.needsReload(ctx, pending) {
 						runnerToExpire = runner
 					} else {
 						// Runner is usable, return it
@@ -274,6 +396,12 @@ func (s *Scheduler) processPending(ctx context.Context) {
 				}
 
 				if runnerToExpire == nil {
+					if s.allPinned() {
+						slog.Warn("unable to make room for model, all loaded models are pinned", "model", pending.model.ModelPath)
+						pending.errCh <- ErrPinned
+						break
+					}
+
 					// Shouildn't happen
 					slog.Error("runner to expire was nil!")
 					continue
@@ -374,6 +502,10 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 
 			s.loadedMu.Lock()
 			slog.Debug("got lock to unload", "modelPath", runner.modelPath)
+			var pinned string
+			if runner.pinned && runner.model != nil {
+				pinned = runner.model.Name
+			}
 			finished := runner.waitForVRAMRecovery()
 			runner.unload()
 			delete(s.loaded, runner.modelPath)
@@ -384,10 +516,24 @@ func (s *Scheduler) processCompleted(ctx context.Context) {
 			<-finished
 			slog.Debug("sending an unloaded event", "modelPath", runner.modelPath)
 			s.unloadedCh <- struct{}{}
+
+			if pinned != "" {
+				slog.Info("pinned model unloaded, reloading", "model", pinned)
+				go s.preload(ctx, pinned)
+			}
 		}
 	}
 }
 
+// cancelled notifies the requester that the request was dropped because its
+// context is done
+func (pending *LlmRequest) cancelled() {
+	select {
+	case pending.errCh <- pending.ctx.Err():
+	default:
+	}
+}
+
 // Complete the pending request and send the runner back to the requester
 // Wires up a finished event after the request context is completed
 // Updates session duration, and resets expiration timer
@@ -399,7 +545,9 @@ func (pending *LlmRequest) useLoadedRunner(runner *runnerRef, finished chan *Llm
 		runner.expireTimer.Stop()
 		runner.expireTimer = nil
 	}
-	if pending.sessionDuration != nil {
+	if pending.pinned {
+		runner.pin()
+	} else if pending.sessionDuration != nil && !runner.pinned {
 		runner.sessionDuration = pending.sessionDuration.Duration
 	}
 	pending.successCh <- runner
@@ -418,7 +566,13 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 	if req.sessionDuration != nil {
 		sessionDuration = req.sessionDuration.Duration
 	}
-	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts, numParallel)
+	start := time.Now()
+	_, span := tracing.Start(req.ctx, "load")
+	span.SetAttribute("ollama.model", req.model.ShortName)
+	span.SetAttribute("ollama.num_parallel", numParallel)
+	span.SetAttribute("ollama.num_gpus", len(gpus))
+
+	llama, err := s.newServerFn(gpus, req.model.ModelPath, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts, numParallel)
 	if err != nil {
 		// some older models are not compatible with newer versions of llama.cpp
 		// show a generalized compatibility error until there is a better way to
@@ -427,6 +581,8 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 			err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, req.model.ShortName)
 		}
 		slog.Info("NewLlamaServer failed", "model", req.model.ModelPath, "error", err)
+		span.RecordError(err)
+		span.End()
 		req.errCh <- err
 		return
 	}
@@ -442,6 +598,9 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 		loading:         true,
 		refCount:        1,
 	}
+	if req.pinned {
+		runner.pin()
+	}
 	runner.numParallel = numParallel
 	runner.refMu.Lock()
 
@@ -452,8 +611,10 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 
 	go func() {
 		defer runner.refMu.Unlock()
+		defer span.End()
 		if err = llama.WaitUntilRunning(req.ctx); err != nil {
 			slog.Error("error loading llama server", "error", err)
+			span.RecordError(err)
 			runner.refCount--
 			req.errCh <- err
 			slog.Debug("triggering expiration for failed load", "model", runner.modelPath)
@@ -461,6 +622,7 @@ func (s *Scheduler) load(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList,
 			return
 		}
 		slog.Debug("finished setting up runner", "model", req.model.ModelPath)
+		modelLoadDuration.Observe(time.Since(start).Seconds(), req.model.ShortName)
 		runner.loading = false
 		go func() {
 			<-req.ctx.Done()
@@ -554,7 +716,36 @@ type runnerRef struct {
 	model       *Model
 	modelPath   string
 	numParallel int
+	pinned      bool // listed in OLLAMA_PINNED_MODELS, never unloaded to make room
 	*api.Options
+
+	// sessions maps chat sessions to the slot that last processed them
+	sessionsMu sync.Mutex
+	sessions   map[string]sessionSlot
+
+	// embedder merges concurrent embedding requests into runner batches
+	embedMu  sync.Mutex
+	embedder *embedBatcher
+}
+
+// pin keeps the runner loaded indefinitely. The refMu must already be held.
+func (runner *runnerRef) pin() {
+	runner.pinned = true
+	runner.sessionDuration = time.Duration(math.MaxInt64)
+}
+
+// reason describes why the runner is resident. The refMu must already be held.
+func (runner *runnerRef) reason() string {
+	switch {
+	case runner.loading:
+		return "loading"
+	case runner.refCount > 0:
+		return "active"
+	case runner.pinned:
+		return "pinned"
+	default:
+		return "keep_alive"
+	}
 }
 
 // The refMu must already be held when calling unload
@@ -597,10 +788,15 @@ func (runner *runnerRef) needsReload(ctx context.Context, req *LlmRequest) bool
 	// Normalize the NumCtx for parallelism
 	optsExisting.NumCtx = optsExisting.NumCtx / runner.numParallel
 
+	// a runner loaded with a draft model serves requests without one as well,
+	// so mixing them doesn't force reloads
+	draftChanged := req.model.DraftPath != "" && runner.model.DraftPath != req.model.DraftPath
+
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	if !reflect.DeepEqual(runner.model.AdapterPaths, req.model.AdapterPaths) || // have the adapters changed?
 		!reflect.DeepEqual(runner.model.ProjectorPaths, req.model.ProjectorPaths) || // have the projectors changed?
+		draftChanged || // has a different draft model been asked for?
 		!reflect.DeepEqual(optsExisting, optsNew) || // have the runner options changed?
 		runner.llama.Ping(ctx) != nil {
 		return true
@@ -711,7 +907,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoL
 			req.opts.NumCtx = req.origNumCtx * p
 			if !envconfig.SchedSpread() {
 				for _, g := range sgl {
-					if ok, estimatedVRAM = llm.PredictServerFit([]gpu.GpuInfo{g}, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
+					if ok, estimatedVRAM = llm.PredictServerFit([]gpu.GpuInfo{g}, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts); ok {
 						slog.Info("new model will fit in available VRAM in single GPU, loading", "model", req.model.ModelPath, "gpu", g.ID, "parallel", p, "available", g.FreeMemory, "required", format.HumanBytes2(estimatedVRAM))
 						*numParallel = p
 						return []gpu.GpuInfo{g}
@@ -727,7 +923,7 @@ func pickBestFullFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoL
 		// Now try all the GPUs
 		for _, p := range numParallelToTry {
 			req.opts.NumCtx = req.origNumCtx * p
-			if ok, estimatedVRAM = llm.PredictServerFit(sgl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts); ok {
+			if ok, estimatedVRAM = llm.PredictServerFit(sgl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts); ok {
 				slog.Info("new model will fit in available VRAM, loading", "model", req.model.ModelPath, "library", sgl[0].Library, "parallel", p, "required", format.HumanBytes2(estimatedVRAM))
 				*numParallel = p
 				return sgl
@@ -750,7 +946,7 @@ func pickBestPartialFitByLibrary(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuIn
 	var bestEstimate uint64
 	var bestFit int
 	for i, gl := range byLibrary {
-		_, estimatedVRAM := llm.PredictServerFit(gl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.opts)
+		_, estimatedVRAM := llm.PredictServerFit(gl, ggml, req.model.AdapterPaths, req.model.ProjectorPaths, req.model.DraftPath, req.opts)
 		if estimatedVRAM > bestEstimate {
 			bestEstimate = estimatedVRAM
 			bestFit = i
@@ -776,6 +972,17 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	// e.g., if we have multiple options, will one make room for the request?
 	sort.Sort(ByDuration(runnerList))
 
+	// Pinned runners are never unloaded to make room
+	runnerList = slices.DeleteFunc(runnerList, func(runner *runnerRef) bool {
+		runner.refMu.Lock()
+		defer runner.refMu.Unlock()
+		return runner.pinned
+	})
+	if len(runnerList) == 0 {
+		slog.Debug("all loaded runners are pinned")
+		return nil
+	}
+
 	// First try to find a runner that's already idle
 	for _, runner := range runnerList {
 		runner.refMu.Lock()
@@ -791,6 +998,21 @@ func (s *Scheduler) findRunnerToUnload() *runnerRef {
 	return runnerList[0]
 }
 
+// allPinned reports whether there are loaded runners and all of them are pinned
+func (s *Scheduler) allPinned() bool {
+	s.loadedMu.Lock()
+	defer s.loadedMu.Unlock()
+	for _, runner := range s.loaded {
+		runner.refMu.Lock()
+		pinned := runner.pinned
+		runner.refMu.Unlock()
+		if !pinned {
+			return false
+		}
+	}
+	return len(s.loaded) > 0
+}
+
 func (s *Scheduler) unloadAllRunners() {
 	s.loadedMu.Lock()
 	defer s.loadedMu.Unlock()
@@ -806,7 +1028,7 @@ func (s *Scheduler) unloadAllRunners() {
 // If not, pick a runner to unload, else return nil and the request can be loaded
 func (s *Scheduler) maybeFindCPURunnerToUnload(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList) *runnerRef {
 	slog.Debug("evaluating if CPU model load will fit in available system memory")
-	estimate := llm.EstimateGPULayers(gpus, ggml, req.model.ProjectorPaths, req.opts)
+	estimate := llm.EstimateGPULayers(gpus, ggml, req.model.ProjectorPaths, req.model.DraftPath, req.opts)
 	if estimate.TotalSize <= gpus[0].FreeMemory {
 		slog.Debug("cpu inference mode, model fits in available system memory", "model", format.HumanBytes2(estimate.TotalSize), "available", format.HumanBytes2(gpus[0].FreeMemory))
 		return nil
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Well known priority classes. Any other non-empty priority is treated as a
+// tenant key and gets its own queue with the weight of PriorityNormal unless
+// one is configured with OLLAMA_SCHED_WEIGHTS.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var defaultPriorityWeights = map[string]uint{
+	PriorityHigh:   4,
+	PriorityNormal: 2,
+	PriorityLow:    1,
+}
+
+type queueClass struct {
+	name    string
+	weight  int
+	current int
+	reqs    []*LlmRequest
+}
+
+// fairQueue holds pending requests in one FIFO per priority class and serves
+// the classes with smooth weighted round robin, so a class with weight 4 is
+// picked four times as often as a class with weight 1 while both have
+// requests waiting, and no non-empty class is ever starved.
+type fairQueue struct {
+	mu      sync.Mutex
+	classes map[string]*queueClass
+	weights map[string]uint
+
+	// ready is signaled whenever the queue may have something to pop
+	ready chan struct{}
+
+	// interval is a moving average of the time between pops, used to
+	// estimate how long a queued request will wait
+	interval time.Duration
+	lastPop  time.Time
+}
+
+func newFairQueue() *fairQueue {
+	weights := make(map[string]uint, len(defaultPriorityWeights))
+	for k, v := range defaultPriorityWeights {
+		weights[k] = v
+	}
+	for k, v := range envconfig.SchedWeights() {
+		weights[k] = v
+	}
+
+	return &fairQueue{
+		classes: make(map[string]*queueClass),
+		weights: weights,
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+func (q *fairQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *fairQueue) weight(name string) int {
+	if w, ok := q.weights[name]; ok && w > 0 {
+		return int(w)
+	}
+
+	return int(q.weights[PriorityNormal])
+}
+
+func (req *LlmRequest) class() string {
+	if req.priority == "" {
+		return PriorityNormal
+	}
+
+	return req.priority
+}
+
+func (q *fairQueue) push(req *LlmRequest) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	name := req.class()
+	c, ok := q.classes[name]
+	if !ok {
+		c = &queueClass{name: name, weight: q.weight(name)}
+		q.classes[name] = c
+	}
+
+	req.queuedAt = time.Now()
+	c.reqs = append(c.reqs, req)
+	q.signal()
+}
+
+// pop removes and returns the next request to schedule, or nil if the queue is empty
+func (q *fairQueue) pop() *LlmRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var total int
+	var best *queueClass
+	for _, c := range q.classes {
+		if len(c.reqs) == 0 {
+			continue
+		}
+
+		c.current += c.weight
+		total += c.weight
+		if best == nil || c.current > best.current || (c.current == best.current && c.name < best.name) {
+			best = c
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	best.current -= total
+	req := best.reqs[0]
+	best.reqs[0] = nil
+	best.reqs = best.reqs[1:]
+	if len(best.reqs) == 0 {
+		// forget idle classes so tenant keys don't accumulate and a class
+		// returning from idle doesn't carry credit from the past
+		delete(q.classes, best.name)
+	}
+
+	if q.lenLocked() > 0 {
+		q.signal()
+	}
+
+	now := time.Now()
+	since := req.queuedAt
+	if q.lastPop.After(since) {
+		since = q.lastPop
+	}
+
+	if q.lastPop.IsZero() {
+		q.interval = now.Sub(since)
+	} else {
+		q.interval = (7*q.interval + now.Sub(since)) / 8
+	}
+	q.lastPop = now
+
+	return req
+}
+
+// remove takes req out of the queue, reporting whether it was queued
+func (q *fairQueue) remove(req *LlmRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.classes[req.class()]
+	if !ok {
+		return false
+	}
+
+	for i := range c.reqs {
+		if c.reqs[i] == req {
+			c.reqs = append(c.reqs[:i], c.reqs[i+1:]...)
+			if len(c.reqs) == 0 {
+				delete(q.classes, c.name)
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// position returns the 1-based order in which req will be popped given the
+// requests queued right now, and an estimate of how long that will take.
+// Position is zero if req is not queued.
+func (q *fairQueue) position(req *LlmRequest) (int, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	target, ok := q.classes[req.class()]
+	if !ok {
+		return 0, 0
+	}
+
+	index := -1
+	for i := range target.reqs {
+		if target.reqs[i] == req {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		return 0, 0
+	}
+
+	// replay the weighted round robin without mutating the queue
+	type simClass struct {
+		*queueClass
+		current   int
+		remaining int
+	}
+
+	sims := make([]*simClass, 0, len(q.classes))
+	for _, c := range q.classes {
+		sims = append(sims, &simClass{queueClass: c, current: c.current, remaining: len(c.reqs)})
+	}
+
+	for position := 1; ; position++ {
+		var total int
+		var best *simClass
+		for _, c := range sims {
+			if c.remaining == 0 {
+				continue
+			}
+
+			c.current += c.weight
+			total += c.weight
+			if best == nil || c.current > best.current || (c.current == best.current && c.name < best.name) {
+				best = c
+			}
+		}
+
+		best.current -= total
+		best.remaining--
+		if best.queueClass == target && len(target.reqs)-best.remaining-1 == index {
+			return position, time.Duration(position) * q.interval
+		}
+	}
+}
+
+func (q *fairQueue) lenLocked() (n int) {
+	for _, c := range q.classes {
+		n += len(c.reqs)
+	}
+
+	return n
+}
+
+func (q *fairQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lenLocked()
+}
+
+// Depth returns the number of queued requests per priority class
+func (q *fairQueue) Depth() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	depth := make(map[string]int, len(q.classes))
+	for _, c := range q.classes {
+		if len(c.reqs) > 0 {
+			depth[c.name] = len(c.reqs)
+		}
+	}
+
+	return depth
+}
+
+type priorityKey struct{}
+
+// withPriority returns a copy of ctx carrying the scheduling priority class
+// for requests made with it
+func withPriority(ctx context.Context, priority string) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+func priorityFromContext(ctx context.Context) string {
+	if p, ok := ctx.Value(priorityKey{}).(string); ok {
+		return p
+	}
+
+	return ""
+}
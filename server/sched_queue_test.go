@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFairQueueWeights(t *testing.T) {
+	t.Setenv("OLLAMA_SCHED_WEIGHTS", "")
+	q := newFairQueue()
+	require.Nil(t, q.pop())
+
+	for range 8 {
+		q.push(&LlmRequest{priority: PriorityHigh})
+		q.push(&LlmRequest{priority: PriorityLow})
+	}
+	require.Equal(t, map[string]int{PriorityHigh: 8, PriorityLow: 8}, q.Depth())
+
+	// high has 4x the weight of low so it should be picked 4 times as often
+	// while both classes have requests waiting
+	counts := map[string]int{}
+	for range 5 {
+		counts[q.pop().priority]++
+	}
+	require.Equal(t, map[string]int{PriorityHigh: 4, PriorityLow: 1}, counts)
+
+	// low priority requests are not starved once high priority drains
+	for q.Len() > 0 {
+		q.pop()
+	}
+	require.Empty(t, q.Depth())
+}
+
+func TestFairQueueTenants(t *testing.T) {
+	t.Setenv("OLLAMA_SCHED_WEIGHTS", "team-a=3")
+	q := newFairQueue()
+
+	for range 4 {
+		q.push(&LlmRequest{priority: "team-a"})
+		q.push(&LlmRequest{priority: "team-b"})
+	}
+	q.push(&LlmRequest{})
+	require.Equal(t, map[string]int{"team-a": 4, "team-b": 4, PriorityNormal: 1}, q.Depth())
+
+	var order []string
+	for req := q.pop(); req != nil; req = q.pop() {
+		order = append(order, req.priority)
+	}
+	require.Len(t, order, 9)
+	require.Equal(t, "team-a", order[0])
+
+	// requests within a class keep their arrival order
+	first, second := &LlmRequest{priority: "x"}, &LlmRequest{priority: "x"}
+	q.push(first)
+	q.push(second)
+	require.Same(t, first, q.pop())
+	require.Same(t, second, q.pop())
+}
+
+func TestPriorityContext(t *testing.T) {
+	ctx := context.Background()
+	require.Empty(t, priorityFromContext(ctx))
+	require.Equal(t, PriorityLow, priorityFromContext(withPriority(ctx, PriorityLow)))
+}
+
+func TestFairQueuePosition(t *testing.T) {
+	t.Setenv("OLLAMA_SCHED_WEIGHTS", "")
+	q := newFairQueue()
+
+	var high []*LlmRequest
+	for range 4 {
+		req := &LlmRequest{priority: PriorityHigh}
+		high = append(high, req)
+		q.push(req)
+	}
+	low := &LlmRequest{priority: PriorityLow}
+	q.push(low)
+
+	// smooth weighted round robin interleaves low after two high requests
+	position, _ := q.position(low)
+	require.Equal(t, 3, position)
+	position, _ = q.position(high[3])
+	require.Equal(t, 5, position)
+
+	// the reported position matches the actual pop order
+	for i := 1; q.Len() > 0; i++ {
+		if req := q.pop(); req == low {
+			require.Equal(t, 3, i)
+		}
+	}
+
+	position, wait := q.position(low)
+	require.Zero(t, position)
+	require.Zero(t, wait)
+
+	require.False(t, q.remove(low))
+	q.push(low)
+	require.True(t, q.remove(low))
+	require.Zero(t, q.Len())
+}
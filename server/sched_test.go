@@ -47,7 +47,7 @@ func TestLoad(t *testing.T) {
 		sessionDuration: &api.Duration{Duration: 2 * time.Second},
 	}
 	// Fail to load model first
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return nil, errors.New("something failed to load model blah")
 	}
 	gpus := gpu.GpuInfoList{}
@@ -61,7 +61,7 @@ func TestLoad(t *testing.T) {
 	require.Contains(t, err.Error(), "this model may be incompatible")
 
 	server := &mockLlm{estimatedVRAM: 10, estimatedVRAMByGPU: map[string]uint64{}}
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		return server, nil
 	}
 	s.load(req, ggml, gpus, 0)
@@ -102,7 +102,7 @@ type reqBundle struct {
 	ggml    *llm.GGML
 }
 
-func (scenario *reqBundle) newServer(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+func (scenario *reqBundle) newServer(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 	return scenario.srv, nil
 }
 
@@ -568,6 +568,86 @@ func TestFindRunnerToUnload(t *testing.T) {
 	require.Equal(t, r1, resp)
 }
 
+func TestFindRunnerToUnloadPinned(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer done()
+
+	r1 := &runnerRef{sessionDuration: 1, numParallel: 1}
+	r1.pin()
+	r2 := &runnerRef{refCount: 1, sessionDuration: 2, numParallel: 1}
+
+	s := InitScheduler(ctx)
+	s.loadedMu.Lock()
+	s.loaded["a"] = r1
+	s.loaded["b"] = r2
+	s.loadedMu.Unlock()
+
+	// the busy runner is picked over the idle pinned one
+	require.Equal(t, r2, s.findRunnerToUnload())
+	require.False(t, s.allPinned())
+
+	r2.pin()
+	require.Nil(t, s.findRunnerToUnload())
+	require.True(t, s.allPinned())
+}
+
+func TestPinnedModel(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 0})
+	t.Setenv("OLLAMA_PINNED_MODELS", a.req.model.Name)
+	s := InitScheduler(ctx)
+	s.getGpuFn = getGpuFn
+	s.getCpuFn = getCpuFn
+	s.newServerFn = a.newServer
+	s.getModelFn = func(name string) (*Model, error) {
+		require.Equal(t, a.req.model.Name, name)
+		return a.req.model, nil
+	}
+	s.Run(ctx)
+	s.loadPinned(ctx)
+
+	var runner *runnerRef
+	require.Eventually(t, func() bool {
+		s.loadedMu.Lock()
+		defer s.loadedMu.Unlock()
+		runner = s.loaded[a.req.model.ModelPath]
+		return runner != nil
+	}, time.Second, time.Millisecond)
+
+	// a request with a zero keep alive doesn't unload a pinned model
+	s.pendingReqCh <- a.req
+	select {
+	case resp := <-a.req.successCh:
+		require.Equal(t, runner, resp)
+	case err := <-a.req.errCh:
+		t.Fatal(err.Error())
+	case <-ctx.Done():
+		t.Fatal("timeout")
+	}
+	a.ctxDone()
+	time.Sleep(10 * time.Millisecond)
+
+	runner.refMu.Lock()
+	require.True(t, runner.pinned)
+	require.Equal(t, "pinned", runner.reason())
+	require.Zero(t, runner.refCount)
+	runner.refMu.Unlock()
+	s.loadedMu.Lock()
+	require.Len(t, s.loaded, 1)
+	s.loadedMu.Unlock()
+
+	// pinned models are loaded again after they are unloaded
+	s.expiredCh <- runner
+	require.Eventually(t, func() bool {
+		s.loadedMu.Lock()
+		defer s.loadedMu.Unlock()
+		reloaded := s.loaded[a.req.model.ModelPath]
+		return reloaded != nil && reloaded != runner
+	}, time.Second, time.Millisecond)
+}
+
 func TestNeedsReload(t *testing.T) {
 	ctx, done := context.WithTimeout(context.Background(), 100*time.Millisecond)
 	defer done()
@@ -613,6 +693,18 @@ func TestNeedsReload(t *testing.T) {
 	req.opts.NumGPU = -1
 	resp = runner.needsReload(ctx, req)
 	require.False(t, resp)
+	req.model.DraftPath = "draft1"
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
+	runner.model.DraftPath = "draft1"
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.model.DraftPath = ""
+	resp = runner.needsReload(ctx, req)
+	require.False(t, resp)
+	req.model.DraftPath = "draft2"
+	resp = runner.needsReload(ctx, req)
+	require.True(t, resp)
 }
 
 func TestUnloadAllRunners(t *testing.T) {
@@ -660,8 +752,37 @@ func TestAlreadyCanceled(t *testing.T) {
 	s.Run(ctx)
 	time.Sleep(5 * time.Millisecond)
 	require.Empty(t, s.pendingReqCh)
-	require.Empty(t, scenario1a.req.errCh)
+	require.Zero(t, s.queue.Len())
 	require.Empty(t, scenario1a.req.successCh)
+	require.Len(t, scenario1a.req.errCh, 1)
+	require.ErrorIs(t, <-scenario1a.req.errCh, context.Canceled)
+}
+
+func TestCanceledWhileQueued(t *testing.T) {
+	ctx, done := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer done()
+	s := InitScheduler(ctx)
+	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 0})
+	b := newScenarioRequest(t, ctx, "ollama-model-2", 10, &api.Duration{Duration: 0})
+	b.req.priority = PriorityLow
+
+	// only run the incoming loop so requests stay queued
+	go s.processIncoming(ctx)
+	s.pendingReqCh <- a.req
+	s.pendingReqCh <- b.req
+	require.Eventually(t, func() bool { return s.queue.Len() == 2 }, time.Second, time.Millisecond)
+
+	status := s.queueStatus(b.req)
+	require.Equal(t, 2, status.Position)
+
+	a.ctxDone()
+	require.Eventually(t, func() bool { return s.queue.Len() == 1 }, time.Second, time.Millisecond)
+	require.ErrorIs(t, <-a.req.errCh, context.Canceled)
+	require.Empty(t, a.req.successCh)
+
+	require.Equal(t, 1, s.queueStatus(b.req).Position)
+	require.Zero(t, s.queueStatus(a.req).Position)
+	b.ctxDone()
 }
 
 func TestHomogeneousGPUs(t *testing.T) {
@@ -683,9 +804,9 @@ func TestHomogeneousGPUs(t *testing.T) {
 	}
 	s.getCpuFn = getCpuFn
 	a := newScenarioRequest(t, ctx, "ollama-model-1", 10, &api.Duration{Duration: 5 * time.Millisecond})
-	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
+	s.newServerFn = func(gpus gpu.GpuInfoList, model string, ggml *llm.GGML, adapters []string, projectors []string, draft string, opts api.Options, numParallel int) (llm.LlamaServer, error) {
 		require.Len(t, gpus, 1)
-		return a.newServer(gpus, model, ggml, adapters, projectors, opts, numParallel)
+		return a.newServer(gpus, model, ggml, adapters, projectors, draft, opts, numParallel)
 	}
 	slog.Info("a")
 	s.pendingReqCh <- a.req
@@ -730,6 +851,19 @@ func (s *mockLlm) Embedding(ctx context.Context, input string) ([]float32, error
 	return s.embeddingResp, s.embeddingRespErr
 }
 
+func (s *mockLlm) Embeddings(ctx context.Context, inputs []string) ([][]float32, error) {
+	if s.embeddingRespErr != nil {
+		return nil, s.embeddingRespErr
+	}
+
+	embeddings := make([][]float32, len(inputs))
+	for i := range inputs {
+		embeddings[i] = s.embeddingResp
+	}
+
+	return embeddings, nil
+}
+
 func (s *mockLlm) Tokenize(ctx context.Context, content string) ([]int, error) {
 	return s.tokenizeResp, s.tokenizeRespErr
 }
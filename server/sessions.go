@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// maxSessions is the most chat sessions a runner remembers the slot of
+const maxSessions = 1024
+
+type sessionSlot struct {
+	slot     int
+	lastUsed time.Time
+}
+
+// chatSession returns the session of a chat request. Requests that don't
+// name one are identified by their messages up to the first user message,
+// which every turn of a conversation starts with.
+func chatSession(req api.ChatRequest) string {
+	if req.Session != "" {
+		return req.Session
+	}
+
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, msg := range req.Messages {
+		if err := enc.Encode(msg); err != nil {
+			return ""
+		}
+
+		if msg.Role == "user" {
+			break
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sessionSlot returns the slot that last processed a session
+func (runner *runnerRef) sessionSlot(session string) (int, bool) {
+	runner.sessionsMu.Lock()
+	defer runner.sessionsMu.Unlock()
+
+	s, ok := runner.sessions[session]
+	return s.slot, ok
+}
+
+// recordSession records the slot that processed a session, forgetting the
+// least recently used session once it remembers maxSessions
+func (runner *runnerRef) recordSession(session string, slot int) {
+	runner.sessionsMu.Lock()
+	defer runner.sessionsMu.Unlock()
+
+	if runner.sessions == nil {
+		runner.sessions = make(map[string]sessionSlot)
+	}
+
+	runner.sessions[session] = sessionSlot{slot: slot, lastUsed: time.Now()}
+	if len(runner.sessions) > maxSessions {
+		var oldest string
+		for k, s := range runner.sessions {
+			if oldest == "" || s.lastUsed.Before(runner.sessions[oldest].lastUsed) {
+				oldest = k
+			}
+		}
+
+		delete(runner.sessions, oldest)
+	}
+}
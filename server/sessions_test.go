@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/gpu"
+	"github.com/ollama/ollama/llm"
+)
+
+func TestChatSession(t *testing.T) {
+	system := api.Message{Role: "system", Content: "You are a helpful assistant."}
+	first := api.Message{Role: "user", Content: "Hello!"}
+
+	turn1 := chatSession(api.ChatRequest{Messages: []api.Message{system, first}})
+	turn2 := chatSession(api.ChatRequest{Messages: []api.Message{system, first, {Role: "assistant", Content: "Hi!"}, {Role: "user", Content: "How are you?"}}})
+	if turn1 != turn2 {
+		t.Errorf("expected turns of a conversation to share a session, got %q and %q", turn1, turn2)
+	}
+
+	other := chatSession(api.ChatRequest{Messages: []api.Message{system, {Role: "user", Content: "Goodbye!"}}})
+	if other == turn1 {
+		t.Errorf("expected conversations to have different sessions, got %q", other)
+	}
+
+	if s := chatSession(api.ChatRequest{Session: "abc", Messages: []api.Message{system, first}}); s != "abc" {
+		t.Errorf("expected session %q, got %q", "abc", s)
+	}
+}
+
+func TestRecordSession(t *testing.T) {
+	var runner runnerRef
+	if _, ok := runner.sessionSlot("a"); ok {
+		t.Fatal("expected no slot for an unknown session")
+	}
+
+	runner.recordSession("a", 2)
+	if slot, ok := runner.sessionSlot("a"); !ok || slot != 2 {
+		t.Errorf("expected slot 2, got %d, %t", slot, ok)
+	}
+
+	for i := range maxSessions {
+		runner.recordSession(strconv.Itoa(i), i)
+	}
+
+	if _, ok := runner.sessionSlot("a"); ok {
+		t.Error("expected the least recently used session to be forgotten")
+	}
+
+	if len(runner.sessions) != maxSessions {
+		t.Errorf("expected %d sessions, got %d", maxSessions, len(runner.sessions))
+	}
+}
+
+func TestChatSessionSlots(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mock := mockRunner{
+		CompletionResponse: llm.CompletionResponse{
+			Done:       true,
+			DoneReason: "stop",
+			Slot:       1,
+		},
+	}
+
+	// the same runner serves every request, so it remembers sessions
+	runner := &runnerRef{llama: &mock}
+	s := Server{
+		sched: &Scheduler{
+			pendingReqCh:  make(chan *LlmRequest, 1),
+			queue:         newFairQueue(),
+			maxQueue:      1,
+			finishedReqCh: make(chan *LlmRequest, 1),
+			expiredCh:     make(chan *runnerRef, 1),
+			unloadedCh:    make(chan any, 1),
+			loaded:        make(map[string]*runnerRef),
+			newServerFn:   newMockServer(&mock),
+			getGpuFn:      gpu.GetGPUInfo,
+			getCpuFn:      gpu.GetCPUInfo,
+			reschedDelay:  250 * time.Millisecond,
+			loadFn: func(req *LlmRequest, ggml *llm.GGML, gpus gpu.GpuInfoList, numParallel int) {
+				req.successCh <- runner
+			},
+		},
+	}
+
+	go s.sched.Run(context.TODO())
+
+	w := createRequest(t, s.CreateHandler, api.CreateRequest{
+		Model: "test",
+		Modelfile: fmt.Sprintf("FROM %s", createBinFile(t, llm.KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(1),
+			"llama.context_length":          uint32(8192),
+			"llama.embedding_length":        uint32(4096),
+			"llama.attention.head_count":    uint32(32),
+			"llama.attention.head_count_kv": uint32(8),
+			"tokenizer.ggml.tokens":         []string{""},
+			"tokenizer.ggml.scores":         []float32{0},
+			"tokenizer.ggml.token_type":     []int32{0},
+		}, []llm.Tensor{
+			{Name: "token_embd.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+			{Name: "output.weight", Shape: []uint64{1}, WriterTo: bytes.NewReader(make([]byte, 4))},
+		})),
+		Stream: &stream,
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	chat := func(t *testing.T, messages ...api.Message) api.ChatResponse {
+		t.Helper()
+
+		w := createRequest(t, s.ChatHandler, api.ChatRequest{
+			Model:    "test",
+			Messages: messages,
+			Stream:   &stream,
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+
+		var resp api.ChatResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	hello := api.Message{Role: "user", Content: "Hello!"}
+
+	t.Run("new session", func(t *testing.T) {
+		resp := chat(t, hello)
+		if mock.CompletionRequest.Slot != nil {
+			t.Errorf("expected no slot, got %d", *mock.CompletionRequest.Slot)
+		}
+
+		if resp.SessionHit != nil {
+			t.Errorf("expected no session hit, got %t", *resp.SessionHit)
+		}
+	})
+
+	t.Run("hit", func(t *testing.T) {
+		resp := chat(t, hello, api.Message{Role: "assistant", Content: "Hi!"}, api.Message{Role: "user", Content: "How are you?"})
+		if slot := mock.CompletionRequest.Slot; slot == nil || *slot != 1 {
+			t.Errorf("expected slot 1, got %v", slot)
+		}
+
+		if resp.SessionHit == nil || !*resp.SessionHit {
+			t.Errorf("expected a session hit, got %v", resp.SessionHit)
+		}
+	})
+
+	t.Run("miss", func(t *testing.T) {
+		// another request was processed in the session's slot
+		mock.CompletionResponse.Slot = 0
+		resp := chat(t, hello, api.Message{Role: "assistant", Content: "Hi!"}, api.Message{Role: "user", Content: "What's new?"})
+		if resp.SessionHit == nil || *resp.SessionHit {
+			t.Errorf("expected a session miss, got %v", resp.SessionHit)
+		}
+
+		if slot, _ := runner.sessionSlot(chatSession(api.ChatRequest{Messages: []api.Message{hello}})); slot != 0 {
+			t.Errorf("expected the session to move to slot 0, got %d", slot)
+		}
+	})
+}
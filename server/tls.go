@@ -0,0 +1,50 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ollama/ollama/envconfig"
+)
+
+// serverTLSConfig returns the TLS configuration for serving HTTPS or nil if
+// the server should serve plain HTTP. Client certificates are required and
+// verified when a client CA bundle is configured.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile, clientCAFile := envconfig.TLSCert(), envconfig.TLSKey(), envconfig.TLSClientCA()
+	switch {
+	case certFile == "" && keyFile == "" && clientCAFile == "":
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("OLLAMA_TLS_CERT and OLLAMA_TLS_KEY must both be set to serve HTTPS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1, usable
+// as both a CA and a leaf certificate, and its key to dir
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ollama test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	empty := filepath.Join(dir, "empty.pem")
+	require.NoError(t, os.WriteFile(empty, nil, 0o600))
+
+	cases := []struct {
+		name                    string
+		cert, key, clientCA     string
+		err                     bool
+		tls, requireClientCerts bool
+	}{
+		{name: "disabled"},
+		{name: "cert and key", cert: certFile, key: keyFile, tls: true},
+		{name: "client ca", cert: certFile, key: keyFile, clientCA: certFile, tls: true, requireClientCerts: true},
+		{name: "missing key", cert: certFile, err: true},
+		{name: "client ca only", clientCA: certFile, err: true},
+		{name: "missing file", cert: filepath.Join(dir, "missing.pem"), key: keyFile, err: true},
+		{name: "empty client ca", cert: certFile, key: keyFile, clientCA: empty, err: true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OLLAMA_TLS_CERT", tt.cert)
+			t.Setenv("OLLAMA_TLS_KEY", tt.key)
+			t.Setenv("OLLAMA_TLS_CLIENT_CA", tt.clientCA)
+
+			config, err := serverTLSConfig()
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			if !tt.tls {
+				require.Nil(t, config)
+				return
+			}
+
+			require.Len(t, config.Certificates, 1)
+			require.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+			if tt.requireClientCerts {
+				require.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+				require.NotNil(t, config.ClientCAs)
+			} else {
+				require.Equal(t, tls.NoClientCert, config.ClientAuth)
+			}
+		})
+	}
+}
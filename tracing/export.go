@@ -0,0 +1,332 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ollama/ollama/version"
+)
+
+const (
+	batchSize     = 512
+	batchInterval = 5 * time.Second
+	queueSize     = 4 * batchSize
+)
+
+var active atomic.Pointer[processor]
+
+// Init enables tracing and exports spans to target, which is either "stdout",
+// the URL of an OTLP/HTTP collector (e.g. http://localhost:4318), or the path of
+// a file to append to. An empty target leaves tracing disabled. The returned
+// function flushes any pending spans and disables tracing.
+func Init(target string) (func(context.Context) error, error) {
+	var e exporter
+	switch {
+	case target == "":
+		return func(context.Context) error { return nil }, nil
+	case target == "stdout":
+		e = &writerExporter{w: os.Stdout}
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/traces"
+		}
+
+		e = &httpExporter{url: u.String(), client: http.DefaultClient}
+	default:
+		f, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		e = &writerExporter{w: f, c: f}
+	}
+
+	p := &processor{
+		exporter: e,
+		spans:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+
+	go p.run()
+	active.Store(p)
+	slog.Info("tracing enabled", "exporter", target)
+
+	return p.shutdown, nil
+}
+
+// processor batches ended spans and hands them to an exporter in the background
+type processor struct {
+	exporter exporter
+	spans    chan *Span
+	done     chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (p *processor) enqueue(s *Span) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return
+	}
+
+	select {
+	case p.spans <- s:
+	default:
+		slog.Debug("tracing queue full, dropping span", "name", s.name)
+	}
+}
+
+func (p *processor) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		b, err := encode(batch)
+		if err == nil {
+			err = p.exporter.export(b)
+		}
+
+		if err != nil {
+			slog.Warn("failed to export spans", "error", err)
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s, ok := <-p.spans:
+			if !ok {
+				flush()
+				if err := p.exporter.close(); err != nil {
+					slog.Warn("failed to close span exporter", "error", err)
+				}
+				return
+			}
+
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (p *processor) shutdown(ctx context.Context) error {
+	active.CompareAndSwap(p, nil)
+
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.spans)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type exporter interface {
+	export([]byte) error
+	close() error
+}
+
+// writerExporter writes each batch as a single line of OTLP JSON, the format
+// read by the OpenTelemetry collector's otlpjsonfile receiver
+type writerExporter struct {
+	w io.Writer
+	c io.Closer
+}
+
+func (e *writerExporter) export(b []byte) error {
+	_, err := e.w.Write(append(b, '\n'))
+	return err
+}
+
+func (e *writerExporter) close() error {
+	if e.c != nil {
+		return e.c.Close()
+	}
+
+	return nil
+}
+
+// httpExporter sends batches to an OTLP/HTTP collector using the JSON encoding
+type httpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (e *httpExporter) export(b []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+func (e *httpExporter) close() error {
+	return nil
+}
+
+// The types below mirror the JSON encoding of the OTLP
+// ExportTraceServiceRequest message. IDs are hex encoded and 64 bit integers
+// are encoded as strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Flags             uint32          `json:"flags,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func encode(spans []*Span) ([]byte, error) {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Flags:             uint32(s.flags),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: a.key, Value: attributeValue(a.value)})
+		}
+
+		if s.err != nil {
+			// STATUS_CODE_ERROR
+			span.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.mu.Unlock()
+
+		otlpSpans = append(otlpSpans, span)
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{
+					{Key: "service.name", Value: attributeValue("ollama")},
+					{Key: "service.version", Value: attributeValue(version.Version)},
+				},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/ollama/ollama", Version: version.Version},
+				Spans: otlpSpans,
+			}},
+		}},
+	})
+}
+
+func attributeValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
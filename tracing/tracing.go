@@ -0,0 +1,195 @@
+// Package tracing records spans for requests handled by the server and exports
+// them in the OpenTelemetry (OTLP) JSON format. Tracing is disabled unless
+// an exporter is configured with Init.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+}
+
+func (sc spanContext) valid() bool {
+	return sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+// sampled reports whether the trace-flags of sc ask for the trace to be
+// recorded
+func (sc spanContext) sampled() bool {
+	return sc.flags&1 == 1
+}
+
+type spanContextKey struct{}
+
+// Span is a single timed operation within a trace. A nil *Span is valid and
+// records nothing, so callers don't need to check whether tracing is enabled.
+type Span struct {
+	spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []attribute
+	err   error
+	ended bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Start begins a span named name as a child of the span in ctx, if any. The
+// returned context carries the new span and should be passed to any work the
+// span covers. The span must be ended with End.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, kindInternal)
+}
+
+// StartServer begins a span for an incoming request. If the request headers
+// carry a W3C traceparent the span joins the caller's trace, and isn't
+// recorded if the caller's trace isn't sampled.
+func StartServer(ctx context.Context, header http.Header, name string) (context.Context, *Span) {
+	if sc, ok := parseTraceparent(header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, spanContextKey{}, sc)
+	}
+
+	return start(ctx, name, kindServer)
+}
+
+func start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if active.Load() == nil {
+		return ctx, nil
+	}
+
+	s := Span{name: name, kind: kind, start: time.Now()}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		if !parent.sampled() {
+			// the caller chose not to record this trace, and ctx already
+			// carries its decision on to any children
+			return ctx, nil
+		}
+
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.flags = parent.flags
+	} else {
+		s.traceID = newTraceID()
+		s.flags = 1
+	}
+
+	s.spanID = newSpanID()
+	return context.WithValue(ctx, spanContextKey{}, s.spanContext), &s
+}
+
+// SetAttribute records a key value pair on the span. Values may be strings,
+// bools, integers or floats.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// RecordError marks the span as failed. Context cancellation is not treated
+// as an error.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// End completes the span and queues it for export. Calling End more than once
+// has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if p := active.Load(); p != nil {
+		p.enqueue(s)
+	}
+}
+
+// parseTraceparent parses a W3C traceparent header value of the form
+// version-traceid-parentid-flags
+func parseTraceparent(s string) (sc spanContext, _ bool) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+
+	sc.flags = flags[0]
+	return sc, sc.valid()
+}
+
+func newTraceID() (id [16]byte) {
+	for id == [16]byte{} {
+		binary.BigEndian.PutUint64(id[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(id[8:], rand.Uint64())
+	}
+
+	return id
+}
+
+func newSpanID() (id [8]byte) {
+	for id == [8]byte{} {
+		binary.BigEndian.PutUint64(id[:], rand.Uint64())
+	}
+
+	return id
+}
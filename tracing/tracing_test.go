@@ -0,0 +1,168 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	cases := map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00":       true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":       false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01":        false,
+		"00-xxf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":       false,
+		"": false,
+	}
+
+	for s, valid := range cases {
+		t.Run(s, func(t *testing.T) {
+			_, ok := parseTraceparent(s)
+			require.Equal(t, valid, ok)
+		})
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(context.Background(), "test")
+	require.Nil(t, span)
+	require.Nil(t, ctx.Value(spanContextKey{}))
+
+	// methods on a nil span are no-ops
+	span.SetAttribute("key", "value")
+	span.RecordError(errors.New("error"))
+	span.End()
+}
+
+func readSpans(t *testing.T, r io.Reader) map[string]otlpSpan {
+	t.Helper()
+
+	spans := make(map[string]otlpSpan)
+	d := json.NewDecoder(r)
+	for d.More() {
+		var req otlpRequest
+		require.NoError(t, d.Decode(&req))
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}
+
+	return spans
+}
+
+func TestExportFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := Init(path)
+	require.NoError(t, err)
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, server := StartServer(context.Background(), header, "POST /api/chat")
+	server.SetAttribute("model", "llama3")
+
+	_, child := Start(ctx, "completion")
+	child.SetAttribute("eval_count", 10)
+	child.RecordError(errors.New("boom"))
+	child.End()
+	server.End()
+
+	require.NoError(t, shutdown(context.Background()))
+
+	// spans started after shutdown aren't recorded
+	_, span := Start(context.Background(), "after")
+	require.Nil(t, span)
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	spans := readSpans(t, f)
+	require.Len(t, spans, 2)
+
+	s := spans["POST /api/chat"]
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID)
+	require.Equal(t, "00f067aa0ba902b7", s.ParentSpanID)
+	require.Equal(t, kindServer, s.Kind)
+	require.Equal(t, []otlpAttribute{{Key: "model", Value: map[string]any{"stringValue": "llama3"}}}, s.Attributes)
+	require.Nil(t, s.Status)
+
+	c := spans["completion"]
+	require.Equal(t, s.TraceID, c.TraceID)
+	require.Equal(t, s.SpanID, c.ParentSpanID)
+	require.Equal(t, kindInternal, c.Kind)
+	require.Equal(t, []otlpAttribute{{Key: "eval_count", Value: map[string]any{"intValue": "10"}}}, c.Attributes)
+	require.Equal(t, &otlpStatus{Code: 2, Message: "boom"}, c.Status)
+}
+
+func TestUnsampled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := Init(path)
+	require.NoError(t, err)
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	ctx, server := StartServer(context.Background(), header, "POST /api/chat")
+	require.Nil(t, server)
+
+	// children of an unsampled trace aren't recorded either
+	_, child := Start(ctx, "completion")
+	require.Nil(t, child)
+
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, sampled := StartServer(context.Background(), header, "POST /api/generate")
+	require.NotNil(t, sampled)
+	sampled.End()
+
+	require.NoError(t, shutdown(context.Background()))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	spans := readSpans(t, f)
+	require.Len(t, spans, 1)
+	require.Contains(t, spans, "POST /api/generate")
+}
+
+func TestExportHTTP(t *testing.T) {
+	var spans map[string]otlpSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/traces", r.URL.Path)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		spans = readSpans(t, r.Body)
+	}))
+	defer srv.Close()
+
+	shutdown, err := Init(srv.URL)
+	require.NoError(t, err)
+
+	ctx, span := StartServer(context.Background(), http.Header{}, "GET /api/tags")
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	require.True(t, ok)
+	require.True(t, sc.valid())
+	require.True(t, sc.sampled())
+	span.End()
+
+	require.NoError(t, shutdown(context.Background()))
+	require.Len(t, spans, 1)
+	require.Empty(t, spans["GET /api/tags"].ParentSpanID)
+}